@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+type BenchCommand struct {
+	Server      string        `short:"s" long:"server" description:"DoQ server to benchmark" default:"localhost:8853"`
+	Names       []string      `short:"n" long:"name" description:"Name to query, may be repeated" default:"example.com"`
+	Type        string        `short:"t" long:"type" description:"Query type" default:"A"`
+	QPS         int           `short:"q" long:"qps" description:"Target queries per second, 0 for unlimited"`
+	Concurrency int           `short:"c" long:"concurrency" description:"Number of concurrent workers" default:"10"`
+	Connections int           `long:"connections" description:"Number of QUIC connections shared by the workers" default:"1"`
+	Datagrams   bool          `long:"experimental-datagrams" description:"Send small queries in QUIC DATAGRAM frames when the server supports the experimental doq-dgram-exp ALPN"`
+	Duration    time.Duration `short:"d" long:"duration" description:"Benchmark duration" default:"10s"`
+}
+
+var benchCommand BenchCommand
+
+func init() {
+	if _, err := parser.AddCommand(
+		"bench",
+		"DoQ benchmark",
+		"Drive a DoQ server at a configurable rate and report latency statistics",
+		&benchCommand); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// benchResult stores the outcome of a single benchmark worker
+type benchResult struct {
+	latencies []time.Duration
+	errors    int
+	rcodes    map[int]int
+}
+
+func (b *BenchCommand) Execute(args []string) error {
+	qtype, ok := dns.StringToType[strings.ToUpper(b.Type)]
+	if !ok {
+		return errors.New("unknown query type " + b.Type)
+	}
+	if b.Concurrency < 1 || b.Connections < 1 {
+		return errors.New("concurrency and connections must be at least 1")
+	}
+	// The ticker needs a non-zero interval
+	if b.QPS < 0 || b.QPS > int(time.Second) {
+		return errors.New("qps must be between 0 and 1000000000")
+	}
+
+	clientCert, err := clientCertificate()
+	if err != nil {
+		return err
+	}
+
+	// Establish the connections up front so handshakes are measured separately
+	clients := make([]client.Client, 0, b.Connections)
+	var handshakeTotal time.Duration
+	zeroRTT, resumed := 0, 0
+	for i := 0; i < b.Connections; i++ {
+		start := time.Now()
+		c, err := client.New(client.Config{
+			Server:           b.Server,
+			TLSSkipVerify:    options.Insecure,
+			Compat:           options.Compat,
+			ALPN:             options.ALPN,
+			Logger:           log.StandardLogger(),
+			QUICConfig:       quicConfig(),
+			QlogDir:          options.QlogDir,
+			KeyLogWriter:     keyLogWriter(),
+			SessionCacheFile: options.SessionCache,
+			AddressFamily:    options.Family,
+			Datagrams:        b.Datagrams,
+			Certificate:      clientCert,
+		})
+		if err != nil {
+			return err
+		}
+		handshakeTotal += time.Since(start)
+
+		state := c.Session.ConnectionState()
+		if state.Used0RTT {
+			zeroRTT++
+		}
+		if state.TLS.DidResume {
+			resumed++
+		}
+		//goland:noinspection GoUnhandledErrorResult
+		defer c.Close()
+		clients = append(clients, c)
+	}
+
+	// Hand out query tokens at the target rate, or as fast as workers take them
+	tokens := make(chan struct{}, b.Concurrency)
+	go func() {
+		defer close(tokens)
+		deadline := time.After(b.Duration)
+		var tick <-chan time.Time
+		if b.QPS > 0 {
+			ticker := time.NewTicker(time.Second / time.Duration(b.QPS))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-deadline:
+					return
+				}
+			}
+			select {
+			case tokens <- struct{}{}:
+			case <-deadline:
+				return
+			}
+		}
+	}()
+
+	results := make([]benchResult, b.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < b.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := &results[i]
+			res.rcodes = map[int]int{}
+			c := clients[i%len(clients)]
+			n := i
+			for range tokens {
+				req := dns.Msg{}
+				req.SetQuestion(dns.Fqdn(b.Names[n%len(b.Names)]), qtype)
+				req.Id = 0
+				n++
+
+				queryStart := time.Now()
+				resp, err := c.SendQuery(req)
+				if err != nil {
+					log.Debugf("bench query: %s", err)
+					res.errors++
+					continue
+				}
+				res.latencies = append(res.latencies, time.Since(queryStart))
+				res.rcodes[resp.Rcode]++
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	b.report(results, elapsed, handshakeTotal, zeroRTT, resumed)
+	return nil
+}
+
+// report prints the aggregated benchmark results
+func (b *BenchCommand) report(results []benchResult, elapsed, handshakeTotal time.Duration, zeroRTT, resumed int) {
+	var latencies []time.Duration
+	errCount := 0
+	rcodes := map[int]int{}
+	for _, res := range results {
+		latencies = append(latencies, res.latencies...)
+		errCount += res.errors
+		for rcode, n := range res.rcodes {
+			rcodes[rcode] += n
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	total := len(latencies) + errCount
+	w := os.Stdout
+	_, _ = fmt.Fprintf(w, "Target:         %s\n", b.Server)
+	_, _ = fmt.Fprintf(w, "Duration:       %s\n", elapsed.Round(time.Millisecond))
+	_, _ = fmt.Fprintf(w, "Queries:        %d (%.1f qps)\n", total, float64(total)/elapsed.Seconds())
+	if total > 0 {
+		_, _ = fmt.Fprintf(w, "Errors:         %d (%.2f%%)\n", errCount, 100*float64(errCount)/float64(total))
+	}
+	_, _ = fmt.Fprintf(w, "Handshakes:     %d (avg %s, 0-RTT %d, resumed %d)\n",
+		b.Connections, (handshakeTotal / time.Duration(b.Connections)).Round(time.Microsecond), zeroRTT, resumed)
+
+	if len(latencies) > 0 {
+		_, _ = fmt.Fprintln(w, "Latency:")
+		for _, p := range []float64{50, 90, 99, 99.9} {
+			_, _ = fmt.Fprintf(w, "  p%-5v        %s\n", p, percentile(latencies, p).Round(time.Microsecond))
+		}
+		_, _ = fmt.Fprintf(w, "  max           %s\n", latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+
+	_, _ = fmt.Fprintln(w, "Response codes:")
+	codes := make([]int, 0, len(rcodes))
+	for rcode := range rcodes {
+		codes = append(codes, rcode)
+	}
+	sort.Ints(codes)
+	for _, rcode := range codes {
+		_, _ = fmt.Fprintf(w, "  %-13s %d\n", dns.RcodeToString[rcode], rcodes[rcode])
+	}
+}
+
+// percentile returns the p-th percentile of a sorted slice of durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
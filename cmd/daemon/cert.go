@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mosajjal/doqd/pkg/cert"
+)
+
+type CertCommand struct{}
+
+type CertGenerateCommand struct {
+	Hosts []string `short:"H" long:"host" description:"Hostname or IP address to include in the certificate, may be repeated" required:"true"`
+	Cert  string   `short:"c" long:"cert" description:"Certificate output file" default:"cert.pem"`
+	Key   string   `short:"k" long:"key" description:"Private key output file" default:"key.pem"`
+	Days  int      `short:"d" long:"days" description:"Validity period in days" default:"365"`
+}
+
+type CertFingerprintCommand struct {
+	Args struct {
+		Certs []string `positional-arg-name:"cert" description:"PEM certificate file" required:"1"`
+	} `positional-args:"true"`
+}
+
+var certCommand CertCommand
+var certGenerateCommand CertGenerateCommand
+var certFingerprintCommand CertFingerprintCommand
+
+func init() {
+	cmd, err := parser.AddCommand(
+		"cert",
+		"TLS certificate helpers",
+		"Manage TLS certificates for the DoQ server",
+		&certCommand)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := cmd.AddCommand(
+		"generate",
+		"Generate a self-signed certificate",
+		"Generate a self-signed certificate and key for local testing",
+		&certGenerateCommand); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := cmd.AddCommand(
+		"fingerprint",
+		"Print certificate public key fingerprints",
+		"Print the SHA-256 public key fingerprint of each certificate, for the server's client fingerprint allowlist",
+		&certFingerprintCommand); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c *CertGenerateCommand) Execute(args []string) error {
+	certPEM, keyPEM, err := cert.Generate(c.Hosts, time.Duration(c.Days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(c.Cert, certPEM, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.Key, keyPEM, 0600); err != nil {
+		return err
+	}
+
+	log.Infof("wrote certificate to %s and key to %s", c.Cert, c.Key)
+	return nil
+}
+
+func (c *CertFingerprintCommand) Execute(args []string) error {
+	for _, path := range c.Args.Certs {
+		certPEM, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fingerprint, err := cert.Fingerprint(certPEM)
+		if err != nil {
+			return errors.New(path + ": " + err.Error())
+		}
+		fmt.Printf("%s # %s\n", fingerprint, path)
+	}
+	return nil
+}
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
@@ -10,85 +18,265 @@ import (
 )
 
 type ClientCommand struct {
-	Listen   string `short:"l" long:"listen" description:"Address to listen on" required:"true" default:":53"`
-	Upstream string `short:"u" long:"upstream" description:"Upstream DNS server" required:"true" default:":8853"`
+	Server string `short:"s" long:"server" description:"DoQ server to query" default:"localhost:8853"`
+	JSON   bool   `short:"j" long:"json" description:"Print the response as JSON"`
+	Short  bool   `long:"short" description:"Print only the answer RDATA, one record per line"`
+
+	Reverse []string `short:"x" long:"reverse" description:"Send a PTR query for the reverse name of an IP address, may be repeated"`
+	Subnet  string   `long:"subnet" description:"Attach an EDNS Client Subnet option for this prefix, e.g. 203.0.113.0/24"`
+	TLSInfo bool     `long:"tlsinfo" description:"Print the negotiated TLS and QUIC connection details"`
+
+	Datagrams bool `long:"experimental-datagrams" description:"Send small queries in QUIC DATAGRAM frames when the server supports the experimental doq-dgram-exp ALPN"`
+
+	Timeout time.Duration `short:"T" long:"timeout" description:"Timeout for the handshake and for each query attempt" default:"5s"`
+	Retries int           `short:"r" long:"retries" description:"Number of times to retry a failed handshake or query" default:"2"`
+
+	Interactive bool `short:"I" long:"interactive" description:"Read queries interactively over a single connection"`
+
+	File        string `short:"f" long:"file" description:"Read \"name [type]\" queries line by line from a file (- for stdin)"`
+	Concurrency int    `short:"c" long:"concurrency" description:"Number of concurrent queries in batch mode" default:"10"`
+
+	outputLock sync.Mutex
+	handshake  time.Duration // reported with the first response, then reset
 }
 
 var clientCommand ClientCommand
 
 func init() {
-	if _, err := parser.AddCommand(
+	cmd, err := parser.AddCommand(
 		"client",
-		"DoQ client proxy",
-		"Start a DoQ client proxy",
-		&clientCommand); err != nil {
+		"DoQ query client",
+		"Send DNS queries to a DoQ server: client [options] [-x address] name [type] [name [type]...]",
+		&clientCommand)
+	if err != nil {
 		log.Fatal(err)
 	}
+	cmd.Aliases = []string{"query"}
 }
 
-func (c *ClientCommand) Execute(args []string) error {
-	// Create the UDP DNS listener
-	log.Infof("starting UDP listener on %s\n", c.Listen)
-	pc, err := net.ListenPacket("udp", c.Listen)
-	if err != nil {
-		log.Fatal(err)
+// parseQuestions parses dig-style "name [type]" pairs into DNS questions
+func parseQuestions(args []string) ([]dns.Question, error) {
+	var questions []dns.Question
+	for i, arg := range args {
+		if qtype, ok := dns.StringToType[strings.ToUpper(arg)]; ok && i > 0 {
+			last := &questions[len(questions)-1]
+			if last.Qtype != 0 {
+				return nil, errors.New("unexpected query type " + arg)
+			}
+			last.Qtype = qtype
+			continue
+		}
+		questions = append(questions, dns.Question{Name: dns.Fqdn(arg), Qclass: dns.ClassINET})
 	}
-	//goland:noinspection GoUnhandledErrorResult
-	defer pc.Close()
+	if len(questions) == 0 {
+		return nil, errors.New("expected at least one name to query")
+	}
+
+	for i := range questions {
+		if questions[i].Qtype == 0 {
+			questions[i].Qtype = dns.TypeA
+		}
+	}
+	return questions, nil
+}
 
-	log.Debugln("ready to accept connections")
-	for {
-		log.Debugln("ready to read from buffer")
-		buffer := make([]byte, 4096)
-		n, addr, err := pc.ReadFrom(buffer)
+func (c *ClientCommand) Execute(args []string) error {
+	var questions []dns.Question
+	for _, addr := range c.Reverse {
+		name, err := dns.ReverseAddr(addr)
+		if err != nil {
+			return err
+		}
+		questions = append(questions, dns.Question{Name: name, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+	}
+	if c.File == "" && (len(args) > 0 || (len(questions) == 0 && !c.Interactive)) {
+		parsed, err := parseQuestions(args)
 		if err != nil {
-			log.Warn(err)
+			return err
 		}
-		log.Debugf("read %d bytes from buffer", n)
+		questions = append(questions, parsed...)
+	}
 
-		// Unpack the DNS message
-		log.Debugln("unpacking DNS message")
-		var msgIn dns.Msg
-		err = msgIn.Unpack(buffer)
+	var subnet *net.IPNet
+	if c.Subnet != "" {
+		var err error
+		_, subnet, err = net.ParseCIDR(c.Subnet)
 		if err != nil {
-			log.Warn(err)
+			return err
 		}
+	}
+
+	clientCert, err := clientCertificate()
+	if err != nil {
+		return err
+	}
+
+	conf := client.Config{
+		Server:           c.Server,
+		TLSSkipVerify:    options.Insecure,
+		Compat:           options.Compat,
+		ALPN:             options.ALPN,
+		Logger:           log.StandardLogger(),
+		QUICConfig:       quicConfig(),
+		QlogDir:          options.QlogDir,
+		KeyLogWriter:     keyLogWriter(),
+		SessionCacheFile: options.SessionCache,
+		AddressFamily:    options.Family,
+		Datagrams:        c.Datagrams,
+		Certificate:      clientCert,
+		ClientSubnet:     subnet,
+	}
+	doqClient, err := c.dial(conf)
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer doqClient.Close()
 
-		// Create a new DoQ client
-		log.Debugf("opening QUIC connection to %s\n", c.Upstream)
-		conf := client.Config{
-			Server:        c.Upstream,
-			TLSSkipVerify: true,
-			Compat:        true,
-			Debug:         false,
+	if c.TLSInfo {
+		// Keep stdout parseable in JSON mode
+		w := os.Stdout
+		if c.JSON {
+			w = os.Stderr
 		}
-		doqClient, err := client.New(conf)
-		if err != nil {
-			log.Warn(err)
+		if err := printTLSInfo(w, doqClient.Session.ConnectionState()); err != nil {
+			return err
 		}
+	}
 
-		// Send the DoQ query
-		log.Debugln("sending DoQ query")
-		resp, err := doqClient.SendQuery(msgIn)
-		if err != nil {
-			log.Warn(err)
+	// All questions are sent sequentially over the same QUIC connection
+	for _, question := range questions {
+		if err := c.query(doqClient, question); err != nil {
+			return err
+		}
+	}
+
+	if c.File != "" {
+		return c.batch(doqClient)
+	}
+	if c.Interactive {
+		return c.repl(conf, doqClient)
+	}
+	return nil
+}
+
+// dial connects to the server, retrying failed handshakes, and records the
+// handshake time for reporting with the next response
+func (c *ClientCommand) dial(conf client.Config) (client.Client, error) {
+	var doqClient client.Client
+	var err error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		start := time.Now()
+		ctx, cancel := c.context()
+		doqClient, err = client.NewContext(ctx, conf)
+		cancel()
+		if err == nil {
+			c.outputLock.Lock()
+			c.handshake = time.Since(start)
+			c.outputLock.Unlock()
+			return doqClient, nil
+		}
+		log.Debugf("handshake attempt %d: %s", attempt+1, err)
+	}
+	return client.Client{}, err
+}
+
+// context returns a context bounded by the configured timeout
+func (c *ClientCommand) context() (context.Context, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), c.Timeout)
+}
+
+// query sends a single question and prints the response
+func (c *ClientCommand) query(doqClient client.Client, question dns.Question) error {
+	req := dns.Msg{}
+	req.SetQuestion(question.Name, question.Qtype)
+	req.Id = 0 // DoQ queries MUST use a message ID of zero
+
+	var resp dns.Msg
+	var rtt time.Duration
+	var err error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		start := time.Now()
+		ctx, cancel := c.context()
+		resp, err = doqClient.SendQueryContext(ctx, req)
+		cancel()
+		rtt = time.Since(start)
+		if err == nil {
+			break
 		}
-		log.Debugln("closing doq QUIC stream")
-		_ = doqClient.Close()
+		log.Debugf("query %s attempt %d: %s", question.Name, attempt+1, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.outputLock.Lock()
+	defer c.outputLock.Unlock()
+	handshake := c.handshake
+	c.handshake = 0
+
+	switch {
+	case c.JSON:
+		return printJSON(os.Stdout, c.Server, doqClient, &resp, rtt, handshake)
+	case c.Short:
+		return printShort(os.Stdout, &resp)
+	}
+	return printText(os.Stdout, c.Server, doqClient, &resp, rtt, handshake)
+}
 
-		// Pack the response DNS message to wire format
-		log.Debugln("packing response DNS message")
-		packed, err := resp.Pack()
+// batch streams questions read from a file or stdin through the connection
+// using a pool of concurrent workers
+func (c *ClientCommand) batch(doqClient client.Client) error {
+	var in io.Reader = os.Stdin
+	if c.File != "-" {
+		f, err := os.Open(c.File)
 		if err != nil {
-			log.Warn(err)
+			return err
 		}
+		//goland:noinspection GoUnhandledErrorResult
+		defer f.Close()
+		in = f
+	}
+
+	concurrency := c.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	questions := make(chan dns.Question)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for question := range questions {
+				if err := c.query(doqClient, question); err != nil {
+					log.Warnf("query %s: %s", question.Name, err)
+				}
+			}
+		}()
+	}
 
-		// Write response to UDP connection
-		log.Debugln("writing response DNS message")
-		_, err = pc.WriteTo(packed, addr)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		parsed, err := parseQuestions(fields)
 		if err != nil {
-			log.Warn(err)
+			log.Warnf("skipping line %q: %s", scanner.Text(), err)
+			continue
+		}
+		for _, question := range parsed {
+			questions <- question
 		}
-		log.Debug("finished writing")
 	}
+	close(questions)
+	wg.Wait()
+
+	return scanner.Err()
 }
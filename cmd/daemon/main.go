@@ -1,34 +1,165 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"io"
 	"os"
+	"sync"
 
 	"github.com/jessevdk/go-flags"
+	"github.com/quic-go/quic-go"
 	log "github.com/sirupsen/logrus"
-)
 
-var version = "dev" // set by build process
+	doq "github.com/mosajjal/doqd"
+	"github.com/mosajjal/doqd/pkg/logging"
+)
 
 type Options struct {
-	Compat      bool `short:"z" long:"compat" description:"Enable TLS backwards compatibility mode"`
-	Insecure    bool `short:"i" long:"insecure" description:"Ignore TLS certificate validation errors"`
-	Verbose     bool `short:"v" long:"verbose" description:"Enable verbose logging"`
-	ShowVersion bool `short:"V" long:"version" description:"Show version and exit"`
+	Config      string   `short:"C" long:"config" description:"Load options from an INI file, command line flags take precedence"`
+	Compat      bool     `short:"z" long:"compat" description:"Enable TLS backwards compatibility mode"`
+	ALPN        []string `long:"alpn" description:"DoQ ALPN token to offer or accept instead of the defaults, in order of preference, may be repeated: doq, doq-i02, doq-i01, doq-i00 or dq"`
+	Insecure    bool     `short:"i" long:"insecure" description:"Ignore TLS certificate validation errors"`
+	LogLevel    string   `short:"L" long:"log-level" description:"Log level, trace includes per-stream QUIC events" choice:"error" choice:"warn" choice:"info" choice:"debug" choice:"trace" default:"info"`
+	Quiet       bool     `short:"q" long:"quiet" description:"Only log errors, overrides --log-level"`
+	ShowVersion bool     `short:"V" long:"version" description:"Show version and exit"`
+
+	LogOutput      string `long:"log-output" description:"Write logs to stderr, syslog or journald" choice:"stderr" choice:"syslog" choice:"journald" default:"stderr"`
+	SyslogAddr     string `long:"syslog-addr" description:"Syslog server as udp://host:port, tcp://host:port or unix:///path, the local syslog daemon when empty"`
+	SyslogFacility string `long:"syslog-facility" description:"Syslog facility, e.g. daemon, user or local0 to local7" default:"daemon"`
+
+	QUICVersions []string `long:"quic-version" description:"QUIC version to offer, in order of preference, may be repeated" choice:"1" choice:"2"`
+	QlogDir      string   `long:"qlog-dir" description:"Write a qlog trace of every QUIC connection to this directory"`
+	ClientCert   string   `long:"client-cert" description:"TLS client certificate file for servers requiring client authentication"`
+	ClientKey    string   `long:"client-key" description:"TLS client private key file"`
+	SessionCache string   `long:"session-cache" description:"Store TLS session tickets in this file so later runs resume their sessions"`
+	Family       string   `long:"address-family" description:"Address family of the DoQ servers dialed, preferring one and falling back to the other, or requiring one" choice:"prefer-ipv4" choice:"prefer-ipv6" choice:"ipv4" choice:"ipv6"`
 }
 
 var options Options
 
 var parser = flags.NewParser(&options, flags.Default)
 
+// configPath finds the config file option in the command line arguments
+// without requiring the rest of them to be valid yet
+func configPath(args []string) string {
+	var pre struct {
+		Config string `short:"C" long:"config"`
+	}
+	_, _ = flags.NewParser(&pre, flags.IgnoreUnknown).ParseArgs(args)
+	return pre.Config
+}
+
+// setupLogging applies the log level and output options to the standard
+// logger
+func setupLogging() {
+	level, err := log.ParseLevel(options.LogLevel)
+	if err != nil {
+		log.Fatalf("parse log level: %s", err)
+	}
+	if options.Quiet {
+		level = log.ErrorLevel
+	}
+	log.SetLevel(level)
+
+	// The output stays open for the life of the process
+	if _, err := logging.Setup(log.StandardLogger(), logging.Config{
+		Output:         options.LogOutput,
+		SyslogAddr:     options.SyslogAddr,
+		SyslogFacility: options.SyslogFacility,
+	}); err != nil {
+		log.Fatalf("log output: %s", err)
+	}
+}
+
+// quicVersions maps the --quic-version choices to QUIC versions
+var quicVersions = map[string]quic.Version{
+	"1": quic.Version1, // RFC 9000
+	"2": quic.Version2, // RFC 9369
+}
+
+// quicConfig returns a QUIC config honouring the global QUIC options
+func quicConfig() *quic.Config {
+	conf := &quic.Config{}
+	for _, v := range options.QUICVersions {
+		conf.Versions = append(conf.Versions, quicVersions[v])
+	}
+	return conf
+}
+
+// keyLogWriter opens the file named by SSLKEYLOGFILE, if any, so captured
+// TLS traffic can be decrypted in Wireshark
+var keyLogWriter = sync.OnceValue(func() io.Writer {
+	path := os.Getenv("SSLKEYLOGFILE")
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Fatalf("open SSLKEYLOGFILE: %s", err)
+	}
+	log.Warnf("Logging TLS secrets to %s, connections are not private", path)
+	return f
+})
+
+// clientCertificate loads the TLS client certificate, if any
+var clientCertificate = sync.OnceValues(func() (*tls.Certificate, error) {
+	if options.ClientCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(options.ClientCert, options.ClientKey)
+	if err != nil {
+		return nil, errors.New("load client certificate: " + err.Error())
+	}
+	return &cert, nil
+})
+
 func main() {
-	if _, err := parser.Parse(); err != nil {
-		// Enable debug logging in development releases
-		if options.Verbose {
-			log.SetLevel(log.DebugLevel)
+	// Configure logging before any command runs
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		setupLogging()
+		if options.ShowVersion {
+			printVersion()
+			os.Exit(0)
+		}
+		if command == nil {
+			return nil
+		}
+		return command.Execute(args)
+	}
+
+	// Load the config file first so it only provides defaults for the flags
+	if path := configPath(os.Args[1:]); path != "" {
+		if err := flags.NewIniParser(parser).ParseFile(path); err != nil {
+			log.Fatalf("load config %s: %s", path, err)
 		}
+	}
+
+	// Windows services are started and stopped by the service manager
+	if !runService(parse) {
+		parse()
+	}
+}
+
+// printVersion logs the build information of the binary
+func printVersion() {
+	build := doq.Build()
+	log.Printf("doqd version %s (commit %s, built %s, %s) https://github.com/mosajjal/doqd", doq.Version(), orUnknown(build.Commit), orUnknown(build.Date), build.GoVersion)
+}
 
+// orUnknown returns s, or "unknown" when it is empty
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// parse runs the command line, exiting when it fails
+func parse() {
+	if _, err := parser.Parse(); err != nil {
 		if options.ShowVersion {
-			log.Printf("doq version %s https://github.com/natesales/doqd", version)
+			printVersion()
 			os.Exit(0)
 		}
 
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+type jsonRR struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+	TTL   uint32 `json:"ttl"`
+	Data  string `json:"data"`
+}
+
+type jsonQuestion struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+type jsonFlags struct {
+	Authoritative      bool `json:"aa"`
+	Truncated          bool `json:"tc"`
+	RecursionDesired   bool `json:"rd"`
+	RecursionAvailable bool `json:"ra"`
+	AuthenticatedData  bool `json:"ad"`
+	CheckingDisabled   bool `json:"cd"`
+}
+
+type jsonServer struct {
+	Address string `json:"address"`
+	ALPN    string `json:"alpn"`
+}
+
+type jsonResponse struct {
+	Server     jsonServer     `json:"server"`
+	RTT        float64        `json:"rtt_ms"`
+	Handshake  float64        `json:"handshake_ms,omitempty"`
+	ID         uint16         `json:"id"`
+	Opcode     string         `json:"opcode"`
+	Rcode      string         `json:"rcode"`
+	Flags      jsonFlags      `json:"flags"`
+	Question   []jsonQuestion `json:"question"`
+	Answer     []jsonRR       `json:"answer"`
+	Authority  []jsonRR       `json:"authority"`
+	Additional []jsonRR       `json:"additional"`
+}
+
+// jsonRRs converts resource records to their JSON representation
+func jsonRRs(rrs []dns.RR) []jsonRR {
+	out := make([]jsonRR, 0, len(rrs))
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		out = append(out, jsonRR{
+			Name:  hdr.Name,
+			Type:  dns.TypeToString[hdr.Rrtype],
+			Class: dns.ClassToString[hdr.Class],
+			TTL:   hdr.Ttl,
+			Data:  rrData(rr),
+		})
+	}
+	return out
+}
+
+// rrData returns the presentation format RDATA of a resource record
+func rrData(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// printText writes a DNS response in dig-like presentation format followed by
+// the query time. A non-zero handshake duration is reported alongside it.
+func printText(w io.Writer, server string, c client.Client, msg *dns.Msg, rtt, handshake time.Duration) error {
+	var b strings.Builder
+	b.WriteString(msg.String())
+	b.WriteString("\n")
+	_, _ = fmt.Fprintf(&b, ";; Query time: %.3f msec\n", milliseconds(rtt))
+	if handshake > 0 {
+		_, _ = fmt.Fprintf(&b, ";; Handshake time: %.3f msec\n", milliseconds(handshake))
+	}
+	_, _ = fmt.Fprintf(&b, ";; SERVER: %s (%s)\n\n", server, c.Session.ConnectionState().TLS.NegotiatedProtocol)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// printJSON writes a DNS response as a single JSON document
+func printJSON(w io.Writer, server string, c client.Client, msg *dns.Msg, rtt, handshake time.Duration) error {
+	out := jsonResponse{
+		Server: jsonServer{
+			Address: server,
+			ALPN:    c.Session.ConnectionState().TLS.NegotiatedProtocol,
+		},
+		RTT:       milliseconds(rtt),
+		Handshake: milliseconds(handshake),
+		ID:        msg.Id,
+		Opcode:    dns.OpcodeToString[msg.Opcode],
+		Rcode:     dns.RcodeToString[msg.Rcode],
+		Flags: jsonFlags{
+			Authoritative:      msg.Authoritative,
+			Truncated:          msg.Truncated,
+			RecursionDesired:   msg.RecursionDesired,
+			RecursionAvailable: msg.RecursionAvailable,
+			AuthenticatedData:  msg.AuthenticatedData,
+			CheckingDisabled:   msg.CheckingDisabled,
+		},
+		Question:   make([]jsonQuestion, 0, len(msg.Question)),
+		Answer:     jsonRRs(msg.Answer),
+		Authority:  jsonRRs(msg.Ns),
+		Additional: jsonRRs(msg.Extra),
+	}
+	for _, q := range msg.Question {
+		out.Question = append(out.Question, jsonQuestion{
+			Name:  q.Name,
+			Type:  dns.TypeToString[q.Qtype],
+			Class: dns.ClassToString[q.Qclass],
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// printShort writes the RDATA of each answer record on its own line
+func printShort(w io.Writer, msg *dns.Msg) error {
+	for _, rr := range msg.Answer {
+		if _, err := io.WriteString(w, rrData(rr)+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printTLSInfo writes the negotiated TLS and QUIC connection parameters and
+// the server certificate chain as dig-style comments
+func printTLSInfo(w io.Writer, state quic.ConnectionState) error {
+	var b strings.Builder
+	b.WriteString(";; CONNECTION:\n")
+	_, _ = fmt.Fprintf(&b, ";; QUIC version: %s\n", state.Version)
+	_, _ = fmt.Fprintf(&b, ";; ALPN: %s\n", state.TLS.NegotiatedProtocol)
+	_, _ = fmt.Fprintf(&b, ";; TLS version: %s\n", tls.VersionName(state.TLS.Version))
+	_, _ = fmt.Fprintf(&b, ";; Cipher suite: %s\n", tls.CipherSuiteName(state.TLS.CipherSuite))
+	_, _ = fmt.Fprintf(&b, ";; Server name: %s\n", state.TLS.ServerName)
+	_, _ = fmt.Fprintf(&b, ";; Resumed: %t, 0-RTT: %t, ECH: %t\n", state.TLS.DidResume, state.Used0RTT, state.TLS.ECHAccepted)
+	for i, cert := range state.TLS.PeerCertificates {
+		_, _ = fmt.Fprintf(&b, ";; Certificate %d: %s\n", i, cert.Subject)
+		_, _ = fmt.Fprintf(&b, ";;   Issuer: %s\n", cert.Issuer)
+		if len(cert.DNSNames) > 0 {
+			_, _ = fmt.Fprintf(&b, ";;   DNS names: %s\n", strings.Join(cert.DNSNames, ", "))
+		}
+		_, _ = fmt.Fprintf(&b, ";;   Valid: %s to %s\n", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+type ProxyCommand struct {
+	Listen   string `short:"l" long:"listen" description:"Address to listen on" required:"true" default:":53"`
+	Upstream string `short:"u" long:"upstream" description:"Upstream DNS server" required:"true" default:":8853"`
+
+	ECHConfig   string `long:"ech-config" description:"Base64 encoded ECHConfigList for the upstream"`
+	ECHResolver string `long:"ech-resolver" description:"DNS resolver used to fetch the upstream ECHConfigList"`
+}
+
+var proxyCommand ProxyCommand
+
+func init() {
+	if _, err := parser.AddCommand(
+		"proxy",
+		"DoQ client proxy",
+		"Start a plain DNS to DoQ proxy",
+		&proxyCommand); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c *ProxyCommand) Execute(args []string) error {
+	var echConfig []byte
+	if c.ECHConfig != "" {
+		var err error
+		echConfig, err = base64.StdEncoding.DecodeString(c.ECHConfig)
+		if err != nil {
+			log.Fatalf("decode ECH config: %s", err)
+		}
+	} else if c.ECHResolver != "" {
+		// Fetch once up front rather than on every upstream connection
+		host, _, _ := net.SplitHostPort(c.Upstream)
+		var err error
+		echConfig, err = client.FetchECHConfigList(context.Background(), host, c.ECHResolver)
+		if err != nil {
+			log.Fatalf("fetch ECH config: %s", err)
+		}
+	}
+
+	clientCert, err := clientCertificate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create the UDP DNS listener
+	log.Infof("starting UDP listener on %s\n", c.Listen)
+	pc, err := net.ListenPacket("udp", c.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer pc.Close()
+
+	log.Debugln("ready to accept connections")
+	for {
+		log.Debugln("ready to read from buffer")
+		buffer := make([]byte, dns.MaxMsgSize)
+		n, addr, err := pc.ReadFrom(buffer)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		log.Debugf("read %d bytes from buffer", n)
+
+		// Unpack the DNS message
+		log.Debugln("unpacking DNS message")
+		var msgIn dns.Msg
+		err = msgIn.Unpack(buffer[:n])
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+
+		// Create a new DoQ client
+		log.Debugf("opening QUIC connection to %s\n", c.Upstream)
+		conf := client.Config{
+			Server:           c.Upstream,
+			TLSSkipVerify:    true,
+			Compat:           true,
+			Logger:           log.StandardLogger(),
+			QUICConfig:       quicConfig(),
+			QlogDir:          options.QlogDir,
+			KeyLogWriter:     keyLogWriter(),
+			SessionCacheFile: options.SessionCache,
+			AddressFamily:    options.Family,
+			Certificate:      clientCert,
+			ECHConfigList:    echConfig,
+		}
+		var resp dns.Msg
+		doqClient, err := client.New(conf)
+		if err == nil {
+			// Send the DoQ query
+			log.Debugln("sending DoQ query")
+			resp, err = doqClient.SendQuery(msgIn)
+			log.Debugln("closing doq QUIC stream")
+			_ = doqClient.Close()
+		}
+		if err != nil {
+			// The client is answered rather than left to time out
+			log.Warn(err)
+			resp = dns.Msg{}
+			resp.SetRcode(&msgIn, dns.RcodeServerFailure)
+		}
+
+		// The response must fit the buffer size the client advertised
+		size := dns.MinMsgSize
+		if opt := msgIn.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+
+		// Pack the response DNS message to wire format
+		log.Debugln("packing response DNS message")
+		packed, err := resp.Pack()
+		if err != nil {
+			log.Warn(err)
+		}
+
+		// Write response to UDP connection
+		log.Debugln("writing response DNS message")
+		_, err = pc.WriteTo(packed, addr)
+		if err != nil {
+			log.Warn(err)
+		}
+		log.Debug("finished writing")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+// repl reads "name [type]" queries from the terminal and sends them over a
+// single DoQ connection, reconnecting if the server closes it
+func (c *ClientCommand) repl(conf client.Config, doqClient client.Client) error {
+	_, _ = fmt.Fprintf(os.Stderr, ";; connected to %s, enter \"name [type]\" queries or \"quit\"\n", c.Server)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		_, _ = fmt.Fprint(os.Stderr, "doq> ")
+		if !scanner.Scan() {
+			break
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			break
+		}
+		questions, err := parseQuestions(fields)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, ";; %s\n", err)
+			continue
+		}
+
+		// The server may have closed an idle connection since the last query
+		if doqClient.Session.Context().Err() != nil {
+			_ = doqClient.Close()
+			doqClient, err = c.dial(conf)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(os.Stderr, ";; reconnected to %s\n", c.Server)
+		}
+
+		for _, question := range questions {
+			if err := c.query(doqClient, question); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, ";; %s\n", err)
+			}
+		}
+	}
+
+	// The deferred close in Execute only covers the original connection
+	_ = doqClient.Close()
+	return scanner.Err()
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// runService reports that the process never runs under the Windows service
+// manager, other platforms signal their daemons instead
+func runService(func()) bool {
+	return false
+}
@@ -0,0 +1,228 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name doqd is registered as with the service manager
+// and the event log
+const serviceName = "doqd"
+
+// serviceStopTimeout bounds how long stopping the service may take
+const serviceStopTimeout = 10 * time.Second
+
+type ServiceCommand struct{}
+
+type ServiceInstallCommand struct{}
+type ServiceUninstallCommand struct{}
+type ServiceStartCommand struct{}
+type ServiceStopCommand struct{}
+
+var serviceCommand ServiceCommand
+var serviceInstallCommand ServiceInstallCommand
+var serviceUninstallCommand ServiceUninstallCommand
+var serviceStartCommand ServiceStartCommand
+var serviceStopCommand ServiceStopCommand
+
+func init() {
+	cmd, err := parser.AddCommand(
+		"service",
+		"Windows service management",
+		"Install, uninstall, start and stop doqd as a Windows service",
+		&serviceCommand)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, sub := range []struct {
+		name, short, long string
+		data              interface{}
+	}{
+		{"install", "Install the service", "Install the service, running the command line given after --, e.g. doqd service install -- server --cert C:\\doqd\\cert.pem --key C:\\doqd\\key.pem", &serviceInstallCommand},
+		{"uninstall", "Uninstall the service", "Remove the service and its event log source", &serviceUninstallCommand},
+		{"start", "Start the service", "Start the installed service", &serviceStartCommand},
+		{"stop", "Stop the service", "Stop the running service", &serviceStopCommand},
+	} {
+		if _, err := cmd.AddCommand(sub.name, sub.short, sub.long, sub.data); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func (c *ServiceInstallCommand) Execute(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing service command line, e.g. doqd service install -- server --cert cert.pem --key key.pem")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.New("connect to service manager: " + err.Error())
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errors.New("service " + serviceName + " is already installed")
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "doqd",
+		Description: "DNS over QUIC server",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return errors.New("create service: " + err.Error())
+	}
+	defer s.Close()
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		_ = s.Delete()
+		return errors.New("install event log source: " + err.Error())
+	}
+	log.Infof("Installed service %s running %s %s", serviceName, exe, strings.Join(args, " "))
+	return nil
+}
+
+func (c *ServiceUninstallCommand) Execute([]string) error {
+	return withService(func(s *mgr.Service) error {
+		if err := s.Delete(); err != nil {
+			return errors.New("delete service: " + err.Error())
+		}
+		if err := eventlog.Remove(serviceName); err != nil {
+			return errors.New("remove event log source: " + err.Error())
+		}
+		log.Infof("Uninstalled service %s", serviceName)
+		return nil
+	})
+}
+
+func (c *ServiceStartCommand) Execute([]string) error {
+	return withService(func(s *mgr.Service) error {
+		if err := s.Start(); err != nil {
+			return errors.New("start service: " + err.Error())
+		}
+		return nil
+	})
+}
+
+func (c *ServiceStopCommand) Execute([]string) error {
+	return withService(func(s *mgr.Service) error {
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return errors.New("stop service: " + err.Error())
+		}
+		deadline := time.Now().Add(serviceStopTimeout)
+		for status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return errors.New("service " + serviceName + " did not stop")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return errors.New("query service: " + err.Error())
+			}
+		}
+		return nil
+	})
+}
+
+// withService opens the installed service
+func withService(f func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.New("connect to service manager: " + err.Error())
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return errors.New("service " + serviceName + " is not installed: " + err.Error())
+	}
+	defer s.Close()
+	return f(s)
+}
+
+// runService runs the command line under the service manager when it
+// started the process, logging to the event log, and reports whether it did
+func runService(run func()) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+	if elog, err := eventlog.Open(serviceName); err == nil {
+		log.AddHook(eventLogHook{elog})
+		log.SetOutput(io.Discard)
+	}
+	if err := svc.Run(serviceName, windowsService{run: run}); err != nil {
+		log.Errorf("run service: %s", err)
+	}
+	return true
+}
+
+// windowsService answers the service manager while the command runs
+type windowsService struct {
+	run func()
+}
+
+func (w windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.run()
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(stopRequested)
+				select {
+				case <-done:
+				case <-time.After(serviceStopTimeout):
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogHook writes log entries to the Windows event log
+type eventLogHook struct {
+	log *eventlog.Log
+}
+
+func (h eventLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h eventLogHook) Fire(entry *log.Entry) error {
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry.Level <= log.ErrorLevel:
+		return h.log.Error(1, msg)
+	case entry.Level == log.WarnLevel:
+		return h.log.Warning(1, msg)
+	default:
+		return h.log.Info(1, msg)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// stopRequested is closed when a service manager without signals, like the
+// Windows one, asks the process to stop
+var stopRequested = make(chan struct{})
+
+// waitForShutdown blocks until the process is interrupted, terminated, or
+// stopped by its service manager
+func waitForShutdown() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
+	select {
+	case <-c:
+	case <-stopRequested:
+	}
+}
@@ -0,0 +1,10 @@
+//go:build sqlite && cgo
+
+package main
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is the database/sql driver of --query-log-sqlite
+const sqliteDriver = "sqlite3"
@@ -0,0 +1,7 @@
+//go:build !sqlite || !cgo
+
+package main
+
+// sqliteDriver is empty as the SQLite driver requires cgo, which release
+// builds disable. Build with cgo and -tags sqlite to log queries to SQLite.
+const sqliteDriver = ""
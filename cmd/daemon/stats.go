@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/mosajjal/doqd/pkg/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// logStats logs a snapshot of every server's counters
+func logStats(servers []*server.Server) {
+	for i, s := range servers {
+		stats := s.Stats()
+		fields := log.Fields{
+			"listener":      i,
+			"queries":       stats.Queries,
+			"in_flight":     stats.QueriesInFlight,
+			"connections":   stats.Connections,
+			"streams":       stats.Streams,
+			"cache_entries": stats.CacheEntries,
+		}
+		if lookups := stats.CacheHits + stats.CacheMisses; lookups > 0 {
+			fields["cache_hit_ratio"] = float64(stats.CacheHits) / float64(lookups)
+		}
+		log.WithFields(fields).Info("stats")
+		for _, u := range stats.Upstreams {
+			fields := log.Fields{
+				"listener":       i,
+				"upstream":       u.Address,
+				"healthy":        u.Healthy,
+				"queries":        u.Queries,
+				"errors":         u.Errors,
+				"avg_latency_ms": u.Latency,
+			}
+			if u.LastError != "" {
+				fields["last_error"] = u.LastError
+			}
+			log.WithFields(fields).Info("upstream stats")
+		}
+	}
+}
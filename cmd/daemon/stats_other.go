@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "github.com/mosajjal/doqd/pkg/server"
+
+// dumpStatsOnSignal is a no-op, there is no SIGUSR1 on this platform
+func dumpStatsOnSignal([]*server.Server) {}
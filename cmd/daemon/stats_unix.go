@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mosajjal/doqd/pkg/server"
+)
+
+// dumpStatsOnSignal logs the servers' counters every time the process
+// receives SIGUSR1
+func dumpStatsOnSignal(servers []*server.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			logStats(servers)
+		}
+	}()
+}
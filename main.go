@@ -1,5 +1,10 @@
 package doq
 
+import (
+	"errors"
+	"slices"
+)
+
 // Only implementations of the final, published RFC can identify
 // themselves as "doq". Until such an RFC exists, implementations MUST
 // NOT identify themselves using this string. Implementations of draft
@@ -13,8 +18,33 @@ var TlsProtos = []string{"doq-i02"}
 // TlsProtosCompat stores alternative TLS protocols for experimental interoperability
 var TlsProtosCompat = []string{"doq-i02", "doq-i01", "doq-i00", "doq", "dq"}
 
+// Protos returns the DoQ ALPN tokens to negotiate, in order of preference:
+// protos when set, which must all be known tokens, otherwise TlsProtosCompat
+// in compat mode or TlsProtos
+func Protos(protos []string, compat bool) ([]string, error) {
+	if len(protos) == 0 {
+		if compat {
+			return slices.Clone(TlsProtosCompat), nil
+		}
+		return slices.Clone(TlsProtos), nil
+	}
+	for _, proto := range protos {
+		if !slices.Contains(TlsProtosCompat, proto) {
+			return nil, errors.New("unsupported DoQ ALPN token " + proto)
+		}
+	}
+	return slices.Clone(protos), nil
+}
+
+// TlsProtoDatagram identifies the experimental DoQ mode carrying queries
+// and responses that fit in a single packet in QUIC DATAGRAM frames (RFC
+// 9221), with RFC 9250 streams for the others
+const TlsProtoDatagram = "doq-dgram-exp"
+
 // Errors
 const (
-	NoError       = 0x00 // No error. This is used when the connection or stream needs to be closed, but there is no error to signal.
-	InternalError = 0x01 // The DoQ implementation encountered an internal error and is incapable of pursuing the transaction or the connection
+	NoError          = 0x00 // No error. This is used when the connection or stream needs to be closed, but there is no error to signal.
+	InternalError    = 0x01 // The DoQ implementation encountered an internal error and is incapable of pursuing the transaction or the connection
+	ProtocolError    = 0x02 // The DoQ implementation encountered a protocol error and is forcibly aborting the connection
+	RequestCancelled = 0x03 // A DoQ client uses this to signal that it wants to cancel an outstanding transaction
 )
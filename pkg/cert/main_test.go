@@ -0,0 +1,38 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	certPEM, keyPEM, err := Generate([]string{"localhost", "127.0.0.1"}, 24*time.Hour)
+	assert.Nil(t, err)
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	assert.Nil(t, err)
+	assert.Nil(t, leaf.VerifyHostname("localhost"))
+	assert.Nil(t, leaf.VerifyHostname("127.0.0.1"))
+
+	_, _, err = Generate(nil, time.Hour)
+	assert.NotNil(t, err)
+}
+
+func TestFingerprint(t *testing.T) {
+	certPEM, _, err := Generate([]string{"client"}, time.Hour)
+	assert.Nil(t, err)
+
+	fingerprint, err := Fingerprint(certPEM)
+	assert.Nil(t, err)
+	assert.Len(t, fingerprint, 64)
+
+	_, err = Fingerprint([]byte("not a certificate"))
+	assert.NotNil(t, err)
+}
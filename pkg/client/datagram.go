@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// defaultDatagramTimeout is how long a query sent in a DATAGRAM frame waits
+// for its response before being retried over a stream
+const defaultDatagramTimeout = 500 * time.Millisecond
+
+// errDatagramFallback asks for a query to be retried over a stream
+var errDatagramFallback = errors.New("datagram exchange failed")
+
+// datagrams exchanges queries in QUIC DATAGRAM frames over connections of
+// the experimental doq-dgram-exp mode, matching responses to queries by ID
+type datagrams struct {
+	timeout time.Duration
+
+	lock sync.Mutex
+	// receiving are the connections whose responses are being read
+	receiving map[*quic.Conn]bool
+	pending   map[uint16]chan []byte
+}
+
+// newDatagrams returns the datagram exchanges of a client
+func newDatagrams(timeout time.Duration) *datagrams {
+	if timeout == 0 {
+		timeout = defaultDatagramTimeout
+	}
+	return &datagrams{
+		timeout:   timeout,
+		receiving: map[*quic.Conn]bool{},
+		pending:   map[uint16]chan []byte{},
+	}
+}
+
+// exchange sends a query in a DATAGRAM frame and returns its response, or
+// errDatagramFallback when it should be retried over a stream: when the
+// query doesn't fit in a frame, the response is lost or truncated.
+func (d *datagrams) exchange(ctx context.Context, conn *quic.Conn, query []byte) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, errDatagramFallback
+	}
+	// The query ID matches the response, it is restored on the response
+	b := append([]byte{}, query...)
+	resp := make(chan []byte, 1)
+	id := d.register(conn, resp)
+	defer d.unregister(id)
+	binary.BigEndian.PutUint16(b, id)
+	if err := conn.SendDatagram(b); err != nil {
+		return nil, errDatagramFallback
+	}
+
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-resp:
+		msg, q := new(dns.Msg), new(dns.Msg)
+		if err := msg.Unpack(r); err != nil || msg.Truncated || q.Unpack(query) != nil || !sameQuestion(q, msg) {
+			return nil, errDatagramFallback
+		}
+		copy(r, query[:2])
+		return r, nil
+	case <-timer.C:
+		return nil, errDatagramFallback
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// register returns a free ID for a query waiting for its response on resp,
+// reading the responses of conn
+func (d *datagrams) register(conn *quic.Conn, resp chan []byte) uint16 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.receiving[conn] {
+		d.receiving[conn] = true
+		go d.receive(conn)
+	}
+	for {
+		id := uint16(rand.N(1 << 16))
+		if _, ok := d.pending[id]; !ok {
+			d.pending[id] = resp
+			return id
+		}
+	}
+}
+
+// unregister frees the ID of a query
+func (d *datagrams) unregister(id uint16) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.pending, id)
+}
+
+// receive hands the responses received on conn to their queries until it
+// closes
+func (d *datagrams) receive(conn *quic.Conn) {
+	defer func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		delete(d.receiving, conn)
+	}()
+	for {
+		b, err := conn.ReceiveDatagram(conn.Context())
+		if err != nil {
+			return
+		}
+		if len(b) < 2 {
+			continue
+		}
+		d.lock.Lock()
+		resp, ok := d.pending[binary.BigEndian.Uint16(b)]
+		d.lock.Unlock()
+		if ok {
+			select {
+			case resp <- b:
+			default: // A duplicate
+			}
+		}
+	}
+}
+
+// sameQuestion tells whether a response answers the question of a query,
+// rather than an earlier one that had the same ID
+func sameQuestion(q, resp *dns.Msg) bool {
+	if len(q.Question) != len(resp.Question) {
+		return false
+	}
+	for i, question := range q.Question {
+		other := resp.Question[i]
+		if !strings.EqualFold(question.Name, other.Name) || question.Qtype != other.Qtype || question.Qclass != other.Qclass {
+			return false
+		}
+	}
+	return true
+}
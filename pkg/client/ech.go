@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// FetchECHConfigList looks up the ECHConfigList published for a DoQ server.
+// The SVCB record at _dns.<host> (RFC 9461) is tried first, followed by the
+// HTTPS record at the host itself. Lookups are sent in plain DNS to resolver.
+func FetchECHConfigList(ctx context.Context, host string, resolver string) ([]byte, error) {
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"_dns." + dns.Fqdn(host), dns.TypeSVCB},
+		{dns.Fqdn(host), dns.TypeHTTPS},
+	} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(q.name, q.qtype)
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+
+		resp, _, err := new(dns.Client).ExchangeContext(ctx, msg, resolver)
+		if err != nil {
+			return nil, errors.New("ech config lookup: " + err.Error())
+		}
+
+		for _, rr := range resp.Answer {
+			var values []dns.SVCBKeyValue
+			switch v := rr.(type) {
+			case *dns.SVCB:
+				values = v.Value
+			case *dns.HTTPS:
+				values = v.Value
+			}
+			for _, kv := range values {
+				if ech, ok := kv.(*dns.SVCBECHConfig); ok && len(ech.ECH) > 0 {
+					return ech.ECH, nil
+				}
+			}
+		}
+	}
+
+	return nil, errors.New("no ECH config published for " + host)
+}
+
+// serverHost returns the host part of a host:port server address
+func serverHost(server string) string {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return server
+	}
+	return host
+}
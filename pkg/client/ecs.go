@@ -0,0 +1,36 @@
+package client
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// SetClientSubnet attaches an EDNS Client Subnet option (RFC 7871) for subnet
+// to msg, adding an OPT record if needed. Any existing ECS option is replaced.
+func SetClientSubnet(msg *dns.Msg, subnet *net.IPNet) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	ones, _ := subnet.Mask.Size()
+	ecs.SourceNetmask = uint8(ones)
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.Address = ip4
+	} else {
+		ecs.Family = 2
+		ecs.Address = subnet.IP
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, ecs)
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetClientSubnet(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	_, subnet, err := net.ParseCIDR("203.0.113.0/24")
+	assert.Nil(t, err)
+	SetClientSubnet(msg, subnet)
+
+	_, subnet6, err := net.ParseCIDR("2001:db8::/56")
+	assert.Nil(t, err)
+	SetClientSubnet(msg, subnet6)
+
+	opt := msg.IsEdns0()
+	assert.NotNil(t, opt)
+	assert.Len(t, opt.Option, 1)
+
+	ecs, ok := opt.Option[0].(*dns.EDNS0_SUBNET)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(2), ecs.Family)
+	assert.Equal(t, uint8(56), ecs.SourceNetmask)
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+)
+
+// Address families of Config.AddressFamily
+const (
+	// AnyFamily dials the server addresses in the order the system resolver
+	// returns them
+	AnyFamily = ""
+	// PreferIPv4 and PreferIPv6 dial the addresses of one family first,
+	// falling back to the other when the connection fails
+	PreferIPv4 = "prefer-ipv4"
+	PreferIPv6 = "prefer-ipv6"
+	// IPv4Only and IPv6Only only dial the addresses of one family
+	IPv4Only = "ipv4"
+	IPv6Only = "ipv6"
+)
+
+// checkAddressFamily validates an address family preference
+func checkAddressFamily(family string) error {
+	switch family {
+	case AnyFamily, PreferIPv4, PreferIPv6, IPv4Only, IPv6Only:
+		return nil
+	}
+	return errors.New("unknown address family " + family)
+}
+
+// resolveServer returns the addresses of a host:port server to dial, in
+// order, following an address family preference
+func resolveServer(ctx context.Context, server, family string) ([]*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port " + portStr)
+	}
+
+	network := "ip"
+	switch family {
+	case IPv4Only:
+		network = "ip4"
+	case IPv6Only:
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	sortAddrs(ips, family)
+
+	addrs := make([]*net.UDPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(port))))
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no " + network + " address for " + host)
+	}
+	return addrs, nil
+}
+
+// sortAddrs moves the addresses of the preferred family first, keeping the
+// resolver order otherwise
+func sortAddrs(ips []netip.Addr, family string) {
+	// IPv6 addresses rank before IPv4 ones
+	rank := func(ip netip.Addr) int {
+		if ip.Unmap().Is4() {
+			return 1
+		}
+		return 0
+	}
+	switch family {
+	case PreferIPv4:
+		slices.SortStableFunc(ips, func(a, b netip.Addr) int { return rank(b) - rank(a) })
+	case PreferIPv6:
+		slices.SortStableFunc(ips, func(a, b netip.Addr) int { return rank(a) - rank(b) })
+	}
+}
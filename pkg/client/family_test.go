@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveServer(t *testing.T) {
+	ctx := context.Background()
+	addrs, err := resolveServer(ctx, "127.0.0.1:853", AnyFamily)
+	if assert.Nil(t, err) && assert.Len(t, addrs, 1) {
+		assert.Equal(t, "127.0.0.1:853", addrs[0].String())
+	}
+	addrs, err = resolveServer(ctx, "[2001:db8::1]:853", PreferIPv4)
+	if assert.Nil(t, err) && assert.Len(t, addrs, 1) {
+		assert.Equal(t, "[2001:db8::1]:853", addrs[0].String())
+	}
+
+	// Required families exclude the other one
+	_, err = resolveServer(ctx, "127.0.0.1:853", IPv6Only)
+	assert.NotNil(t, err)
+	_, err = resolveServer(ctx, "[2001:db8::1]:853", IPv4Only)
+	assert.NotNil(t, err)
+	_, err = resolveServer(ctx, "127.0.0.1", AnyFamily)
+	assert.NotNil(t, err)
+}
+
+func TestSortAddrs(t *testing.T) {
+	v4a, v4b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	v6a, v6b := netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")
+	for family, want := range map[string][]netip.Addr{
+		AnyFamily:  {v4a, v6a, v4b, v6b},
+		PreferIPv4: {v4a, v4b, v6a, v6b},
+		PreferIPv6: {v6a, v6b, v4a, v4b},
+	} {
+		ips := []netip.Addr{v4a, v6a, v4b, v6b}
+		sortAddrs(ips, family)
+		assert.Equal(t, want, ips, family)
+	}
+
+	assert.Nil(t, checkAddressFamily(IPv6Only))
+	assert.NotNil(t, checkAddressFamily("ipv5"))
+}
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// lookupCacheSize bounds the number of answers cached by the lookup helpers
+const lookupCacheSize = 1000
+
+// LookupHost returns the IPv4 and IPv6 addresses of host, querying A and
+// AAAA records concurrently
+func (c Client) LookupHost(ctx context.Context, host string) ([]string, error) {
+	type result struct {
+		addrs []string
+		err   error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		go func(qtype uint16) {
+			answer, err := c.lookup(ctx, host, qtype)
+			var addrs []string
+			for _, rr := range answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					addrs = append(addrs, rr.A.String())
+				case *dns.AAAA:
+					addrs = append(addrs, rr.AAAA.String())
+				}
+			}
+			results <- result{addrs, err}
+		}(qtype)
+	}
+
+	// Either family is enough, IPv4 first
+	var addrs []string
+	var err error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		addrs = append(addrs, r.addrs...)
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return !strings.Contains(addrs[i], ":") && strings.Contains(addrs[j], ":")
+	})
+	if len(addrs) == 0 {
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// LookupTXT returns the TXT records of name, each joined into one string
+func (c Client) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	answer, err := c.lookup(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var txts []string
+	for _, rr := range answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			txts = append(txts, strings.Join(txt.Txt, ""))
+		}
+	}
+	return txts, nil
+}
+
+// LookupMX returns the MX records of name, sorted by preference
+func (c Client) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	answer, err := c.lookup(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	var mxs []*net.MX
+	for _, rr := range answer {
+		if mx, ok := rr.(*dns.MX); ok {
+			mxs = append(mxs, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+		}
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	return mxs, nil
+}
+
+// LookupSRV returns the SRV records of _service._proto.name, or of name when
+// service and proto are empty, sorted by priority and then weight. It also
+// returns the canonical name the records were found under.
+func (c Client) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	answer, err := c.lookup(ctx, target, dns.TypeSRV)
+	if err != nil {
+		return "", nil, err
+	}
+	cname := dns.Fqdn(target)
+	var srvs []*net.SRV
+	for _, rr := range answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			cname = rr.Target
+		case *dns.SRV:
+			srvs = append(srvs, &net.SRV{Target: rr.Target, Port: rr.Port, Priority: rr.Priority, Weight: rr.Weight})
+		}
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	return cname, srvs, nil
+}
+
+// lookup returns the answer section for a name and type, from the cache
+// while its TTL lasts. Failures are returned as *net.DNSError.
+func (c Client) lookup(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	key := lookupKey{name: strings.ToLower(dns.Fqdn(name)), qtype: qtype}
+	if answer, ok := c.lookups.get(key); ok {
+		return answer, nil
+	}
+
+	req := dns.Msg{}
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.Id = 0 // DoQ queries MUST use a message ID of zero
+	resp, err := c.SendQueryContext(ctx, req)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, Server: c.Conn().RemoteAddr().String(), IsTimeout: ctx.Err() != nil}
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: c.Conn().RemoteAddr().String(), IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: "server misbehaving: " + dns.RcodeToString[resp.Rcode], Name: name, Server: c.Conn().RemoteAddr().String(), IsTemporary: true}
+	}
+
+	c.lookups.set(key, resp.Answer)
+	return resp.Answer, nil
+}
+
+// lookupKey identifies a cached answer
+type lookupKey struct {
+	name  string
+	qtype uint16
+}
+
+// lookupEntry is an answer cached until its smallest TTL expires
+type lookupEntry struct {
+	answer  []dns.RR
+	expires time.Time
+}
+
+// lookupCache holds the answers of the lookup helpers
+type lookupCache struct {
+	lock    sync.Mutex
+	entries map[lookupKey]lookupEntry
+}
+
+func (l *lookupCache) get(key lookupKey) ([]dns.RR, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(l.entries, key)
+		return nil, false
+	}
+	return entry.answer, true
+}
+
+// set caches an answer for its smallest TTL. Empty answers are not cached.
+func (l *lookupCache) set(key lookupKey, answer []dns.RR) {
+	if len(answer) == 0 {
+		return
+	}
+	ttl := answer[0].Header().Ttl
+	for _, rr := range answer[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	if ttl == 0 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.entries) >= lookupCacheSize {
+		// Drop the expired answers, or everything when none has expired
+		now := time.Now()
+		for k, entry := range l.entries {
+			if now.After(entry.expires) {
+				delete(l.entries, k)
+			}
+		}
+		if len(l.entries) >= lookupCacheSize {
+			clear(l.entries)
+		}
+	}
+	l.entries[key] = lookupEntry{answer: answer, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
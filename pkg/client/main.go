@@ -5,110 +5,365 @@ import (
 	"crypto/tls"
 	"errors"
 	"io"
-
-	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
 
 	doq "github.com/mosajjal/doqd"
+	"github.com/mosajjal/doqd/pkg/codec"
 )
 
+// defaultCloseTimeout bounds how long Close waits for queries in flight
+const defaultCloseTimeout = 5 * time.Second
+
 // Client stores a DoQ client
 type Client struct {
+	// Session is the connection established by New. Use Conn for the
+	// current connection of clients that reconnect.
 	Session *quic.Conn
-	Debug   bool
+
+	conn *connection
+
+	logger       *logrus.Logger
+	clientSubnet *net.IPNet
+	closeTimeout time.Duration
+	inFlight     *atomic.Int64
+	stats        *connStats
+	lookups      *lookupCache
+	datagrams    *datagrams
+	metrics      *metrics
 }
 
 type Config struct {
 	Server        string
 	TLSSkipVerify bool
 	Compat        bool
-	Debug         bool
+	// ALPN lists the DoQ ALPN tokens offered, in order of preference,
+	// instead of doq.TlsProtos, or doq.TlsProtosCompat with Compat
+	ALPN []string
+	// Debug enables debug logging on the default logger. It is ignored when
+	// Logger is set.
+	Debug bool
+	// Logger receives the client's log output, with per-stream events
+	// logged at trace level
+	Logger *logrus.Logger
+
+	// ECHConfigList is a serialized ECHConfigList used to encrypt the
+	// ClientHello, hiding the server name from on-path observers.
+	ECHConfigList []byte
+	// ECHResolver is a plain DNS resolver used to fetch the ECHConfigList
+	// from the server's SVCB/HTTPS records when ECHConfigList is empty.
+	ECHResolver string
+
+	// AddressFamily selects the addresses of Server dialed, for networks
+	// where one family is present but broken: AnyFamily, PreferIPv4,
+	// PreferIPv6, IPv4Only or IPv6Only
+	AddressFamily string
+
+	// ClientSubnet, when set, is attached to every query as an EDNS Client
+	// Subnet option
+	ClientSubnet *net.IPNet
+
+	// Certificate, when set, is presented to servers requiring client
+	// authentication
+	Certificate *tls.Certificate
+	// TLSConfig, when set, is the base of the connection's TLS config, for
+	// custom server names, root CAs or certificate verification. The options
+	// above are applied on top of a copy.
+	TLSConfig *tls.Config
+
+	// QlogDir, when set, receives a qlog trace of the QUIC connection
+	QlogDir string
+	// KeyLogWriter, when set, receives TLS secrets in NSS key log format so
+	// captured traffic can be decrypted. It compromises security and should
+	// only be used for debugging.
+	KeyLogWriter io.Writer
+
+	// QUICConfig is passed through to the QUIC dialer. When nil, the quic-go
+	// defaults are used.
+	QUICConfig *quic.Config
+
+	// CloseTimeout bounds how long Close waits for queries in flight, 5
+	// seconds when zero
+	CloseTimeout time.Duration
+
+	// SessionCacheFile, when set, stores TLS session tickets in this file so
+	// later clients, even in other processes, resume their sessions
+	SessionCacheFile string
+
+	// Registerer, when set, receives the client's metrics, named
+	// <MetricsNamespace>_client_<metric> with doqd as the default namespace,
+	// and carrying MetricsLabels. Clients with the same registry, namespace
+	// and labels share their metrics.
+	Registerer       prometheus.Registerer
+	MetricsNamespace string
+	MetricsLabels    prometheus.Labels
+
+	// Datagrams offers the experimental doq-dgram-exp mode to the server.
+	// When it is negotiated, queries that fit in a single packet are sent
+	// in QUIC DATAGRAM frames, and retried over a stream when the response
+	// doesn't arrive within DatagramTimeout, 500ms when zero, or is
+	// truncated.
+	Datagrams       bool
+	DatagramTimeout time.Duration
+
+	// Reconnect re-establishes a connection that failed, e.g. after the
+	// network changed, and retries the queries that failed with it once.
+	// Path failures are detected by the idle timeout, sooner with a
+	// KeepAlivePeriod in QUICConfig.
+	Reconnect bool
+}
+
+// logger returns the configured logger, or a default one honouring Debug
+func (c Config) logger() *logrus.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	logger := logrus.New()
+	if c.Debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	return logger
 }
 
 // New constructs a new client
 func New(c Config) (Client, error) {
+	return NewContext(context.Background(), c)
+}
+
+// NewContext constructs a new client, aborting the handshake when ctx is done
+func NewContext(ctx context.Context, c Config) (Client, error) {
+	logger := c.logger()
+	if err := checkAddressFamily(c.AddressFamily); err != nil {
+		return Client{}, err
+	}
+
 	// Select TLS protocols for DoQ
-	var tlsProtos []string
-	if c.Compat {
-		tlsProtos = doq.TlsProtosCompat
-	} else {
-		tlsProtos = doq.TlsProtos
+	tlsProtos, err := doq.Protos(c.ALPN, c.Compat)
+	if err != nil {
+		return Client{}, err
+	}
+	var dgrams *datagrams
+	if c.Datagrams {
+		tlsProtos = append([]string{doq.TlsProtoDatagram}, tlsProtos...)
+		dgrams = newDatagrams(c.DatagramTimeout)
 	}
 
-	// Connect to DoQ server
-	if c.Debug {
-		log.Println("dialing quic server")
+	echConfig := c.ECHConfigList
+	if echConfig == nil && c.ECHResolver != "" {
+		logger.Debugln("fetching ECH config")
+		var err error
+		echConfig, err = FetchECHConfigList(ctx, serverHost(c.Server), c.ECHResolver)
+		if err != nil {
+			return Client{}, err
+		}
+	}
+
+	quicConf := &quic.Config{}
+	if c.QUICConfig != nil {
+		quicConf = c.QUICConfig.Clone()
+	}
+	if c.QlogDir != "" {
+		if err := os.MkdirAll(c.QlogDir, 0o755); err != nil {
+			return Client{}, errors.New("create qlog directory: " + err.Error())
+		}
+		quicConf.Tracer = doq.QlogTracer(c.QlogDir)
+	}
+	quicConf.EnableDatagrams = quicConf.EnableDatagrams || c.Datagrams
+	stats := &connStats{}
+	quicConf.Tracer = stats.tracer(quicConf.Tracer)
+	if quicConf.TokenStore == nil {
+		quicConf.TokenStore = tokenStore
+	}
+
+	tlsConf := &tls.Config{}
+	if c.TLSConfig != nil {
+		tlsConf = c.TLSConfig.Clone()
+	}
+	tlsConf.InsecureSkipVerify = tlsConf.InsecureSkipVerify || c.TLSSkipVerify
+	tlsConf.NextProtos = tlsProtos
+	tlsConf.EncryptedClientHelloConfigList = echConfig
+	if c.KeyLogWriter != nil {
+		tlsConf.KeyLogWriter = c.KeyLogWriter
+	}
+	if c.Certificate != nil {
+		tlsConf.Certificates = []tls.Certificate{*c.Certificate}
 	}
-	session, err := quic.DialAddr(context.Background(), c.Server, &tls.Config{
-		InsecureSkipVerify: c.TLSSkipVerify,
-		NextProtos:         tlsProtos,
-	}, nil)
+	if c.SessionCacheFile != "" && tlsConf.ClientSessionCache == nil {
+		tlsConf.ClientSessionCache = NewFileSessionCache(c.SessionCacheFile)
+	}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = serverHost(c.Server)
+	}
+
+	m, err := newMetrics(c.Registerer, c.MetricsNamespace, c.MetricsLabels)
 	if err != nil {
-		log.Fatalf("failed to connect to the server: %v\n", err)
+		return Client{}, err
 	}
 
-	return Client{Session: session, Debug: c.Debug}, nil // nil error
+	// Connect to DoQ server
+	logger.Debugf("dialing quic server %s", c.Server)
+	conn, err := newConnection(ctx, func(ctx context.Context) (*quic.Conn, *quic.Transport, error) {
+		return dialTransport(ctx, c.Server, c.AddressFamily, tlsConf, quicConf)
+	}, c.Reconnect, m)
+	if err != nil {
+		return Client{}, errors.New("quic dial: " + err.Error())
+	}
+
+	closeTimeout := c.CloseTimeout
+	if closeTimeout == 0 {
+		closeTimeout = defaultCloseTimeout
+	}
+	return Client{
+		Session:      conn.current(),
+		conn:         conn,
+		logger:       logger,
+		clientSubnet: c.ClientSubnet,
+		closeTimeout: closeTimeout,
+		inFlight:     new(atomic.Int64),
+		stats:        stats,
+		lookups:      &lookupCache{entries: map[lookupKey]lookupEntry{}},
+		datagrams:    dgrams,
+		metrics:      m,
+	}, nil // nil error
 }
 
-// Close closes a Client QUIC connection
+// Close waits for the queries in flight to be answered, up to the close
+// timeout, then closes the QUIC connection with DOQ_NO_ERROR
 func (c Client) Close() error {
-	if c.Debug {
-		log.Println("closing quic session")
+	deadline := time.Now().Add(c.closeTimeout)
+	for c.inFlight.Load() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-c.Conn().Context().Done():
+			return c.Abort()
+		case <-time.After(10 * time.Millisecond):
+		}
 	}
-	return c.Session.CloseWithError(0, "")
+	return c.Abort()
+}
+
+// Abort closes the QUIC connection with DOQ_NO_ERROR immediately, failing
+// the queries in flight
+func (c Client) Abort() error {
+	c.logger.Debugln("closing quic session")
+	return c.conn.close()
 }
 
 // SendQuery sends query over a new QUIC stream
 func (c Client) SendQuery(message dns.Msg) (dns.Msg, error) {
-	// Open a new QUIC stream
-	if c.Debug {
-		log.Println("opening new quic stream")
-	}
-	stream, err := c.Session.OpenStream()
-	if err != nil {
-		return dns.Msg{}, errors.New("quic stream open: " + err.Error())
+	return c.SendQueryContext(context.Background(), message)
+}
+
+// SendQueryContext sends query over a new QUIC stream. The stream is
+// cancelled when ctx is done, and the context deadline applies to the
+// stream's reads and writes.
+func (c Client) SendQueryContext(ctx context.Context, message dns.Msg) (dns.Msg, error) {
+	if c.clientSubnet != nil {
+		message = *message.Copy()
+		SetClientSubnet(&message, c.clientSubnet)
 	}
 
 	// Pack the DNS message for transmission
-	if c.Debug {
-		log.Println("packing dns message")
-	}
+	c.logger.Debugln("packing dns message")
 	packed, err := message.Pack()
 	if err != nil {
-		_ = stream.Close()
 		return dns.Msg{}, errors.New("dns message pack: " + err.Error())
 	}
 
-	// Send the DNS query over QUIC
-	if c.Debug {
-		log.Println("writing packed format to the stream")
+	response, err := c.ExchangeRaw(ctx, packed)
+	if err != nil {
+		return dns.Msg{}, err
 	}
-	_, err = stream.Write(packed)
-	_ = stream.Close()
+
+	// Unpack the DNS message
+	c.logger.Debugln("unpacking response dns message")
+	var msg dns.Msg
+	err = msg.Unpack(response)
 	if err != nil {
-		return dns.Msg{}, errors.New("quic stream write: " + err.Error())
+		return dns.Msg{}, errors.New("dns message unpack: " + err.Error())
 	}
 
-	// Read the response
-	if c.Debug {
-		log.Println("reading server response")
+	return msg, nil // nil error
+}
+
+// ExchangeRaw sends a query in wire format over a new QUIC stream and returns
+// the response in wire format, for proxies relaying packed messages. The
+// query is sent as is, without the client subnet option.
+func (c Client) ExchangeRaw(ctx context.Context, query []byte) ([]byte, error) {
+	c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	c.metrics.queries.Inc()
+
+	conn := c.Conn()
+	response, err := c.exchange(ctx, conn, query)
+	if err != nil && c.conn.reconnect && ctx.Err() == nil && conn.Context().Err() != nil {
+		// The connection failed rather than the query, retry over a new one
+		c.logger.Debugf("reconnecting after connection failure: %s", context.Cause(conn.Context()))
+		var rerr error
+		if conn, rerr = c.conn.replace(ctx, conn); rerr != nil {
+			err = errors.New(err.Error() + ", " + rerr.Error())
+		} else {
+			response, err = c.exchange(ctx, conn, query)
+		}
 	}
-	response, err := io.ReadAll(stream)
 	if err != nil {
-		return dns.Msg{}, errors.New("quic stream read: " + err.Error())
+		c.metrics.errors.Inc()
 	}
+	return response, err
+}
 
-	// Unpack the DNS message
-	if c.Debug {
-		log.Println("unpacking response dns message")
+// exchange sends a query in wire format over a new stream of conn
+func (c Client) exchange(ctx context.Context, conn *quic.Conn, query []byte) ([]byte, error) {
+	if c.datagrams != nil && conn.ConnectionState().TLS.NegotiatedProtocol == doq.TlsProtoDatagram {
+		response, err := c.datagrams.exchange(ctx, conn, query)
+		if !errors.Is(err, errDatagramFallback) {
+			return response, err
+		}
+		c.logger.Debugln("retrying the query over a stream")
+		c.metrics.datagramFallbacks.Inc()
 	}
-	var msg dns.Msg
-	err = msg.Unpack(response)
+
+	// Open a new QUIC stream
+	c.logger.Debugln("opening new quic stream")
+	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
-		return dns.Msg{}, errors.New("dns message unpack: " + err.Error())
+		return nil, errors.New("quic stream open: " + err.Error())
+	}
+	streamLog := c.logger.WithField("stream", stream.StreamID())
+	streamLog.Trace("stream opened")
+	defer streamLog.Trace("stream finished")
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
 	}
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelWrite(doq.RequestCancelled)
+		stream.CancelRead(doq.RequestCancelled)
+	})
+	defer stop()
 
-	return msg, nil // nil error
+	// Send the DNS query over QUIC
+	c.logger.Debugln("writing packed format to the stream")
+	framing := codec.FramingFor(conn.ConnectionState().TLS.NegotiatedProtocol)
+	err = codec.WriteRaw(stream, query, framing)
+	_ = stream.Close()
+	if err != nil {
+		return nil, errors.New("quic stream write: " + err.Error())
+	}
+
+	// Read the response
+	c.logger.Debugln("reading server response")
+	response, err := codec.ReadRaw(stream, framing)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, errors.New("quic stream read: " + err.Error())
+	}
+	return response, nil // nil error
 }
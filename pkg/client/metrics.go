@@ -0,0 +1,54 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the Prometheus metrics of a client, only exported when the
+// client is configured with a registry
+type metrics struct {
+	queries           prometheus.Gauge
+	errors            prometheus.Gauge
+	reconnects        prometheus.Gauge
+	datagramFallbacks prometheus.Gauge
+}
+
+// newMetrics returns the metrics of a client named
+// <namespace>_client_<metric>, registered on reg unless it is nil. Clients
+// sharing a registry with the same namespace and labels share their metrics.
+func newMetrics(reg prometheus.Registerer, namespace string, labels prometheus.Labels) (*metrics, error) {
+	if namespace == "" {
+		namespace = "doqd"
+	}
+	var err error
+	gauge := func(name, help string) prometheus.Gauge {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "client", Name: name, Help: help, ConstLabels: labels,
+		})
+		if reg == nil {
+			return g
+		}
+		var registered prometheus.AlreadyRegisteredError
+		switch rerr := reg.Register(g); {
+		case rerr == nil:
+		case errors.As(rerr, &registered):
+			return registered.ExistingCollector.(prometheus.Gauge)
+		case err == nil:
+			err = rerr
+		}
+		return g
+	}
+
+	m := &metrics{
+		queries:           gauge("queries", "Total queries sent"),
+		errors:            gauge("errors", "Total queries that failed without a response"),
+		reconnects:        gauge("reconnects", "Total connections re-established after a failure"),
+		datagramFallbacks: gauge("datagram_fallbacks", "Total queries sent in DATAGRAM frames and retried over a stream"),
+	}
+	if err != nil {
+		return nil, errors.New("register metrics: " + err.Error())
+	}
+	return m, nil
+}
@@ -0,0 +1,202 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+
+	doq "github.com/mosajjal/doqd"
+)
+
+// errClientClosed is returned by queries after Close or Abort
+var errClientClosed = errors.New("client closed")
+
+// connection holds the client's current QUIC connection, which is moved to a
+// new network path or replaced when its path fails
+type connection struct {
+	lock sync.Mutex
+	conn *quic.Conn
+	// transports are the UDP sockets of conn, the last one in use
+	transports []*quic.Transport
+	dial       func(ctx context.Context) (*quic.Conn, *quic.Transport, error)
+	reconnect  bool
+	closed     bool
+	metrics    *metrics
+}
+
+// newConnection dials the server and returns its connection
+func newConnection(ctx context.Context, dial func(ctx context.Context) (*quic.Conn, *quic.Transport, error), reconnect bool, m *metrics) (*connection, error) {
+	c := &connection{dial: dial, reconnect: reconnect, metrics: m}
+	conn, transport, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.set(conn, transport)
+	return c, nil
+}
+
+// dialTransport dials a QUIC connection from a new UDP socket, which the
+// connection can later migrate away from. The server addresses are tried in
+// the order of the address family preference until one connects.
+func dialTransport(ctx context.Context, server, family string, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, *quic.Transport, error) {
+	addrs, err := resolveServer(ctx, server, family)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, addr := range addrs {
+		var transport *quic.Transport
+		transport, err = newTransport()
+		if err != nil {
+			return nil, nil, err
+		}
+		var conn *quic.Conn
+		conn, err = transport.Dial(ctx, addr, tlsConf, quicConf)
+		if err == nil {
+			return conn, transport, nil
+		}
+		closeTransport(transport)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, nil, err
+}
+
+// newTransport opens a UDP socket on a random port, bound to the interface
+// the OS currently routes through
+func newTransport() (*quic.Transport, error) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		return nil, err
+	}
+	return &quic.Transport{Conn: udpConn}, nil
+}
+
+// closeTransport closes a transport and its socket, which the transport
+// doesn't own
+func closeTransport(transport *quic.Transport) {
+	_ = transport.Close()
+	_ = transport.Conn.Close()
+}
+
+// set makes conn the current connection, its sockets closed once it is
+// closed. The lock must be held, or c not yet shared.
+func (c *connection) set(conn *quic.Conn, transport *quic.Transport) {
+	c.conn = conn
+	c.transports = []*quic.Transport{transport}
+	context.AfterFunc(conn.Context(), func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.conn == conn {
+			c.closeTransports()
+		}
+	})
+}
+
+// closeTransports closes the sockets of the current connection. The lock
+// must be held.
+func (c *connection) closeTransports() {
+	for _, transport := range c.transports {
+		closeTransport(transport)
+	}
+	c.transports = nil
+}
+
+// current returns the current connection
+func (c *connection) current() *quic.Conn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn
+}
+
+// replace returns a new connection in place of failed, unless another query
+// replaced it already
+func (c *connection) replace(ctx context.Context, failed *quic.Conn) (*quic.Conn, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil, errClientClosed
+	}
+	if c.conn != failed {
+		return c.conn, nil
+	}
+	if err := c.redial(ctx); err != nil {
+		return nil, err
+	}
+	return c.conn, nil
+}
+
+// redial closes the current connection and dials a new one. The lock must
+// be held.
+func (c *connection) redial(ctx context.Context) error {
+	conn, transport, err := c.dial(ctx)
+	if err != nil {
+		return errors.New("quic redial: " + err.Error())
+	}
+	_ = c.conn.CloseWithError(doq.NoError, "")
+	c.closeTransports()
+	c.set(conn, transport)
+	c.metrics.reconnects.Inc()
+	return nil
+}
+
+// migrate moves the connection to a new UDP socket, falling back to a new
+// connection when the path can't be validated and reconnecting is enabled
+func (c *connection) migrate(ctx context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return errClientClosed
+	}
+
+	transport, err := newTransport()
+	if err != nil {
+		return errors.New("quic migrate: " + err.Error())
+	}
+	path, err := c.conn.AddPath(transport)
+	if err == nil {
+		if err = path.Probe(ctx); err == nil {
+			err = path.Switch()
+		}
+		if err != nil {
+			_ = path.Close()
+		}
+	}
+	if err != nil {
+		closeTransport(transport)
+		if c.reconnect && ctx.Err() == nil {
+			return c.redial(ctx)
+		}
+		return errors.New("quic migrate: " + err.Error())
+	}
+	c.transports = append(c.transports, transport)
+	return nil
+}
+
+// close closes the connection and its sockets for good
+func (c *connection) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	err := c.conn.CloseWithError(doq.NoError, "")
+	c.closeTransports()
+	return err
+}
+
+// Conn returns the client's current QUIC connection, which differs from
+// Session once the client reconnected
+func (c Client) Conn() *quic.Conn {
+	return c.conn.current()
+}
+
+// Migrate moves the connection to a new UDP socket after the network
+// changed, e.g. from Wi-Fi to cellular, keeping the queries in flight. When
+// the server refuses the new path and Reconnect is set, the client opens a
+// new connection instead.
+func (c Client) Migrate(ctx context.Context) error {
+	return c.conn.migrate(ctx)
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resolverSessionCacheSize bounds the TLS sessions a Resolver keeps to
+// resume its connections
+const resolverSessionCacheSize = 8
+
+// ResolverConfig configures a Resolver
+type ResolverConfig struct {
+	// Config configures the connections of the resolver. Reconnect is always
+	// enabled.
+	Config
+	// HealthCheckInterval, when set, queries the root NS records over the
+	// open connection at this interval, closing it when the query fails so
+	// the next one opens a new connection instead of waiting for the idle
+	// timeout
+	HealthCheckInterval time.Duration
+}
+
+// Resolver resolves queries over a DoQ connection it manages: it is dialed
+// on the first query, replaced when it fails or the server closes it, and
+// resumes the TLS session of the previous one. It is safe for concurrent
+// use.
+type Resolver struct {
+	conf ResolverConfig
+
+	lock    sync.Mutex
+	client  *Client
+	dialing chan struct{}
+	closed  bool
+	done    chan struct{}
+}
+
+// NewResolver returns a resolver for a server, without connecting to it
+func NewResolver(c ResolverConfig) *Resolver {
+	c.Reconnect = true
+	tlsConf := &tls.Config{}
+	if c.TLSConfig != nil {
+		tlsConf = c.TLSConfig.Clone()
+	}
+	if tlsConf.ClientSessionCache == nil && c.SessionCacheFile == "" {
+		tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(resolverSessionCacheSize)
+	}
+	c.TLSConfig = tlsConf
+
+	r := &Resolver{conf: c, done: make(chan struct{})}
+	if c.HealthCheckInterval > 0 {
+		go r.checkHealth()
+	}
+	return r
+}
+
+// Query sends a query over the resolver's connection, connecting first
+// when it has none or it was closed
+func (r *Resolver) Query(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	c, err := r.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.SendQueryContext(ctx, *msg)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil // nil error
+}
+
+// connect returns the client of the open connection, dialing a new one when
+// there is none. Concurrent queries wait for the same dial.
+func (r *Resolver) connect(ctx context.Context) (Client, error) {
+	for {
+		r.lock.Lock()
+		if r.closed {
+			r.lock.Unlock()
+			return Client{}, errClientClosed
+		}
+		if r.client != nil && r.client.Conn().Context().Err() == nil {
+			c := *r.client
+			r.lock.Unlock()
+			return c, nil
+		}
+		if dialing := r.dialing; dialing != nil {
+			r.lock.Unlock()
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return Client{}, ctx.Err()
+			}
+		}
+		dialing, stale := make(chan struct{}), r.client
+		r.dialing, r.client = dialing, nil
+		r.lock.Unlock()
+
+		if stale != nil {
+			_ = stale.Abort()
+		}
+		c, err := NewContext(ctx, r.conf.Config)
+
+		r.lock.Lock()
+		r.dialing = nil
+		close(dialing)
+		if err == nil && r.closed {
+			_ = c.Abort()
+			err = errClientClosed
+		}
+		if err == nil {
+			r.client = &c
+		}
+		r.lock.Unlock()
+		return c, err
+	}
+}
+
+// checkHealth periodically queries the server over the open connection,
+// closing it when the query fails
+func (r *Resolver) checkHealth() {
+	ticker := time.NewTicker(r.conf.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		r.lock.Lock()
+		c := r.client
+		r.lock.Unlock()
+		if c == nil || c.Conn().Context().Err() != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.conf.HealthCheckInterval)
+		msg := new(dns.Msg)
+		msg.SetQuestion(".", dns.TypeNS)
+		msg.Id = 0
+		_, err := c.SendQueryContext(ctx, *msg)
+		cancel()
+		if err != nil {
+			c.logger.Debugf("health check: %v", err)
+			_ = c.Abort()
+		}
+	}
+}
+
+// Close waits for the queries in flight and closes the connection. Later
+// queries fail.
+func (r *Resolver) Close() error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	c := r.client
+	r.client = nil
+	r.lock.Unlock()
+
+	if c == nil {
+		return nil
+	}
+	return c.Close()
+}
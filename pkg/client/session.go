@@ -0,0 +1,125 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// sessionCacheSize bounds the number of servers a session file holds
+// tickets for
+const sessionCacheSize = 100
+
+// tokenStore keeps the address validation tokens servers hand out for the
+// life of the process, so reconnecting clients skip the QUIC Retry. quic-go
+// tokens are opaque and can't be persisted.
+var tokenStore = quic.NewLRUTokenStore(sessionCacheSize, 4)
+
+// FileSessionCache is a TLS client session cache persisted to a file, so
+// short-lived processes resume their sessions with the servers they talked
+// to before. It is safe for concurrent use. Processes sharing the file
+// overwrite each other's tickets for the same server.
+type FileSessionCache struct {
+	path string
+	lock sync.Mutex
+}
+
+// sessionEntry is a serialized TLS session
+type sessionEntry struct {
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+// NewFileSessionCache returns a session cache stored in path, created when
+// the first session is stored
+func NewFileSessionCache(path string) *FileSessionCache {
+	return &FileSessionCache{path: path}
+}
+
+// Get returns the session stored for a server, if any
+func (c *FileSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.load()[sessionKey]
+	if !ok {
+		return nil, false
+	}
+	state, err := tls.ParseSessionState(entry.State)
+	if err != nil {
+		return nil, false
+	}
+	cs, err := tls.NewResumptionState(entry.Ticket, state)
+	if err != nil {
+		return nil, false
+	}
+	return cs, true
+}
+
+// Put stores the session of a server, or removes it when cs is nil
+func (c *FileSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries := c.load()
+	if cs == nil {
+		delete(entries, sessionKey)
+	} else {
+		ticket, state, err := cs.ResumptionState()
+		if err != nil || state == nil {
+			return
+		}
+		stateBytes, err := state.Bytes()
+		if err != nil {
+			return
+		}
+		if _, ok := entries[sessionKey]; !ok && len(entries) >= sessionCacheSize {
+			for key := range entries {
+				delete(entries, key)
+				break
+			}
+		}
+		entries[sessionKey] = sessionEntry{Ticket: ticket, State: stateBytes}
+	}
+	_ = c.save(entries)
+}
+
+// load reads the sessions from the file, which may not exist yet
+func (c *FileSessionCache) load() map[string]sessionEntry {
+	entries := map[string]sessionEntry{}
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return entries
+	}
+	_ = json.Unmarshal(b, &entries)
+	return entries
+}
+
+// save replaces the file atomically, readable by the owner only since
+// tickets allow resuming sessions
+func (c *FileSessionCache) save(entries map[string]sessionEntry) error {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return errors.New("create session cache directory: " + err.Error())
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
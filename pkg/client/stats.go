@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// ConnectionState describes the transport of a client's QUIC connection
+type ConnectionState struct {
+	// ALPN is the negotiated DoQ protocol identifier
+	ALPN    string
+	Version quic.Version
+	// SmoothedRTT and MinRTT are the round-trip time estimates of the
+	// connection
+	SmoothedRTT time.Duration
+	MinRTT      time.Duration
+	// PacketsSent and PacketsLost count the packets sent on the connection
+	// and those declared lost
+	PacketsSent uint64
+	PacketsLost uint64
+	// Used0RTT reports whether queries were sent before the handshake
+	// completed, and Resumed whether the TLS session was resumed
+	Used0RTT bool
+	Resumed  bool
+}
+
+// Loss returns the share of sent packets that were lost
+func (s ConnectionState) Loss() float64 {
+	if s.PacketsSent == 0 {
+		return 0
+	}
+	return float64(s.PacketsLost) / float64(s.PacketsSent)
+}
+
+// connStats collects the transport metrics of a connection from its tracer
+type connStats struct {
+	smoothedRTT atomic.Int64
+	minRTT      atomic.Int64
+	sent        atomic.Uint64
+	lost        atomic.Uint64
+}
+
+// tracer returns a QUIC connection tracer updating the stats, chained with
+// the tracer of the config, if any
+func (s *connStats) tracer(next func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer) func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+	return func(ctx context.Context, p logging.Perspective, connID quic.ConnectionID) *logging.ConnectionTracer {
+		t := &logging.ConnectionTracer{
+			UpdatedMetrics: func(rtt *logging.RTTStats, _, _ logging.ByteCount, _ int) {
+				s.smoothedRTT.Store(int64(rtt.SmoothedRTT()))
+				s.minRTT.Store(int64(rtt.MinRTT()))
+			},
+			SentLongHeaderPacket: func(*logging.ExtendedHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+				s.sent.Add(1)
+			},
+			SentShortHeaderPacket: func(*logging.ShortHeader, logging.ByteCount, logging.ECN, *logging.AckFrame, []logging.Frame) {
+				s.sent.Add(1)
+			},
+			LostPacket: func(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+				s.lost.Add(1)
+			},
+		}
+		if next != nil {
+			if nt := next(ctx, p, connID); nt != nil {
+				return logging.NewMultiplexedConnectionTracer(t, nt)
+			}
+		}
+		return t
+	}
+}
+
+// ConnectionState returns the negotiated protocol and transport quality of
+// the connection, so applications can log it or fall back to another
+// transport
+func (c Client) ConnectionState() ConnectionState {
+	state := c.Conn().ConnectionState()
+	return ConnectionState{
+		ALPN:        state.TLS.NegotiatedProtocol,
+		Version:     state.Version,
+		SmoothedRTT: time.Duration(c.stats.smoothedRTT.Load()),
+		MinRTT:      time.Duration(c.stats.minRTT.Load()),
+		PacketsSent: c.stats.sent.Load(),
+		PacketsLost: c.stats.lost.Load(),
+		Used0RTT:    state.Used0RTT,
+		Resumed:     state.TLS.DidResume,
+	}
+}
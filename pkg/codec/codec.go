@@ -0,0 +1,192 @@
+// Package codec reads and writes DNS messages on DoQ streams. Each stream
+// carries a single message in each direction. Draft versions of DoQ up to
+// doq-i02 end the message with the stream FIN, while RFC 9250 ("doq")
+// prefixes it with its length as a 2-byte integer.
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/miekg/dns"
+)
+
+// Message size limits
+const (
+	// MinMsgSize is the size of a header and a question for the root
+	MinMsgSize = 17
+	// MaxMsgSize is the largest message a 2-byte length prefix can describe
+	MaxMsgSize = dns.MaxMsgSize
+)
+
+// Errors returned for malformed streams
+var (
+	ErrTooShort     = errors.New("codec: message too short")
+	ErrTooLong      = errors.New("codec: message too long")
+	ErrTruncated    = errors.New("codec: stream ended before the end of the message")
+	ErrTrailingData = errors.New("codec: data after the message")
+)
+
+// Framing is the way a message is delimited on a stream
+type Framing int
+
+const (
+	// Unprefixed messages end with the stream FIN (draft versions)
+	Unprefixed Framing = iota
+	// LengthPrefixed messages start with their length (RFC 9250)
+	LengthPrefixed
+)
+
+// FramingFor returns the framing of a negotiated ALPN protocol. The
+// experimental doq-dgram-exp mode uses RFC 9250 streams.
+func FramingFor(alpn string) Framing {
+	if alpn == "doq" || alpn == "doq-dgram-exp" {
+		return LengthPrefixed
+	}
+	return Unprefixed
+}
+
+// maxStreamSize returns the number of bytes a stream carrying a message may
+// hold
+func (f Framing) maxStreamSize() int {
+	if f == LengthPrefixed {
+		return MaxMsgSize + 2
+	}
+	return MaxMsgSize
+}
+
+// Frame returns a message in wire format as sent on a stream
+func Frame(msg []byte, f Framing) ([]byte, error) {
+	if len(msg) > MaxMsgSize {
+		return nil, ErrTooLong
+	}
+	if f != LengthPrefixed {
+		return msg, nil
+	}
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	return b, nil
+}
+
+// Unframe returns the message in wire format carried by the content of a
+// stream, checking its size. It only fails on malformed framing, the message
+// itself isn't parsed.
+func Unframe(b []byte, f Framing) ([]byte, error) {
+	if len(b) > f.maxStreamSize() {
+		return nil, ErrTooLong
+	}
+	if f == LengthPrefixed {
+		if len(b) < 2 {
+			return nil, ErrTruncated
+		}
+		size := int(binary.BigEndian.Uint16(b))
+		switch {
+		case len(b)-2 < size:
+			return nil, ErrTruncated
+		case len(b)-2 > size:
+			return nil, ErrTrailingData
+		}
+		b = b[2:]
+	}
+	if len(b) < MinMsgSize {
+		return nil, ErrTooShort
+	}
+	return b, nil
+}
+
+// Decode parses the content of a stream into a DNS message
+func Decode(b []byte, f Framing) (*dns.Msg, error) {
+	raw, err := Unframe(b, f)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw); err != nil {
+		return nil, errors.New("codec: " + err.Error())
+	}
+	return msg, nil
+}
+
+// Encode packs a DNS message as sent on a stream
+func Encode(msg *dns.Msg, f Framing) ([]byte, error) {
+	raw, err := msg.Pack()
+	if err != nil {
+		return nil, errors.New("codec: " + err.Error())
+	}
+	return Frame(raw, f)
+}
+
+// ReadRaw reads a stream until its FIN and returns the message in wire
+// format it carries. Streams longer than a message are not read past the
+// size limit.
+func ReadRaw(r io.Reader, f Framing) ([]byte, error) {
+	return ReadRawLimit(r, f, MaxMsgSize)
+}
+
+// ReadRawLimit reads a stream like ReadRaw, failing with ErrTooLong as soon
+// as the message is known to be larger than limit bytes: from its length
+// prefix, or after reading limit bytes without reaching the FIN
+func ReadRawLimit(r io.Reader, f Framing, limit int) ([]byte, error) {
+	limit = min(limit, MaxMsgSize)
+	if f == LengthPrefixed {
+		var prefix [2]byte
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, ErrTruncated
+			}
+			return nil, err
+		}
+		size := int(binary.BigEndian.Uint16(prefix[:]))
+		if size > limit {
+			return nil, ErrTooLong
+		}
+		// One more byte tells trailing data apart
+		b, err := io.ReadAll(io.LimitReader(r, int64(size)+1))
+		if err != nil {
+			return nil, err
+		}
+		return Unframe(append(prefix[:], b...), f)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > limit {
+		return nil, ErrTooLong
+	}
+	return Unframe(b, f)
+}
+
+// ReadMsg reads a stream until its FIN and parses the DNS message it carries
+func ReadMsg(r io.Reader, f Framing) (*dns.Msg, error) {
+	b, err := io.ReadAll(io.LimitReader(r, int64(f.maxStreamSize())+1))
+	if err != nil {
+		return nil, err
+	}
+	return Decode(b, f)
+}
+
+// WriteRaw writes a message in wire format to a stream. The caller closes
+// the stream to send the FIN.
+func WriteRaw(w io.Writer, msg []byte, f Framing) error {
+	b, err := Frame(msg, f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// WriteMsg packs a DNS message and writes it to a stream. The caller closes
+// the stream to send the FIN.
+func WriteMsg(w io.Writer, msg *dns.Msg, f Framing) error {
+	b, err := Encode(msg, f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,125 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func testQuery(t testing.TB) []byte {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Id = 0
+	b, err := msg.Pack()
+	assert.Nil(t, err)
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeAAAA)
+	for _, f := range []Framing{Unprefixed, LengthPrefixed} {
+		var buf bytes.Buffer
+		assert.Nil(t, WriteMsg(&buf, msg, f))
+		got, err := ReadMsg(&buf, f)
+		if assert.Nil(t, err) {
+			assert.Equal(t, msg.Question, got.Question)
+		}
+	}
+}
+
+func TestFramingFor(t *testing.T) {
+	assert.Equal(t, LengthPrefixed, FramingFor("doq"))
+	assert.Equal(t, LengthPrefixed, FramingFor("doq-dgram-exp"))
+	assert.Equal(t, Unprefixed, FramingFor("doq-i02"))
+}
+
+func TestUnframe(t *testing.T) {
+	query := testQuery(t)
+	prefixed, err := Frame(query, LengthPrefixed)
+	assert.Nil(t, err)
+	assert.Equal(t, len(query)+2, len(prefixed))
+
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		f    Framing
+		err  error
+	}{
+		{name: "unprefixed", b: query, f: Unprefixed},
+		{name: "prefixed", b: prefixed, f: LengthPrefixed},
+		{name: "short", b: query[:MinMsgSize-1], f: Unprefixed, err: ErrTooShort},
+		{name: "long", b: make([]byte, MaxMsgSize+1), f: Unprefixed, err: ErrTooLong},
+		{name: "no prefix", b: []byte{0}, f: LengthPrefixed, err: ErrTruncated},
+		{name: "truncated", b: prefixed[:len(prefixed)-1], f: LengthPrefixed, err: ErrTruncated},
+		{name: "two messages", b: append(prefixed, prefixed...), f: LengthPrefixed, err: ErrTrailingData},
+		{name: "short prefixed", b: []byte{0, 1, 0}, f: LengthPrefixed, err: ErrTooShort},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := Unframe(tc.b, tc.f)
+			assert.Equal(t, tc.err, err)
+			if err == nil {
+				assert.Equal(t, query, raw)
+			}
+		})
+	}
+
+	_, err = Frame(make([]byte, MaxMsgSize+1), LengthPrefixed)
+	assert.Equal(t, ErrTooLong, err)
+}
+
+func TestReadRawLimit(t *testing.T) {
+	// Streams aren't read far past the limit
+	r := bytes.NewReader(make([]byte, 10*MaxMsgSize))
+	_, err := ReadRaw(r, Unprefixed)
+	assert.Equal(t, ErrTooLong, err)
+	assert.Greater(t, r.Len(), 8*MaxMsgSize)
+
+	query := testQuery(t)
+	prefixed, _ := Frame(query, LengthPrefixed)
+	for _, f := range []Framing{Unprefixed, LengthPrefixed} {
+		b := query
+		if f == LengthPrefixed {
+			b = prefixed
+		}
+		raw, err := ReadRawLimit(bytes.NewReader(b), f, len(query))
+		assert.Nil(t, err)
+		assert.Equal(t, query, raw)
+		_, err = ReadRawLimit(bytes.NewReader(b), f, len(query)-1)
+		assert.Equal(t, ErrTooLong, err)
+	}
+
+	// Length-prefixed messages are rejected from their prefix
+	r = bytes.NewReader(append([]byte{0xFF, 0xFF}, make([]byte, MaxMsgSize)...))
+	_, err = ReadRawLimit(r, LengthPrefixed, 512)
+	assert.Equal(t, ErrTooLong, err)
+	assert.Equal(t, MaxMsgSize, r.Len())
+
+	_, err = ReadRawLimit(bytes.NewReader(prefixed[:1]), LengthPrefixed, MaxMsgSize)
+	assert.Equal(t, ErrTruncated, err)
+	_, err = ReadRawLimit(bytes.NewReader(append(prefixed, 0)), LengthPrefixed, MaxMsgSize)
+	assert.Equal(t, ErrTrailingData, err)
+}
+
+func FuzzDecode(f *testing.F) {
+	query := testQuery(f)
+	prefixed, _ := Frame(query, LengthPrefixed)
+	f.Add(query, false)
+	f.Add(prefixed, true)
+	f.Fuzz(func(t *testing.T, b []byte, prefixed bool) {
+		framing := Unprefixed
+		if prefixed {
+			framing = LengthPrefixed
+		}
+		msg, err := Decode(b, framing)
+		if err != nil {
+			return
+		}
+		// Decoded messages encode again
+		if _, err := Encode(msg, framing); err != nil {
+			t.Fatalf("encode decoded message: %v", err)
+		}
+	})
+}
@@ -0,0 +1,176 @@
+// Package doqtest runs in-process DoQ servers for integration tests, on a
+// random port with a freshly generated certificate.
+package doqtest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+
+	"github.com/mosajjal/doqd/pkg/cert"
+	"github.com/mosajjal/doqd/pkg/client"
+	"github.com/mosajjal/doqd/pkg/server"
+)
+
+// certValidity is the validity of the generated certificates
+const certValidity = 24 * time.Hour
+
+// Server is a DoQ server listening on localhost
+type Server struct {
+	*server.Server
+	// Addr is the host:port the server listens on
+	Addr string
+	// RootCAs holds the server's self-signed certificate, for clients
+	// verifying it
+	RootCAs *x509.CertPool
+}
+
+// NewServer starts a DoQ server answering from records, given in zone file
+// format, e.g. "example.com. 300 IN A 192.0.2.1". The server is closed when
+// the test ends.
+func NewServer(t testing.TB, records ...string) *Server {
+	t.Helper()
+	stub, err := NewStub(records...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServerConfig(t, server.Config{Resolver: stub})
+}
+
+// NewServerConfig starts a DoQ server with a config, listening on a random
+// localhost port with a generated certificate. A config without Upstream or
+// Resolver answers every query with NXDOMAIN. The server is closed when the
+// test ends.
+func NewServerConfig(t testing.TB, c server.Config) *Server {
+	t.Helper()
+	certPEM, keyPEM, err := cert.Generate([]string{"localhost", "127.0.0.1"}, certValidity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+
+	c.ListenAddr = "127.0.0.1:0"
+	c.Cert = pair
+	if c.Upstream == "" && c.Resolver == nil {
+		c.Resolver = &Stub{}
+	}
+	if c.Logger == nil {
+		c.Logger = quietLogger()
+	}
+	s, err := server.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Listen()
+	t.Cleanup(func() { _ = s.Close() })
+
+	return &Server{Server: s, Addr: s.Listener.Addr().String(), RootCAs: roots}
+}
+
+// Client returns a client connected to the server and verifying its
+// certificate. The client is closed when the test ends.
+func (s *Server) Client(t testing.TB) client.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.NewContext(ctx, s.ClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Abort() })
+	return c
+}
+
+// ClientConfig returns the config of a client connecting to the server and
+// verifying its certificate
+func (s *Server) ClientConfig() client.Config {
+	return client.Config{
+		Server:    s.Addr,
+		TLSConfig: &tls.Config{RootCAs: s.RootCAs},
+		Logger:    quietLogger(),
+	}
+}
+
+// quietLogger returns a logger discarding everything below errors, keeping
+// test output readable
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	return logger
+}
+
+// Stub is a resolver answering from static records, with NXDOMAIN for names
+// it has no records for. It is safe for concurrent use.
+type Stub struct {
+	lock    sync.RWMutex
+	records map[string][]dns.RR
+}
+
+// NewStub returns a resolver answering from records in zone file format
+func NewStub(records ...string) (*Stub, error) {
+	s := &Stub{}
+	for _, record := range records {
+		if err := s.Add(record); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Add adds a record in zone file format
+func (s *Stub) Add(record string) error {
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		return errors.New("stub record " + record + ": " + err.Error())
+	}
+	if rr == nil {
+		return errors.New("stub record " + record + ": empty record")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.records == nil {
+		s.records = map[string][]dns.RR{}
+	}
+	name := strings.ToLower(rr.Header().Name)
+	s.records[name] = append(s.records[name], rr)
+	return nil
+}
+
+// Exchange answers a query from the records
+func (s *Stub) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	resp.RecursionAvailable = true
+	if len(msg.Question) == 0 {
+		resp.Rcode = dns.RcodeFormatError
+		return resp, nil
+	}
+
+	q := msg.Question[0]
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	records, ok := s.records[strings.ToLower(q.Name)]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+		return resp, nil
+	}
+	for _, rr := range records {
+		if q.Qtype == dns.TypeANY || rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			resp.Answer = append(resp.Answer, dns.Copy(rr))
+		}
+	}
+	return resp, nil // nil error
+}
@@ -0,0 +1,45 @@
+package doqtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mosajjal/doqd/pkg/server"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer(t, "example.com. 300 IN A 192.0.2.1", "www.example.com. 300 IN CNAME example.com.")
+	c := s.Client(t)
+
+	addrs, err := c.LookupHost(context.Background(), "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, addrs)
+
+	req := dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	req.Id = 0
+	resp, err := c.SendQuery(req)
+	assert.Nil(t, err)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, dns.TypeCNAME, resp.Answer[0].Header().Rrtype)
+	}
+
+	req.SetQuestion("missing.example.com.", dns.TypeA)
+	req.Id = 0
+	resp, err = c.SendQuery(req)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
+
+func TestServerConfig(t *testing.T) {
+	s := NewServerConfig(t, server.Config{Rewrites: map[string]string{"whoami.test": "192.0.2.2"}})
+	addrs, err := s.Client(t).LookupHost(context.Background(), "whoami.test")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"192.0.2.2"}, addrs)
+
+	_, err = NewStub("not a record")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,140 @@
+package doqtest
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Behavior scripts how an upstream answers queries for a name
+type Behavior struct {
+	// Delay holds the answer back
+	Delay time.Duration
+	// Rcode, when set, answers with this response code and no records,
+	// e.g. dns.RcodeServerFailure
+	Rcode int
+	// Truncate answers UDP queries with the TC bit set and no records, so
+	// clients retry over TCP
+	Truncate bool
+	// Drop leaves queries unanswered
+	Drop bool
+}
+
+// Upstream is a plain DNS resolver listening on localhost over UDP and TCP,
+// answering from records unless a name's behavior is scripted
+type Upstream struct {
+	// Addr is the host:port the upstream listens on over both transports
+	Addr string
+
+	stub      *Stub
+	lock      sync.Mutex
+	behaviors map[string]Behavior
+	queries   map[string]int
+}
+
+// NewUpstream starts a plain DNS resolver answering from records, given in
+// zone file format. It is closed when the test ends.
+func NewUpstream(t testing.TB, records ...string) *Upstream {
+	t.Helper()
+	stub, err := NewStub(records...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &Upstream{stub: stub, behaviors: map[string]Behavior{}, queries: map[string]int{}}
+
+	udpConn, tcpListener, err := listenBoth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Addr = udpConn.LocalAddr().String()
+	for _, s := range []*dns.Server{
+		{PacketConn: udpConn, Handler: dns.HandlerFunc(u.serve)},
+		{Listener: tcpListener, Handler: dns.HandlerFunc(u.serve)},
+	} {
+		started := make(chan struct{})
+		s.NotifyStartedFunc = func() { close(started) }
+		go func() { _ = s.ActivateAndServe() }()
+		<-started
+		t.Cleanup(func() { _ = s.Shutdown() })
+	}
+	return u
+}
+
+// listenBoth opens UDP and TCP sockets on the same random localhost port
+func listenBoth() (net.PacketConn, net.Listener, error) {
+	var err error
+	for i := 0; i < 10; i++ {
+		var udpConn net.PacketConn
+		udpConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, err
+		}
+		var tcpListener net.Listener
+		tcpListener, err = net.Listen("tcp", udpConn.LocalAddr().String())
+		if err == nil {
+			return udpConn, tcpListener, nil
+		}
+		_ = udpConn.Close() // The port is taken over TCP, try another
+	}
+	return nil, nil, err
+}
+
+// Script sets how queries for a name are answered, replacing its previous
+// behavior
+func (u *Upstream) Script(name string, b Behavior) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.behaviors[strings.ToLower(dns.Fqdn(name))] = b
+}
+
+// Add adds a record in zone file format
+func (u *Upstream) Add(record string) error {
+	return u.stub.Add(record)
+}
+
+// Queries returns the number of queries received for a name over both
+// transports, including dropped ones
+func (u *Upstream) Queries(name string) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.queries[strings.ToLower(dns.Fqdn(name))]
+}
+
+// serve answers a query according to the behavior of its name
+func (u *Upstream) serve(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 {
+		resp := new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeFormatError)
+		_ = w.WriteMsg(resp)
+		return
+	}
+
+	name := strings.ToLower(r.Question[0].Name)
+	u.lock.Lock()
+	u.queries[name]++
+	b := u.behaviors[name]
+	u.lock.Unlock()
+
+	if b.Drop {
+		return
+	}
+	time.Sleep(b.Delay)
+
+	resp := new(dns.Msg)
+	switch {
+	case b.Rcode != dns.RcodeSuccess:
+		resp.SetRcode(r, b.Rcode)
+	case b.Truncate && w.LocalAddr().Network() == "udp":
+		resp.SetReply(r)
+		resp.Truncated = true
+	default:
+		resp, _ = u.stub.Exchange(context.Background(), r)
+	}
+	resp.RecursionAvailable = true
+	_ = w.WriteMsg(resp)
+}
@@ -0,0 +1,54 @@
+package doqtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mosajjal/doqd/pkg/server"
+)
+
+func TestUpstream(t *testing.T) {
+	up := NewUpstream(t, "example.com. 300 IN A 192.0.2.1", "big.example.com. 300 IN A 192.0.2.2")
+	up.Script("big.example.com", Behavior{Truncate: true})
+	up.Script("broken.example.com", Behavior{Rcode: dns.RcodeServerFailure})
+	up.Script("slow.example.com", Behavior{Delay: 200 * time.Millisecond})
+	up.Script("dropped.example.com", Behavior{Drop: true})
+
+	c := NewServerConfig(t, server.Config{Upstream: up.Addr}).Client(t)
+	query := func(ctx context.Context, name string) (dns.Msg, error) {
+		req := dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		req.Id = 0
+		return c.SendQueryContext(ctx, req)
+	}
+
+	resp, err := query(context.Background(), "example.com.")
+	assert.Nil(t, err)
+	assert.Len(t, resp.Answer, 1)
+
+	// The truncated answer is retried over TCP
+	resp, err = query(context.Background(), "big.example.com.")
+	assert.Nil(t, err)
+	assert.Len(t, resp.Answer, 1)
+	assert.False(t, resp.Truncated)
+	assert.Equal(t, 2, up.Queries("big.example.com"))
+
+	resp, err = query(context.Background(), "broken.example.com.")
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	start := time.Now()
+	_, err = query(context.Background(), "slow.example.com.")
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = query(ctx, "dropped.example.com.")
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, up.Queries("dropped.example.com"))
+}
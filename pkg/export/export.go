@@ -0,0 +1,105 @@
+// Package export publishes query log entries as JSON events to Kafka or
+// NATS, to feed DoQ traffic into detection pipelines. The sinks plug into
+// server.QueryLogConfig, which batches entries and drops them rather than
+// slowing queries down when a sink can't keep up.
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+
+	"github.com/mosajjal/doqd/pkg/server"
+)
+
+// KafkaSink publishes query log entries to a Kafka topic, keyed by client
+// so the events of a client stay in order on one partition
+type KafkaSink struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaSink returns a sink publishing to a topic through brokers, as
+// host:port. Connections are opened on the first batch.
+func NewKafkaSink(brokers []string, topic string) (*KafkaSink, error) {
+	if len(brokers) == 0 || topic == "" {
+		return nil, errors.New("kafka: brokers and topic are required")
+	}
+	return &KafkaSink{writer: &kafka.Writer{
+		Addr:     kafka.TCP(brokers...),
+		Topic:    topic,
+		Balancer: &kafka.Hash{},
+		// Entries arrive batched already
+		BatchSize:    1000,
+		BatchTimeout: 10 * time.Millisecond,
+		RequiredAcks: kafka.RequireOne,
+	}}, nil
+}
+
+// WriteEntries publishes a batch of entries
+func (k *KafkaSink) WriteEntries(ctx context.Context, entries []server.QueryLogEntry) error {
+	msgs := make([]kafka.Message, 0, len(entries))
+	for _, e := range entries {
+		value, err := json.Marshal(e)
+		if err != nil {
+			return errors.New("kafka: " + err.Error())
+		}
+		msgs = append(msgs, kafka.Message{Key: []byte(e.Client), Value: value})
+	}
+	if err := k.writer.WriteMessages(ctx, msgs...); err != nil {
+		return errors.New("kafka: " + err.Error())
+	}
+	return nil
+}
+
+// Close closes the connections to the brokers
+func (k *KafkaSink) Close() error {
+	return k.writer.Close()
+}
+
+// NATSSink publishes query log entries to a NATS subject
+type NATSSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNATSSink connects to the NATS server at url, e.g. nats://host:4222,
+// and returns a sink publishing to a subject. The connection is
+// re-established when lost.
+func NewNATSSink(url, subject string) (*NATSSink, error) {
+	if subject == "" {
+		return nil, errors.New("nats: subject is required")
+	}
+	conn, err := nats.Connect(url, nats.Name("doqd"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, errors.New("nats: " + err.Error())
+	}
+	return &NATSSink{conn: conn, subject: subject}, nil
+}
+
+// WriteEntries publishes a batch of entries, waiting for the server to
+// receive them
+func (n *NATSSink) WriteEntries(ctx context.Context, entries []server.QueryLogEntry) error {
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return errors.New("nats: " + err.Error())
+		}
+		if err := n.conn.Publish(n.subject, data); err != nil {
+			return errors.New("nats: " + err.Error())
+		}
+	}
+	if err := n.conn.FlushWithContext(ctx); err != nil {
+		return errors.New("nats: " + err.Error())
+	}
+	return nil
+}
+
+// Close closes the connection
+func (n *NATSSink) Close() error {
+	n.conn.Close()
+	return nil
+}
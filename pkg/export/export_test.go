@@ -0,0 +1,87 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mosajjal/doqd/pkg/server"
+)
+
+// fakeNATS speaks enough of the NATS protocol to accept publications,
+// sending their subject and payload on msgs
+func fakeNATS(t *testing.T, msgs chan<- [2]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, `INFO {"server_id":"test","version":"2.10.0","max_payload":1048576}`+"\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 0:
+			case fields[0] == "PING":
+				_, _ = io.WriteString(conn, "PONG\r\n")
+			case fields[0] == "PUB" && len(fields) == 3:
+				size, _ := strconv.Atoi(fields[2])
+				payload := make([]byte, size+2)
+				if _, err := io.ReadFull(r, payload); err != nil {
+					return
+				}
+				msgs <- [2]string{fields[1], string(payload[:size])}
+			}
+		}
+	}()
+	return "nats://" + l.Addr().String()
+}
+
+func TestNATSSink(t *testing.T) {
+	msgs := make(chan [2]string, 10)
+	sink, err := NewNATSSink(fakeNATS(t, msgs), "doqd.queries")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = sink.WriteEntries(ctx, []server.QueryLogEntry{
+		{Client: "192.0.2.1", Name: "example.com.", Type: "A", Rcode: "NOERROR"},
+		{Client: "192.0.2.2", Name: "example.net.", Type: "AAAA", Rcode: "NXDOMAIN"},
+	})
+	assert.Nil(t, err)
+
+	for _, name := range []string{"example.com.", "example.net."} {
+		msg := <-msgs
+		assert.Equal(t, "doqd.queries", msg[0])
+		var entry server.QueryLogEntry
+		assert.Nil(t, json.Unmarshal([]byte(msg[1]), &entry))
+		assert.Equal(t, name, entry.Name)
+	}
+}
+
+func TestKafkaSinkConfig(t *testing.T) {
+	_, err := NewKafkaSink(nil, "queries")
+	assert.NotNil(t, err)
+	sink, err := NewKafkaSink([]string{"127.0.0.1:9092"}, "queries")
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Close())
+}
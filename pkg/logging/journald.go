@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"github.com/sirupsen/logrus"
+)
+
+// JournaldHook sends log entries to the local systemd journal, their fields
+// as journal fields, e.g. the client field as CLIENT
+type JournaldHook struct {
+	tag string
+}
+
+// NewJournaldHook returns a hook logging to the journal as tag, failing when
+// journald isn't running
+func NewJournaldHook(tag string) (*JournaldHook, error) {
+	if !journal.Enabled() {
+		return nil, errors.New("journald: not available")
+	}
+	return &JournaldHook{tag: tag}, nil
+}
+
+// Levels returns all levels, the logger's level filters entries
+func (h *JournaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire sends an entry to the journal
+func (h *JournaldHook) Fire(entry *logrus.Entry) error {
+	vars := map[string]string{"SYSLOG_IDENTIFIER": h.tag}
+	for k, v := range entry.Data {
+		if name := journalField(k); name != "" {
+			vars[name] = fmt.Sprint(v)
+		}
+	}
+	return journal.Send(entry.Message, journal.Priority(severity(entry.Level)), vars)
+}
+
+// Close does nothing, the journal connection is shared by the process
+func (h *JournaldHook) Close() error {
+	return nil
+}
+
+// journalField returns the journal field name of a log field, made of
+// uppercase letters, digits and underscores and not starting with an
+// underscore, empty when nothing is left
+func journalField(name string) string {
+	f := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	f = strings.TrimLeft(f, "_")
+	if f != "" && f[0] >= '0' && f[0] <= '9' {
+		f = "F_" + f
+	}
+	return f
+}
@@ -0,0 +1,90 @@
+// Package logging sends logrus logs to syslog or systemd-journald, with the
+// priority of each entry mapped from its level.
+package logging
+
+import (
+	"errors"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log outputs
+const (
+	OutputStderr   = "stderr"
+	OutputSyslog   = "syslog"
+	OutputJournald = "journald"
+)
+
+// Config selects where logs are written
+type Config struct {
+	// Output is stderr (the default), syslog or journald
+	Output string
+	// SyslogAddr is the syslog server as udp://host:port, tcp://host:port
+	// or unix:///path, the local syslog daemon when empty
+	SyslogAddr string
+	// SyslogFacility is the facility of syslog messages, e.g. daemon (the
+	// default), user or local0 to local7
+	SyslogFacility string
+	// Tag identifies the program in syslog and journald, doqd when empty
+	Tag string
+}
+
+// Setup sends the logs of logger to the configured output. Outputs other
+// than stderr replace the logger's writer, the returned closer closes their
+// connection.
+func Setup(logger *logrus.Logger, c Config) (io.Closer, error) {
+	tag := c.Tag
+	if tag == "" {
+		tag = "doqd"
+	}
+	var hook interface {
+		logrus.Hook
+		io.Closer
+	}
+	var err error
+	switch c.Output {
+	case "", OutputStderr:
+		return io.NopCloser(nil), nil
+	case OutputSyslog:
+		hook, err = NewSyslogHook(c.SyslogAddr, c.SyslogFacility, tag)
+	case OutputJournald:
+		hook, err = NewJournaldHook(tag)
+	default:
+		return nil, errors.New("unknown log output " + c.Output)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.AddHook(hook)
+	logger.SetOutput(io.Discard)
+	return hook, nil
+}
+
+// Syslog severities, shared by journald
+const (
+	severityEmergency = 0
+	severityCritical  = 2
+	severityError     = 3
+	severityWarning   = 4
+	severityInfo      = 6
+	severityDebug     = 7
+)
+
+// severity returns the syslog severity of a log level
+func severity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return severityEmergency
+	case logrus.FatalLevel:
+		return severityCritical
+	case logrus.ErrorLevel:
+		return severityError
+	case logrus.WarnLevel:
+		return severityWarning
+	case logrus.InfoLevel:
+		return severityInfo
+	default:
+		return severityDebug
+	}
+}
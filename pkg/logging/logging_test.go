@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer server.Close()
+
+	logger := logrus.New()
+	closer, err := Setup(logger, Config{Output: OutputSyslog, SyslogAddr: "udp://" + server.LocalAddr().String(), SyslogFacility: "local3"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer closer.Close()
+	logger.WithField("client", "192.0.2.1").Warn("upstream slow")
+
+	buf := make([]byte, 1024)
+	_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := server.ReadFrom(buf)
+	assert.Nil(t, err)
+	msg := string(buf[:n])
+	// local3 (19) * 8 + warning (4)
+	assert.True(t, strings.HasPrefix(msg, "<156>1 "), msg)
+	assert.Contains(t, msg, " doqd ")
+	assert.True(t, strings.HasSuffix(msg, " - - upstream slow client=192.0.2.1"), msg)
+}
+
+func TestSyslogTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	hook, err := NewSyslogHook("tcp://"+listener.Addr().String(), "", "resolver")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer hook.Close()
+	conn, err := listener.Accept()
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	logger := logrus.New()
+	logger.AddHook(hook)
+	logger.Error("listener failed")
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(conn)
+	length, err := r.ReadString(' ')
+	assert.Nil(t, err)
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	assert.Nil(t, err)
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	assert.Nil(t, err)
+	// daemon (3) * 8 + error (3)
+	assert.True(t, strings.HasPrefix(string(msg), "<27>1 "), string(msg))
+	assert.True(t, strings.HasSuffix(string(msg), " resolver "+strconv.Itoa(os.Getpid())+" - - listener failed"), string(msg))
+}
+
+func TestSetup(t *testing.T) {
+	_, err := Setup(logrus.New(), Config{Output: "carrier-pigeon"})
+	assert.NotNil(t, err)
+	_, err = NewSyslogHook("udp://127.0.0.1:514", "nope", "doqd")
+	assert.NotNil(t, err)
+
+	closer, err := Setup(logrus.New(), Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, closer.Close())
+}
+
+func TestJournalField(t *testing.T) {
+	assert.Equal(t, "CLIENT", journalField("client"))
+	assert.Equal(t, "QUERY_NAME", journalField("query.name"))
+	assert.Equal(t, "ERROR", journalField("_error"))
+	assert.Equal(t, "F_2XX", journalField("2xx"))
+	assert.Equal(t, "", journalField("__"))
+}
@@ -0,0 +1,171 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// facilities are the syslog facilities by name
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// localSyslogSockets are the sockets local syslog daemons listen on
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogHook sends log entries as RFC 5424 messages to a local or remote
+// syslog server
+type SyslogHook struct {
+	network  string
+	addr     string
+	facility int
+	tag      string
+	hostname string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogHook returns a hook logging to the syslog server at addr, as
+// udp://host:port, tcp://host:port or unix:///path, or to the local syslog
+// daemon when addr is empty. Messages are sent with the facility, daemon
+// when empty, and tag as the application name.
+func NewSyslogHook(addr, facility, tag string) (*SyslogHook, error) {
+	if facility == "" {
+		facility = "daemon"
+	}
+	f, ok := facilities[facility]
+	if !ok {
+		return nil, errors.New("syslog: unknown facility " + facility)
+	}
+	hostname, _ := os.Hostname()
+	h := &SyslogHook{facility: f, tag: tag, hostname: hostname}
+	if addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, errors.New("syslog: " + err.Error())
+		}
+		switch u.Scheme {
+		case "udp", "tcp":
+			h.network, h.addr = u.Scheme, u.Host
+		case "unix":
+			h.network, h.addr = "unix", u.Path
+		default:
+			return nil, errors.New("syslog: unsupported address " + addr)
+		}
+	}
+	if err := h.connect(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// connect opens the connection to the syslog server. The lock must be held,
+// or h not yet shared.
+func (h *SyslogHook) connect() error {
+	if h.network == "udp" || h.network == "tcp" {
+		conn, err := net.DialTimeout(h.network, h.addr, 5*time.Second)
+		if err != nil {
+			return errors.New("syslog: " + err.Error())
+		}
+		h.conn = conn
+		return nil
+	}
+
+	paths := localSyslogSockets
+	if h.addr != "" {
+		paths = []string{h.addr}
+	}
+	for _, path := range paths {
+		// Syslog daemons listen on datagram sockets, some on stream ones
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := net.Dial(network, path); err == nil {
+				h.conn = conn
+				return nil
+			}
+		}
+	}
+	return errors.New("syslog: no syslog daemon listening on " + strings.Join(paths, ", "))
+}
+
+// Levels returns all levels, the logger's level filters entries
+func (h *SyslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire sends an entry, reconnecting once when the connection failed
+func (h *SyslogHook) Fire(entry *logrus.Entry) error {
+	msg := h.format(entry)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.conn != nil {
+		if _, err := h.conn.Write(msg); err == nil {
+			return nil
+		}
+		_ = h.conn.Close()
+		h.conn = nil
+	}
+	if err := h.connect(); err != nil {
+		return err
+	}
+	_, err := h.conn.Write(msg)
+	return err
+}
+
+// format returns an entry as an RFC 5424 message, its fields appended to
+// the text as key=value. Messages sent over TCP are prefixed with their
+// length (RFC 6587 octet counting).
+func (h *SyslogHook) format(entry *logrus.Entry) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - - %s",
+		h.facility*8+severity(entry.Level),
+		entry.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		nilValue(h.hostname), nilValue(h.tag), os.Getpid(), entry.Message)
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, entry.Data[k])
+	}
+
+	if h.network == "tcp" {
+		return []byte(strconv.Itoa(b.Len()) + " " + b.String())
+	}
+	return []byte(b.String())
+}
+
+// nilValue returns s, or the RFC 5424 nil value when it is empty
+func nilValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Close closes the connection to the syslog server
+func (h *SyslogHook) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn = nil
+	return err
+}
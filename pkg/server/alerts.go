@@ -0,0 +1,336 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Alerting limits
+const (
+	defaultAlertInterval = time.Minute
+	// alertMinSamples is the number of queries needed in an interval before
+	// a rate can fire, so a single failure doesn't make a 100% error rate
+	alertMinSamples = 20
+	// maxAlertClients bounds the clients counted per interval
+	maxAlertClients = 100000
+	alertTimeout    = 10 * time.Second
+)
+
+// AlertConfig configures alerts fired when thresholds are crossed, posted
+// to a webhook or passed to a command. Thresholds are checked every
+// Interval, and an alert fires once until its condition clears.
+type AlertConfig struct {
+	// Logger receives the alerts and delivery errors, the standard logger
+	// when nil
+	Logger *logrus.Logger
+	// Webhook receives each alert as a JSON POST
+	Webhook string
+	// Command is run for each alert, without arguments, with the alert as
+	// JSON on its standard input and in the DOQD_ALERT_NAME and
+	// DOQD_ALERT_MESSAGE environment variables
+	Command string
+	// Interval between checks, 1 minute by default
+	Interval time.Duration
+
+	// UpstreamErrorRate fires when this fraction of upstream queries fail
+	// during an interval, 0 to disable
+	UpstreamErrorRate float64
+	// NXDomainRate fires when this fraction of answers are NXDOMAIN during
+	// an interval, 0 to disable
+	NXDomainRate float64
+	// ClientQPS fires when a single client sends more queries per second,
+	// averaged over an interval, 0 to disable
+	ClientQPS float64
+	// CertExpiry fires when a certificate of the server or its tenants
+	// expires within this duration, 0 to disable
+	CertExpiry time.Duration
+	// TunnelingQueries fires when a single client sends this many queries
+	// flagged by tunneling detection during an interval, 0 to disable
+	TunnelingQueries int
+}
+
+// Alert is a crossed threshold
+type Alert struct {
+	// Name is upstream_errors, nxdomain_rate, client_qps, cert_expiry or
+	// tunneling
+	Name      string    `json:"name"`
+	Message   string    `json:"message"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Client    string    `json:"client,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// alertCert is a certificate watched for expiry
+type alertCert struct {
+	name     string
+	notAfter time.Time
+}
+
+// Alerter counts the events alerts are based on and checks them every
+// interval. It can be shared by servers, e.g. listening on several
+// addresses.
+type Alerter struct {
+	conf   AlertConfig
+	logger *logrus.Logger
+	client *http.Client
+
+	lock            sync.Mutex
+	certs           []alertCert
+	upstreamQueries int
+	upstreamErrors  int
+	answers         int
+	nxdomains       int
+	clients         map[netip.Addr]int
+	tunneling       map[netip.Addr]int
+
+	// firing holds the alerts fired whose condition hasn't cleared, only
+	// used by run
+	firing    map[string]bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewAlerter starts checking thresholds every interval. Servers configured
+// with the alerter feed it their queries and certificates.
+func NewAlerter(c AlertConfig) (*Alerter, error) {
+	if c.Webhook == "" && c.Command == "" {
+		return nil, errors.New("alerts: a webhook or command is required")
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultAlertInterval
+	}
+	if c.Logger == nil {
+		c.Logger = logrus.StandardLogger()
+	}
+	a := &Alerter{
+		conf:      c,
+		logger:    c.Logger,
+		client:    &http.Client{Timeout: alertTimeout},
+		clients:   map[netip.Addr]int{},
+		tunneling: map[netip.Addr]int{},
+		firing:    map[string]bool{},
+		done:      make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// watchCertificate checks a certificate for expiry, named after its first
+// DNS name when name is empty. Certificates are watched once per name.
+func (a *Alerter) watchCertificate(name string, cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return errors.New("alerts: certificate " + name + ": " + err.Error())
+	}
+	if name == "" {
+		name = leaf.Subject.CommonName
+		if len(leaf.DNSNames) > 0 {
+			name = leaf.DNSNames[0]
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, c := range a.certs {
+		if c.name == name {
+			return nil
+		}
+	}
+	a.certs = append(a.certs, alertCert{name: name, notAfter: leaf.NotAfter})
+	return nil
+}
+
+// observe counts an answered query
+func (a *Alerter) observe(q *query, reply *dns.Msg) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.answers++
+	if reply.Rcode == dns.RcodeNameError {
+		a.nxdomains++
+	}
+	if a.conf.ClientQPS > 0 && q.client != nil {
+		if ip, ok := clientAddr(q.client); ok {
+			if _, seen := a.clients[ip]; seen || len(a.clients) < maxAlertClients {
+				a.clients[ip]++
+			}
+		}
+	}
+}
+
+// observeUpstream counts an upstream exchange
+func (a *Alerter) observeUpstream(err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.upstreamQueries++
+	if err != nil {
+		a.upstreamErrors++
+	}
+}
+
+// observeTunneling counts a query of a client flagged by tunneling detection
+func (a *Alerter) observeTunneling(ip netip.Addr) {
+	if a.conf.TunnelingQueries == 0 {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, seen := a.tunneling[ip]; seen || len(a.tunneling) < maxAlertClients {
+		a.tunneling[ip]++
+	}
+}
+
+// run checks the thresholds every interval until the alerter is closed
+func (a *Alerter) run() {
+	ticker := time.NewTicker(a.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case now := <-ticker.C:
+			a.check(now)
+		}
+	}
+}
+
+// check fires the alerts whose condition started during the last interval
+// and resets the counts
+func (a *Alerter) check(now time.Time) {
+	a.lock.Lock()
+	upstreamQueries, upstreamErrors := a.upstreamQueries, a.upstreamErrors
+	answers, nxdomains := a.answers, a.nxdomains
+	clients, tunneling := a.clients, a.tunneling
+	certs := a.certs
+	a.upstreamQueries, a.upstreamErrors, a.answers, a.nxdomains = 0, 0, 0, 0
+	a.clients, a.tunneling = map[netip.Addr]int{}, map[netip.Addr]int{}
+	a.lock.Unlock()
+
+	active := map[string]Alert{}
+	if t := a.conf.UpstreamErrorRate; t > 0 && upstreamQueries >= alertMinSamples {
+		if rate := float64(upstreamErrors) / float64(upstreamQueries); rate >= t {
+			active["upstream_errors"] = Alert{
+				Name: "upstream_errors", Value: rate, Threshold: t,
+				Message: fmt.Sprintf("upstream error rate %.0f%% above %.0f%% (%d of %d queries)", rate*100, t*100, upstreamErrors, upstreamQueries),
+			}
+		}
+	}
+	if t := a.conf.NXDomainRate; t > 0 && answers >= alertMinSamples {
+		if rate := float64(nxdomains) / float64(answers); rate >= t {
+			active["nxdomain_rate"] = Alert{
+				Name: "nxdomain_rate", Value: rate, Threshold: t,
+				Message: fmt.Sprintf("NXDOMAIN rate %.0f%% above %.0f%% (%d of %d answers)", rate*100, t*100, nxdomains, answers),
+			}
+		}
+	}
+	if t := a.conf.ClientQPS; t > 0 {
+		for ip, count := range clients {
+			if qps := float64(count) / a.conf.Interval.Seconds(); qps >= t {
+				active["client_qps "+ip.String()] = Alert{
+					Name: "client_qps", Value: qps, Threshold: t, Client: ip.String(),
+					Message: fmt.Sprintf("client %s sent %.0f queries per second, above %.0f", ip, qps, t),
+				}
+			}
+		}
+	}
+	if t := a.conf.TunnelingQueries; t > 0 {
+		for ip, count := range tunneling {
+			if count >= t {
+				active["tunneling "+ip.String()] = Alert{
+					Name: "tunneling", Value: float64(count), Threshold: float64(t), Client: ip.String(),
+					Message: fmt.Sprintf("client %s sent %d queries flagged as possible DNS tunneling, above %d", ip, count, t),
+				}
+			}
+		}
+	}
+	if t := a.conf.CertExpiry; t > 0 {
+		for _, cert := range certs {
+			if left := cert.notAfter.Sub(now); left < t {
+				active["cert_expiry "+cert.name] = Alert{
+					Name: "cert_expiry", Value: left.Hours(), Threshold: t.Hours(),
+					Message: fmt.Sprintf("certificate %s expires in %s, on %s", cert.name, left.Round(time.Minute), cert.notAfter.UTC().Format(time.RFC3339)),
+				}
+			}
+		}
+	}
+
+	for key, alert := range active {
+		if a.firing[key] {
+			continue
+		}
+		a.firing[key] = true
+		alert.Time = now.UTC()
+		a.fire(alert)
+	}
+	for key := range a.firing {
+		if _, ok := active[key]; !ok {
+			delete(a.firing, key)
+		}
+	}
+}
+
+// fire sends an alert to the webhook and command
+func (a *Alerter) fire(alert Alert) {
+	a.logger.Warnf("alert: %s", alert.Message)
+	body, err := json.Marshal(alert)
+	if err != nil {
+		a.logger.Warnf("alert: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	if a.conf.Webhook != "" {
+		if err := a.post(ctx, body); err != nil {
+			a.logger.Warnf("alert webhook: %v", err)
+		}
+	}
+	if a.conf.Command != "" {
+		cmd := exec.CommandContext(ctx, a.conf.Command)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(), "DOQD_ALERT_NAME="+alert.Name, "DOQD_ALERT_MESSAGE="+alert.Message)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			a.logger.Warnf("alert command: %v: %s", err, bytes.TrimSpace(out))
+		}
+	}
+}
+
+// post sends an alert to the webhook
+func (a *Alerter) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.conf.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("status " + resp.Status)
+	}
+	return nil
+}
+
+// Close stops the checks
+func (a *Alerter) Close() error {
+	a.closeOnce.Do(func() { close(a.done) })
+	return nil
+}
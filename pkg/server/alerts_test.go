@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlerts(t *testing.T) {
+	var lock sync.Mutex
+	var alerts []Alert
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&alert))
+		lock.Lock()
+		defer lock.Unlock()
+		alerts = append(alerts, alert)
+	}))
+	defer ts.Close()
+	fired := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		var names []string
+		for _, a := range alerts {
+			names = append(names, a.Name)
+		}
+		alerts = nil
+		return names
+	}
+
+	a, err := NewAlerter(AlertConfig{
+		Logger:            logrus.New(),
+		Webhook:           ts.URL,
+		Interval:          time.Hour, // Checked by hand
+		UpstreamErrorRate: 0.5,
+		NXDomainRate:      0.5,
+		ClientQPS:         0.0001,
+		CertExpiry:        48 * time.Hour,
+		TunnelingQueries:  2,
+	})
+	assert.Nil(t, err)
+	defer a.Close()
+
+	// A 24h certificate expires soon, watching it again is a no-op
+	assert.Nil(t, a.watchCertificate("", testCertificate(t, "doq.example")))
+	assert.Nil(t, a.watchCertificate("", testCertificate(t, "doq.example")))
+	a.check(time.Now())
+	assert.Equal(t, []string{"cert_expiry"}, fired())
+
+	// Rates need enough samples
+	msg := new(dns.Msg)
+	msg.SetQuestion("nope.example.", dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, dns.RcodeNameError)
+	q := &query{msg: msg, client: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	a.observeUpstream(errors.New("timeout"))
+	a.observe(q, reply)
+	a.check(time.Now())
+	assert.ElementsMatch(t, []string{"client_qps"}, fired())
+
+	for i := 0; i < alertMinSamples; i++ {
+		a.observeUpstream(errors.New("timeout"))
+		a.observe(q, reply)
+	}
+	a.check(time.Now())
+	assert.ElementsMatch(t, []string{"upstream_errors", "nxdomain_rate"}, fired())
+
+	// Alerts fire once until their condition clears
+	for i := 0; i < alertMinSamples; i++ {
+		a.observeUpstream(errors.New("timeout"))
+	}
+	a.check(time.Now())
+	assert.Empty(t, fired())
+	a.check(time.Now())
+	for i := 0; i < alertMinSamples; i++ {
+		a.observeUpstream(errors.New("timeout"))
+	}
+	a.check(time.Now())
+	assert.Equal(t, []string{"upstream_errors"}, fired())
+
+	// Clients fire with enough flagged queries
+	a.observeTunneling(netip.MustParseAddr("192.0.2.1"))
+	a.observeTunneling(netip.MustParseAddr("192.0.2.2"))
+	a.observeTunneling(netip.MustParseAddr("192.0.2.2"))
+	a.check(time.Now())
+	assert.Equal(t, []string{"tunneling"}, fired())
+}
+
+func TestAlertCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "alert.json")
+	script := filepath.Join(dir, "alert.sh")
+	assert.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$DOQD_ALERT_NAME\" > "+out+".name\ncat > "+out+"\n"), 0o700))
+
+	a, err := NewAlerter(AlertConfig{Command: script, Interval: time.Hour, Logger: logrus.New()})
+	assert.Nil(t, err)
+	defer a.Close()
+	a.fire(Alert{Name: "client_qps", Message: "client 192.0.2.1 sent 500 queries per second, above 100"})
+
+	name, err := os.ReadFile(out + ".name")
+	assert.Nil(t, err)
+	assert.Equal(t, "client_qps\n", string(name))
+	body, err := os.ReadFile(out)
+	assert.Nil(t, err)
+	var alert Alert
+	assert.Nil(t, json.Unmarshal(body, &alert))
+	assert.Equal(t, "client_qps", alert.Name)
+}
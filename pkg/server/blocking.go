@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Blocking actions, besides comma separated sinkhole IP addresses
+const (
+	// BlockNXDomain answers that the name does not exist
+	BlockNXDomain = "nxdomain"
+	// BlockNoData answers that the name has no records of the queried type
+	BlockNoData = "nodata"
+	// BlockRefused refuses to answer
+	BlockRefused = "refused"
+)
+
+// blockedTTL is the TTL of the records synthesized for blocked queries
+const blockedTTL = 60
+
+// BlockingConfig configures which queries are blocked instead of being
+// forwarded upstream
+type BlockingConfig struct {
+	// Blocklists are files of names to block, one per line or in hosts file
+	// format. An entry matches the name exactly, and *.example.com matches
+	// the names below example.com. A name may be followed by the action
+	// blocking it. # starts a comment.
+	Blocklists []string
+	// Action answers blocked queries: BlockNXDomain, the default,
+	// BlockNoData, BlockRefused, or comma separated IP addresses answering
+	// A and AAAA queries. ListActions overrides it for the names of some
+	// blocklists, by path.
+	Action      string
+	ListActions map[string]string
+	// Allowlists are files in the same format as the blocklists, without
+	// actions, listing names that are never blocked
+	Allowlists []string
+	// Bypass lists trusted clients whose queries are never blocked, as IP
+	// addresses, IP prefixes, or hex SHA-256 fingerprints of a client
+	// certificate or its public key
+	Bypass []string
+}
+
+// blocker decides which queries are blocked and how
+type blocker struct {
+	blocked *domainList
+	allowed *domainList
+	bypass  *clientMatcher
+	// actions holds the parsed actions of the blocklist entries
+	actions map[string]*blockAction
+}
+
+// blockAction is how blocked queries are answered
+type blockAction struct {
+	rcode int
+	addrs []netip.Addr
+}
+
+// parseBlockAction parses a blocking action
+func parseBlockAction(action string) (*blockAction, error) {
+	switch strings.ToLower(action) {
+	case "", BlockNXDomain:
+		return &blockAction{rcode: dns.RcodeNameError}, nil
+	case BlockNoData:
+		return &blockAction{rcode: dns.RcodeSuccess}, nil
+	case BlockRefused:
+		return &blockAction{rcode: dns.RcodeRefused}, nil
+	}
+	a := &blockAction{rcode: dns.RcodeSuccess}
+	for _, field := range strings.Split(action, ",") {
+		addr, err := netip.ParseAddr(strings.TrimSpace(field))
+		if err != nil {
+			return nil, errors.New("invalid action " + action)
+		}
+		a.addrs = append(a.addrs, addr.Unmap())
+	}
+	return a, nil
+}
+
+// newBlocker loads the block and allow lists, or returns nil when there are
+// no blocklists
+func newBlocker(c BlockingConfig) (*blocker, error) {
+	if len(c.Blocklists) == 0 {
+		return nil, nil
+	}
+	bypass, err := newClientMatcher(c.Bypass)
+	if err != nil {
+		return nil, errors.New("blocking bypass: " + err.Error())
+	}
+	b := &blocker{blocked: newDomainList(), allowed: newDomainList(), bypass: bypass, actions: map[string]*blockAction{}}
+	for _, path := range c.Blocklists {
+		action, ok := c.ListActions[path]
+		if !ok {
+			action = c.Action
+		}
+		if err := b.blocked.load(path, action); err != nil {
+			return nil, errors.New("blocklist: " + err.Error())
+		}
+	}
+	for _, list := range []map[string]string{b.blocked.exact, b.blocked.wildcard} {
+		for _, action := range list {
+			if _, ok := b.actions[action]; ok {
+				continue
+			}
+			if b.actions[action], err = parseBlockAction(action); err != nil {
+				return nil, errors.New("blocklist: " + err.Error())
+			}
+		}
+	}
+
+	for _, path := range c.Allowlists {
+		if err := b.allowed.load(path, ""); err != nil {
+			return nil, errors.New("allowlist: " + err.Error())
+		}
+	}
+	for _, list := range []map[string]string{b.allowed.exact, b.allowed.wildcard} {
+		for name, action := range list {
+			if action != "" {
+				return nil, errors.New("allowlist: unexpected action for " + name)
+			}
+		}
+	}
+	return b, nil
+}
+
+// block answers a blocked query, or returns nil if the query is not blocked.
+// Allowlisted names and trusted clients are checked on every query, so they
+// always win.
+func (b *blocker) block(q *query) *dns.Msg {
+	if len(q.msg.Question) != 1 {
+		return nil
+	}
+	name := strings.ToLower(q.msg.Question[0].Name)
+	action, ok := b.blocked.lookup(name)
+	if !ok || b.allowed.match(name) || b.bypass.match(q) {
+		return nil
+	}
+	return blockedReply(q.msg, b.actions[action])
+}
+
+// blockedReply answers a blocked query, explained by an Extended DNS Error
+// (RFC 8914) when the client supports EDNS
+func blockedReply(msg *dns.Msg, action *blockAction) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, action.rcode)
+	reply.RecursionAvailable = true
+	if len(msg.Question) == 1 {
+		reply.Answer = addressRRs(msg.Question[0], action.addrs, blockedTTL)
+	}
+	setBlockedEDE(reply, msg, "")
+	return reply
+}
+
+// setBlockedEDE adds a "Blocked" Extended DNS Error to a reply when the query
+// supports EDNS
+func setBlockedEDE(reply, msg *dns.Msg, text string) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	reply.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	reply.IsEdns0().Option = append(reply.IsEdns0().Option, &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeBlocked,
+		ExtraText: text,
+	})
+}
+
+// domainList matches names exactly, or below a domain for wildcard entries.
+// Each entry carries a value, e.g. a blocking action.
+type domainList struct {
+	exact    map[string]string
+	wildcard map[string]string
+}
+
+func newDomainList() *domainList {
+	return &domainList{exact: map[string]string{}, wildcard: map[string]string{}}
+}
+
+// load adds the entries of a list file. A single name on a line may be
+// followed by its value, otherwise entries get the given one.
+func (l *domainList) load(path, value string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		names, lineValue := fields, value
+		switch {
+		case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+			// Hosts file lines start with the address the names resolve to
+			names = fields[1:]
+		case len(fields) == 2:
+			names, lineValue = fields[:1], fields[1]
+		case len(fields) > 2:
+			return errors.New(path + ": line " + strconv.Itoa(line) + ": too many fields")
+		}
+		for _, name := range names {
+			if err := l.addValue(name, lineValue); err != nil {
+				return errors.New(path + ": line " + strconv.Itoa(line) + ": " + err.Error())
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// add adds a name, or a *. wildcard matching the names below a domain
+func (l *domainList) add(name string) error {
+	return l.addValue(name, "")
+}
+
+// addValue adds a name with a value
+func (l *domainList) addValue(name, value string) error {
+	name = strings.ToLower(name)
+	wildcard := strings.HasPrefix(name, "*.")
+	name = dns.Fqdn(strings.TrimPrefix(name, "*."))
+	if _, ok := dns.IsDomainName(name); !ok {
+		return errors.New("invalid name " + name)
+	}
+	if wildcard {
+		l.wildcard[name] = value
+	} else {
+		l.exact[name] = value
+	}
+	return nil
+}
+
+// lookup returns the value of the entry matching a lowercased fully
+// qualified name
+func (l *domainList) lookup(name string) (string, bool) {
+	if value, ok := l.exact[name]; ok {
+		return value, true
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if value, ok := l.wildcard[name[off:]]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// match reports whether a lowercased fully qualified name is on the list
+func (l *domainList) match(name string) bool {
+	_, ok := l.lookup(name)
+	return ok
+}
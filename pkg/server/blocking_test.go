@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list")
+	assert.Nil(t, os.WriteFile(path, []byte(`# comment
+ads.example.com
+0.0.0.0 tracker.example.net other.example.net # hosts format
+*.Example.ORG
+`), 0o600))
+
+	l := newDomainList()
+	assert.Nil(t, l.load(path, ""))
+	for name, match := range map[string]bool{
+		"ads.example.com.":     true,
+		"www.ads.example.com.": false,
+		"tracker.example.net.": true,
+		"other.example.net.":   true,
+		"example.org.":         false,
+		"a.b.example.org.":     true,
+		"example.com.":         false,
+	} {
+		assert.Equal(t, match, l.match(name), name)
+	}
+
+	assert.Nil(t, os.WriteFile(path, []byte("bad..name\n"), 0o600))
+	assert.NotNil(t, newDomainList().load(path, ""))
+}
+
+func TestBlocking(t *testing.T) {
+	dir := t.TempDir()
+	blocklist := filepath.Join(dir, "block")
+	allowlist := filepath.Join(dir, "allow")
+	assert.Nil(t, os.WriteFile(blocklist, []byte("*.example.com\nexample.net\n"), 0o600))
+	assert.Nil(t, os.WriteFile(allowlist, []byte("good.example.com\n*.cdn.example.com\n"), 0o600))
+
+	pair, fingerprint := testKeyPair(t, "trusted")
+	trustedCert, err := x509.ParseCertificate(pair.Certificate[0])
+	assert.Nil(t, err)
+
+	b, err := newBlocker(BlockingConfig{
+		Blocklists: []string{blocklist},
+		Allowlists: []string{allowlist},
+		Bypass:     []string{"192.0.2.0/24", "2001:db8::1", fingerprint},
+	})
+	assert.Nil(t, err)
+	s := &Server{upstream: &monitoredUpstream{Resolver: &slowUpstream{}}, logger: logrus.New(), blocker: b}
+
+	resolve := func(name string, client net.IP, cert *x509.Certificate) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(1232, false)
+		return s.resolve(&query{msg: msg, client: &net.UDPAddr{IP: client}, peerCert: cert})
+	}
+	client := net.ParseIP("198.51.100.1")
+
+	reply := resolve("ads.example.com.", client, nil)
+	assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	assert.Equal(t, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked}, reply.IsEdns0().Option[0])
+	assert.Equal(t, dns.RcodeNameError, resolve("EXAMPLE.net.", client, nil).Rcode)
+
+	// Allowlisted names and trusted clients are never blocked
+	assert.Equal(t, dns.RcodeSuccess, resolve("good.example.com.", client, nil).Rcode)
+	assert.Equal(t, dns.RcodeSuccess, resolve("img.cdn.example.com.", client, nil).Rcode)
+	assert.Equal(t, dns.RcodeSuccess, resolve("ads.example.com.", net.ParseIP("192.0.2.7"), nil).Rcode)
+	assert.Equal(t, dns.RcodeSuccess, resolve("ads.example.com.", net.ParseIP("2001:db8::1"), nil).Rcode)
+	assert.Equal(t, dns.RcodeSuccess, resolve("ads.example.com.", client, trustedCert).Rcode)
+
+	_, err = newBlocker(BlockingConfig{Blocklists: []string{blocklist}, Bypass: []string{"nonsense"}})
+	assert.NotNil(t, err)
+	b, err = newBlocker(BlockingConfig{Allowlists: []string{allowlist}})
+	assert.Nil(t, err)
+	assert.Nil(t, b)
+}
+
+func TestBlockActions(t *testing.T) {
+	dir := t.TempDir()
+	ads := filepath.Join(dir, "ads")
+	malware := filepath.Join(dir, "malware")
+	assert.Nil(t, os.WriteFile(ads, []byte("ads.example\nnodata.example nodata\nsinkhole.example 192.0.2.1,2001:db8::1\n"), 0o600))
+	assert.Nil(t, os.WriteFile(malware, []byte("0.0.0.0 malware.example\n"), 0o600))
+
+	b, err := newBlocker(BlockingConfig{
+		Blocklists:  []string{ads, malware},
+		Action:      BlockRefused,
+		ListActions: map[string]string{malware: "0.0.0.0"},
+	})
+	assert.Nil(t, err)
+
+	block := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		return b.block(&query{msg: msg})
+	}
+	assert.Nil(t, block("www.example.", dns.TypeA))
+	assert.Equal(t, dns.RcodeRefused, block("ads.example.", dns.TypeA).Rcode)
+
+	reply := block("nodata.example.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+
+	reply = block("sinkhole.example.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, "2001:db8::1", reply.Answer[0].(*dns.AAAA).AAAA.String())
+
+	reply = block("malware.example.", dns.TypeA)
+	assert.Equal(t, "0.0.0.0", reply.Answer[0].(*dns.A).A.String())
+
+	for _, c := range []BlockingConfig{
+		{Blocklists: []string{ads}, Action: "drop"},
+		{Blocklists: []string{ads}, Allowlists: []string{ads}},
+	} {
+		_, err := newBlocker(c)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache stores upstream responses. Keys begin with the lowercased question
+// name followed by a zero byte, so implementations can flush by name without
+// decoding responses. It is safe for concurrent use.
+type Cache interface {
+	// Get returns the response cached under key with its TTLs reduced by the
+	// time it spent in the cache, or nil if there is none
+	Get(ctx context.Context, key string) (*dns.Msg, error)
+	// Set caches msg under key for ttl
+	Set(ctx context.Context, key string, msg *dns.Msg, ttl time.Duration) error
+	// Flush removes the responses whose question name matches and returns how
+	// many were removed
+	Flush(ctx context.Context, match func(name string) bool) (int, error)
+	// Len returns the number of cached responses
+	Len(ctx context.Context) (int, error)
+}
+
+// cacheKeyName returns the question name a cache key begins with
+func cacheKeyName(key string) string {
+	name, _, _ := strings.Cut(key, "\x00")
+	return name
+}
+
+// memoryCache is an in-process Cache evicting the least recently used
+// responses when full
+type memoryCache struct {
+	size    int
+	metrics *metrics
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is the most recently used
+}
+
+// memoryCacheEntry is a response held by a memoryCache
+type memoryCacheEntry struct {
+	key     string
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// NewMemoryCache returns an in-process cache holding up to size responses, at
+// least one, reporting its cache_entries and cache_evictions metrics to sink,
+// or to the default Prometheus registry when nil
+func NewMemoryCache(size int, sink MetricsSink) Cache {
+	if sink == nil {
+		return newMemoryCache(size, defaultMetrics())
+	}
+	return newMemoryCache(size, newMetrics(sink))
+}
+
+// newMemoryCache returns an in-process cache updating the metrics m
+func newMemoryCache(size int, m *metrics) *memoryCache {
+	if size < 1 {
+		size = 1
+	}
+	return &memoryCache{
+		size:    size,
+		metrics: m,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+func (c *memoryCache) Get(_ context.Context, key string) (*dns.Msg, error) {
+	now := time.Now()
+	c.lock.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.lock.Unlock()
+		return nil, nil
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if now.After(entry.expires) {
+		c.remove(elem)
+		c.lock.Unlock()
+		return nil, nil
+	}
+	c.lru.MoveToFront(elem)
+	c.lock.Unlock()
+
+	msg := entry.msg.Copy()
+	ageTTLs(msg, now.Sub(entry.stored))
+	return msg, nil
+}
+
+func (c *memoryCache) Set(_ context.Context, key string, msg *dns.Msg, ttl time.Duration) error {
+	now := time.Now()
+	entry := &memoryCacheEntry{
+		key:     key,
+		msg:     msg.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+		c.metrics.cacheEvictions.Inc()
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.metrics.cacheEntries.Inc()
+	return nil
+}
+
+// remove drops a cache element, the lock must be held
+func (c *memoryCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*memoryCacheEntry).key)
+	c.metrics.cacheEntries.Dec()
+}
+
+func (c *memoryCache) Flush(_ context.Context, match func(name string) bool) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match(cacheKeyName(elem.Value.(*memoryCacheEntry).key)) {
+			c.remove(elem)
+			n++
+		}
+		elem = next
+	}
+	return n, nil
+}
+
+func (c *memoryCache) Len(context.Context) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len(), nil
+}
+
+// ageTTLs reduces the TTLs of a cached response by its age
+func ageTTLs(msg *dns.Msg, age time.Duration) {
+	seconds := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > seconds {
+				rr.Header().Ttl -= seconds
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+}
+
+// cacheTTL returns how long a response may be cached: the lowest TTL of its
+// records, or for negative answers the SOA TTL capped by its minimum field
+// (RFC 2308). Failures and truncated responses are not cached.
+func cacheTTL(msg *dns.Msg) (uint32, bool) {
+	if msg.Truncated || len(msg.Question) != 1 {
+		return 0, false
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	if msg.Rcode == dns.RcodeNameError || len(msg.Answer) == 0 {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := min(soa.Hdr.Ttl, soa.Minttl)
+				return ttl, ttl > 0
+			}
+		}
+		return 0, false
+	}
+
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl, ttl > 0
+}
+
+// cacheGet looks a response up in the cache under each key in turn,
+// counting hits and misses
+func (s *Server) cacheGet(keys ...string) *dns.Msg {
+	for _, key := range keys {
+		msg, err := s.cache.Get(context.Background(), key)
+		if err != nil {
+			s.logger.Debugf("cache get: %v", err)
+		}
+		if msg != nil {
+			s.cacheHits.Add(1)
+			s.metrics().cacheHits.Inc()
+			return msg
+		}
+	}
+	s.cacheMisses.Add(1)
+	s.metrics().cacheMisses.Inc()
+	return nil
+}
+
+// cacheKeys returns the keys the answer to a query may be cached under,
+// beginning with its question key. Answers to queries carrying a client
+// subnet are cached under the subnet's prefix at their scope, so the keys
+// cover the prefixes at the scope lengths answers were cached with, longest
+// first.
+func (s *Server) cacheKeys(key string, msg *dns.Msg) []string {
+	subnet := clientSubnet(msg)
+	if subnet == nil {
+		return []string{key}
+	}
+	prefix, ok := subnetPrefix(subnet)
+	if !ok {
+		return nil
+	}
+	var keys []string
+	for bits := prefix.Bits(); bits >= 0; bits-- {
+		if s.cacheScopes.has(prefix.Addr(), bits) {
+			scoped, _ := prefix.Addr().Prefix(bits)
+			keys = append(keys, key+"/ecs/"+scoped.String())
+		}
+	}
+	return keys
+}
+
+// answerCacheKey returns the key to cache an upstream answer under. Answers
+// to queries carrying a client subnet are cached under the subnet's prefix
+// at the scope the upstream returned (RFC 7871 7.3.1), shared by every subnet
+// within it. Answers without a client subnet option apply to any subnet.
+func (s *Server) answerCacheKey(key string, msg, resp *dns.Msg) (string, bool) {
+	subnet := clientSubnet(msg)
+	if subnet == nil {
+		return key, true
+	}
+	prefix, ok := subnetPrefix(subnet)
+	if !ok {
+		return "", false
+	}
+	bits := 0
+	if answered := clientSubnet(resp); answered != nil {
+		// Answers for another subnet are not cached
+		if answered.Family != subnet.Family || answered.SourceNetmask != subnet.SourceNetmask {
+			return "", false
+		}
+		bits = min(int(answered.SourceScope), prefix.Bits())
+	}
+	scoped, _ := prefix.Addr().Prefix(bits)
+	s.cacheScopes.add(prefix.Addr(), bits)
+	return key + "/ecs/" + scoped.String(), true
+}
+
+// cacheSet caches a response if it is cacheable
+func (s *Server) cacheSet(key string, msg *dns.Msg) {
+	ttl, ok := cacheTTL(msg)
+	if !ok {
+		return
+	}
+	if err := s.cache.Set(context.Background(), key, msg, time.Duration(ttl)*time.Second); err != nil {
+		s.logger.Debugf("cache set: %v", err)
+	}
+}
+
+// FlushCache removes all cached responses and returns how many were removed
+func (s *Server) FlushCache() (int, error) {
+	return s.flushCache(func(string) bool { return true })
+}
+
+// FlushCacheName removes the cached responses for a name and returns how
+// many were removed
+func (s *Server) FlushCacheName(name string) (int, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	return s.flushCache(func(n string) bool { return n == name })
+}
+
+// FlushCacheSuffix removes the cached responses for a name and all names
+// below it and returns how many were removed
+func (s *Server) FlushCacheSuffix(suffix string) (int, error) {
+	suffix = strings.ToLower(dns.Fqdn(suffix))
+	return s.flushCache(func(n string) bool { return dns.IsSubDomain(suffix, n) })
+}
+
+func (s *Server) flushCache(match func(name string) bool) (int, error) {
+	if s.cache == nil {
+		return 0, nil
+	}
+	return s.cache.Flush(context.Background(), match)
+}
+
+// cacheFlushHandler flushes the cache of all servers on POST, limited to a
+// name with ?name= or to a name and all names below it with ?suffix=
+func cacheFlushHandler(servers []*Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name, suffix := r.URL.Query().Get("name"), r.URL.Query().Get("suffix")
+		if name != "" && suffix != "" {
+			http.Error(w, "name and suffix are mutually exclusive", http.StatusBadRequest)
+			return
+		}
+		flushed := 0
+		for _, s := range servers {
+			var n int
+			var err error
+			switch {
+			case name != "":
+				n, err = s.FlushCacheName(name)
+			case suffix != "":
+				n, err = s.FlushCacheSuffix(suffix)
+			default:
+				n, err = s.FlushCache()
+			}
+			if err != nil {
+				http.Error(w, "flush cache: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			flushed += n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Flushed int `json:"flushed"`
+		}{flushed})
+	}
+}
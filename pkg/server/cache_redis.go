@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultRedisCachePrefix namespaces the cache keys in a shared database
+const defaultRedisCachePrefix = "doqd:"
+
+// redisCache is a Cache shared through Redis, so several servers behind one
+// address give consistent answers. Entries expire with the response TTL and
+// hold the time the response was stored, in Unix seconds, followed by the
+// packed response.
+type redisCache struct {
+	client *redis.Client
+	prefix string
+}
+
+// RedisCacheConfig configures a Redis cache
+type RedisCacheConfig struct {
+	// URL locates the database, as redis://[user:password@]host:port/db or
+	// rediss:// for TLS
+	URL string
+	// Prefix is prepended to every key, "doqd:" when empty
+	Prefix string
+}
+
+// NewRedisCache returns a cache stored in a Redis database
+func NewRedisCache(c RedisCacheConfig) (Cache, error) {
+	opts, err := redis.ParseURL(c.URL)
+	if err != nil {
+		return nil, errors.New("parse redis URL: " + err.Error())
+	}
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = defaultRedisCachePrefix
+	}
+	return &redisCache{client: redis.NewClient(opts), prefix: prefix}, nil
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (*dns.Msg, error) {
+	value, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("redis get: " + err.Error())
+	}
+	if len(value) < 8 {
+		return nil, errors.New("redis get: short entry")
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(value[8:]); err != nil {
+		return nil, errors.New("unpack cached response: " + err.Error())
+	}
+	stored := time.Unix(int64(binary.BigEndian.Uint64(value)), 0)
+	ageTTLs(msg, time.Since(stored))
+	return msg, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, msg *dns.Msg, ttl time.Duration) error {
+	packed, err := msg.Pack()
+	if err != nil {
+		return errors.New("pack response: " + err.Error())
+	}
+	value := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(packed)), uint64(time.Now().Unix()))
+	value = append(value, packed...)
+	if err := c.client.Set(ctx, c.prefix+key, value, ttl).Err(); err != nil {
+		return errors.New("redis set: " + err.Error())
+	}
+	return nil
+}
+
+// Flush scans all keys under the prefix, so it is slow on large databases
+func (c *redisCache) Flush(ctx context.Context, match func(name string) bool) (int, error) {
+	n := 0
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if !match(cacheKeyName(strings.TrimPrefix(key, c.prefix))) {
+			continue
+		}
+		deleted, err := c.client.Del(ctx, key).Result()
+		if err != nil {
+			return n, errors.New("redis del: " + err.Error())
+		}
+		n += int(deleted)
+	}
+	if err := iter.Err(); err != nil {
+		return n, errors.New("redis scan: " + err.Error())
+	}
+	return n, nil
+}
+
+// Len scans all keys under the prefix, so it is slow on large databases
+func (c *redisCache) Len(ctx context.Context) (int, error) {
+	n := 0
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		return n, errors.New("redis scan: " + err.Error())
+	}
+	return n, nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// ttlUpstream answers A queries with a record carrying a fixed TTL
+type ttlUpstream struct {
+	slowUpstream
+	ttl uint32
+}
+
+func (u *ttlUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	u.exchanges.Add(1)
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: u.ttl},
+		A:   []byte{192, 0, 2, 1},
+	})
+	return reply, nil
+}
+
+func cacheQuery(s *Server, name string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	return s.forward(&query{msg: msg})
+}
+
+// testCache checks lookups and flushes through a server using cache
+func testCache(t *testing.T, cache Cache) {
+	up := &ttlUpstream{ttl: 300}
+	s := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New(), cache: cache}
+
+	first := cacheQuery(s, "a.example.com.")
+	second := cacheQuery(s, "A.example.COM.")
+	assert.Equal(t, int32(1), up.exchanges.Load())
+	assert.Equal(t, "A.example.COM.", second.Question[0].Name)
+	assert.Equal(t, first.Answer[0].(*dns.A).A, second.Answer[0].(*dns.A).A)
+	assert.Equal(t, uint64(1), s.Stats().CacheHits)
+	assert.Equal(t, uint64(1), s.Stats().CacheMisses)
+
+	flushed := func(n int, err error) int {
+		assert.Nil(t, err)
+		return n
+	}
+	fill := func() {
+		for _, name := range []string{"example.com.", "www.example.com.", "example.org."} {
+			cacheQuery(s, name)
+		}
+	}
+	assert.Equal(t, 1, flushed(s.FlushCache()))
+	fill()
+	assert.Equal(t, 1, flushed(s.FlushCacheName("WWW.example.com")))
+	assert.Equal(t, 2, s.Stats().CacheEntries)
+	fill()
+	assert.Equal(t, 2, flushed(s.FlushCacheSuffix("example.com")))
+	fill()
+	assert.Equal(t, 3, flushed(s.FlushCache()))
+
+	// Zero TTL responses are not cached
+	zero := &ttlUpstream{}
+	s = &Server{upstream: &monitoredUpstream{Resolver: zero}, logger: logrus.New(), cache: cache}
+	cacheQuery(s, "a.example.com.")
+	cacheQuery(s, "a.example.com.")
+	assert.Equal(t, int32(2), zero.exchanges.Load())
+}
+
+func TestMemoryCache(t *testing.T) {
+	testCache(t, NewMemoryCache(10, nil))
+
+	// The least recently used entry is evicted
+	up := &ttlUpstream{ttl: 300}
+	s := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New(), cache: NewMemoryCache(2, nil)}
+	cacheQuery(s, "a.example.com.")
+	cacheQuery(s, "b.example.com.")
+	cacheQuery(s, "a.example.com.")
+	cacheQuery(s, "c.example.com.")
+	assert.Equal(t, 2, s.Stats().CacheEntries)
+	cacheQuery(s, "b.example.com.")
+	assert.Equal(t, int32(4), up.exchanges.Load())
+
+	// Caches of no size hold one entry
+	for _, size := range []int{0, -1} {
+		up = &ttlUpstream{ttl: 300}
+		s = &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New(), cache: NewMemoryCache(size, nil)}
+		cacheQuery(s, "a.example.com.")
+		cacheQuery(s, "b.example.com.")
+		cacheQuery(s, "b.example.com.")
+		assert.Equal(t, 1, s.Stats().CacheEntries, size)
+		assert.Equal(t, int32(2), up.exchanges.Load(), size)
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache, err := NewRedisCache(RedisCacheConfig{URL: "redis://" + mr.Addr()})
+	assert.Nil(t, err)
+	testCache(t, cache)
+
+	// Entries expire with the response and age while cached
+	up := &ttlUpstream{ttl: 300}
+	s := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New(), cache: cache}
+	cacheQuery(s, "example.net.")
+	keys := mr.Keys()
+	assert.Len(t, keys, 1)
+	assert.Equal(t, 300*time.Second, mr.TTL(keys[0]))
+
+	// Another server sharing the database gets the cached answer
+	other := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New(), cache: cache}
+	cacheQuery(other, "example.net.")
+	assert.Equal(t, int32(1), up.exchanges.Load())
+
+	_, err = NewRedisCache(RedisCacheConfig{URL: "http://localhost"})
+	assert.NotNil(t, err)
+}
+
+func TestCacheTTL(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Ttl: 300}},
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Ttl: 60}},
+	}
+	ttl, ok := cacheTTL(msg)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(60), ttl)
+
+	negative := new(dns.Msg)
+	negative.SetQuestion("nx.example.com.", dns.TypeA)
+	negative.Rcode = dns.RcodeNameError
+	_, ok = cacheTTL(negative)
+	assert.False(t, ok)
+	negative.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Ttl: 3600}, Minttl: 30}}
+	ttl, ok = cacheTTL(negative)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(30), ttl)
+
+	negative.Rcode = dns.RcodeServerFailure
+	_, ok = cacheTTL(negative)
+	assert.False(t, ok)
+}
+
+func TestCacheFlushEndpoint(t *testing.T) {
+	s := &Server{upstream: &monitoredUpstream{Resolver: &ttlUpstream{ttl: 300}}, logger: logrus.New(), cache: NewMemoryCache(10, nil)}
+	for _, name := range []string{"example.com.", "www.example.com.", "example.org."} {
+		cacheQuery(s, name)
+	}
+	n, err := (&Server{}).FlushCache()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	flush := func(method, query string) (int, int) {
+		ts := httptest.NewServer(adminMux(AdminConfig{Servers: []*Server{s}}))
+		defer ts.Close()
+		req, err := http.NewRequest(method, ts.URL+"/cache/flush"+query, nil)
+		assert.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		var body struct{ Flushed int }
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Flushed
+	}
+	code, _ := flush(http.MethodGet, "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = flush(http.MethodPost, "?name=a&suffix=b")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, n = flush(http.MethodPost, "?suffix=org")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, n)
+	_, n = flush(http.MethodPost, "")
+	assert.Equal(t, 2, n)
+}
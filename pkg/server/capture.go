@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// pcapng block types and constants
+const (
+	pcapngSectionHeader     = 0x0A0D0D0A
+	pcapngInterface         = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1A2B3C4D
+	pcapngLinkTypeRaw       = 101 // Raw IPv4 or IPv6 packets
+	pcapngOptionEnd         = 0
+	pcapngOptionComment     = 1
+	captureDNSPort          = 53
+	captureMaxPayloadIPv4   = 65535 - 20 - 8
+	captureMaxPayloadIPv6   = 65535 - 8
+	captureUDPProtocol      = 17
+	captureHopLimit         = 64
+	captureIPv4HeaderLen    = 20
+	captureIPv6HeaderLen    = 40
+	captureUDPHeaderLen     = 8
+	captureIPv4DontFragment = 0x4000
+)
+
+// Capture writes the plaintext DNS messages a server exchanges with its
+// clients to a pcapng file, for debugging what QUIC and TLS encrypt on the
+// wire. Messages are written as UDP packets between the client and port 53
+// of the server, so Wireshark and tcpdump decode them as DNS, with the
+// transport and server address in the packet comment. It is safe for
+// concurrent use by several servers.
+type Capture struct {
+	lock sync.Mutex
+	w    io.Writer
+	err  error
+}
+
+// NewCapture writes the pcapng section and interface headers to w and
+// returns a capture appending packets to it
+func NewCapture(w io.Writer) (*Capture, error) {
+	c := &Capture{w: w}
+
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], 28)
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1) // Version 1.0
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], 28)
+
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], pcapngInterface)
+	binary.LittleEndian.PutUint32(idb[4:], 20)
+	binary.LittleEndian.PutUint16(idb[8:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[16:], 20)
+
+	if _, err := w.Write(append(shb, idb...)); err != nil {
+		return nil, errors.New("capture: " + err.Error())
+	}
+	return c, nil
+}
+
+// Err returns the first write error, after which nothing is captured
+func (c *Capture) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// capture records a query and its reply
+func (c *Capture) capture(q *query, reply *dns.Msg, local net.Addr, start time.Time) {
+	client, ok := addrPort(q.client)
+	if !ok {
+		return
+	}
+	server, _ := addrPort(local)
+	serverIP := server.Addr()
+	if !serverIP.IsValid() || serverIP.Is4() != client.Addr().Is4() {
+		// Listening on all addresses or on another family
+		serverIP = netip.IPv4Unspecified()
+		if client.Addr().Is6() {
+			serverIP = netip.IPv6Unspecified()
+		}
+	}
+	serverAddr := netip.AddrPortFrom(serverIP, captureDNSPort)
+	comment := q.transport
+	if local != nil {
+		comment += " " + local.String()
+	}
+
+	queryWire, err := q.msg.Pack()
+	if err != nil {
+		return
+	}
+	replyWire, err := reply.Pack()
+	if err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writePacket(start, client, serverAddr, queryWire, comment)
+	c.writePacket(time.Now(), serverAddr, client, replyWire, comment)
+}
+
+// writePacket writes a UDP packet carrying payload. The lock must be held.
+func (c *Capture) writePacket(t time.Time, src, dst netip.AddrPort, payload []byte, comment string) {
+	if c.err != nil {
+		return
+	}
+	var packet []byte
+	if src.Addr().Is4() {
+		if len(payload) > captureMaxPayloadIPv4 {
+			return
+		}
+		packet = ipv4Packet(src, dst, payload)
+	} else {
+		if len(payload) > captureMaxPayloadIPv6 {
+			return
+		}
+		packet = ipv6Packet(src, dst, payload)
+	}
+
+	options := pcapngOption(pcapngOptionComment, []byte(comment))
+	options = append(options, pcapngOption(pcapngOptionEnd, nil)...)
+	padded := (len(packet) + 3) &^ 3
+	length := 28 + padded + len(options) + 4
+
+	block := make([]byte, 28, length)
+	binary.LittleEndian.PutUint32(block[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(block[4:], uint32(length))
+	// Interface 0, timestamps in microseconds
+	micros := uint64(t.UnixMicro())
+	binary.LittleEndian.PutUint32(block[12:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(micros))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(len(packet)))
+	block = append(block, packet...)
+	block = append(block, make([]byte, padded-len(packet))...)
+	block = append(block, options...)
+	block = binary.LittleEndian.AppendUint32(block, uint32(length))
+
+	if _, err := c.w.Write(block); err != nil {
+		c.err = errors.New("capture: " + err.Error())
+	}
+}
+
+// pcapngOption encodes a block option, padded to 32 bits
+func pcapngOption(code uint16, value []byte) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, (4-len(value)%4)%4)...)
+}
+
+// ipv4Packet returns an IPv4 UDP packet, without UDP checksum
+func ipv4Packet(src, dst netip.AddrPort, payload []byte) []byte {
+	total := captureIPv4HeaderLen + captureUDPHeaderLen + len(payload)
+	b := make([]byte, captureIPv4HeaderLen, total)
+	b[0] = 0x45 // Version 4, 5 words of header
+	binary.BigEndian.PutUint16(b[2:], uint16(total))
+	binary.BigEndian.PutUint16(b[6:], captureIPv4DontFragment)
+	b[8] = captureHopLimit
+	b[9] = captureUDPProtocol
+	srcIP, dstIP := src.Addr().As4(), dst.Addr().As4()
+	copy(b[12:], srcIP[:])
+	copy(b[16:], dstIP[:])
+	binary.BigEndian.PutUint16(b[10:], ^checksum(0, b))
+	b = append(b, udpHeader(src, dst, len(payload), 0)...)
+	return append(b, payload...)
+}
+
+// ipv6Packet returns an IPv6 UDP packet
+func ipv6Packet(src, dst netip.AddrPort, payload []byte) []byte {
+	udpLen := captureUDPHeaderLen + len(payload)
+	b := make([]byte, captureIPv6HeaderLen, captureIPv6HeaderLen+udpLen)
+	b[0] = 0x60 // Version 6
+	binary.BigEndian.PutUint16(b[4:], uint16(udpLen))
+	b[6] = captureUDPProtocol
+	b[7] = captureHopLimit
+	srcIP, dstIP := src.Addr().As16(), dst.Addr().As16()
+	copy(b[8:], srcIP[:])
+	copy(b[24:], dstIP[:])
+
+	// The UDP checksum is mandatory over IPv6, covering a pseudo-header
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, srcIP[:]...)
+	pseudo = append(pseudo, dstIP[:]...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(udpLen))
+	pseudo = binary.BigEndian.AppendUint32(pseudo, captureUDPProtocol)
+	sum := checksum(checksum(checksum(0, pseudo), udpHeader(src, dst, len(payload), 0)), payload)
+	udpSum := ^sum
+	if udpSum == 0 {
+		udpSum = 0xffff
+	}
+	b = append(b, udpHeader(src, dst, len(payload), udpSum)...)
+	return append(b, payload...)
+}
+
+// udpHeader returns a UDP header
+func udpHeader(src, dst netip.AddrPort, payloadLen int, sum uint16) []byte {
+	b := make([]byte, captureUDPHeaderLen)
+	binary.BigEndian.PutUint16(b[0:], src.Port())
+	binary.BigEndian.PutUint16(b[2:], dst.Port())
+	binary.BigEndian.PutUint16(b[4:], uint16(captureUDPHeaderLen+payloadLen))
+	binary.BigEndian.PutUint16(b[6:], sum)
+	return b
+}
+
+// checksum adds data to a ones' complement Internet checksum. Data of odd
+// length is padded, so only the last call may pass an odd length.
+func checksum(sum uint16, data []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
+
+// addrPort returns the IP address and port of a UDP or TCP address
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ap := a.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+	case *net.TCPAddr:
+		ap := a.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+	case nil:
+		return netip.AddrPort{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapture(t *testing.T) {
+	var buf bytes.Buffer
+	c, err := NewCapture(&buf)
+	assert.Nil(t, err)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, dns.RcodeNameError)
+	for _, client := range []string{"192.0.2.1", "2001:db8::1"} {
+		q := &query{msg: msg, client: &net.UDPAddr{IP: net.ParseIP(client), Port: 40000}, transport: transportDoQ}
+		c.capture(q, reply, &net.UDPAddr{IP: net.IPv6unspecified, Port: 853}, time.Now())
+	}
+	assert.Nil(t, c.Err())
+
+	b := buf.Bytes()
+	assert.Equal(t, uint32(pcapngSectionHeader), binary.LittleEndian.Uint32(b))
+	var packets [][]byte
+	for len(b) >= 12 {
+		length := binary.LittleEndian.Uint32(b[4:])
+		if !assert.Equal(t, length, binary.LittleEndian.Uint32(b[length-4:]), "trailing block length") {
+			return
+		}
+		if binary.LittleEndian.Uint32(b) == pcapngEnhancedPacket {
+			captured := binary.LittleEndian.Uint32(b[20:])
+			packets = append(packets, b[28:28+captured])
+			assert.Contains(t, string(b[28+captured:length]), "doq [::]:853")
+		}
+		b = b[length:]
+	}
+	if !assert.Len(t, packets, 4) {
+		return
+	}
+
+	for i, packet := range packets {
+		var payload []byte
+		if packet[0]>>4 == 4 {
+			// A valid header sums to all ones
+			assert.Equal(t, uint16(0xffff), checksum(0, packet[:20]))
+			payload = packet[28:]
+		} else {
+			pseudo := append(append([]byte{}, packet[8:40]...), 0, 0, packet[4], packet[5], 0, 0, 0, 17)
+			assert.Equal(t, uint16(0xffff), checksum(checksum(0, pseudo), packet[40:]))
+			payload = packet[48:]
+		}
+		m := new(dns.Msg)
+		assert.Nil(t, m.Unpack(payload))
+		assert.Equal(t, msg.Id, m.Id)
+		assert.Equal(t, i%2 == 1, m.Response)
+	}
+}
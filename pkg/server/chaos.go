@@ -0,0 +1,39 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// chaosReply answers CHAOS class identification queries (version.bind,
+// hostname.bind and their RFC 4892 equivalents) locally. Names without a
+// configured string, and any other CHAOS query, are refused. It returns nil
+// for queries in other classes.
+func (s *Server) chaosReply(msg *dns.Msg) *dns.Msg {
+	if len(msg.Question) != 1 || msg.Question[0].Qclass != dns.ClassCHAOS {
+		return nil
+	}
+	q := msg.Question[0]
+
+	var txt string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		txt = s.chaosVersion
+	case "hostname.bind.", "id.server.":
+		txt = s.chaosHostname
+	}
+
+	reply := new(dns.Msg)
+	if txt == "" || (q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY) {
+		reply.SetRcode(msg, dns.RcodeRefused)
+		return reply
+	}
+	reply.SetReply(msg)
+	reply.Authoritative = true
+	reply.Answer = append(reply.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{txt},
+	})
+	return reply
+}
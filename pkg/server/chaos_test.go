@@ -0,0 +1,39 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChaosReply(t *testing.T) {
+	s := &Server{chaosVersion: "doqd test"}
+
+	chaosQuery := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		msg.Question[0].Qclass = dns.ClassCHAOS
+		return msg
+	}
+
+	reply := s.chaosReply(chaosQuery("VERSION.BIND.", dns.TypeTXT))
+	if assert.NotNil(t, reply) && assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+		assert.Equal(t, []string{"doqd test"}, reply.Answer[0].(*dns.TXT).Txt)
+		assert.Equal(t, uint16(dns.ClassCHAOS), reply.Answer[0].Header().Class)
+	}
+
+	// No hostname configured
+	reply = s.chaosReply(chaosQuery("hostname.bind.", dns.TypeTXT))
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+
+	// Other CHAOS names are not forwarded either
+	reply = s.chaosReply(chaosQuery("authors.bind.", dns.TypeTXT))
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+
+	// Internet class queries go to the upstream
+	msg := new(dns.Msg)
+	msg.SetQuestion("version.bind.", dns.TypeTXT)
+	assert.Nil(t, s.chaosReply(msg))
+}
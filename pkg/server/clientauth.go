@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// allowlistCheckInterval bounds how often the allowlist file is checked for
+// changes
+const allowlistCheckInterval = time.Second
+
+// fingerprintAllowlist authorizes clients by the SHA-256 fingerprint of their
+// certificate or its public key, reloading the list when its file changes
+type fingerprintAllowlist struct {
+	path   string
+	logger *logrus.Logger
+
+	lock         sync.Mutex
+	modTime      time.Time
+	checked      time.Time
+	fingerprints map[string]bool
+}
+
+// newFingerprintAllowlist loads an allowlist file with one hex SHA-256
+// fingerprint per line. Colons are ignored and # starts a comment.
+func newFingerprintAllowlist(path string, logger *logrus.Logger) (*fingerprintAllowlist, error) {
+	a := &fingerprintAllowlist{path: path, logger: logger}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.New("client fingerprints: " + err.Error())
+	}
+	a.fingerprints, err = loadFingerprints(path)
+	if err != nil {
+		return nil, err
+	}
+	a.modTime, a.checked = info.ModTime(), time.Now()
+	return a, nil
+}
+
+// loadFingerprints parses an allowlist file
+func loadFingerprints(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("client fingerprints: " + err.Error())
+	}
+	defer f.Close()
+
+	fingerprints := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(text), ":", ""))
+		if text == "" {
+			continue
+		}
+		if !isFingerprint(text) {
+			return nil, errors.New("client fingerprints: line " + strconv.Itoa(line) + ": not a SHA-256 fingerprint")
+		}
+		fingerprints[text] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("client fingerprints: " + err.Error())
+	}
+	return fingerprints, nil
+}
+
+// current returns the allowlist, reloading it first if the file changed.
+// A file that fails to load is logged and the previous list is kept.
+func (a *fingerprintAllowlist) current() map[string]bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if time.Since(a.checked) < allowlistCheckInterval {
+		return a.fingerprints
+	}
+	a.checked = time.Now()
+
+	info, err := os.Stat(a.path)
+	if err != nil || info.ModTime().Equal(a.modTime) {
+		return a.fingerprints
+	}
+	fingerprints, err := loadFingerprints(a.path)
+	if err != nil {
+		a.logger.Warnf("reload %v", err)
+		return a.fingerprints
+	}
+	a.logger.Infof("reloaded %d client fingerprints from %s", len(fingerprints), a.path)
+	a.fingerprints, a.modTime = fingerprints, info.ModTime()
+	return a.fingerprints
+}
+
+// verifyConnection is a tls.Config VerifyConnection callback rejecting
+// clients whose certificate is not on the allowlist. It also runs for
+// resumed sessions, so removing a fingerprint takes effect immediately.
+func (a *fingerprintAllowlist) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("client certificate required")
+	}
+	certSum, spkiSum := certFingerprints(cs.PeerCertificates[0])
+
+	allowed := a.current()
+	if allowed[certSum] || allowed[spkiSum] {
+		return nil
+	}
+	return errors.New("client certificate " + spkiSum + " is not allowed")
+}
+
+// clientMatcher identifies clients by address or certificate
+type clientMatcher struct {
+	prefixes     []netip.Prefix
+	fingerprints map[string]bool
+}
+
+// newClientMatcher parses a list of IP addresses, IP prefixes, and hex
+// SHA-256 fingerprints of client certificates or their public keys
+func newClientMatcher(entries []string) (*clientMatcher, error) {
+	m := &clientMatcher{fingerprints: map[string]bool{}}
+	for _, entry := range entries {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			m.prefixes = append(m.prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			m.prefixes = append(m.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		} else if fp := strings.ToLower(strings.ReplaceAll(entry, ":", "")); isFingerprint(fp) {
+			m.fingerprints[fp] = true
+		} else {
+			return nil, errors.New(entry + " is not an address, prefix or fingerprint")
+		}
+	}
+	return m, nil
+}
+
+// match reports whether a query comes from one of the clients
+func (m *clientMatcher) match(q *query) bool {
+	if q.peerCert != nil && len(m.fingerprints) > 0 {
+		certSum, spkiSum := certFingerprints(q.peerCert)
+		if m.fingerprints[certSum] || m.fingerprints[spkiSum] {
+			return true
+		}
+	}
+	if addr, ok := clientAddr(q.client); ok {
+		for _, prefix := range m.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// certFingerprints returns the hex SHA-256 fingerprints of a certificate and
+// of its public key
+func certFingerprints(cert *x509.Certificate) (string, string) {
+	certSum := sha256.Sum256(cert.Raw)
+	spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(certSum[:]), hex.EncodeToString(spkiSum[:])
+}
+
+// isFingerprint reports whether s is a hex SHA-256 fingerprint
+func isFingerprint(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// clientAddr returns the IP address of a client
+func clientAddr(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+	ap, ok := netip.AddrFromSlice(ip)
+	return ap.Unmap(), ok
+}
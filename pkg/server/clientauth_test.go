@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mosajjal/doqd/pkg/cert"
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+// testKeyPair generates a self-signed certificate and its fingerprint
+func testKeyPair(t *testing.T, host string) (tls.Certificate, string) {
+	certPEM, keyPEM, err := cert.Generate([]string{host}, time.Hour)
+	require.NoError(t, err)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	fingerprint, err := cert.Fingerprint(certPEM)
+	require.NoError(t, err)
+	return pair, fingerprint
+}
+
+func TestClientFingerprintAllowlist(t *testing.T) {
+	serverPair, _ := testKeyPair(t, "localhost")
+	allowed, allowedFP := testKeyPair(t, "allowed")
+	other, otherFP := testKeyPair(t, "other")
+
+	allowlist := filepath.Join(t.TempDir(), "clients")
+	assert.Nil(t, os.WriteFile(allowlist, []byte("# test clients\n"+allowedFP+"\n"), 0o600))
+
+	doqServer, err := New(Config{
+		ListenAddr:             "127.0.0.1:0",
+		Cert:                   serverPair,
+		Resolver:               &ttlUpstream{ttl: 60},
+		ClientFingerprintsFile: allowlist,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = doqServer.Close() })
+	go doqServer.Listen()
+
+	query := func(certificate *tls.Certificate) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := client.NewContext(ctx, client.Config{
+			Server:        doqServer.Listener.Addr().String(),
+			TLSSkipVerify: true,
+			Certificate:   certificate,
+		})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		req := dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeA)
+		_, err = c.SendQueryContext(ctx, req)
+		return err
+	}
+
+	assert.Nil(t, query(&allowed))
+	assert.NotNil(t, query(&other))
+	assert.NotNil(t, query(nil))
+
+	// Allow the other client without restarting
+	time.Sleep(allowlistCheckInterval)
+	assert.Nil(t, os.WriteFile(allowlist, []byte(allowedFP+"\n"+otherFP+"\n"), 0o600))
+	assert.Nil(t, query(&other))
+}
+
+func TestLoadFingerprints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients")
+	fp := "AB:cdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+	assert.Nil(t, os.WriteFile(path, []byte(fp+" # with colons and a comment\n\n"), 0o600))
+	fingerprints, err := loadFingerprints(path)
+	assert.Nil(t, err)
+	assert.True(t, fingerprints["abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789"])
+
+	assert.Nil(t, os.WriteFile(path, []byte("not a fingerprint\n"), 0o600))
+	_, err = loadFingerprints(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+
+	doq "github.com/mosajjal/doqd"
+)
+
+// maxDatagramResponse is the largest response sent in a DATAGRAM frame,
+// leaving room for the packet and frame overhead in the 1200 bytes every
+// QUIC path carries
+const maxDatagramResponse = 1100
+
+// serveDatagrams answers the queries a client of the experimental
+// doq-dgram-exp mode sends in QUIC DATAGRAM frames, until the connection
+// closes. Each frame carries a single DNS message, without length prefix,
+// matched to its response by ID. Responses too large for a frame are
+// replaced by an empty one with the TC bit set, which the client retries
+// over a stream.
+func (s *Server) serveDatagrams(session *quic.Conn, peerCert *x509.Certificate, limiter *rate.Limiter, sessionLog *logrus.Entry) {
+	for {
+		b, err := session.ReceiveDatagram(session.Context())
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					s.metrics().panics.Inc()
+					sessionLog.Errorf("datagram handler panic: %v", v)
+				}
+			}()
+			s.metrics().queries.Inc()
+			reply, err := s.answerDatagram(session, b, peerCert, limiter)
+			if err != nil {
+				sessionLog.Debugf("DoQ datagram: %v", err)
+				return
+			}
+			if reply == nil {
+				return
+			}
+			if err := session.SendDatagram(reply); err != nil {
+				sessionLog.Debugf("DoQ datagram write: %v", err)
+			}
+		}()
+	}
+}
+
+// answerDatagram returns the packed response to a query received in a
+// DATAGRAM frame, or nil when the query is dropped
+func (s *Server) answerDatagram(session *quic.Conn, b []byte, peerCert *x509.Certificate, limiter *rate.Limiter) ([]byte, error) {
+	if len(b) > s.maxQuerySize {
+		s.metrics().invalidQueries.Inc()
+		return nil, errors.New("query too large")
+	}
+	if err := checkWire(b); err != nil {
+		s.metrics().invalidQueries.Inc()
+		if reply := formErrReply(b); reply != nil {
+			return reply.Pack()
+		}
+		return nil, errors.New("malformed query: " + err.Error())
+	}
+	ctx := session.Context()
+	if s.rawHandler != nil {
+		return s.rawHandler(ctx, session.RemoteAddr(), b)
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return nil, errors.New("DNS query unpack: " + err.Error())
+	}
+	if hasEDNSOption(msg, dns.EDNS0TCPKEEPALIVE) || msg.Response {
+		_ = session.CloseWithError(doq.ProtocolError, "")
+		return nil, errors.New("protocol error, aborting connection")
+	}
+
+	state := session.ConnectionState()
+	reply := s.resolve(&query{
+		ctx:        ctx,
+		msg:        msg,
+		client:     session.RemoteAddr(),
+		transport:  transportDoQ,
+		peerCert:   peerCert,
+		serverName: state.TLS.ServerName,
+	})
+	packed, err := reply.Pack()
+	if err != nil {
+		return nil, errors.New("DNS response pack: " + err.Error())
+	}
+	if shaped, ok := s.shaper.shape(msg, reply, packed, limiter); ok {
+		s.metrics().shapedResponses.Inc()
+		packed = shaped
+	}
+	if len(packed) > maxDatagramResponse {
+		truncated := emptyReply(msg, reply)
+		truncated.Truncated = true
+		return truncated.Pack()
+	}
+	return packed, nil
+}
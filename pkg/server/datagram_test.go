@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	doq "github.com/mosajjal/doqd"
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+// sizedUpstream answers large.test. with 100 records and other names with
+// one
+type sizedUpstream struct{}
+
+func (sizedUpstream) String() string { return "sized" }
+
+func (sizedUpstream) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if msg.Question[0].Name == "large.test." {
+		return largeReply(msg, 100), nil
+	}
+	return largeReply(msg, 1), nil
+}
+
+// gaugeValue returns the value of a gauge gathered from a registry
+func gaugeValue(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	families, err := reg.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	return -1
+}
+
+func TestDatagrams(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Cert:       testCertificate(t, "localhost"),
+		Resolver:   sizedUpstream{},
+		Datagrams:  true,
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+	defer doqServer.Close()
+
+	reg := prometheus.NewRegistry()
+	doqClient, err := client.New(client.Config{
+		Server:        doqServer.Listener.Addr().String(),
+		TLSSkipVerify: true,
+		Datagrams:     true,
+		Registerer:    reg,
+	})
+	assert.Nil(t, err)
+	defer doqClient.Close()
+	assert.Equal(t, doq.TlsProtoDatagram, doqClient.Conn().ConnectionState().TLS.NegotiatedProtocol)
+
+	// Small answers arrive in a DATAGRAM frame, with the query ID
+	req := new(dns.Msg)
+	req.SetQuestion("small.test.", dns.TypeA)
+	req.Id = 0
+	resp, err := doqClient.SendQuery(*req)
+	if assert.Nil(t, err) {
+		assert.Len(t, resp.Answer, 1)
+		assert.Equal(t, uint16(0), resp.Id)
+	}
+	assert.Equal(t, float64(0), gaugeValue(t, reg, "doqd_client_datagram_fallbacks"))
+
+	// Large ones are truncated and retried over a stream
+	req.SetQuestion("large.test.", dns.TypeA)
+	resp, err = doqClient.SendQuery(*req)
+	if assert.Nil(t, err) {
+		assert.Len(t, resp.Answer, 100)
+	}
+	assert.Equal(t, float64(1), gaugeValue(t, reg, "doqd_client_datagram_fallbacks"))
+
+	// Other clients keep using streams
+	other, err := client.New(client.Config{Server: doqServer.Listener.Addr().String(), TLSSkipVerify: true})
+	assert.Nil(t, err)
+	defer other.Close()
+	assert.Equal(t, doq.TlsProtos[0], other.Conn().ConnectionState().TLS.NegotiatedProtocol)
+	_, err = other.SendQuery(*req)
+	assert.Nil(t, err)
+}
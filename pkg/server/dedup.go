@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// questionKey identifies queries that are answered identically by the
+// upstream for a given client subnet. It covers the question, and the header
+// and EDNS flags, and begins the cache keys.
+func questionKey(msg *dns.Msg) (string, bool) {
+	if len(msg.Question) != 1 {
+		return "", false
+	}
+	q := msg.Question[0]
+
+	var b strings.Builder
+	b.WriteString(strings.ToLower(q.Name) + "\x00")
+	b.WriteString(strconv.Itoa(int(q.Qtype)) + "/" + strconv.Itoa(int(q.Qclass)))
+	b.WriteString("/" + strconv.Itoa(msg.Opcode))
+	b.WriteString("/" + strconv.FormatBool(msg.RecursionDesired))
+	b.WriteString("/" + strconv.FormatBool(msg.CheckingDisabled))
+	if opt := msg.IsEdns0(); opt != nil {
+		b.WriteString("/edns/" + strconv.FormatBool(opt.Do()))
+	}
+	return b.String(), true
+}
+
+// subnetKey returns the client subnet of a query, completing its question
+// key so only queries for the same subnet share an upstream exchange
+func subnetKey(msg *dns.Msg) string {
+	if subnet := clientSubnet(msg); subnet != nil {
+		return "/" + subnet.String()
+	}
+	return ""
+}
+
+// inflightGroup shares one upstream exchange between identical queries in
+// flight, cancelling it once every client waiting for the answer is gone
+type inflightGroup struct {
+	group singleflight.Group
+
+	lock  sync.Mutex
+	calls map[string]*inflightCall
+}
+
+// inflightCall is the context of a shared upstream exchange
+type inflightCall struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// do calls exchange once for the queries with the same key in flight, with
+// a context carrying the values of the first query's. It returns when the
+// answer arrives or ctx is done, reporting whether the answer was shared.
+func (g *inflightGroup) do(ctx context.Context, key string, exchange func(ctx context.Context) (*dns.Msg, error)) (*dns.Msg, bool, error) {
+	shared, leave := g.join(ctx, key)
+	defer leave()
+	result := g.group.DoChan(key, func() (_ interface{}, err error) {
+		// A panic in the shared goroutine would crash the server, so it is
+		// raised again in the goroutines of the queries waiting for it
+		defer func() {
+			if v := recover(); v != nil {
+				err = &exchangePanic{value: v, stack: debug.Stack()}
+			}
+		}()
+		return exchange(shared)
+	})
+	select {
+	case r := <-result:
+		if p, ok := r.Err.(*exchangePanic); ok {
+			panic(p)
+		}
+		if r.Err != nil {
+			return nil, r.Shared, r.Err
+		}
+		return r.Val.(*dns.Msg), r.Shared, nil
+	case <-ctx.Done():
+		return nil, false, context.Cause(ctx)
+	}
+}
+
+// exchangePanic is a panic of a shared upstream exchange, with the stack of
+// the goroutine it happened in
+type exchangePanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *exchangePanic) Error() string {
+	return fmt.Sprintf("upstream exchange panic: %v\n%s", p.value, p.stack)
+}
+
+// join returns the context of the exchange for key, and a function to call
+// when leaving it. The last one leaving cancels the exchange, and later
+// queries start a new one.
+func (g *inflightGroup) join(ctx context.Context, key string) (context.Context, func()) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.calls == nil {
+		g.calls = map[string]*inflightCall{}
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		shared, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &inflightCall{ctx: shared, cancel: cancel}
+		g.calls[key] = call
+	}
+	call.waiters++
+
+	return call.ctx, func() {
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			delete(g.calls, key)
+			g.group.Forget(key)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+// slowUpstream answers every query after a delay and counts the exchanges
+type slowUpstream struct {
+	exchanges atomic.Int32
+}
+
+func (u *slowUpstream) String() string { return "slow" }
+
+func (u *slowUpstream) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	u.exchanges.Add(1)
+	time.Sleep(100 * time.Millisecond)
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.Id = dns.Id()
+	return reply, nil
+}
+
+func TestForwardDeduplication(t *testing.T) {
+	up := &slowUpstream{}
+	s := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion("Example.com.", dns.TypeA)
+			if id%2 == 0 {
+				msg.Question[0].Name = "example.COM."
+			}
+			msg.Id = id
+			reply := s.forward(&query{msg: msg})
+			assert.Equal(t, id, reply.Id)
+			assert.Equal(t, msg.Question[0].Name, reply.Question[0].Name)
+		}(uint16(i))
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), up.exchanges.Load())
+
+	// Different types are not collapsed
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", qtype)
+		s.forward(&query{msg: msg})
+	}
+	assert.Equal(t, int32(3), up.exchanges.Load())
+}
+
+func TestForwardDeduplicationScope(t *testing.T) {
+	up := &monitoredUpstream{Resolver: &slowUpstream{}}
+	s := &Server{upstream: up, logger: logrus.New()}
+
+	// Queries differing by flags, view, tenant or client subnet don't share
+	// an answer
+	withSubnet := func(subnet string) func(*query) {
+		return func(q *query) {
+			q.msg.SetEdns0(1232, false)
+			q.msg.IsEdns0().Option = append(q.msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet).To4(),
+			})
+		}
+	}
+	variants := []func(*query){
+		func(*query) {},
+		func(q *query) { q.msg.SetEdns0(1232, true) },
+		func(q *query) { q.msg.CheckingDisabled = true },
+		func(q *query) { q.view = &view{name: "a", upstream: up} },
+		func(q *query) { q.view = &view{name: "b", upstream: up} },
+		func(q *query) { q.view = &view{name: "a", tenant: true, upstream: up} },
+		withSubnet("192.0.2.0"),
+		withSubnet("198.51.100.0"),
+	}
+	var wg sync.WaitGroup
+	for _, variant := range variants {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				q := &query{msg: new(dns.Msg)}
+				q.msg.SetQuestion("example.com.", dns.TypeA)
+				variant(q)
+				s.forward(q)
+			}()
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, int32(len(variants)), up.Resolver.(*slowUpstream).exchanges.Load())
+}
+
+// blockingUpstream answers once its context is done, reporting it
+type blockingUpstream struct {
+	started   chan struct{}
+	cancelled chan struct{}
+}
+
+func (u *blockingUpstream) Exchange(ctx context.Context, _ *dns.Msg) (*dns.Msg, error) {
+	u.started <- struct{}{}
+	<-ctx.Done()
+	close(u.cancelled)
+	return nil, ctx.Err()
+}
+
+func TestForwardCancellation(t *testing.T) {
+	up := &blockingUpstream{started: make(chan struct{}, 1), cancelled: make(chan struct{})}
+	s := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New()}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	replies := make(chan *dns.Msg, 2)
+	go func() { replies <- s.forward(&query{ctx: first, msg: msg}) }()
+	<-up.started
+	go func() { replies <- s.forward(&query{ctx: second, msg: msg}) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// The exchange goes on while a client waits for it
+	cancelFirst()
+	assert.Equal(t, dns.RcodeServerFailure, (<-replies).Rcode)
+	select {
+	case <-up.cancelled:
+		t.Fatal("shared exchange cancelled with a client waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelSecond()
+	assert.Equal(t, dns.RcodeServerFailure, (<-replies).Rcode)
+	select {
+	case <-up.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("exchange not cancelled")
+	}
+	// Abandoned queries aren't upstream failures
+	assert.Equal(t, uint64(0), s.upstream.stats().Errors)
+}
+
+func TestDoQCancellation(t *testing.T) {
+	up := &blockingUpstream{started: make(chan struct{}, 1), cancelled: make(chan struct{})}
+	doqServer, err := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Cert:       testCertificate(t, "localhost"),
+		Resolver:   up,
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+	defer doqServer.Close()
+
+	doqClient, err := client.New(client.Config{Server: doqServer.Listener.Addr().String(), TLSSkipVerify: true})
+	assert.Nil(t, err)
+	defer doqClient.Close()
+
+	// Cancelling the query stops the stream and aborts the upstream exchange
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err := doqClient.SendQueryContext(ctx, *req)
+		errs <- err
+	}()
+	<-up.started
+	cancel()
+	assert.NotNil(t, <-errs)
+	select {
+	case <-up.cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream exchange not cancelled")
+	}
+	assert.Eventually(t, func() bool { return doqServer.Stats().Streams == 0 }, time.Second, 10*time.Millisecond)
+}
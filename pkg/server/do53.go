@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// newDo53Servers creates plain DNS listeners on UDP and TCP
+func newDo53Servers(listenAddr string, socket SocketConfig, handler dns.Handler) ([]frontend, error) {
+	packetConn, err := socket.listenPacket(listenAddr, false)
+	if err != nil {
+		return nil, errors.New("could not start UDP DNS listener: " + err.Error())
+	}
+	listener, err := socket.listen(listenAddr)
+	if err != nil {
+		_ = packetConn.Close()
+		return nil, errors.New("could not start TCP DNS listener: " + err.Error())
+	}
+
+	return []frontend{
+		&dnsFrontend{name: "UDP DNS", server: &dns.Server{PacketConn: packetConn, Net: "udp", Handler: handler, MsgAcceptFunc: acceptMsg}},
+		&dnsFrontend{name: "TCP DNS", server: &dns.Server{Listener: listener, Net: "tcp", Handler: handler, MsgAcceptFunc: acceptMsg}},
+	}, nil // nil error
+}
+
+// acceptMsg extends the default checks of incoming messages to accept
+// dynamic UPDATE messages, whose update section is larger than a query's
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	const qr, opcodeShift = 1 << 15, 11
+	if dh.Bits&qr == 0 && int(dh.Bits>>opcodeShift)&0xF == dns.OpcodeUpdate {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// serveDo53 handles a plain DNS query received over UDP or TCP
+func (s *Server) serveDo53(w dns.ResponseWriter, r *dns.Msg) {
+	// Increment query metric
+	s.metrics().queries.Inc()
+
+	transport := transportTCP
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		transport = transportUDP
+	}
+
+	reply := s.resolve(&query{msg: r, client: w.RemoteAddr(), transport: transport})
+
+	// Responses over UDP must fit the client's advertised buffer size
+	if transport == transportUDP {
+		reply.Truncate(udpBufferSize(r))
+	}
+
+	if err := w.WriteMsg(reply); err != nil {
+		s.logger.Debugf("%s DNS write: %v", transport, err)
+	}
+}
+
+// udpBufferSize returns the UDP payload size a query advertises through EDNS,
+// or the 512 byte minimum without it
+func udpBufferSize(msg *dns.Msg) int {
+	if opt := msg.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
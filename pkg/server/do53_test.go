@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// frontendAddr returns the address of the front-end of a server named name
+func frontendAddr(t *testing.T, s *Server, name string) string {
+	for _, f := range s.frontends {
+		if f.String() == name {
+			return f.addr().String()
+		}
+	}
+	t.Fatalf("no %s front-end", name)
+	return ""
+}
+
+func TestDo53(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr:     "127.0.0.1:0",
+		Do53ListenAddr: "127.0.0.1:0",
+		Cert:           testCertificate(t, "localhost"),
+		Resolver:       &ttlUpstream{ttl: 60},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = doqServer.Close() })
+	go doqServer.Listen()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for network, name := range map[string]string{"udp": "UDP DNS", "tcp": "TCP DNS"} {
+		dnsClient := dns.Client{Net: network, Timeout: 5 * time.Second}
+		addr := frontendAddr(t, doqServer, name)
+		var resp *dns.Msg
+		for i := 0; i < 10; i++ { // Wait for the listeners to start
+			if resp, _, err = dnsClient.Exchange(req, addr); err == nil {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		require.NoError(t, err, network)
+		assert.Equal(t, req.Id, resp.Id, network)
+		assert.Len(t, resp.Answer, 1, network)
+	}
+}
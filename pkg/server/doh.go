@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// dohPath is the well-known DoH endpoint path
+const dohPath = "/dns-query"
+
+// dohServer is a DNS over HTTPS (RFC 8484) front-end
+type dohServer struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// newDoHServer creates a DoH listener serving handler at /dns-query
+func newDoHServer(listenAddr string, socket SocketConfig, tlsConf *tls.Config, handler http.HandlerFunc) (frontend, error) {
+	listener, err := socket.listen(listenAddr)
+	if err != nil {
+		return nil, errors.New("could not start DoH listener: " + err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, handler)
+	return &dohServer{
+		listener: listener,
+		server: &http.Server{
+			Handler:   mux,
+			TLSConfig: tlsConf.Clone(),
+		},
+	}, nil // nil error
+}
+
+// serve serves HTTP/2 and HTTP/1.1 requests until the listener is closed
+func (d *dohServer) serve() error {
+	return d.server.ServeTLS(d.listener, "", "")
+}
+
+func (d *dohServer) close() error {
+	// The listener is only tracked by the HTTP server once serving
+	_ = d.listener.Close()
+	return d.server.Close()
+}
+
+func (d *dohServer) addr() net.Addr {
+	return d.listener.Addr()
+}
+
+func (d *dohServer) String() string {
+	return "DoH"
+}
+
+// errMalformedQuery is returned with the FORMERR reply to a pathological
+// DoH query
+var errMalformedQuery = errors.New("malformed DNS query")
+
+// readDoHRequest extracts the DNS query from a GET or POST DoH request,
+// rejecting messages larger than maxSize bytes
+func readDoHRequest(r *http.Request, maxSize int) (*dns.Msg, int, error) {
+	var packed []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest, errors.New("missing dns query parameter")
+		}
+		var err error
+		packed, err = base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("dns parameter decode: " + err.Error())
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			return nil, http.StatusUnsupportedMediaType, errors.New("unsupported content type")
+		}
+		var err error
+		packed, err = io.ReadAll(io.LimitReader(r.Body, int64(maxSize)+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("request body read: " + err.Error())
+		}
+	default:
+		return nil, http.StatusMethodNotAllowed, errors.New("unsupported method " + r.Method)
+	}
+
+	if len(packed) > maxSize {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("DNS query too large")
+	}
+
+	if err := checkWire(packed); err != nil {
+		if reply := formErrReply(packed); reply != nil {
+			return reply, http.StatusOK, errMalformedQuery
+		}
+		return nil, http.StatusBadRequest, errors.New("DNS query: " + err.Error())
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packed); err != nil {
+		return nil, http.StatusBadRequest, errors.New("DNS query unpack: " + err.Error())
+	}
+	return msg, http.StatusOK, nil // nil error
+}
+
+// writeDoHResponse writes a DNS reply with a cache lifetime matching its
+// smallest TTL
+func writeDoHResponse(w http.ResponseWriter, reply *dns.Msg) error {
+	packed, err := reply.Pack()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	if ttl, ok := minTTL(reply); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	_, err = w.Write(packed)
+	return err
+}
+
+// minTTL returns the smallest TTL of the records in a message
+func minTTL(msg *dns.Msg) (uint32, bool) {
+	found := false
+	var ttl uint32
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// httpRemoteAddr parses the client address of an HTTP request
+func httpRemoteAddr(r *http.Request) net.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	if r.ProtoMajor == 3 {
+		return net.UDPAddrFromAddrPort(addrPort)
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// dohHandler returns a handler for DNS queries received over HTTPS on the
+// given transport
+func (s *Server) dohHandler(transport string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Increment query metric
+		s.metrics().queries.Inc()
+
+		msg, status, err := readDoHRequest(r, s.maxQuerySize)
+		if errors.Is(err, errMalformedQuery) {
+			s.logger.Debugf("%s request: %v", transport, err)
+			s.metrics().invalidQueries.Inc()
+			if err := writeDoHResponse(w, msg); err != nil {
+				s.logger.Debugf("%s write: %v", transport, err)
+			}
+			return
+		}
+		if err != nil {
+			s.logger.Debugf("%s request: %v", transport, err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		reply := s.resolve(&query{
+			ctx:        r.Context(),
+			msg:        msg,
+			client:     httpRemoteAddr(r),
+			transport:  transport,
+			peerCert:   peerCertificate(r.TLS),
+			serverName: serverName(r.TLS),
+		})
+		if err := writeDoHResponse(w, reply); err != nil {
+			s.logger.Debugf("%s write: %v", transport, err)
+		}
+	}
+}
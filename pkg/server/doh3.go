@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newDoH3Server creates a DNS over HTTP/3 server for connections
+// demultiplexed from the DoQ listener by ALPN
+func newDoH3Server(handler http.HandlerFunc) *http3.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, handler)
+	return &http3.Server{Handler: mux}
+}
+
+// serveDoH3 serves DoH requests on an HTTP/3 connection
+func (s *Server) serveDoH3(session *quic.Conn) {
+	s.connections.Add(1)
+	defer s.connections.Add(-1)
+	if err := s.doh3Server.ServeQUICConn(session); err != nil {
+		s.logger.Debugf("DoH3 connection: %v", err)
+	}
+}
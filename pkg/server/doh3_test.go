@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+func TestDoH3SharedListener(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Cert:       testCertificate(t, "localhost"),
+		Resolver:   &ttlUpstream{ttl: 60},
+		DoH3:       true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = doqServer.Close() })
+	go doqServer.Listen()
+	addr := doqServer.Listener.Addr().String()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 0
+	packed, err := req.Pack()
+	require.NoError(t, err)
+
+	// DoH3 on the shared port
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer transport.Close()
+	httpClient := http.Client{Transport: transport, Timeout: 5 * time.Second}
+	resp, err := httpClient.Post("https://"+addr+"/dns-query", "application/dns-message", bytes.NewReader(packed))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var msg dns.Msg
+	require.NoError(t, msg.Unpack(body))
+	assert.Len(t, msg.Answer, 1)
+
+	// DoQ on the same port
+	doqClient, err := client.New(client.Config{Server: addr, TLSSkipVerify: true})
+	require.NoError(t, err)
+	defer doqClient.Close()
+	msg, err = doqClient.SendQuery(*req)
+	require.NoError(t, err)
+	assert.Len(t, msg.Answer, 1)
+}
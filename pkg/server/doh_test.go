@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoH(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr:    "127.0.0.1:0",
+		DoHListenAddr: "127.0.0.1:0",
+		Cert:          testCertificate(t, "localhost"),
+		Resolver:      &ttlUpstream{ttl: 60},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = doqServer.Close() })
+	go doqServer.Listen()
+	url := "https://" + frontendAddr(t, doqServer, "DoH") + "/dns-query"
+
+	httpClient := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 0
+	packed, err := req.Pack()
+	assert.Nil(t, err)
+
+	// GET with the base64url encoded query
+	var resp *http.Response
+	for i := 0; i < 10; i++ { // Wait for the DoH server to start
+		resp, err = httpClient.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(packed))
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/dns-message", resp.Header.Get("Content-Type"))
+	assert.Equal(t, 2, resp.ProtoMajor)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Nil(t, err)
+	var msg dns.Msg
+	if assert.Nil(t, msg.Unpack(body)) {
+		assert.Len(t, msg.Answer, 1)
+	}
+
+	// POST with the raw query as the body
+	resp, err = httpClient.Post(url, "application/dns-message", bytes.NewReader(packed))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Pathological queries are answered with FORMERR
+	resp, err = httpClient.Post(url, "application/dns-message", bytes.NewReader(append(packed, 0)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Nil(t, err)
+	if assert.Nil(t, msg.Unpack(body)) {
+		assert.Equal(t, dns.RcodeFormatError, msg.Rcode)
+	}
+
+	// Missing query parameter
+	resp, err = httpClient.Get(url)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
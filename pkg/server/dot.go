@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// newDoTServer creates a DNS over TLS (RFC 7858) listener
+func newDoTServer(listenAddr string, socket SocketConfig, tlsConf *tls.Config, handler dns.Handler) (frontend, error) {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{"dot"}
+	listener, err := socket.listen(listenAddr)
+	if err != nil {
+		return nil, errors.New("could not start DoT listener: " + err.Error())
+	}
+	listener = tls.NewListener(listener, tlsConf)
+
+	return &dnsFrontend{name: "DoT", server: &dns.Server{
+		Listener:      listener,
+		Net:           "tcp-tls",
+		Handler:       handler,
+		MsgAcceptFunc: acceptMsg,
+	}}, nil // nil error
+}
+
+// serveDoT handles a DNS query received over TLS
+func (s *Server) serveDoT(w dns.ResponseWriter, r *dns.Msg) {
+	// Increment query metric
+	s.metrics().queries.Inc()
+
+	q := &query{msg: r, client: w.RemoteAddr(), transport: transportDoT}
+	if cs, ok := w.(dns.ConnectionStater); ok {
+		q.peerCert = peerCertificate(cs.ConnectionState())
+		q.serverName = serverName(cs.ConnectionState())
+	}
+	reply := s.resolve(q)
+	if err := w.WriteMsg(reply); err != nil {
+		s.logger.Debugf("DoT write: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoT(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr:    "127.0.0.1:0",
+		DoTListenAddr: "127.0.0.1:0",
+		Cert:          testCertificate(t, "localhost"),
+		Resolver:      &ttlUpstream{ttl: 60},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = doqServer.Close() })
+	go doqServer.Listen()
+
+	dotClient := dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		Timeout:   5 * time.Second,
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	addr := frontendAddr(t, doqServer, "DoT")
+	var resp *dns.Msg
+	for i := 0; i < 10; i++ { // Wait for the DoT server to start
+		resp, _, err = dotClient.Exchange(req, addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	assert.Equal(t, req.Id, resp.Id)
+	assert.Len(t, resp.Answer, 1)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS Client Subnet modes
+const (
+	// ClientSubnetStrip removes client subnets from queries
+	ClientSubnetStrip = "strip"
+	// ClientSubnetTruncate shortens client subnets to a coarser prefix
+	ClientSubnetTruncate = "truncate"
+	// ClientSubnetInject replaces client subnets with a static prefix, and
+	// adds it to queries without one
+	ClientSubnetInject = "inject"
+)
+
+// ClientSubnetConfig configures the EDNS Client Subnet (RFC 7871) sent
+// upstream, trading CDN answer accuracy for client privacy
+type ClientSubnetConfig struct {
+	// Mode is strip, truncate or inject. Without it, client subnets are
+	// forwarded as sent.
+	Mode string
+	// IPv4Bits and IPv6Bits are the prefix lengths subnets are truncated to,
+	// 24 and 56 when zero
+	IPv4Bits int
+	IPv6Bits int
+	// Prefix is the subnet injected in every query
+	Prefix string
+}
+
+// clientSubnetPolicy rewrites the client subnet of queries sent upstream
+type clientSubnetPolicy struct {
+	mode     string
+	ipv4Bits int
+	ipv6Bits int
+	prefix   netip.Prefix
+}
+
+// newClientSubnetPolicy parses the client subnet config, or returns nil when
+// subnets are forwarded as sent
+func newClientSubnetPolicy(c ClientSubnetConfig) (*clientSubnetPolicy, error) {
+	p := &clientSubnetPolicy{mode: c.Mode, ipv4Bits: c.IPv4Bits, ipv6Bits: c.IPv6Bits}
+	if p.ipv4Bits == 0 {
+		p.ipv4Bits = 24
+	}
+	if p.ipv6Bits == 0 {
+		p.ipv6Bits = 56
+	}
+	switch c.Mode {
+	case "":
+		return nil, nil
+	case ClientSubnetStrip:
+	case ClientSubnetTruncate:
+		if p.ipv4Bits < 0 || p.ipv4Bits > 32 || p.ipv6Bits < 0 || p.ipv6Bits > 128 {
+			return nil, errors.New("client subnet: invalid prefix length")
+		}
+	case ClientSubnetInject:
+		prefix, err := netip.ParsePrefix(c.Prefix)
+		if err != nil {
+			return nil, errors.New("client subnet: " + err.Error())
+		}
+		p.prefix = prefix.Masked()
+	default:
+		return nil, errors.New("client subnet: unknown mode " + c.Mode)
+	}
+	return p, nil
+}
+
+// apply returns the query to forward upstream, a copy with the rewritten
+// client subnet, or the query itself when it is unchanged
+func (p *clientSubnetPolicy) apply(msg *dns.Msg) *dns.Msg {
+	subnet := clientSubnet(msg)
+	// A source prefix length of zero opts out of client subnets (RFC 7871
+	// 7.1.2), and is forwarded as sent
+	if subnet != nil && subnet.SourceNetmask == 0 {
+		return msg
+	}
+
+	var prefix netip.Prefix
+	switch p.mode {
+	case ClientSubnetStrip:
+		if subnet == nil {
+			return msg
+		}
+	case ClientSubnetTruncate:
+		if subnet == nil {
+			return msg
+		}
+		addr, ok := netip.AddrFromSlice(subnet.Address)
+		if !ok {
+			return msg
+		}
+		addr = addr.Unmap()
+		bits := p.ipv6Bits
+		if addr.Is4() {
+			bits = p.ipv4Bits
+		}
+		if int(subnet.SourceNetmask) <= bits {
+			return msg
+		}
+		prefix, _ = addr.Prefix(bits)
+	case ClientSubnetInject:
+		prefix = p.prefix
+	}
+
+	msg = msg.Copy()
+	removeEDNSOption(msg, dns.EDNS0SUBNET)
+	if !prefix.IsValid() {
+		return msg
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	option := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(prefix.Bits()),
+		Address:       net.IP(prefix.Addr().AsSlice()),
+	}
+	if prefix.Addr().Is6() {
+		option.Family = 2
+	}
+	opt.Option = append(opt.Option, option)
+	return msg
+}
+
+// restoreClientSubnet gives a reply the client subnet of the client's query,
+// as clients drop answers whose subnet does not match theirs (RFC 7871 7.3),
+// with the upstream's scope capped to the client's source prefix length
+func restoreClientSubnet(query, reply *dns.Msg) {
+	sent := clientSubnet(query)
+	if sent != nil && sent.SourceNetmask == 0 {
+		return
+	}
+	answered := clientSubnet(reply)
+	removeEDNSOption(reply, dns.EDNS0SUBNET)
+	opt := reply.IsEdns0()
+	if sent == nil || answered == nil || opt == nil {
+		return
+	}
+	restored := *sent
+	restored.SourceScope = min(answered.SourceScope, sent.SourceNetmask)
+	opt.Option = append(opt.Option, &restored)
+}
+
+// subnetPrefix returns the masked source prefix of a client subnet option
+func subnetPrefix(subnet *dns.EDNS0_SUBNET) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(subnet.Address)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	prefix, err := addr.Unmap().Prefix(int(subnet.SourceNetmask))
+	return prefix, err == nil
+}
+
+// scopeLengths records the scope prefix lengths of the cached answers, per
+// address family, so cache lookups only try the prefixes of these lengths
+type scopeLengths struct {
+	// seen holds bits 0 to 128 for IPv4 and IPv6
+	seen [2][3]atomic.Uint64
+}
+
+// add records a scope length of an address family
+func (l *scopeLengths) add(addr netip.Addr, bits int) {
+	l.seen[l.family(addr)][bits/64].Or(1 << (bits % 64))
+}
+
+// has tells whether a scope length of an address family was recorded
+func (l *scopeLengths) has(addr netip.Addr, bits int) bool {
+	return l.seen[l.family(addr)][bits/64].Load()&(1<<(bits%64)) != 0
+}
+
+func (l *scopeLengths) family(addr netip.Addr) int {
+	if addr.Is4() {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// subnetUpstream records the client subnet it receives and echoes it with a
+// scope of its source prefix length
+type subnetUpstream struct {
+	received string
+}
+
+func (u *subnetUpstream) String() string { return "subnet" }
+
+func (u *subnetUpstream) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	u.received = ""
+	if subnet := clientSubnet(msg); subnet != nil {
+		u.received = subnet.String()
+		reply.SetEdns0(dns.DefaultMsgSize, false)
+		echo := *subnet
+		echo.SourceScope = subnet.SourceNetmask
+		reply.IsEdns0().Option = []dns.EDNS0{&echo}
+	}
+	return reply, nil
+}
+
+func TestClientSubnetPolicy(t *testing.T) {
+	resolve := func(c ClientSubnetConfig, subnet *dns.EDNS0_SUBNET) (string, *dns.EDNS0_SUBNET) {
+		policy, err := newClientSubnetPolicy(c)
+		assert.Nil(t, err)
+		up := &subnetUpstream{}
+		s := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New(), clientSubnet: policy}
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if subnet != nil {
+			msg.SetEdns0(1232, false)
+			msg.IsEdns0().Option = []dns.EDNS0{subnet}
+		}
+		reply := s.resolve(&query{msg: msg})
+		return up.received, clientSubnet(reply)
+	}
+	v4 := func() *dns.EDNS0_SUBNET {
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("192.0.2.77").To4()}
+	}
+	v6 := func() *dns.EDNS0_SUBNET {
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: 64, Address: net.ParseIP("2001:db8:1:2:3::")}
+	}
+
+	// Forwarded as sent
+	received, replied := resolve(ClientSubnetConfig{}, v4())
+	assert.Equal(t, "192.0.2.77/32/0", received)
+	assert.Equal(t, uint8(32), replied.SourceScope)
+
+	// Stripped
+	received, replied = resolve(ClientSubnetConfig{Mode: ClientSubnetStrip}, v4())
+	assert.Empty(t, received)
+	assert.Nil(t, replied)
+
+	// Truncated, with the client's own subnet in the reply
+	received, replied = resolve(ClientSubnetConfig{Mode: ClientSubnetTruncate}, v4())
+	assert.Equal(t, "192.0.2.0/24/0", received)
+	if assert.NotNil(t, replied) {
+		assert.Equal(t, "192.0.2.77/32/24", replied.String())
+	}
+	received, _ = resolve(ClientSubnetConfig{Mode: ClientSubnetTruncate}, v6())
+	assert.Equal(t, "[2001:db8:1::]/56/0", received)
+	received, _ = resolve(ClientSubnetConfig{Mode: ClientSubnetTruncate, IPv4Bits: 16}, v4())
+	assert.Equal(t, "192.0.0.0/16/0", received)
+	received, _ = resolve(ClientSubnetConfig{Mode: ClientSubnetTruncate}, nil)
+	assert.Empty(t, received)
+
+	// Injected, without a subnet in the reply to clients that sent none
+	received, replied = resolve(ClientSubnetConfig{Mode: ClientSubnetInject, Prefix: "198.51.100.0/24"}, nil)
+	assert.Equal(t, "198.51.100.0/24/0", received)
+	assert.Nil(t, replied)
+	received, replied = resolve(ClientSubnetConfig{Mode: ClientSubnetInject, Prefix: "2001:db8::/32"}, v4())
+	assert.Equal(t, "[2001:db8::]/32/0", received)
+	if assert.NotNil(t, replied) {
+		assert.Equal(t, "192.0.2.77/32/32", replied.String())
+	}
+
+	// Clients opting out with a zero source prefix length are respected
+	optOut := v4()
+	optOut.SourceNetmask = 0
+	optOut.Address = net.IPv4zero.To4()
+	received, _ = resolve(ClientSubnetConfig{Mode: ClientSubnetInject, Prefix: "198.51.100.0/24"}, optOut)
+	assert.Equal(t, "0.0.0.0/0/0", received)
+
+	for _, c := range []ClientSubnetConfig{
+		{Mode: "bogus"},
+		{Mode: ClientSubnetInject, Prefix: "nope"},
+		{Mode: ClientSubnetTruncate, IPv4Bits: 33},
+	} {
+		_, err := newClientSubnetPolicy(c)
+		assert.NotNil(t, err)
+	}
+}
+
+// scopedUpstream answers with the client subnet it receives at a fixed
+// scope, or without one when the scope is negative, and counts the exchanges
+type scopedUpstream struct {
+	ttlUpstream
+	scope int
+}
+
+func (u *scopedUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	reply, _ := u.ttlUpstream.Exchange(ctx, msg)
+	if subnet := clientSubnet(msg); subnet != nil && u.scope >= 0 {
+		reply.SetEdns0(dns.DefaultMsgSize, false)
+		echo := *subnet
+		echo.SourceScope = uint8(u.scope)
+		reply.IsEdns0().Option = []dns.EDNS0{&echo}
+	}
+	return reply, nil
+}
+
+func TestClientSubnetCache(t *testing.T) {
+	exchanges := func(scope int, subnets ...string) int32 {
+		up := &scopedUpstream{ttlUpstream: ttlUpstream{ttl: 300}, scope: scope}
+		s := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New(), cache: NewMemoryCache(10, nil)}
+		for _, subnet := range subnets {
+			ip, ipNet, _ := net.ParseCIDR(subnet)
+			bits, _ := ipNet.Mask.Size()
+			msg := new(dns.Msg)
+			msg.SetQuestion("cdn.example.", dns.TypeA)
+			msg.SetEdns0(1232, false)
+			option := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(bits), Address: ip.To4()}
+			if ip.To4() == nil {
+				option.Family, option.Address = 2, ip
+			}
+			msg.IsEdns0().Option = []dns.EDNS0{option}
+			reply := s.forward(&query{msg: msg})
+			if scope >= 0 && assert.NotNil(t, clientSubnet(reply)) {
+				// Cached answers carry the client's own subnet
+				assert.Equal(t, option.Address.String(), clientSubnet(reply).Address.String())
+			}
+		}
+		return up.exchanges.Load()
+	}
+
+	// Answers are shared within their scope
+	assert.Equal(t, int32(2), exchanges(16, "192.0.2.0/24", "192.0.3.0/24", "198.51.100.0/24", "192.0.2.0/24"))
+	assert.Equal(t, int32(3), exchanges(24, "192.0.2.0/24", "192.0.3.0/24", "198.51.100.0/24", "192.0.3.0/24"))
+	assert.Equal(t, int32(2), exchanges(48, "2001:db8::/48", "2001:db8:1::/48", "2001:db8::/48"))
+	// Answers scoped to /0, or without a client subnet, apply to any subnet
+	assert.Equal(t, int32(1), exchanges(0, "192.0.2.0/24", "198.51.100.0/24"))
+	assert.Equal(t, int32(1), exchanges(-1, "192.0.2.0/24", "198.51.100.0/24"))
+}
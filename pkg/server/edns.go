@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ednsOptions names the EDNS option codes a policy can refer to
+var ednsOptions = map[string]uint16{
+	"llq":       dns.EDNS0LLQ,
+	"ul":        dns.EDNS0UL,
+	"nsid":      dns.EDNS0NSID,
+	"dau":       dns.EDNS0DAU,
+	"dhu":       dns.EDNS0DHU,
+	"n3u":       dns.EDNS0N3U,
+	"ecs":       dns.EDNS0SUBNET,
+	"expire":    dns.EDNS0EXPIRE,
+	"cookie":    dns.EDNS0COOKIE,
+	"keepalive": dns.EDNS0TCPKEEPALIVE,
+	"padding":   dns.EDNS0PADDING,
+	"ede":       dns.EDNS0EDE,
+}
+
+// ednsUnknown refers to every option code without a name in ednsOptions
+const ednsUnknown = "unknown"
+
+// EDNSOptionsConfig selects the EDNS options of client queries forwarded
+// upstream. Options are given by name (ecs, cookie, ede, padding, nsid,
+// expire, keepalive, llq, ul, dau, dhu, n3u), by code, or as unknown for
+// every code without a name. Without either list, every option is forwarded.
+type EDNSOptionsConfig struct {
+	// Forward lists the only options forwarded, the others are stripped
+	Forward []string
+	// Strip lists the options stripped, the others are forwarded
+	Strip []string
+}
+
+// ednsPolicy strips EDNS options of client queries before forwarding them
+type ednsPolicy struct {
+	// allowlist forwards the listed options only, instead of all but them
+	allowlist bool
+	options   map[uint16]bool
+	unknown   bool
+}
+
+// newEDNSPolicy parses the EDNS option policy, or returns nil when every
+// option is forwarded
+func newEDNSPolicy(c EDNSOptionsConfig) (*ednsPolicy, error) {
+	if len(c.Forward) > 0 && len(c.Strip) > 0 {
+		return nil, errors.New("edns options: forward and strip lists are exclusive")
+	}
+	names := c.Strip
+	if len(c.Forward) > 0 {
+		names = c.Forward
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	p := &ednsPolicy{allowlist: len(c.Forward) > 0, options: map[uint16]bool{}}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if code, ok := ednsOptions[name]; ok {
+			p.options[code] = true
+		} else if name == ednsUnknown {
+			p.unknown = true
+		} else if code, err := strconv.ParseUint(name, 10, 16); err == nil {
+			p.options[uint16(code)] = true
+		} else {
+			return nil, errors.New("edns options: unknown option " + name)
+		}
+	}
+	return p, nil
+}
+
+// forwards reports whether an option is forwarded upstream
+func (p *ednsPolicy) forwards(code uint16) bool {
+	listed := p.options[code]
+	if !listed && p.unknown {
+		listed = true
+		for _, known := range ednsOptions {
+			if code == known {
+				listed = false
+				break
+			}
+		}
+	}
+	return listed == p.allowlist
+}
+
+// apply returns the query to forward upstream, a copy without the stripped
+// options, or the query itself when it has none
+func (p *ednsPolicy) apply(msg *dns.Msg) *dns.Msg {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return msg
+	}
+	for i, option := range opt.Option {
+		if p.forwards(option.Option()) {
+			continue
+		}
+		msg = msg.Copy()
+		opt = msg.IsEdns0()
+		options := opt.Option[:i]
+		for _, option := range opt.Option[i:] {
+			if p.forwards(option.Option()) {
+				options = append(options, option)
+			}
+		}
+		opt.Option = options
+		return msg
+	}
+	return msg
+}
+
+// hasEDNSOption reports whether a message carries the given EDNS option
+func hasEDNSOption(msg *dns.Msg, code uint16) bool {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if option.Option() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeEDNSOption strips every instance of an EDNS option from a message
+func removeEDNSOption(msg *dns.Msg, code uint16) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != code {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
+
+// setNSID answers an NSID request (RFC 5001) with this server's identifier,
+// replacing any identifier the upstream returned
+func setNSID(reply *dns.Msg, nsid string) {
+	removeEDNSOption(reply, dns.EDNS0NSID)
+	opt := reply.IsEdns0()
+	if opt == nil {
+		reply.SetEdns0(dns.DefaultMsgSize, false)
+		opt = reply.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+		Code: dns.EDNS0NSID,
+		Nsid: hex.EncodeToString([]byte(nsid)),
+	})
+}
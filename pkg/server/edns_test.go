@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetNSID(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// Reply without an OPT record gets one
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	setNSID(reply, "node1")
+	opt := reply.IsEdns0()
+	if assert.NotNil(t, opt) && assert.Len(t, opt.Option, 1) {
+		assert.Equal(t, hex.EncodeToString([]byte("node1")), opt.Option[0].(*dns.EDNS0_NSID).Nsid)
+	}
+
+	// The upstream's NSID is replaced and other options are kept
+	reply = new(dns.Msg)
+	reply.SetReply(req)
+	reply.SetEdns0(1232, false)
+	reply.IsEdns0().Option = []dns.EDNS0{
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "aa"},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 4)},
+	}
+	setNSID(reply, "node1")
+	assert.Len(t, reply.IsEdns0().Option, 2)
+	assert.True(t, hasEDNSOption(reply, dns.EDNS0PADDING))
+	assert.Equal(t, uint16(1232), reply.IsEdns0().UDPSize())
+}
+
+// optionUpstream records the EDNS options of the queries it receives
+type optionUpstream struct {
+	options []uint16
+}
+
+func (u *optionUpstream) String() string { return "options" }
+
+func (u *optionUpstream) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	u.options = nil
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			u.options = append(u.options, option.Option())
+		}
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	return reply, nil
+}
+
+func TestEDNSPolicy(t *testing.T) {
+	forward := func(c EDNSOptionsConfig) []uint16 {
+		policy, err := newEDNSPolicy(c)
+		assert.Nil(t, err)
+		up := &optionUpstream{}
+		s := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New(), ednsPolicy: policy}
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.SetEdns0(1232, false)
+		msg.IsEdns0().Option = []dns.EDNS0{
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0")},
+			&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+			&dns.EDNS0_PADDING{Padding: make([]byte, 4)},
+			&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1}},
+		}
+		s.resolve(&query{msg: msg})
+		// The client's query is left untouched
+		assert.Len(t, msg.IsEdns0().Option, 4)
+		return up.options
+	}
+
+	assert.Equal(t, []uint16{dns.EDNS0SUBNET, dns.EDNS0COOKIE, dns.EDNS0PADDING, 65001}, forward(EDNSOptionsConfig{}))
+	assert.Equal(t, []uint16{dns.EDNS0SUBNET, 65001}, forward(EDNSOptionsConfig{Strip: []string{"cookie", "PADDING"}}))
+	assert.Equal(t, []uint16{dns.EDNS0COOKIE}, forward(EDNSOptionsConfig{Forward: []string{"cookie", "nsid"}}))
+	assert.Equal(t, []uint16{dns.EDNS0SUBNET, dns.EDNS0COOKIE, dns.EDNS0PADDING}, forward(EDNSOptionsConfig{Strip: []string{"unknown"}}))
+	assert.Equal(t, []uint16{dns.EDNS0PADDING, 65001}, forward(EDNSOptionsConfig{Forward: []string{"12", "unknown"}}))
+
+	for _, c := range []EDNSOptionsConfig{
+		{Forward: []string{"ecs"}, Strip: []string{"cookie"}},
+		{Strip: []string{"bogus"}},
+		{Strip: []string{"70000"}},
+	} {
+		_, err := newEDNSPolicy(c)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// frontend is an additional listener feeding queries into the server's
+// shared backend alongside the DoQ listener
+type frontend interface {
+	// serve blocks serving queries until the frontend is closed
+	serve() error
+	// close stops the frontend and releases its sockets
+	close() error
+	// addr returns the address the frontend listens on
+	addr() net.Addr
+	// String names the frontend in log messages
+	String() string
+}
+
+// dnsFrontend serves DNS messages with a miekg/dns server
+type dnsFrontend struct {
+	name   string
+	server *dns.Server
+}
+
+func (f *dnsFrontend) serve() error {
+	return f.server.ActivateAndServe()
+}
+
+func (f *dnsFrontend) close() error {
+	if f.server.Listener != nil {
+		return f.server.Listener.Close()
+	}
+	return f.server.PacketConn.Close()
+}
+
+func (f *dnsFrontend) addr() net.Addr {
+	if f.server.Listener != nil {
+		return f.server.Listener.Addr()
+	}
+	return f.server.PacketConn.LocalAddr()
+}
+
+func (f *dnsFrontend) String() string {
+	return f.name
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIPConfig configures ordering the A and AAAA answers of some names by
+// how close they are to the client, for backends with servers in several
+// locations
+type GeoIPConfig struct {
+	// Database is a MaxMind GeoIP2 or GeoLite2 City or Country database,
+	// locating both clients and answers
+	Database string
+	// Names are the names whose answers are ordered, *.example.com matching
+	// the names below example.com
+	Names []string
+	// Filter drops the answers farther from the client than the closest
+	// ones instead of moving them last
+	Filter bool
+}
+
+// geoLocation is the part of a MaxMind record used to compare locations
+type geoLocation struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// geoLocator finds where an IP address is
+type geoLocator interface {
+	locate(ip net.IP) (*geoLocation, bool)
+}
+
+// maxmindLocator locates addresses with a MaxMind database
+type maxmindLocator struct {
+	reader *maxminddb.Reader
+}
+
+func (m *maxmindLocator) locate(ip net.IP) (*geoLocation, bool) {
+	var loc geoLocation
+	if err := m.reader.Lookup(ip, &loc); err != nil || (loc.Country.ISOCode == "" && loc.Continent.Code == "") {
+		return nil, false
+	}
+	return &loc, true
+}
+
+// geoSelector orders answers by distance to the client
+type geoSelector struct {
+	locator geoLocator
+	names   *domainList
+	filter  bool
+}
+
+// newGeoSelector opens the GeoIP database, or returns nil when there is none
+func newGeoSelector(c GeoIPConfig) (*geoSelector, error) {
+	if c.Database == "" {
+		return nil, nil
+	}
+	reader, err := maxminddb.Open(c.Database)
+	if err != nil {
+		return nil, errors.New("open GeoIP database: " + err.Error())
+	}
+	g := &geoSelector{locator: &maxmindLocator{reader: reader}, names: newDomainList(), filter: c.Filter}
+	for _, name := range c.Names {
+		if err := g.names.add(name); err != nil {
+			return nil, errors.New("GeoIP: " + err.Error())
+		}
+	}
+	return g, nil
+}
+
+// geoRank is how far an answer is from the client, compared by tier first:
+// the same country, the same continent, and elsewhere
+type geoRank struct {
+	tier     int
+	distance float64
+}
+
+// apply orders the A and AAAA answers of a reply, closest to the client
+// first. The client is located by its EDNS Client Subnet when present.
+func (g *geoSelector) apply(q *query, reply *dns.Msg) {
+	if len(q.msg.Question) != 1 || !g.names.match(strings.ToLower(q.msg.Question[0].Name)) {
+		return
+	}
+	var clientIP net.IP
+	if subnet := clientSubnet(q.msg); subnet != nil {
+		clientIP = subnet.Address
+	} else if addr, ok := clientAddr(q.client); ok {
+		clientIP = addr.AsSlice()
+	}
+	if clientIP == nil {
+		return
+	}
+	client, ok := g.locator.locate(clientIP)
+	if !ok {
+		return
+	}
+
+	var others, addrs []dns.RR
+	ranks := map[dns.RR]geoRank{}
+	for _, rr := range reply.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			others = append(others, rr)
+			continue
+		}
+		addrs = append(addrs, rr)
+		ranks[rr] = g.rank(client, ip)
+	}
+	if len(addrs) < 2 {
+		return
+	}
+
+	slices.SortStableFunc(addrs, func(a, b dns.RR) int {
+		ra, rb := ranks[a], ranks[b]
+		if ra.tier != rb.tier {
+			return ra.tier - rb.tier
+		}
+		switch {
+		case ra.distance < rb.distance:
+			return -1
+		case ra.distance > rb.distance:
+			return 1
+		}
+		return 0
+	})
+	if g.filter {
+		best := ranks[addrs[0]].tier
+		addrs = slices.DeleteFunc(addrs, func(rr dns.RR) bool { return ranks[rr].tier != best })
+	}
+	reply.Answer = append(others, addrs...)
+}
+
+// rank compares the location of an answer to the client's
+func (g *geoSelector) rank(client *geoLocation, ip net.IP) geoRank {
+	loc, ok := g.locator.locate(ip)
+	if !ok {
+		return geoRank{tier: 2, distance: math.Inf(1)}
+	}
+	rank := geoRank{tier: 2, distance: geoDistance(client, loc)}
+	switch {
+	case client.Country.ISOCode != "" && loc.Country.ISOCode == client.Country.ISOCode:
+		rank.tier = 0
+	case client.Continent.Code != "" && loc.Continent.Code == client.Continent.Code:
+		rank.tier = 1
+	}
+	return rank
+}
+
+// geoDistance returns the great circle distance between two locations in
+// kilometers, or infinity when either has no coordinates
+func geoDistance(a, b *geoLocation) float64 {
+	if a.Location.Latitude == nil || a.Location.Longitude == nil || b.Location.Latitude == nil || b.Location.Longitude == nil {
+		return math.Inf(1)
+	}
+	const earthRadius = 6371
+	lat1, lat2 := *a.Location.Latitude*math.Pi/180, *b.Location.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (*b.Location.Longitude - *a.Location.Longitude) * math.Pi / 180
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// clientSubnet returns the EDNS Client Subnet option of a message, if any
+func clientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return subnet
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLocator locates addresses from a fixed table
+type fakeLocator map[string]*geoLocation
+
+func (f fakeLocator) locate(ip net.IP) (*geoLocation, bool) {
+	loc, ok := f[ip.String()]
+	return loc, ok
+}
+
+func testLocation(country, continent string, lat, lon float64) *geoLocation {
+	loc := &geoLocation{}
+	loc.Country.ISOCode = country
+	loc.Continent.Code = continent
+	loc.Location.Latitude, loc.Location.Longitude = &lat, &lon
+	return loc
+}
+
+func TestGeoSelector(t *testing.T) {
+	g := &geoSelector{
+		locator: fakeLocator{
+			"198.51.100.1": testLocation("DE", "EU", 52.5, 13.4),   // client in Berlin
+			"203.0.113.1":  testLocation("US", "NA", 37.8, -122.4), // client subnet in San Francisco
+			"192.0.2.1":    testLocation("US", "NA", 40.7, -74.0),
+			"192.0.2.2":    testLocation("FR", "EU", 48.9, 2.3),
+			"192.0.2.3":    testLocation("NL", "EU", 52.4, 4.9),
+			"192.0.2.4":    testLocation("DE", "EU", 50.1, 8.7),
+		},
+		names: newDomainList(),
+	}
+	assert.Nil(t, g.names.add("*.cdn.example"))
+
+	answer := func(name string) *dns.Msg {
+		reply := new(dns.Msg)
+		reply.SetQuestion(name, dns.TypeA)
+		reply.Answer = append(reply.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME}, Target: "edge." + name})
+		for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.99"} {
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: dns.RR_Header{Name: "edge." + name, Rrtype: dns.TypeA}, A: net.ParseIP(ip)})
+		}
+		return reply
+	}
+	order := func(reply *dns.Msg) []string {
+		var ips []string
+		for _, rr := range reply.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				ips = append(ips, a.A.String())
+			}
+		}
+		return ips
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("198.51.100.1")}
+
+	// Same country first, then the same continent by distance
+	q := &query{msg: answer("www.cdn.example."), client: client}
+	reply := answer("www.cdn.example.")
+	g.apply(q, reply)
+	assert.IsType(t, &dns.CNAME{}, reply.Answer[0])
+	assert.Equal(t, []string{"192.0.2.4", "192.0.2.3", "192.0.2.2", "192.0.2.1", "192.0.2.99"}, order(reply))
+
+	// The client subnet takes precedence over the client address
+	q.msg.SetEdns0(1232, false)
+	q.msg.IsEdns0().Option = append(q.msg.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("203.0.113.1"),
+	})
+	reply = answer("www.cdn.example.")
+	g.apply(q, reply)
+	assert.Equal(t, "192.0.2.1", order(reply)[0])
+
+	g.filter = true
+	q = &query{msg: answer("www.cdn.example."), client: client}
+	reply = answer("www.cdn.example.")
+	g.apply(q, reply)
+	assert.Equal(t, []string{"192.0.2.4"}, order(reply))
+
+	// Other names and unknown clients are left alone
+	for _, q := range []*query{
+		{msg: answer("www.example."), client: client},
+		{msg: answer("www.cdn.example."), client: &net.UDPAddr{IP: net.ParseIP("192.0.2.200")}},
+	} {
+		reply = answer(q.msg.Question[0].Name)
+		g.apply(q, reply)
+		assert.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.99"}, order(reply))
+	}
+
+	_, err := newGeoSelector(GeoIPConfig{Database: "/nonexistent"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mosajjal/doqd/pkg/upstream"
+)
+
+// Front-end transports a query can arrive on
+const (
+	transportDoQ  = "doq"
+	transportDoT  = "dot"
+	transportDoH  = "doh"
+	transportDoH3 = "doh3"
+	transportUDP  = "udp"
+	transportTCP  = "tcp"
+)
+
+// query is a DNS query received on one of the server's front-ends
+type query struct {
+	// ctx is cancelled when the client goes away, e.g. its DoQ stream or
+	// connection closes, aborting the upstream exchange
+	ctx       context.Context
+	msg       *dns.Msg
+	client    net.Addr
+	transport string
+	// peerCert is the client's TLS certificate, if it presented one
+	peerCert *x509.Certificate
+	// serverName is the TLS server name the client connected to, if any
+	serverName string
+	// view is the policy applied to the query, nil for the server's
+	view *view
+}
+
+// context returns the query's context, never cancelled when it has none
+func (q *query) context() context.Context {
+	if q.ctx == nil {
+		return context.Background()
+	}
+	return q.ctx
+}
+
+// peerCertificate returns the client certificate of a TLS connection, if any
+func peerCertificate(cs *tls.ConnectionState) *x509.Certificate {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	return cs.PeerCertificates[0]
+}
+
+// serverName returns the TLS server name a client connected to, if any
+func serverName(cs *tls.ConnectionState) string {
+	if cs == nil {
+		return ""
+	}
+	return cs.ServerName
+}
+
+// resolve answers a query through the backend shared by all front-ends. It
+// always returns a reply, falling back to SERVFAIL when the upstream fails.
+func (s *Server) resolve(q *query) *dns.Msg {
+	start := time.Now()
+	s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	defer s.queries.Add(1)
+
+	var reply *dns.Msg
+	if s.onQuery != nil {
+		reply = s.onQuery(q.client, q.msg)
+	}
+	if reply == nil {
+		reply = s.answer(q)
+	}
+	if s.onResponse != nil {
+		s.onResponse(q.client, q.msg, reply)
+	}
+
+	if s.queryLog != nil {
+		s.queryLog.log(q, reply, start)
+	}
+	if s.alerts != nil {
+		s.alerts.observe(q, reply)
+	}
+	if s.capture != nil {
+		s.capture.capture(q, reply, s.Listener.Addr(), start)
+	}
+	if s.top != nil && len(q.msg.Question) == 1 {
+		var client string
+		if addr, ok := clientAddr(q.client); ok {
+			client = addr.String()
+		}
+		s.top.record(q.msg.Question[0].Name, client)
+	}
+	if s.uniques != nil {
+		if addr, ok := clientAddr(q.client); ok {
+			s.uniques.record(addr)
+		}
+	}
+	return reply
+}
+
+// answer applies the server's policies to a query and resolves it
+func (s *Server) answer(q *query) *dns.Msg {
+	if s.primary != nil && s.primary.handles(q.msg) {
+		return s.primary.forward(q.context(), q, s.metrics())
+	}
+
+	if rcode := validateQuery(q.msg); rcode != dns.RcodeSuccess {
+		s.metrics().invalidQueries.Inc()
+		reply := new(dns.Msg)
+		return reply.SetRcode(q.msg, rcode)
+	}
+
+	// Increment valid queries metric
+	s.metrics().validQueries.Inc()
+
+	if s.tunneling != nil {
+		if reply := s.inspectTunneling(q); reply != nil {
+			return reply
+		}
+	}
+
+	blocker, rewriter := s.blocker, s.rewriter
+	if q.view = s.viewFor(q); q.view != nil {
+		blocker, rewriter = q.view.blocker, q.view.rewriter
+		if q.view.tenant {
+			s.metrics().tenantQueries.Inc(q.view.name)
+		}
+	}
+
+	reply := s.chaosReply(q.msg)
+	if reply == nil && blocker != nil {
+		if reply = blocker.block(q); reply != nil {
+			s.metrics().blockedQueries.Inc()
+		}
+	}
+	if reply == nil && rewriter != nil {
+		reply = s.rewrite(rewriter, q)
+	}
+	if reply == nil && s.reverse != nil {
+		reply = s.reverse.answer(q.msg)
+	}
+	if reply == nil {
+		reply = s.forward(q)
+		if s.rebinding != nil {
+			reply = s.rebinding.filter(q, reply, s.metrics())
+		}
+	}
+	if s.geo != nil {
+		s.geo.apply(q, reply)
+	}
+
+	if s.nsid != "" && hasEDNSOption(q.msg, dns.EDNS0NSID) {
+		setNSID(reply, s.nsid)
+	}
+	return reply
+}
+
+// forward answers a query from the cache or the upstream, falling back to
+// SERVFAIL. Identical queries in flight at the same time share one upstream
+// exchange.
+func (s *Server) forward(q *query) *dns.Msg {
+	// Query the upstream for our DNS response
+	up := s.upstream
+	if q.view != nil {
+		up = q.view.upstream
+	}
+
+	// The upstream query only carries the EDNS options allowed by the policy,
+	// and the client subnet it allows
+	msg := q.msg
+	if s.ednsPolicy != nil {
+		msg = s.ednsPolicy.apply(msg)
+	}
+	if s.clientSubnet != nil {
+		msg = s.clientSubnet.apply(msg)
+	}
+
+	// Resolvers answering per client, such as upstream.Handler, find the
+	// client in the context. Identical queries in flight share the answer
+	// to the first one.
+	ctx := upstream.WithClient(q.context(), q.client)
+	var resp *dns.Msg
+	var err error
+	if key, ok := questionKey(msg); ok {
+		// Views and tenants may answer differently, so they do not share
+		// answers
+		if q.view != nil && q.view.tenant {
+			key += "/tenant/" + q.view.name
+		} else if q.view != nil {
+			key += "/view/" + q.view.name
+		}
+		if s.cache != nil {
+			if resp := s.cacheGet(s.cacheKeys(key, msg)...); resp != nil {
+				resp.Id = q.msg.Id
+				resp.Question = append([]dns.Question{}, q.msg.Question...)
+				if s.rotateAnswers {
+					rotateAddresses(resp, s.rotation.Add(1))
+				}
+				// Cached answers may be shared by clients of other subnets
+				// within their scope
+				restoreClientSubnet(q.msg, resp)
+				return resp
+			}
+		}
+		var shared bool
+		resp, shared, err = s.inflight.do(ctx, key+subnetKey(msg), func(ctx context.Context) (*dns.Msg, error) {
+			resp, err := s.exchange(ctx, up, msg)
+			if err == nil && s.cache != nil {
+				if key, ok := s.answerCacheKey(key, msg, resp); ok {
+					s.cacheSet(key, resp)
+				}
+			}
+			return resp, err
+		})
+		if err == nil && shared {
+			s.metrics().deduplicatedQueries.Inc()
+			// Every caller gets its own copy, carrying its question's case
+			resp = resp.Copy()
+			resp.Question = append([]dns.Question{}, q.msg.Question...)
+		}
+	} else {
+		resp, err = s.exchange(ctx, up, msg)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Nobody is waiting for the answer
+		s.logger.Debugf("DNS query cancelled: %v", err)
+		reply := new(dns.Msg)
+		reply.SetRcode(q.msg, dns.RcodeServerFailure)
+		return reply
+	}
+	if err != nil {
+		s.metrics().upstreamErrors.Inc()
+		s.logger.Debugf("DNS query error: %v", err)
+		reply := new(dns.Msg)
+		reply.SetRcode(q.msg, dns.RcodeServerFailure)
+		return reply
+	}
+	resp.Id = q.msg.Id
+	if s.clientSubnet != nil {
+		restoreClientSubnet(q.msg, resp)
+	}
+	return resp
+}
+
+// exchange sends a query to an upstream, recording the latency of
+// successful exchanges
+func (s *Server) exchange(ctx context.Context, up *monitoredUpstream, msg *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := up.exchange(ctx, msg)
+	if err == nil {
+		s.metrics().upstreamLatency.Observe(time.Since(start))
+	}
+	if s.alerts != nil && ctx.Err() == nil {
+		s.alerts.observeUpstream(err)
+	}
+	return resp, err
+}
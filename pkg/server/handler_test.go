@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooks(t *testing.T) {
+	up := &ttlUpstream{ttl: 300}
+	var responses []string
+	s := &Server{
+		upstream: &monitoredUpstream{Resolver: up},
+		logger:   logrus.New(),
+		onQuery: func(client net.Addr, msg *dns.Msg) *dns.Msg {
+			switch msg.Question[0].Name {
+			case "vetoed.example.":
+				return new(dns.Msg).SetRcode(msg, dns.RcodeRefused)
+			case "alias.example.":
+				msg.Question[0].Name = "target.example."
+			}
+			return nil
+		},
+		onResponse: func(client net.Addr, query, reply *dns.Msg) {
+			responses = append(responses, client.String()+" "+query.Question[0].Name)
+			reply.Answer = append(reply.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{"hooked"},
+			})
+		},
+	}
+
+	resolve := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		return s.resolve(&query{msg: msg, client: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}})
+	}
+
+	reply := resolve("vetoed.example.")
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, int32(0), up.exchanges.Load())
+
+	reply = resolve("alias.example.")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Equal(t, "target.example.", reply.Question[0].Name)
+	assert.Len(t, reply.Answer, 2)
+	assert.Equal(t, int32(1), up.exchanges.Load())
+
+	assert.Equal(t, []string{"192.0.2.1:53 vetoed.example.", "192.0.2.1:53 target.example."}, responses)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/time/rate"
+)
+
+// handshakeSweepInterval is how often the limiters of source prefixes back
+// to a full budget are forgotten
+const handshakeSweepInterval = time.Minute
+
+// errHandshakeLimit refuses a connection over the handshake limits
+var errHandshakeLimit = errors.New("handshake rate limit exceeded")
+
+// HandshakeLimitConfig caps the new QUIC connections accepted per second,
+// so a handshake flood can't exhaust the CPU spent on TLS. Connections over
+// a limit are refused with CONNECTION_REFUSED before their handshake starts.
+type HandshakeLimitConfig struct {
+	// Rate is the number of new connections accepted per second across
+	// all clients, 0 for no limit
+	Rate int
+	// PrefixRate is the number of new connections accepted per second from
+	// a source prefix, 0 for no limit
+	PrefixRate int
+	// IPv4PrefixLen and IPv6PrefixLen group client addresses into source
+	// prefixes, /24 and /56 when zero
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+	// RetryOnly, when the global rate is exceeded, asks new clients to
+	// validate their address with a QUIC Retry instead of refusing them, and
+	// accepts the validated ones within their prefix rate. Spoofed floods
+	// then cost a stateless Retry instead of a handshake.
+	RetryOnly bool
+}
+
+// handshakeLimiter enforces the handshake limits of a server's QUIC
+// listeners
+type handshakeLimiter struct {
+	conf    HandshakeLimitConfig
+	global  *rate.Limiter
+	metrics *metrics
+
+	lock      sync.Mutex
+	prefixes  map[netip.Prefix]*rate.Limiter
+	lastSweep time.Time
+}
+
+// newHandshakeLimiter validates the handshake limits, or returns nil when
+// handshakes aren't limited
+func newHandshakeLimiter(c HandshakeLimitConfig, m *metrics) (*handshakeLimiter, error) {
+	if c.Rate < 0 || c.PrefixRate < 0 {
+		return nil, errors.New("handshake limit: rates must not be negative")
+	}
+	if c.IPv4PrefixLen == 0 {
+		c.IPv4PrefixLen = 24
+	}
+	if c.IPv6PrefixLen == 0 {
+		c.IPv6PrefixLen = 56
+	}
+	if c.IPv4PrefixLen < 0 || c.IPv4PrefixLen > 32 || c.IPv6PrefixLen < 0 || c.IPv6PrefixLen > 128 {
+		return nil, errors.New("handshake limit: invalid prefix length")
+	}
+	if c.RetryOnly && c.Rate == 0 {
+		return nil, errors.New("handshake limit: Retry-only mode needs a global rate")
+	}
+	if c.Rate == 0 && c.PrefixRate == 0 {
+		return nil, nil
+	}
+
+	l := &handshakeLimiter{
+		conf:      c,
+		metrics:   m,
+		prefixes:  map[netip.Prefix]*rate.Limiter{},
+		lastSweep: time.Now(),
+	}
+	if c.Rate > 0 {
+		l.global = rate.NewLimiter(rate.Limit(c.Rate), c.Rate)
+	}
+	return l, nil
+}
+
+// connContext is the quic-go ConnContext callback refusing connections over
+// the limits
+func (l *handshakeLimiter) connContext(ctx context.Context, info *quic.ClientInfo) (context.Context, error) {
+	if l.conf.PrefixRate > 0 && !l.allowPrefix(info.RemoteAddr) {
+		l.metrics.refusedHandshakes.Inc()
+		return ctx, errHandshakeLimit
+	}
+	if l.global != nil && !(l.conf.RetryOnly && info.AddrVerified) && !l.global.Allow() {
+		l.metrics.refusedHandshakes.Inc()
+		return ctx, errHandshakeLimit
+	}
+	return ctx, nil
+}
+
+// verifySourceAddress wraps a VerifySourceAddress callback, asking for a
+// Retry while the global rate is exceeded in Retry-only mode
+func (l *handshakeLimiter) verifySourceAddress(verify func(net.Addr) bool) func(net.Addr) bool {
+	if l == nil || !l.conf.RetryOnly {
+		return verify
+	}
+	return func(addr net.Addr) bool {
+		if verify != nil && verify(addr) {
+			return true
+		}
+		if l.global.Tokens() < 1 {
+			l.metrics.retries.Inc()
+			return true
+		}
+		return false
+	}
+}
+
+// allowPrefix takes a handshake from the budget of the source prefix of addr
+func (l *handshakeLimiter) allowPrefix(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return true
+	}
+	ip := ap.Addr().Unmap()
+	bits := l.conf.IPv6PrefixLen
+	if ip.Is4() {
+		bits = l.conf.IPv4PrefixLen
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > handshakeSweepInterval {
+		for p, limiter := range l.prefixes {
+			if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+				delete(l.prefixes, p)
+			}
+		}
+		l.lastSweep = now
+	}
+	limiter, ok := l.prefixes[prefix]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(l.conf.PrefixRate), l.conf.PrefixRate)
+		l.prefixes[prefix] = limiter
+	}
+	return limiter.AllowN(now, 1)
+}
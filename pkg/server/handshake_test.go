@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+func TestNewHandshakeLimiter(t *testing.T) {
+	l, err := newHandshakeLimiter(HandshakeLimitConfig{}, defaultMetrics())
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+	assert.Nil(t, l.verifySourceAddress(nil))
+
+	for _, c := range []HandshakeLimitConfig{
+		{Rate: -1},
+		{PrefixRate: 10, IPv4PrefixLen: 33},
+		{PrefixRate: 10, RetryOnly: true},
+	} {
+		_, err = newHandshakeLimiter(c, defaultMetrics())
+		assert.NotNil(t, err)
+	}
+}
+
+func TestHandshakePrefixRate(t *testing.T) {
+	l, err := newHandshakeLimiter(HandshakeLimitConfig{PrefixRate: 2}, defaultMetrics())
+	assert.Nil(t, err)
+	conn := func(ip string) error {
+		_, err := l.connContext(context.Background(), &quic.ClientInfo{RemoteAddr: &net.UDPAddr{IP: net.ParseIP(ip), Port: 443}})
+		return err
+	}
+
+	assert.Nil(t, conn("192.0.2.1"))
+	assert.Nil(t, conn("192.0.2.2"))
+	assert.Equal(t, errHandshakeLimit, conn("192.0.2.3"))
+	// Other prefixes have their own budget
+	assert.Nil(t, conn("198.51.100.1"))
+	assert.Nil(t, conn("2001:db8::1"))
+	assert.Nil(t, conn("2001:db8:0:ff::1"))
+	assert.Equal(t, errHandshakeLimit, conn("2001:db8::2"))
+}
+
+func TestHandshakeRetryOnly(t *testing.T) {
+	l, err := newHandshakeLimiter(HandshakeLimitConfig{Rate: 1, RetryOnly: true}, defaultMetrics())
+	assert.Nil(t, err)
+	verify := l.verifySourceAddress(nil)
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+
+	assert.False(t, verify(addr))
+	_, err = l.connContext(context.Background(), &quic.ClientInfo{RemoteAddr: addr})
+	assert.Nil(t, err)
+
+	// Under pressure, new clients are asked to Retry and validated ones
+	// accepted
+	assert.True(t, verify(addr))
+	_, err = l.connContext(context.Background(), &quic.ClientInfo{RemoteAddr: addr})
+	assert.Equal(t, errHandshakeLimit, err)
+	_, err = l.connContext(context.Background(), &quic.ClientInfo{RemoteAddr: addr, AddrVerified: true})
+	assert.Nil(t, err)
+}
+
+func TestHandshakeLimit(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr:     "127.0.0.1:0",
+		Cert:           testCertificate(t, "localhost"),
+		Resolver:       &ttlUpstream{ttl: 60},
+		HandshakeLimit: HandshakeLimitConfig{PrefixRate: 1},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = doqServer.Close() })
+	go doqServer.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conf := client.Config{Server: doqServer.Listener.Addr().String(), TLSSkipVerify: true}
+	c, err := client.NewContext(ctx, conf)
+	require.NoError(t, err)
+	_ = c.Close()
+	_, err = client.NewContext(ctx, conf)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstreamProbeInterval is how long an upstream health probe result is reused
+const upstreamProbeInterval = 5 * time.Second
+
+// Ready returns nil when the server is accepting QUIC connections, is not
+// draining, and its upstream answers queries
+func (s *Server) Ready(ctx context.Context) error {
+	select {
+	case <-s.draining:
+		return errors.New("server is draining")
+	default:
+	}
+	if s.accepting.Load() == 0 {
+		return errors.New("QUIC listener is not accepting connections")
+	}
+	return s.upstreamHealth(ctx)
+}
+
+// upstreamHealth probes the upstream with a root NS query, reusing the last
+// result for a short while so frequent readiness checks don't flood it. Any
+// response counts as healthy.
+func (s *Server) upstreamHealth(ctx context.Context) error {
+	s.probeLock.Lock()
+	defer s.probeLock.Unlock()
+	if !s.probedAt.IsZero() && time.Since(s.probedAt) < upstreamProbeInterval {
+		return s.probeErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	_, err := s.upstream.exchange(ctx, msg)
+	if err != nil {
+		err = errors.New("upstream " + s.upstream.String() + ": " + err.Error())
+	}
+	s.probedAt, s.probeErr = time.Now(), err
+	return err
+}
+
+// healthzHandler reports that the process is up
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// readyzHandler reports whether all servers are ready to answer queries
+func readyzHandler(servers []*Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, s := range servers {
+			if err := s.Ready(r.Context()); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+
+	doq "github.com/mosajjal/doqd"
+)
+
+// connectionDrainTimeout bounds how long a connection past its maximum age
+// waits for its queries in flight before closing
+const connectionDrainTimeout = 5 * time.Second
+
+// connectionAge returns the lifetime of a new connection, up to a tenth
+// shorter than the maximum so connections opened together do not all close
+// at once
+func connectionAge(maxAge time.Duration) time.Duration {
+	return maxAge - rand.N(maxAge/10+1)
+}
+
+// expireSession closes a connection that reached its maximum age with
+// DOQ_NO_ERROR, once its queries in flight are answered
+func expireSession(session *quic.Conn, active *atomic.Int64, sessionLog *logrus.Entry) {
+	sessionLog.Debug("closing connection at its maximum age")
+	closeWhenIdle(session, active, time.Now().Add(connectionDrainTimeout))
+}
+
+// closeGrace is how long a connection stays idle before being closed, so
+// the last responses are sent rather than discarded with the connection
+const closeGrace = 50 * time.Millisecond
+
+// closeWhenIdle closes a connection with DOQ_NO_ERROR once its queries in
+// flight are answered, or at the deadline when set
+func closeWhenIdle(session *quic.Conn, active *atomic.Int64, deadline time.Time) {
+	for session.Context().Err() == nil && (deadline.IsZero() || time.Now().Before(deadline)) {
+		if active.Load() == 0 {
+			time.Sleep(closeGrace)
+			if active.Load() == 0 {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = session.CloseWithError(doq.NoError, "")
+}
+
+// Shutdown gracefully stops the server, for rolling deploys behind anycast or
+// a load balancer: it stops accepting QUIC connections, closes idle DoQ
+// connections with DOQ_NO_ERROR and the others once their queries in flight
+// are answered, and closes the server once no connection is left. When ctx
+// is done first, the server is closed with the remaining connections and
+// ctx's error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drainOnce.Do(func() {
+		s.drainDeadline, _ = ctx.Deadline()
+		close(s.draining)
+	})
+	s.listenerLock.Lock()
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+	s.listenerLock.Unlock()
+	if s.doh3Server != nil {
+		// HTTP/3 clients are sent a GOAWAY
+		go func() { _ = s.doh3Server.Shutdown(ctx) }()
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+	for err == nil && s.connections.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	_ = s.Close()
+	return err
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+
+	doq "github.com/mosajjal/doqd"
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+func TestConnectionAge(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		age := connectionAge(time.Minute)
+		assert.LessOrEqual(t, age, time.Minute)
+		assert.GreaterOrEqual(t, age, 54*time.Second)
+	}
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr:       "localhost:8863",
+		Cert:             testCertificate(t, "localhost"),
+		Upstream:         "127.0.0.1:1",
+		Rewrites:         map[string]string{"whoami.test": "192.0.2.1"},
+		MaxConnectionAge: 300 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+
+	doqClient, err := client.New(client.Config{Server: "localhost:8863", TLSSkipVerify: true})
+	assert.Nil(t, err)
+	req := dns.Msg{}
+	req.SetQuestion("whoami.test.", dns.TypeA)
+	req.Id = 0
+	_, err = doqClient.SendQuery(req)
+	assert.Nil(t, err)
+
+	select {
+	case <-doqClient.Session.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	var appErr *quic.ApplicationError
+	if assert.True(t, errors.As(context.Cause(doqClient.Session.Context()), &appErr)) {
+		assert.Equal(t, quic.ApplicationErrorCode(doq.NoError), appErr.ErrorCode)
+		assert.True(t, appErr.Remote)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		addr      string
+		keepAlive time.Duration
+	}{
+		{addr: "localhost:8864"},
+		{addr: "localhost:8865", keepAlive: 100 * time.Millisecond},
+	} {
+		doqServer, err := New(Config{
+			ListenAddr:      tc.addr,
+			Cert:            testCertificate(t, "localhost"),
+			Upstream:        "127.0.0.1:1",
+			Rewrites:        map[string]string{"whoami.test": "192.0.2.1"},
+			IdleTimeout:     300 * time.Millisecond,
+			KeepAlivePeriod: tc.keepAlive,
+		})
+		assert.Nil(t, err)
+		go doqServer.Listen()
+
+		doqClient, err := client.New(client.Config{Server: tc.addr, TLSSkipVerify: true})
+		assert.Nil(t, err)
+		time.Sleep(time.Second)
+
+		// The server drops idle connections silently, so the query goes unanswered
+		req := dns.Msg{}
+		req.SetQuestion("whoami.test.", dns.TypeA)
+		req.Id = 0
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		_, err = doqClient.SendQueryContext(ctx, req)
+		cancel()
+		if tc.keepAlive > 0 {
+			assert.Nil(t, err)
+		} else {
+			assert.NotNil(t, err)
+		}
+		_ = doqClient.Close()
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr: "localhost:8868",
+		Cert:       testCertificate(t, "localhost"),
+		Resolver:   &slowUpstream{},
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+
+	for _, abort := range []bool{false, true} {
+		doqClient, err := client.New(client.Config{Server: "localhost:8868", TLSSkipVerify: true})
+		assert.Nil(t, err)
+
+		errs := make(chan error)
+		go func() {
+			req := dns.Msg{}
+			req.SetQuestion("example.com.", dns.TypeA)
+			req.Id = 0
+			_, err := doqClient.SendQuery(req)
+			errs <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		if abort {
+			assert.Nil(t, doqClient.Abort())
+			assert.NotNil(t, <-errs)
+		} else {
+			// The query in flight is answered before the connection closes
+			assert.Nil(t, doqClient.Close())
+			assert.Nil(t, <-errs)
+		}
+
+		var appErr *quic.ApplicationError
+		if assert.True(t, errors.As(context.Cause(doqClient.Session.Context()), &appErr)) {
+			assert.Equal(t, quic.ApplicationErrorCode(doq.NoError), appErr.ErrorCode)
+			assert.False(t, appErr.Remote)
+		}
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr:       "localhost:8872",
+		Cert:             testCertificate(t, "localhost"),
+		Upstream:         "127.0.0.1:1",
+		Rewrites:         map[string]string{"whoami.test": "192.0.2.1"},
+		MaxConnectionAge: 300 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+
+	doqClient, err := client.New(client.Config{Server: "localhost:8872", TLSSkipVerify: true, Reconnect: true})
+	assert.Nil(t, err)
+	select {
+	case <-doqClient.Session.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+
+	// The query fails over the closed connection and is retried over a new one
+	req := dns.Msg{}
+	req.SetQuestion("whoami.test.", dns.TypeA)
+	req.Id = 0
+	_, err = doqClient.SendQuery(req)
+	assert.Nil(t, err)
+	assert.NotEqual(t, doqClient.Session, doqClient.Conn())
+
+	assert.Nil(t, doqClient.Close())
+	_, err = doqClient.SendQuery(req)
+	assert.NotNil(t, err)
+}
+
+func TestClientMigrate(t *testing.T) {
+	clients := make(chan string, 2)
+	doqServer, err := New(Config{
+		ListenAddr: "localhost:8873",
+		Cert:       testCertificate(t, "localhost"),
+		Upstream:   "127.0.0.1:1",
+		Rewrites:   map[string]string{"whoami.test": "192.0.2.1"},
+		OnQuery: func(client net.Addr, _ *dns.Msg) *dns.Msg {
+			clients <- client.String()
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+
+	doqClient, err := client.New(client.Config{Server: "localhost:8873", TLSSkipVerify: true})
+	assert.Nil(t, err)
+	req := dns.Msg{}
+	req.SetQuestion("whoami.test.", dns.TypeA)
+	req.Id = 0
+	_, err = doqClient.SendQuery(req)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, doqClient.Migrate(ctx))
+
+	// The same connection carries queries from the new socket
+	_, err = doqClient.SendQuery(req)
+	assert.Nil(t, err)
+	assert.Equal(t, doqClient.Session, doqClient.Conn())
+	assert.NotEqual(t, <-clients, <-clients)
+	assert.Nil(t, doqClient.Close())
+}
+
+func TestClientResolver(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr:       "127.0.0.1:0",
+		Cert:             testCertificate(t, "localhost"),
+		Upstream:         "127.0.0.1:1",
+		Rewrites:         map[string]string{"whoami.test": "192.0.2.1"},
+		MaxConnectionAge: 300 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+	defer doqServer.Close()
+
+	resolver := client.NewResolver(client.ResolverConfig{
+		Config: client.Config{Server: doqServer.Listener.Addr().String(), TLSSkipVerify: true},
+	})
+	assert.Equal(t, int64(0), doqServer.Stats().Connections)
+
+	// Concurrent first queries share a single connection
+	req := new(dns.Msg)
+	req.SetQuestion("whoami.test.", dns.TypeA)
+	req.Id = 0
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := resolver.Query(context.Background(), req)
+			if assert.Nil(t, err) {
+				assert.Len(t, resp.Answer, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), doqServer.Stats().Connections)
+
+	// A new connection is opened once the server closed it
+	assert.Eventually(t, func() bool { return doqServer.Stats().Connections == 0 }, 5*time.Second, 10*time.Millisecond)
+	_, err = resolver.Query(context.Background(), req)
+	assert.Nil(t, err)
+
+	assert.Nil(t, resolver.Close())
+	_, err = resolver.Query(context.Background(), req)
+	assert.NotNil(t, err)
+}
+
+func TestShutdown(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Cert:       testCertificate(t, "localhost"),
+		Resolver:   &slowUpstream{},
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+	addr := doqServer.Listener.Addr().String()
+
+	busy, err := client.New(client.Config{Server: addr, TLSSkipVerify: true})
+	assert.Nil(t, err)
+	idle, err := client.New(client.Config{Server: addr, TLSSkipVerify: true})
+	assert.Nil(t, err)
+
+	// The query in flight during the drain is answered
+	req := dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 0
+	answered := make(chan error, 1)
+	go func() {
+		_, err := busy.SendQuery(req)
+		answered <- err
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, doqServer.Shutdown(ctx))
+	assert.Nil(t, <-answered)
+	assert.NotNil(t, doqServer.Ready(ctx))
+
+	for _, c := range []client.Client{busy, idle} {
+		var appErr *quic.ApplicationError
+		if assert.True(t, errors.As(context.Cause(c.Session.Context()), &appErr)) {
+			assert.Equal(t, quic.ApplicationErrorCode(doq.NoError), appErr.ErrorCode)
+		}
+	}
+	dialCtx, cancelDial := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancelDial()
+	_, err = client.NewContext(dialCtx, client.Config{Server: addr, TLSSkipVerify: true})
+	assert.NotNil(t, err)
+}
+
+func TestMaxConnectionQueries(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr:           "127.0.0.1:0",
+		Cert:                 testCertificate(t, "localhost"),
+		Upstream:             "127.0.0.1:1",
+		Rewrites:             map[string]string{"whoami.test": "192.0.2.1"},
+		MaxConnectionQueries: 3,
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+	defer doqServer.Close()
+
+	doqClient, err := client.New(client.Config{Server: doqServer.Listener.Addr().String(), TLSSkipVerify: true})
+	assert.Nil(t, err)
+	req := dns.Msg{}
+	req.SetQuestion("whoami.test.", dns.TypeA)
+	req.Id = 0
+	for i := 0; i < 3; i++ {
+		_, err = doqClient.SendQuery(req)
+		assert.Nil(t, err)
+	}
+
+	select {
+	case <-doqClient.Session.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	var appErr *quic.ApplicationError
+	if assert.True(t, errors.As(context.Cause(doqClient.Session.Context()), &appErr)) {
+		assert.Equal(t, quic.ApplicationErrorCode(doq.NoError), appErr.ErrorCode)
+	}
+
+	_, err = New(Config{ListenAddr: "127.0.0.1:0", Cert: testCertificate(t, "localhost"), Upstream: "127.0.0.1:1", MaxConnectionQueries: -1})
+	assert.NotNil(t, err)
+}
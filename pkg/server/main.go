@@ -2,109 +2,855 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"io"
 	"net"
+	"os"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/quic-go/quic-go"
-
-	"log"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/sirupsen/logrus"
 
 	doq "github.com/mosajjal/doqd"
+	"github.com/mosajjal/doqd/pkg/codec"
+	"github.com/mosajjal/doqd/pkg/upstream"
 )
 
 // Server stores a DoQ server
 type Server struct {
 	Upstream string
 	Listener quic.Listener
-	Debug    bool
+
+	logger *logrus.Logger
+	// listenerLock guards the listeners and transports, which Serve adds
+	// to after construction
+	listenerLock      sync.Mutex
+	listeners         []*quic.Listener
+	transports        []*quic.Transport
+	transportSettings transportSettings
+	tlsConf           *tls.Config
+	quicConf          *quic.Config
+	alpn              []string // accepted on the QUIC listeners
+	frontends         []frontend
+	doh3Server        *http3.Server
+
+	upstream *monitoredUpstream
+	inflight inflightGroup
+	cache    Cache
+	// cacheScopes are the client subnet scopes of the cached answers
+	cacheScopes scopeLengths
+
+	rotateAnswers bool
+	// rotation counts the answers rotated by rotateAnswers
+	rotation atomic.Uint64
+
+	maxConnectionAge time.Duration
+	maxConnQueries   int
+	shaper           *shaper
+	maxQuerySize     int
+
+	nsid          string
+	chaosVersion  string
+	chaosHostname string
+
+	queryLog  *queryLog
+	alerts    *Alerter
+	capture   *Capture
+	top       *topTracker
+	uniques   *uniqueClients
+	blocker   *blocker
+	rewriter  *rewriter
+	views     []*view
+	tenants   *tenants
+	geo       *geoSelector
+	rebinding *rebindingFilter
+	tunneling *tunnelingDetector
+	reverse   *privateReverse
+	primary   *primary
+
+	ednsPolicy   *ednsPolicy
+	clientSubnet *clientSubnetPolicy
+
+	onQuery    func(client net.Addr, msg *dns.Msg) *dns.Msg
+	onResponse func(client net.Addr, query, reply *dns.Msg)
+	rawHandler func(ctx context.Context, client net.Addr, query []byte) ([]byte, error)
+
+	metricSet   *metrics
+	accepting   atomic.Int32
+	connections atomic.Int64
+	streams     atomic.Int64
+	inFlight    atomic.Int64
+	queries     atomic.Uint64
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+	probeLock   sync.Mutex
+	probedAt    time.Time
+	probeErr    error
+
+	done      chan struct{}
+	closeOnce sync.Once
+	// draining is closed when Shutdown starts, asking connections to close
+	// once idle, by drainDeadline when set
+	draining      chan struct{}
+	drainOnce     sync.Once
+	drainDeadline time.Time
 }
 
 type Config struct {
 	ListenAddr string
 	Cert       tls.Certificate
-	Upstream   string
-	TLSCompat  bool
-	Debug      bool
+	// Upstream is a plain DNS resolver host:port queried over UDP, or a URL
+	// such as tls://host:port, quic://host:port, https://host/dns-query or
+	// odoh://target/path?relay=https://relay/path, see upstream.New.
+	// Encrypted upstreams accept name, ca, pin and insecure URL parameters
+	// controlling certificate verification.
+	Upstream string
+	// Resolver, when set, answers queries instead of Upstream, so any backend
+	// can be served behind the server's front-ends
+	Resolver  upstream.Resolver
+	TLSCompat bool
+	// ALPN lists the DoQ ALPN tokens accepted, in order of preference,
+	// instead of doq.TlsProtos, or doq.TlsProtosCompat with TLSCompat.
+	// Datagrams and DoH3 add their own. Connections offering none of them
+	// are refused with a no_application_protocol TLS alert.
+	ALPN []string
+	// Debug enables debug logging on the default logger. It is ignored when
+	// Logger is set.
+	Debug bool
+	// Logger receives the server's log output, with per-stream events
+	// logged at trace level
+	Logger *logrus.Logger
+
+	// DoTListenAddr, when set, also serves DNS over TLS on this TCP address
+	// using the same certificate and backend
+	DoTListenAddr string
+	// DoHListenAddr, when set, also serves DNS over HTTPS at /dns-query on
+	// this TCP address using the same certificate and backend
+	DoHListenAddr string
+	// Do53ListenAddr, when set, also serves plain DNS over UDP and TCP on
+	// this address using the same backend
+	Do53ListenAddr string
+	// DoH3 also serves DNS over HTTP/3 at /dns-query on the DoQ listener,
+	// selecting the protocol per connection by its ALPN
+	DoH3 bool
+	// Datagrams enables the experimental doq-dgram-exp mode on the DoQ
+	// listener for clients offering it, answering queries that fit in a
+	// single packet in QUIC DATAGRAM frames
+	Datagrams bool
+
+	// NSID is the server identifier returned to queries carrying the NSID
+	// EDNS option (RFC 5001). When empty, the upstream's NSID is passed through.
+	NSID string
+	// ChaosVersion and ChaosHostname answer version.bind and hostname.bind
+	// TXT queries in the CHAOS class. CHAOS queries are never forwarded, and
+	// are refused when the matching string is empty.
+	ChaosVersion  string
+	ChaosHostname string
+
+	// SocketBufferSize is the receive and send buffer size requested for the
+	// QUIC listener's UDP socket, 8 MiB when zero
+	SocketBufferSize int
+	// DisableGSO and DisableECN turn off quic-go's UDP segmentation offload
+	// and ECN support for every QUIC socket in the process, for kernels or
+	// network paths that mishandle them
+	DisableGSO bool
+	DisableECN bool
+
+	// Socket controls how every listener is bound on multi-homed hosts
+	Socket SocketConfig
+
+	// ReusePortListeners opens this many QUIC listeners on ListenAddr with
+	// SO_REUSEPORT, each with its own accept loop, to spread load across
+	// cores. Values above 1 are only supported on Linux.
+	ReusePortListeners int
+
+	// ForceRetry requires every client to validate its address with a QUIC
+	// Retry before the handshake, costing a round trip. RetryAboveRate only
+	// does so above this many new connection attempts per second, to defend
+	// against handshake floods from spoofed addresses. Until an address is
+	// validated, the server sends at most three times the data it received.
+	ForceRetry     bool
+	RetryAboveRate int
+	// TokenLifetime is how long address validation tokens handed to clients
+	// for future connections stay valid, 24 hours when zero
+	TokenLifetime time.Duration
+	// HandshakeLimit caps the new QUIC connections accepted per second,
+	// globally and per source prefix
+	HandshakeLimit HandshakeLimitConfig
+
+	// MaxConnectionAge, when set, closes DoQ connections with DOQ_NO_ERROR
+	// after about this long, once their queries in flight are answered, so
+	// clients reconnect and rebalance instead of pinning a draining node
+	MaxConnectionAge time.Duration
+	// MaxConnectionQueries, when set, closes DoQ connections with
+	// DOQ_NO_ERROR after this many queries, once they are answered, bounding
+	// the state held for a single client and spreading clients across nodes
+	MaxConnectionQueries int
+	// Shaping caps the size and rate of the responses sent over each DoQ
+	// connection
+	Shaping ShapingConfig
+	// MaxQuerySize is the largest message in bytes accepted from DoQ and DoH
+	// clients, 4096 when zero. DoQ streams carrying a larger one are reset
+	// with DOQ_PROTOCOL_ERROR as soon as its size is known, and DoH requests
+	// are answered with 413.
+	MaxQuerySize int
+
+	// UpstreamProbeInterval, when set, probes what plain DNS upstreams
+	// support at startup and at this interval: EDNS, the largest UDP answer
+	// size, TCP and DoT. Queries then avoid what an upstream mishandles,
+	// e.g. going over TCP to one dropping EDNS, and the results are shown in
+	// Stats.
+	UpstreamProbeInterval time.Duration
+
+	// Cache, when set, stores upstream responses until their TTL expires and
+	// may be shared between servers. Otherwise, CacheSize is the number of
+	// responses kept in memory, 0 disabling the cache.
+	Cache     Cache
+	CacheSize int
+	// RotateAnswers rotates the order of the A and AAAA records of every
+	// answer served from the cache
+	RotateAnswers bool
+
+	// Blocking configures blocklists and their exceptions
+	Blocking BlockingConfig
+	// Rewrites answers names, or *. wildcards matching the names below a
+	// domain, with comma separated IP addresses, or with the answer for
+	// another name behind a CNAME
+	Rewrites map[string]string
+	// Views apply other policies to some clients, the first matching view
+	// is used
+	Views []ViewConfig
+	// Tenants host other resolvers, with their own certificate and policy,
+	// for the TLS server names clients connect to. A tenant's policy takes
+	// precedence over views.
+	Tenants []TenantConfig
+	// GeoIP orders answers by how close they are to the client
+	GeoIP GeoIPConfig
+	// Rebinding protects clients from public names resolving to private
+	// addresses
+	Rebinding RebindingConfig
+	// Tunneling flags queries of suspected DNS tunnels and generated names,
+	// and may refuse them or limit their clients
+	Tunneling TunnelingConfig
+	// PrivateReverse answers reverse lookups of private addresses locally
+	PrivateReverse PrivateReverseConfig
+	// Primary forwards NOTIFY and dynamic UPDATE messages to a primary server.
+	// Without it they are answered with NOTIMP.
+	Primary PrimaryConfig
+	// EDNSOptions selects the EDNS options of client queries forwarded
+	// upstream
+	EDNSOptions EDNSOptionsConfig
+	// ClientSubnet strips, truncates or injects the EDNS Client Subnet of
+	// queries sent upstream
+	ClientSubnet ClientSubnetConfig
+
+	// OnQuery, when set, is called with every query from every front-end
+	// before it is resolved. It may modify the query, and answers it instead
+	// of the server by returning a reply, e.g. to veto it with REFUSED.
+	OnQuery func(client net.Addr, msg *dns.Msg) *dns.Msg
+	// OnResponse, when set, is called with every reply before it is written
+	// to the client, and may modify it
+	OnResponse func(client net.Addr, query, reply *dns.Msg)
+	// RawHandler, when set, answers DoQ queries in wire format instead of the
+	// server's resolver, for proxies relaying packed messages without
+	// unpacking them. An error resets the stream with DOQ_INTERNAL_ERROR.
+	// Queries on other front-ends are resolved as usual.
+	RawHandler func(ctx context.Context, client net.Addr, query []byte) ([]byte, error)
+
+	// QueryLog configures logging of every answered query
+	QueryLog QueryLogConfig
+
+	// Alerts, when set, counts the server's queries and watches its
+	// certificates, notifying a webhook or command when error rates, client
+	// query rates or certificate expiry cross thresholds. Servers can share
+	// an Alerter, which they don't close.
+	Alerts *Alerter
+
+	// Registerer receives the server's metrics, the default Prometheus
+	// registry when nil. Metrics are named <MetricsNamespace>_<metric>, with
+	// doqd as the default namespace, and carry MetricsLabels, e.g. to tell
+	// servers sharing a registry apart. Servers with the same registry,
+	// namespace and labels share their metrics.
+	Registerer       prometheus.Registerer
+	MetricsNamespace string
+	MetricsLabels    prometheus.Labels
+	// Metrics, when set, receives the server's metrics instead of
+	// Prometheus, e.g. a StatsDSink, and Registerer, MetricsNamespace and
+	// MetricsLabels are ignored
+	Metrics MetricsSink
+
+	// ClientCAs, when set, requires clients to present a certificate signed
+	// by one of these CAs
+	ClientCAs *x509.CertPool
+	// ClientFingerprintsFile, when set, only accepts clients presenting a
+	// certificate whose SHA-256 fingerprint, or that of its public key, is
+	// listed in this file, one hex fingerprint per line. Self-signed client
+	// certificates are accepted unless ClientCAs is also set. Changes to the
+	// file apply to new connections without a restart.
+	ClientFingerprintsFile string
+
+	// QlogDir, when set, receives a qlog trace of every QUIC connection
+	QlogDir string
+	// KeyLogWriter, when set, receives TLS secrets in NSS key log format so
+	// captured traffic can be decrypted. It compromises security and should
+	// only be used for debugging.
+	KeyLogWriter io.Writer
+	// Capture, when set, records the decrypted DNS messages exchanged with
+	// clients, for debugging
+	Capture *Capture
+	// Top tracks the most queried names and busiest clients, served at /top
+	// on the admin listener
+	Top TopConfig
+	// UniqueClientsWindow, when set, estimates the number of distinct client
+	// addresses seen over each window of this length without keeping them,
+	// exported as the unique_clients gauge when the window ends
+	UniqueClientsWindow time.Duration
+
+	// IdleTimeout closes DoQ connections without activity for this long,
+	// 30 seconds when zero and QUICConfig sets none. Clients keeping warm
+	// connections (RFC 9250 5.5) need it longer than their query interval.
+	IdleTimeout time.Duration
+	// KeepAlivePeriod, when set, has the server send keep-alive PINGs on idle
+	// connections, keeping them open until the client closes them
+	KeepAlivePeriod time.Duration
+
+	// QUICConfig is passed through to the QUIC listener. When nil, a default
+	// config is used.
+	QUICConfig *quic.Config
+}
+
+// logger returns the configured logger, or a default one honouring Debug
+func (c Config) logger() *logrus.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	logger := logrus.New()
+	if c.Debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	return logger
 }
 
+// defaultIdleTimeout is the idle timeout of DoQ connections when none is
+// configured
+const defaultIdleTimeout = 30 * time.Second
+
 // New constructs a new Server
 func New(c Config) (*Server, error) {
+	return newServer(c, nil)
+}
+
+// newServer constructs a Server accepting DoQ connections on transport, or
+// on its own sockets bound to ListenAddr when nil
+func newServer(c Config, transport *quic.Transport) (*Server, error) {
+	up := c.Resolver
+	if up == nil {
+		var err error
+		if up, err = upstream.New(c.Upstream); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.Socket.validate(); err != nil {
+		return nil, err
+	}
+	var m *metrics
+	switch {
+	case c.Metrics != nil:
+		m = newMetrics(c.Metrics)
+	case c.Registerer != nil || c.MetricsNamespace != "" || len(c.MetricsLabels) > 0:
+		sink, err := NewPrometheusSink(c.Registerer, c.MetricsNamespace, c.MetricsLabels)
+		if err != nil {
+			return nil, err
+		}
+		m = newMetrics(sink)
+	default:
+		m = defaultMetrics()
+	}
+	ql, err := newQueryLog(c.QueryLog, c.logger())
+	if err != nil {
+		return nil, err
+	}
+	if c.Alerts != nil {
+		if err := c.Alerts.watchCertificate("", c.Cert); err != nil {
+			return nil, err
+		}
+		for _, t := range c.Tenants {
+			if err := c.Alerts.watchCertificate("tenant "+t.Name, t.Cert); err != nil {
+				return nil, err
+			}
+		}
+	}
+	blocker, err := newBlocker(c.Blocking)
+	if err != nil {
+		return nil, err
+	}
+	rw, err := newRewriter(c.Rewrites)
+	if err != nil {
+		return nil, err
+	}
+	geo, err := newGeoSelector(c.GeoIP)
+	if err != nil {
+		return nil, err
+	}
+	rebinding, err := newRebindingFilter(c.Rebinding)
+	if err != nil {
+		return nil, err
+	}
+	tunneling, err := newTunnelingDetector(c.Tunneling)
+	if err != nil {
+		return nil, err
+	}
+	reverse, err := newPrivateReverse(c.PrivateReverse)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := newPrimary(c.Primary)
+	if err != nil {
+		return nil, err
+	}
+	ednsPolicy, err := newEDNSPolicy(c.EDNSOptions)
+	if err != nil {
+		return nil, err
+	}
+	clientSubnet, err := newClientSubnetPolicy(c.ClientSubnet)
+	if err != nil {
+		return nil, err
+	}
+	shaper, err := newShaper(c.Shaping)
+	if err != nil {
+		return nil, err
+	}
+	top, err := newTopTracker(c.Top)
+	if err != nil {
+		return nil, err
+	}
+	uniques, err := newUniqueClients(c.UniqueClientsWindow, m.uniqueClients)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxConnectionQueries < 0 {
+		return nil, errors.New("max connection queries must not be negative")
+	}
+	if c.MaxQuerySize < 0 {
+		return nil, errors.New("max query size must not be negative")
+	}
+	if c.MaxQuerySize == 0 {
+		c.MaxQuerySize = defaultMaxQuerySize
+	}
+	monitored := &monitoredUpstream{Resolver: up}
+	views, err := newViews(c.Views, monitored)
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := newTenants(c.Tenants, monitored)
+	if err != nil {
+		return nil, err
+	}
+
 	// Select TLS protocols for DoQ
-	var tlsProtos []string
-	if c.TLSCompat {
-		tlsProtos = doq.TlsProtosCompat
-	} else {
-		tlsProtos = doq.TlsProtos
+	tlsProtos, err := doq.Protos(c.ALPN, c.TLSCompat)
+	if err != nil {
+		return nil, errors.New("alpn: " + err.Error())
+	}
+	if c.DoH3 {
+		tlsProtos = append(tlsProtos, http3.NextProtoH3)
+	}
+	if c.Datagrams {
+		// First, as the server's preference selects the protocol
+		tlsProtos = append([]string{doq.TlsProtoDatagram}, tlsProtos...)
+	}
+
+	quicConf := &quic.Config{MaxIdleTimeout: defaultIdleTimeout}
+	if c.QUICConfig != nil {
+		quicConf = c.QUICConfig.Clone()
+	}
+	if c.IdleTimeout > 0 {
+		quicConf.MaxIdleTimeout = c.IdleTimeout
+	}
+	if c.KeepAlivePeriod > 0 {
+		quicConf.KeepAlivePeriod = c.KeepAlivePeriod
+	}
+	quicConf.EnableDatagrams = quicConf.EnableDatagrams || c.Datagrams
+	if c.QlogDir != "" {
+		if err := os.MkdirAll(c.QlogDir, 0o755); err != nil {
+			return nil, errors.New("create qlog directory: " + err.Error())
+		}
+		quicConf.Tracer = doq.QlogTracer(c.QlogDir)
 	}
 
-	// Create QUIC listener
-	listener, err := quic.ListenAddr(c.ListenAddr, &tls.Config{
+	logger := c.logger()
+	setOffloadOptions(c.DisableGSO, c.DisableECN)
+
+	bufSize := c.SocketBufferSize
+	if bufSize == 0 {
+		bufSize = defaultSocketBufferSize
+	}
+	s := &Server{
+		Upstream:         c.Upstream,
+		logger:           logger,
+		upstream:         monitored,
+		cache:            c.Cache,
+		rotateAnswers:    c.RotateAnswers,
+		nsid:             c.NSID,
+		chaosVersion:     c.ChaosVersion,
+		chaosHostname:    c.ChaosHostname,
+		queryLog:         ql,
+		alerts:           c.Alerts,
+		capture:          c.Capture,
+		top:              top,
+		uniques:          uniques,
+		blocker:          blocker,
+		rewriter:         rw,
+		views:            views,
+		tenants:          tenants,
+		geo:              geo,
+		rebinding:        rebinding,
+		tunneling:        tunneling,
+		reverse:          reverse,
+		primary:          primary,
+		ednsPolicy:       ednsPolicy,
+		clientSubnet:     clientSubnet,
+		onQuery:          c.OnQuery,
+		onResponse:       c.OnResponse,
+		rawHandler:       c.RawHandler,
+		maxConnectionAge: c.MaxConnectionAge,
+		maxConnQueries:   c.MaxConnectionQueries,
+		shaper:           shaper,
+		maxQuerySize:     c.MaxQuerySize,
+		done:             make(chan struct{}),
+		draining:         make(chan struct{}),
+		metricSet:        m,
+	}
+	if s.cache == nil && c.CacheSize > 0 {
+		s.cache = newMemoryCache(c.CacheSize, m)
+	}
+
+	// Create QUIC listeners, sharing the address with SO_REUSEPORT when
+	// there is more than one
+	baseTLSConf := &tls.Config{
 		Certificates: []tls.Certificate{c.Cert},
-		NextProtos:   tlsProtos,
-	}, &quic.Config{MaxIdleTimeout: 5 * time.Second})
+		KeyLogWriter: c.KeyLogWriter,
+	}
+	if tenants != nil {
+		baseTLSConf.GetCertificate = tenants.getCertificate
+	}
+	if c.ClientCAs != nil {
+		baseTLSConf.ClientCAs = c.ClientCAs
+		baseTLSConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if c.ClientFingerprintsFile != "" {
+		allowlist, err := newFingerprintAllowlist(c.ClientFingerprintsFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		if baseTLSConf.ClientAuth == tls.NoClientCert {
+			baseTLSConf.ClientAuth = tls.RequireAnyClientCert
+		}
+		baseTLSConf.VerifyConnection = allowlist.verifyConnection
+	}
+	tlsConf := baseTLSConf.Clone()
+	tlsConf.NextProtos = tlsProtos
+	tlsConf.GetConfigForClient = s.checkALPN
+	s.alpn = tlsProtos
+	reusePort := c.ReusePortListeners > 1
+
+	// Listeners sharing the address also share address validation state
+	var tokenKey quic.TokenGeneratorKey
+	if _, err := rand.Read(tokenKey[:]); err != nil {
+		return nil, errors.New("generate token key: " + err.Error())
+	}
+	verifySourceAddress := newSourceAddressVerifier(c.ForceRetry, c.RetryAboveRate, m)
+	handshakes, err := newHandshakeLimiter(c.HandshakeLimit, m)
 	if err != nil {
-		return nil, errors.New("could not start QUIC listener: " + err.Error())
+		return nil, err
+	}
+	verifySourceAddress = handshakes.verifySourceAddress(verifySourceAddress)
+	s.transportSettings = transportSettings{
+		tokenKey:            &tokenKey,
+		tokenLifetime:       c.TokenLifetime,
+		verifySourceAddress: verifySourceAddress,
+	}
+	if handshakes != nil {
+		s.transportSettings.connContext = handshakes.connContext
+	}
+	s.tlsConf, s.quicConf = tlsConf, quicConf
+
+	if transport != nil {
+		// The caller's transport is shared with other protocols, only the
+		// listener is the server's
+		s.transportSettings.apply(transport)
+		listener, err := transport.Listen(tlsConf, quicConf)
+		if err != nil {
+			return nil, errors.New("could not start QUIC listener: " + err.Error())
+		}
+		s.listeners = append(s.listeners, listener)
 	}
+	listenAddr := c.ListenAddr
+	for i := 0; transport == nil && i < max(c.ReusePortListeners, 1); i++ {
+		conn, err := listenUDP(listenAddr, c.Socket, bufSize, reusePort, logger)
+		if err != nil {
+			s.closeListeners()
+			return nil, errors.New("could not start QUIC listener: " + err.Error())
+		}
+		listenAddr = conn.LocalAddr().String() // Resolve a zero port once
 
-	return &Server{Listener: *listener, Upstream: c.Upstream}, nil // nil error
+		if _, err := s.listen(conn); err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+	}
+	s.Listener = *s.listeners[0]
+
+	if c.DoTListenAddr != "" {
+		f, err := newDoTServer(c.DoTListenAddr, c.Socket, baseTLSConf, dns.HandlerFunc(s.serveDoT))
+		if err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+		s.frontends = append(s.frontends, f)
+	}
+
+	if c.DoHListenAddr != "" {
+		f, err := newDoHServer(c.DoHListenAddr, c.Socket, baseTLSConf, s.dohHandler(transportDoH))
+		if err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+		s.frontends = append(s.frontends, f)
+	}
+
+	if c.DoH3 {
+		s.doh3Server = newDoH3Server(s.dohHandler(transportDoH3))
+	}
+
+	if c.Do53ListenAddr != "" {
+		fs, err := newDo53Servers(c.Do53ListenAddr, c.Socket, dns.HandlerFunc(s.serveDo53))
+		if err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+		s.frontends = append(s.frontends, fs...)
+	}
+
+	if c.UpstreamProbeInterval > 0 {
+		go s.probeUpstreams(c.UpstreamProbeInterval)
+	}
+	if s.uniques != nil {
+		go s.countUniqueClients()
+	}
+	return s, nil // nil error
 }
 
-// Listen starts accepting QUIC connections
+// Listen starts any additional front-ends in the background and accepts QUIC
+// connections until the listeners are closed
 func (s *Server) Listen() {
-	// Accept QUIC connections
+	for _, f := range s.frontends {
+		go func(f frontend) {
+			if err := f.serve(); err != nil {
+				s.logger.Warnf("%s server: %v", f, err)
+			}
+		}(f)
+	}
+
+	s.listenerLock.Lock()
+	listeners := s.listeners[1:]
+	s.listenerLock.Unlock()
+	for _, l := range listeners {
+		go s.accept(l)
+	}
+	s.accept(&s.Listener)
+}
+
+// accept accepts QUIC connections on a listener until it is closed
+func (s *Server) accept(listener *quic.Listener) {
+	s.accepting.Add(1)
+	defer s.accepting.Add(-1)
 	for {
-		session, err := s.Listener.Accept(context.Background())
+		session, err := listener.Accept(context.Background())
 		if err != nil {
-			if s.Debug {
-				log.Printf("QUIC accept: %v", err)
-			}
+			s.logger.Debugf("QUIC accept: %v", err)
 			break
+		} else if proto := session.ConnectionState().TLS.NegotiatedProtocol; !slices.Contains(s.alpn, proto) {
+			// Never negotiated by crypto/tls, refused all the same. The
+			// client was counted by checkALPN.
+			s.logger.Debugf("QUIC accept: %s negotiated unexpected ALPN %q", session.RemoteAddr(), proto)
+			_ = session.CloseWithError(doq.ProtocolError, "unexpected ALPN")
+		} else if s.doh3Server != nil && proto == http3.NextProtoH3 {
+			// Hand HTTP/3 connections sharing the socket to the DoH3 server
+			go s.serveDoH3(session)
 		} else {
 			// Handle QUIC session in a new goroutine
-			go s.handleDoQSession(session, s.Upstream)
+			go s.handleDoQSession(session)
+		}
+	}
+}
+
+// checkALPN is the GetConfigForClient callback of the QUIC listeners,
+// counting clients offering none of the accepted ALPN tokens, which
+// crypto/tls then refuses with a no_application_protocol alert
+func (s *Server) checkALPN(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	for _, proto := range hello.SupportedProtos {
+		if slices.Contains(s.alpn, proto) {
+			return nil, nil
 		}
 	}
+	s.metrics().alpnRejected.Inc()
+	if hello.Conn != nil {
+		s.logger.Debugf("QUIC handshake: %s offered none of the accepted ALPN tokens %q, only %q", hello.Conn.RemoteAddr(), s.alpn, hello.SupportedProtos)
+	}
+	return nil, nil
+}
+
+// Close stops the server, closing its listeners, front-ends and the
+// connections they carry
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.closeListeners()
+	if s.queryLog != nil {
+		s.queryLog.close()
+	}
+	return nil
+}
+
+// closeListeners closes the QUIC listeners and all additional front-ends
+func (s *Server) closeListeners() {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+	for _, t := range s.transports {
+		_ = t.Close()
+		_ = t.Conn.Close() // The transport doesn't own its socket
+	}
+	for _, f := range s.frontends {
+		_ = f.close()
+	}
 }
 
 // handleDoQSession handles a new DoQ session
-func (s *Server) handleDoQSession(session *quic.Conn, upstream string) {
+func (s *Server) handleDoQSession(session *quic.Conn) {
+	sessionLog := s.logger.WithField("client", session.RemoteAddr().String())
+	sessionLog.Trace("session accepted")
+	s.connections.Add(1)
+	defer s.connections.Add(-1)
+	state := session.ConnectionState()
+	peerCert := peerCertificate(&state.TLS)
+	framing := codec.FramingFor(state.TLS.NegotiatedProtocol)
+	limiter := s.shaper.newLimiter()
+	if state.TLS.NegotiatedProtocol == doq.TlsProtoDatagram {
+		go s.serveDatagrams(session, peerCert, limiter, sessionLog)
+	}
+
+	// Connections past their maximum age are closed once idle, so clients
+	// reconnect through the load balancer
+	var active atomic.Int64
+	var accepted int
+	if s.maxConnectionAge > 0 {
+		timer := time.AfterFunc(connectionAge(s.maxConnectionAge), func() {
+			expireSession(session, &active, sessionLog)
+		})
+		defer timer.Stop()
+	}
+	go func() {
+		select {
+		case <-s.draining:
+			sessionLog.Debug("closing connection, server draining")
+			closeWhenIdle(session, &active, s.drainDeadline)
+		case <-session.Context().Done():
+		}
+	}()
 	for {
 		// Accept client-originated QUIC stream
-		stream, err := session.AcceptStream(context.Background())
+		stream, err := session.AcceptStream(session.Context())
 		if err != nil {
-			if s.Debug {
-				log.Printf("QUIC stream accept: %v", err)
-			}
+			sessionLog.Debugf("QUIC stream accept: %v", err)
 			_ = session.CloseWithError(doq.InternalError, "") // Close the session with an internal error message
 			return
 		}
 
+		streamLog := sessionLog.WithField("stream", stream.StreamID())
+		streamLog.Trace("stream accepted")
+
 		// Handle QUIC stream (DNS query) in a new goroutine
+		s.streams.Add(1)
+		active.Add(1)
+		// Connections past their query quota are closed once idle too
+		if accepted++; accepted == s.maxConnQueries {
+			go func() {
+				sessionLog.Debugf("closing connection after %d queries", s.maxConnQueries)
+				closeWhenIdle(session, &active, time.Now().Add(connectionDrainTimeout))
+			}()
+		}
 		go func() {
+			defer s.streams.Add(-1)
+			defer active.Add(-1)
+			defer streamLog.Trace("stream finished")
+			var raw []byte
+			defer s.recoverStream(stream, streamLog, &raw)
+
+			// The query is abandoned when the connection closes, or the
+			// client cancels it with STOP_SENDING
+			ctx, cancel := context.WithCancelCause(session.Context())
+			defer cancel(nil)
+			stop := context.AfterFunc(stream.Context(), func() { cancel(context.Cause(stream.Context())) })
+			defer stop()
+
 			// Increment query metric
-			metricQueries.Inc()
+			s.metrics().queries.Inc()
 
 			// The client MUST send the DNS query over the selected stream, and MUST
 			// indicate through the STREAM FIN mechanism that no further data will
 			// be sent on that stream.
-			bytes, err := io.ReadAll(stream) // Ignore error, error handling is done by packet length
-
-			// Check for packet to small
-			if len(bytes) < 17 { // MinDnsPacketSize
-				switch {
-				case err != nil:
-					if s.Debug {
-						log.Printf("QUIC stream read: %v", err)
-					}
-				default:
-					if s.Debug {
-						log.Printf("DNS query length is too small")
+			bytes, err := codec.ReadRawLimit(stream, framing, s.maxQuerySize)
+			if errors.Is(err, codec.ErrTooLong) {
+				streamLog.Debugf("query larger than %d bytes", s.maxQuerySize)
+				s.metrics().invalidQueries.Inc()
+				stream.CancelRead(doq.ProtocolError)
+				stream.CancelWrite(doq.ProtocolError)
+				return
+			}
+			if err != nil {
+				s.logger.Debugf("DoQ query read: %v", err)
+				return
+			}
+			raw = bytes
+
+			// Pathological messages are answered with FORMERR instead of
+			// being unpacked or relayed
+			if err := checkWire(bytes); err != nil {
+				streamLog.Debugf("malformed query: %v", err)
+				s.metrics().invalidQueries.Inc()
+				if reply := formErrReply(bytes); reply != nil {
+					if bytes, err = reply.Pack(); err == nil {
+						s.writeReply(stream, bytes, framing)
+						return
 					}
 				}
+				_ = stream.Close()
+				return
+			}
+
+			if s.rawHandler != nil {
+				reply, err := s.rawHandler(ctx, session.RemoteAddr(), bytes)
+				if err != nil {
+					streamLog.Debugf("raw handler: %v", err)
+					stream.CancelWrite(doq.InternalError)
+					return
+				}
+				s.writeReply(stream, reply, framing)
 				return
 			}
 
@@ -112,117 +858,76 @@ func (s *Server) handleDoQSession(session *quic.Conn, upstream string) {
 			msg := dns.Msg{}
 			err = msg.Unpack(bytes)
 			if err != nil {
-				if s.Debug {
-					log.Printf("DNS query unpack error: %v", err)
-				}
+				s.logger.Debugf("DNS query unpack error: %v", err)
+				_ = stream.Close()
+				return
 			}
 
 			// If any message sent on a DoQ connection contains an edns-tcp-keepalive EDNS(0) Option,
 			// this is a fatal error and the recipient of the defective message MUST forcibly abort
-			// the connection immediately.
-			if opt := msg.IsEdns0(); opt != nil {
-				for _, option := range opt.Option {
-					// Check for EDNS TCP keepalive option
-					if option.Option() == dns.EDNS0TCPKEEPALIVE {
-						_ = stream.Close() // Ignore error if we're already trying to forcibly close the stream
-						return
-					}
-				}
+			// the connection immediately. A response sent as a query is a protocol error too.
+			if hasEDNSOption(&msg, dns.EDNS0TCPKEEPALIVE) || msg.Response {
+				streamLog.Debug("protocol error, aborting connection")
+				_ = session.CloseWithError(doq.ProtocolError, "")
+				return
 			}
 
 			// https://datatracker.ietf.org/doc/html/draft-ietf-dprive-dnsoquic-02#section-6.4
 			// When sending queries over a QUIC connection, the DNS Message ID MUST be set to zero.
-			id := msg.Id
-			var reply *dns.Msg
-			msg.Id = 0
-			defer func() {
-				// Restore the original ID to not break compatibility with proxies
-				msg.Id = id
-				if reply != nil {
-					reply.Id = id
-				}
-			}()
-
-			// Query the upstream for our DNS response
-			resp, err := s.sendUDPDNSMsg(msg, upstream)
-			if err != nil {
-				metricUpstreamErrors.Inc()
-				if s.Debug {
-					log.Printf("DNS query error: %v", err)
-				}
-			}
-
-			// Increment valid queries metric
-			metricValidQueries.Inc()
+			// The reply carries the ID the client sent to not break compatibility with proxies.
+			reply := s.resolve(&query{
+				ctx:        ctx,
+				msg:        &msg,
+				client:     session.RemoteAddr(),
+				transport:  transportDoQ,
+				peerCert:   peerCert,
+				serverName: state.TLS.ServerName,
+			})
 
 			// Pack the response into a byte slice
-			bytes, err = resp.Pack()
+			bytes, err = reply.Pack()
 			if err != nil {
-				if s.Debug {
-					log.Printf("DNS response pack error: %v", err)
-				}
-			}
-
-			// Send the byte slice over the open QUIC stream
-			n, err := stream.Write(bytes)
-			if err != nil {
-				if s.Debug {
-					log.Printf("QUIC stream write: %v", err)
-				}
+				s.logger.Debugf("DNS response pack error: %v", err)
+				return
 			}
-			if n != len(bytes) {
-				if s.Debug {
-					log.Printf("QUIC stream write length mismatch")
-				}
+			if shaped, ok := s.shaper.shape(&msg, reply, bytes, limiter); ok {
+				streamLog.Debugf("response of %d bytes shaped", len(bytes))
+				s.metrics().shapedResponses.Inc()
+				bytes = shaped
 			}
 
-			// Ignore error since we're already trying to close the stream
-			_ = stream.Close()
+			s.writeReply(stream, bytes, framing)
 		}()
 	}
 }
 
-func (s *Server) sendUDPDNSMsg(msg dns.Msg, upstream string) (dns.Msg, error) {
-	// Pack the DNS message
-	packed, err := msg.Pack()
-	if err != nil {
-		return dns.Msg{}, err
-	}
-
-	// Connect to the DNS upstream
-	if s.Debug {
-		log.Printf("dialing udp dns upstream: %s", upstream)
-	}
-	conn, err := net.Dial("udp", upstream)
-	if err != nil {
-		return dns.Msg{}, errors.New("upstream connect: " + err.Error())
-	}
-
-	// Send query to DNS upstream
-	if s.Debug {
-		log.Printf("writing query to dns upstream: %s", upstream)
-	}
-	_, err = conn.Write(packed)
-	if err != nil {
-		return dns.Msg{}, errors.New("upstream query write: " + err.Error())
+// recoverStream recovers from a panic of a stream handler, logging it with
+// the query being handled and resetting the stream with DOQ_INTERNAL_ERROR,
+// so a single query can't bring the server down
+func (s *Server) recoverStream(stream *quic.Stream, streamLog *logrus.Entry, raw *[]byte) {
+	v := recover()
+	if v == nil {
+		return
 	}
-
-	// Read the query response from the upstream
-	if s.Debug {
-		log.Printf("reading query response from dns upstream: %s", upstream)
-	}
-	buf := make([]byte, 4096)
-	size, err := conn.Read(buf)
-	if err != nil {
-		return dns.Msg{}, errors.New("upstream query read: " + err.Error())
+	s.metrics().panics.Inc()
+	msg := new(dns.Msg)
+	if err := msg.Unpack(*raw); err == nil && len(msg.Question) > 0 {
+		streamLog = streamLog.WithField("query", msg.Question[0].String())
+	} else {
+		streamLog = streamLog.WithField("query", hex.EncodeToString(*raw))
 	}
+	streamLog.Errorf("stream handler panic: %v\n%s", v, debug.Stack())
+	stream.CancelRead(doq.InternalError)
+	stream.CancelWrite(doq.InternalError)
+}
 
-	// Pack the response message
-	var retMsg dns.Msg
-	err = retMsg.Unpack(buf[:size])
-	if err != nil {
-		return dns.Msg{}, err
+// writeReply sends a packed reply over a DoQ stream and closes it
+func (s *Server) writeReply(stream *quic.Stream, reply []byte, framing codec.Framing) {
+	// Send the byte slice over the open QUIC stream
+	if err := codec.WriteRaw(stream, reply, framing); err != nil {
+		s.logger.Debugf("QUIC stream write: %v", err)
 	}
 
-	return retMsg, nil // nil error
+	// Ignore error since we're already trying to close the stream
+	_ = stream.Close()
 }
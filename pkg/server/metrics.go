@@ -1,30 +1,310 @@
 package server
 
 import (
+	"errors"
 	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	doq "github.com/mosajjal/doqd"
 )
 
-var (
-	metricQueries = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "doqd_queries",
-		Help: "Total queries",
-	})
-	metricValidQueries = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "doqd_valid_queries",
-		Help: "Total valid queries",
-	})
-	metricUpstreamErrors = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "doqd_upstream_errors",
-		Help: "Total upstream errors",
-	})
+// defaultNamespace prefixes the metric names when no namespace is configured
+const defaultNamespace = "doqd"
+
+// MetricsSink receives the metrics of a server, exported to Prometheus by
+// default. Metrics are named as in Prometheus without the namespace, e.g.
+// queries or cache_entries.
+type MetricsSink interface {
+	// Add adds delta to a counter, or to a gauge such as cache_entries.
+	// labelValues are given for metrics with labels, e.g. the tenant of
+	// tenant_queries.
+	Add(name string, delta float64, labelValues ...string)
+	// Timing records the duration of an operation, e.g. upstream_latency
+	Timing(name string, d time.Duration)
+}
+
+// metricKind tells how a metric is exported
+type metricKind int
+
+const (
+	counterMetric metricKind = iota
+	gaugeMetric
+	timingMetric
 )
 
-// MetricsListen starts the metrics HTTP server
-func MetricsListen(listenAddr string) error {
-	http.Handle("/metrics", promhttp.Handler())
-	return http.ListenAndServe(listenAddr, nil)
+// metricDef describes a metric of a server
+type metricDef struct {
+	name   string
+	help   string
+	kind   metricKind
+	labels []string
+}
+
+// metricDefs are the metrics every sink receives
+var metricDefs = []metricDef{
+	{name: "queries", help: "Total queries"},
+	{name: "valid_queries", help: "Total valid queries"},
+	{name: "invalid_queries", help: "Total messages answered with FORMERR or NOTIMP, or oversized DoQ ones reset, without being forwarded"},
+	{name: "upstream_errors", help: "Total upstream errors"},
+	{name: "deduplicated_queries", help: "Total queries answered by another identical in-flight upstream query"},
+	{name: "blocked_queries", help: "Total queries blocked by the blocklists"},
+	{name: "rebinding_blocked", help: "Total upstream answers with private addresses stripped or refused"},
+	{name: "tunneling_queries", help: "Total queries flagged by DNS tunneling detection, per reason", labels: []string{"reason"}},
+	{name: "cache_hits", help: "Total queries answered from the cache"},
+	{name: "cache_misses", help: "Total cacheable queries not found in the cache"},
+	{name: "cache_evictions", help: "Total cached responses evicted before expiring to make room"},
+	{name: "cache_entries", help: "Number of cached responses", kind: gaugeMetric},
+	{name: "unique_clients", help: "Approximate number of distinct client addresses in the last complete window", kind: gaugeMetric},
+	{name: "retries", help: "Total QUIC connection attempts asked to validate their address with a Retry"},
+	{name: "refused_handshakes", help: "Total QUIC connection attempts refused for exceeding the handshake rate limits"},
+	{name: "alpn_rejected", help: "Total QUIC connection attempts refused for offering none of the accepted ALPN tokens"},
+	{name: "shaped_responses", help: "Total DoQ responses truncated or refused for exceeding the response size or rate caps"},
+	{name: "panics", help: "Total DoQ streams reset with DOQ_INTERNAL_ERROR after their handler panicked"},
+	{name: "tenant_queries", help: "Total queries per tenant", labels: []string{"tenant"}},
+	{name: "upstream_latency", help: "Duration of successful upstream exchanges", kind: timingMetric},
+}
+
+// metricKindOf returns the kind of a metric, counters for unknown ones
+func metricKindOf(name string) metricKind {
+	for _, def := range metricDefs {
+		if def.name == name {
+			return def.kind
+		}
+	}
+	return counterMetric
+}
+
+// metric is a counter or gauge of a server, sent to its sink
+type metric struct {
+	sink MetricsSink
+	name string
+}
+
+// Inc adds one to the metric for the label values, if it has labels
+func (m metric) Inc(labelValues ...string) {
+	m.sink.Add(m.name, 1, labelValues...)
+}
+
+// Dec subtracts one from a gauge
+func (m metric) Dec(labelValues ...string) {
+	m.sink.Add(m.name, -1, labelValues...)
+}
+
+// Add adds delta to a gauge
+func (m metric) Add(delta float64, labelValues ...string) {
+	m.sink.Add(m.name, delta, labelValues...)
+}
+
+// timer is a timing metric of a server, sent to its sink
+type timer struct {
+	sink MetricsSink
+	name string
+}
+
+// Observe records the duration of an operation
+func (t timer) Observe(d time.Duration) {
+	t.sink.Timing(t.name, d)
+}
+
+// metrics are the metrics of a server
+type metrics struct {
+	queries             metric
+	validQueries        metric
+	invalidQueries      metric
+	upstreamErrors      metric
+	deduplicatedQueries metric
+	blockedQueries      metric
+	rebindingBlocked    metric
+	tunnelingQueries    metric
+	cacheHits           metric
+	cacheMisses         metric
+	cacheEvictions      metric
+	cacheEntries        metric
+	uniqueClients       metric
+	retries             metric
+	refusedHandshakes   metric
+	alpnRejected        metric
+	shapedResponses     metric
+	panics              metric
+	tenantQueries       metric
+	upstreamLatency     timer
+}
+
+// newMetrics returns the metrics of a server sent to a sink
+func newMetrics(sink MetricsSink) *metrics {
+	return &metrics{
+		queries:             metric{sink, "queries"},
+		validQueries:        metric{sink, "valid_queries"},
+		invalidQueries:      metric{sink, "invalid_queries"},
+		upstreamErrors:      metric{sink, "upstream_errors"},
+		deduplicatedQueries: metric{sink, "deduplicated_queries"},
+		blockedQueries:      metric{sink, "blocked_queries"},
+		rebindingBlocked:    metric{sink, "rebinding_blocked"},
+		tunnelingQueries:    metric{sink, "tunneling_queries"},
+		cacheHits:           metric{sink, "cache_hits"},
+		cacheMisses:         metric{sink, "cache_misses"},
+		cacheEvictions:      metric{sink, "cache_evictions"},
+		cacheEntries:        metric{sink, "cache_entries"},
+		uniqueClients:       metric{sink, "unique_clients"},
+		retries:             metric{sink, "retries"},
+		refusedHandshakes:   metric{sink, "refused_handshakes"},
+		alpnRejected:        metric{sink, "alpn_rejected"},
+		shapedResponses:     metric{sink, "shaped_responses"},
+		panics:              metric{sink, "panics"},
+		tenantQueries:       metric{sink, "tenant_queries"},
+		upstreamLatency:     timer{sink, "upstream_latency"},
+	}
+}
+
+// prometheusSink exports the metrics of servers to Prometheus
+type prometheusSink struct {
+	gauges  map[string]*prometheus.GaugeVec
+	timings map[string]*prometheus.HistogramVec
+}
+
+// NewPrometheusSink registers the metrics of servers on reg, the default
+// Prometheus registry when nil, named <namespace>_<metric> and carrying
+// labels. Counters are exported as gauges, timings as histograms in
+// seconds. Sinks sharing a registry with the same namespace and labels
+// share their metrics. The sink also exports <namespace>_build_info.
+func NewPrometheusSink(reg prometheus.Registerer, namespace string, labels prometheus.Labels) (MetricsSink, error) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	r := &registrar{reg: reg}
+	p := &prometheusSink{
+		gauges:  map[string]*prometheus.GaugeVec{},
+		timings: map[string]*prometheus.HistogramVec{},
+	}
+	for _, def := range metricDefs {
+		if def.kind == timingMetric {
+			p.timings[def.name] = r.register(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Namespace: namespace, Name: def.name + "_seconds", Help: def.help, ConstLabels: labels,
+			}, def.labels)).(*prometheus.HistogramVec)
+			continue
+		}
+		p.gauges[def.name] = r.register(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Name: def.name, Help: def.help, ConstLabels: labels,
+		}, def.labels)).(*prometheus.GaugeVec)
+	}
+	buildInfo := r.register(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "build_info", ConstLabels: labels,
+		Help: "Always 1, labeled with the version, commit and Go version of the running binary",
+	}, []string{"version", "commit", "goversion"})).(*prometheus.GaugeVec)
+	if r.err != nil {
+		return nil, errors.New("register metrics: " + r.err.Error())
+	}
+	build := doq.Build()
+	buildInfo.WithLabelValues(doq.Version(), build.Commit, build.GoVersion).Set(1)
+	return p, nil
+}
+
+// Add adds delta to a gauge
+func (p *prometheusSink) Add(name string, delta float64, labelValues ...string) {
+	if g, ok := p.gauges[name]; ok {
+		g.WithLabelValues(labelValues...).Add(delta)
+	}
+}
+
+// Timing observes a duration in seconds
+func (p *prometheusSink) Timing(name string, d time.Duration) {
+	if h, ok := p.timings[name]; ok {
+		h.WithLabelValues().Observe(d.Seconds())
+	}
+}
+
+// defaultMetrics are the metrics of servers configured without a sink,
+// registry, namespace or labels, registered on the default registry
+var defaultMetrics = sync.OnceValue(func() *metrics {
+	sink, err := NewPrometheusSink(prometheus.DefaultRegisterer, defaultNamespace, nil)
+	if err != nil {
+		panic(err)
+	}
+	return newMetrics(sink)
+})
+
+// registrar registers collectors, keeping the first error
+type registrar struct {
+	reg prometheus.Registerer
+	err error
+}
+
+// register registers a collector, returning the identical one registered
+// before, if any
+func (r *registrar) register(c prometheus.Collector) prometheus.Collector {
+	err := r.reg.Register(c)
+	var registered prometheus.AlreadyRegisteredError
+	switch {
+	case err == nil:
+	case errors.As(err, &registered):
+		return registered.ExistingCollector
+	case r.err == nil:
+		r.err = err
+	}
+	return c
+}
+
+// metrics returns the server's metrics, the default ones for servers
+// assembled without New
+func (s *Server) metrics() *metrics {
+	if s.metricSet == nil {
+		return defaultMetrics()
+	}
+	return s.metricSet
+}
+
+// AdminConfig configures the metrics and admin HTTP listener
+type AdminConfig struct {
+	ListenAddr string
+	// Servers are checked by the /readyz endpoint
+	Servers []*Server
+	// Gatherer provides the metrics served at /metrics, the default
+	// Prometheus registry when nil
+	Gatherer prometheus.Gatherer
+	// Pprof exposes net/http/pprof profiles under /debug/pprof/. Profiles
+	// reveal internals and cost CPU, so the listener should not be public.
+	Pprof bool
+}
+
+// MetricsListen starts the metrics HTTP server. It also serves /healthz,
+// which succeeds while the process is up, and /readyz, which succeeds when
+// all given servers are accepting connections with a responsive upstream.
+func MetricsListen(listenAddr string, servers ...*Server) error {
+	return AdminListen(AdminConfig{ListenAddr: listenAddr, Servers: servers})
+}
+
+// AdminListen starts the metrics and admin HTTP server
+func AdminListen(c AdminConfig) error {
+	return http.ListenAndServe(c.ListenAddr, adminMux(c))
+}
+
+// adminMux routes the admin listener's endpoints
+func adminMux(c AdminConfig) *http.ServeMux {
+	mux := http.NewServeMux()
+	if c.Gatherer != nil {
+		mux.Handle("/metrics", promhttp.HandlerFor(c.Gatherer, promhttp.HandlerOpts{}))
+	} else {
+		mux.Handle("/metrics", promhttp.Handler())
+	}
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler(c.Servers))
+	mux.HandleFunc("/stats", statsHandler(c.Servers))
+	mux.HandleFunc("/top", topHandler(c.Servers))
+	mux.HandleFunc("/cache/flush", cacheFlushHandler(c.Servers))
+	if c.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
 }
@@ -1,11 +1,17 @@
 package server
 
 import (
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/mosajjal/doqd/pkg/client"
 )
 
 func TestMetricsServe(t *testing.T) {
@@ -26,3 +32,95 @@ func TestMetricsServe(t *testing.T) {
 
 	assert.Equal(t, 200, resp.StatusCode)
 }
+
+func TestHealthEndpoints(t *testing.T) {
+	ready := &Server{upstream: &monitoredUpstream{Resolver: &slowUpstream{}}}
+	ready.accepting.Add(1)
+	down := &Server{upstream: &monitoredUpstream{Resolver: downUpstream{}}}
+	down.accepting.Add(1)
+	notAccepting := &Server{upstream: &monitoredUpstream{Resolver: &slowUpstream{}}}
+
+	get := func(servers []*Server, path string) int {
+		ts := httptest.NewServer(adminMux(AdminConfig{Servers: servers}))
+		defer ts.Close()
+		resp, err := http.Get(ts.URL + path)
+		assert.Nil(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, get([]*Server{notAccepting}, "/healthz"))
+	assert.Equal(t, http.StatusOK, get([]*Server{ready}, "/readyz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get([]*Server{ready, down}, "/readyz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get([]*Server{notAccepting}, "/readyz"))
+}
+
+func TestPprofEndpoint(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		ts := httptest.NewServer(adminMux(AdminConfig{Pprof: enabled}))
+		resp, err := http.Get(ts.URL + "/debug/pprof/heap")
+		assert.Nil(t, err)
+		_ = resp.Body.Close()
+		if enabled {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		} else {
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		}
+		ts.Close()
+	}
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	doqServer, err := New(Config{
+		ListenAddr:       "127.0.0.1:0",
+		Cert:             testCertificate(t, "localhost"),
+		Upstream:         "127.0.0.1:1",
+		Rewrites:         map[string]string{"whoami.test": "192.0.2.1"},
+		Registerer:       reg,
+		MetricsNamespace: "embedded",
+		MetricsLabels:    prometheus.Labels{"server": "one"},
+	})
+	assert.Nil(t, err)
+	defer doqServer.Close()
+	go doqServer.Listen()
+
+	// A second server sharing the registry shares the metrics
+	other, err := New(Config{
+		ListenAddr:       "127.0.0.1:0",
+		Cert:             testCertificate(t, "localhost"),
+		Upstream:         "127.0.0.1:1",
+		Registerer:       reg,
+		MetricsNamespace: "embedded",
+		MetricsLabels:    prometheus.Labels{"server": "one"},
+	})
+	assert.Nil(t, err)
+	_ = other.Close()
+
+	doqClient, err := client.New(client.Config{
+		Server:           doqServer.Listener.Addr().String(),
+		TLSSkipVerify:    true,
+		Registerer:       reg,
+		MetricsNamespace: "embedded",
+	})
+	assert.Nil(t, err)
+	defer doqClient.Close()
+	req := dns.Msg{}
+	req.SetQuestion("whoami.test.", dns.TypeA)
+	req.Id = 0
+	_, err = doqClient.SendQuery(req)
+	assert.Nil(t, err)
+
+	ts := httptest.NewServer(adminMux(AdminConfig{Gatherer: reg}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `embedded_queries{server="one"} 1`)
+	assert.Contains(t, string(body), `embedded_client_queries 1`)
+	assert.NotContains(t, string(body), "doqd_")
+}
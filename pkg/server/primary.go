@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/mosajjal/doqd/pkg/upstream"
+)
+
+// PrimaryConfig configures forwarding NOTIFY and dynamic UPDATE messages to
+// a primary server, such as a hidden primary behind doqd
+type PrimaryConfig struct {
+	// Address of the primary, as host:port over TCP or tls://host:port over
+	// DNS over TLS
+	Address string
+	// Zones maps each zone to the client IP addresses, prefixes and
+	// certificate fingerprints allowed to send NOTIFY and UPDATE messages for
+	// it. Messages for other zones are refused.
+	Zones map[string][]string
+}
+
+// primary forwards NOTIFY and UPDATE messages of allowed clients
+type primary struct {
+	addr   string
+	client *dns.Client
+	zones  map[string]*clientMatcher
+}
+
+// newPrimary parses the primary config, or returns nil without an address
+func newPrimary(c PrimaryConfig) (*primary, error) {
+	if c.Address == "" {
+		return nil, nil
+	}
+	p := &primary{
+		addr:   c.Address,
+		client: &dns.Client{Net: "tcp", Timeout: upstream.Timeout, TsigProvider: tsigPassthrough{}},
+		zones:  map[string]*clientMatcher{},
+	}
+	if addr, ok := strings.CutPrefix(c.Address, "tls://"); ok {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, errors.New("primary " + c.Address + ": " + err.Error())
+		}
+		p.addr = addr
+		p.client.Net = "tcp-tls"
+		p.client.TLSConfig = &tls.Config{ServerName: host}
+	} else if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return nil, errors.New("primary " + c.Address + ": " + err.Error())
+	}
+	if len(c.Zones) == 0 {
+		return nil, errors.New("primary " + c.Address + ": no zones")
+	}
+	for zone, clients := range c.Zones {
+		m, err := newClientMatcher(clients)
+		if err != nil {
+			return nil, errors.New("primary zone " + zone + ": " + err.Error())
+		}
+		p.zones[strings.ToLower(dns.Fqdn(zone))] = m
+	}
+	return p, nil
+}
+
+// handles reports whether a message is a NOTIFY or UPDATE
+func (p *primary) handles(msg *dns.Msg) bool {
+	return msg.Opcode == dns.OpcodeNotify || msg.Opcode == dns.OpcodeUpdate
+}
+
+// forward sends a NOTIFY or UPDATE to the primary when the client may send
+// it for the zone, and answers with REFUSED otherwise
+func (p *primary) forward(ctx context.Context, q *query, m *metrics) *dns.Msg {
+	reply := new(dns.Msg)
+	if q.msg.Response || len(q.msg.Question) != 1 {
+		return reply.SetRcode(q.msg, dns.RcodeFormatError)
+	}
+	clients := p.zoneClients(q.msg.Question[0].Name)
+	if clients == nil || !clients.match(q) {
+		return reply.SetRcode(q.msg, dns.RcodeRefused)
+	}
+
+	// The message ID is kept, as TSIG signatures cover it
+	resp, _, err := p.client.ExchangeContext(ctx, q.msg.Copy(), p.addr)
+	if err != nil {
+		m.upstreamErrors.Inc()
+		return reply.SetRcode(q.msg, dns.RcodeServerFailure)
+	}
+	return resp
+}
+
+// zoneClients returns the clients allowed for the closest enclosing zone of
+// a name, or nil
+func (p *primary) zoneClients(name string) *clientMatcher {
+	name = strings.ToLower(dns.Fqdn(name))
+	for {
+		if clients, ok := p.zones[name]; ok {
+			return clients
+		}
+		next, end := dns.NextLabel(name, 0)
+		if end {
+			return p.zones["."]
+		}
+		name = name[next:]
+	}
+}
+
+// tsigPassthrough keeps the TSIG signatures of forwarded messages as they
+// are, for the primary and the client to verify
+type tsigPassthrough struct{}
+
+func (tsigPassthrough) Generate(_ []byte, t *dns.TSIG) ([]byte, error) {
+	return hex.DecodeString(t.MAC)
+}
+
+func (tsigPassthrough) Verify([]byte, *dns.TSIG) error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrimary(t *testing.T) {
+	// The primary echoes the opcode of what it receives
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	secret := map[string]string{"update.": "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"}
+	received := make(chan int, 10)
+	signed := make(chan error, 10)
+	primaryServer := &dns.Server{Listener: l, MsgAcceptFunc: acceptMsg, TsigSecret: secret, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		received <- r.Opcode
+		if r.IsTsig() != nil {
+			signed <- w.TsigStatus()
+		}
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		_ = w.WriteMsg(reply)
+	})}
+	go func() { _ = primaryServer.ActivateAndServe() }()
+	defer primaryServer.Shutdown()
+
+	p, err := newPrimary(PrimaryConfig{
+		Address: l.Addr().String(),
+		Zones: map[string][]string{
+			"example.com":          {"192.0.2.0/24"},
+			"internal.example.com": {"198.51.100.1"},
+		},
+	})
+	assert.Nil(t, err)
+	s := &Server{upstream: &monitoredUpstream{Resolver: addrUpstream{"198.51.100.1"}}, logger: logrus.New(), primary: p}
+
+	send := func(msg *dns.Msg, client string) *dns.Msg {
+		msg.Id = 7
+		reply := s.resolve(&query{msg: msg, client: &net.UDPAddr{IP: net.ParseIP(client)}})
+		assert.Equal(t, uint16(7), reply.Id)
+		return reply
+	}
+	update := func(zone string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetUpdate(zone)
+		rr, _ := dns.NewRR("host." + zone + " 300 IN A 192.0.2.10")
+		msg.Insert([]dns.RR{rr})
+		return msg
+	}
+
+	assert.Equal(t, dns.RcodeSuccess, send(update("example.com."), "192.0.2.1").Rcode)
+	assert.Equal(t, dns.OpcodeUpdate, <-received)
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+	assert.Equal(t, dns.RcodeSuccess, send(notify, "192.0.2.1").Rcode)
+	assert.Equal(t, dns.OpcodeNotify, <-received)
+
+	// TSIG signatures reach the primary intact
+	msg := update("example.com.")
+	msg.Id = 7
+	msg.SetTsig("update.", dns.HmacSHA256, 300, time.Now().Unix())
+	packed, _, err := dns.TsigGenerate(msg, secret["update."], "", false)
+	assert.Nil(t, err)
+	msg = new(dns.Msg)
+	assert.Nil(t, msg.Unpack(packed))
+	assert.Equal(t, dns.RcodeSuccess, send(msg, "192.0.2.1").Rcode)
+	assert.Equal(t, dns.OpcodeUpdate, <-received)
+	assert.Nil(t, <-signed)
+
+	// The closest zone decides
+	assert.Equal(t, dns.RcodeRefused, send(update("internal.example.com."), "192.0.2.1").Rcode)
+	assert.Equal(t, dns.RcodeSuccess, send(update("internal.example.com."), "198.51.100.1").Rcode)
+	assert.Equal(t, dns.OpcodeUpdate, <-received)
+
+	// Unknown zones, other clients and malformed messages are not forwarded
+	assert.Equal(t, dns.RcodeRefused, send(update("example.org."), "192.0.2.1").Rcode)
+	assert.Equal(t, dns.RcodeRefused, send(update("example.com."), "203.0.113.1").Rcode)
+	noZone := update("example.com.")
+	noZone.Question = nil
+	assert.Equal(t, dns.RcodeFormatError, send(noZone, "192.0.2.1").Rcode)
+	assert.Empty(t, received)
+
+	// Queries are resolved as usual
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	assert.Len(t, send(query, "192.0.2.1").Answer, 1)
+
+	for _, c := range []PrimaryConfig{
+		{Address: "nope", Zones: map[string][]string{"example.com": {"192.0.2.0/24"}}},
+		{Address: "127.0.0.1:53"},
+		{Address: "tls://127.0.0.1:853", Zones: map[string][]string{"example.com": {"not a client"}}},
+	} {
+		_, err = newPrimary(c)
+		assert.NotNil(t, err, c.Address)
+	}
+}
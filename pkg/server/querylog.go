@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// QueryLogConfig configures the query log and how much of each query it
+// keeps, so operators can keep diagnostics without storing full browsing
+// histories
+type QueryLogConfig struct {
+	// Writer receives one JSON object per logged query
+	Writer io.Writer
+	// Sink receives the logged queries in batches, e.g. to store them in a
+	// database, alongside or instead of Writer
+	Sink QueryLogSink
+	// BatchSize and BatchInterval bound how many entries are sent to the
+	// Sink at once and how long they wait, 1000 entries and 1 second by
+	// default
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// HashNames replaces query names with a keyed SHA-256 hash. Without a
+	// HashKey a random one is generated, so hashes only correlate queries
+	// within a single run.
+	HashNames bool
+	HashKey   []byte
+	// TruncateNames keeps only this many trailing labels of query names,
+	// e.g. 2 logs www.example.com. as example.com.
+	TruncateNames int
+	// MaskClients truncates client addresses to their /24 (IPv4) or /48
+	// (IPv6) network
+	MaskClients bool
+	// SampleRate is the fraction of queries logged, all of them when zero
+	SampleRate float64
+}
+
+// QueryLogEntry is a logged query, written as a JSON line
+type QueryLogEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Transport string    `json:"transport"`
+	View      string    `json:"view,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Class     string    `json:"class"`
+	Rcode     string    `json:"rcode"`
+	Answers   int       `json:"answers"`
+	Duration  float64   `json:"duration_ms"`
+}
+
+// queryLog writes redacted query log entries
+type queryLog struct {
+	conf QueryLogConfig
+
+	lock    sync.Mutex
+	encoder *json.Encoder
+	batcher *queryLogBatcher
+}
+
+// newQueryLog creates a query log, or returns nil when it has no writer or
+// sink
+func newQueryLog(conf QueryLogConfig, logger *logrus.Logger) (*queryLog, error) {
+	if conf.Writer == nil && conf.Sink == nil {
+		return nil, nil
+	}
+	if conf.HashNames && len(conf.HashKey) == 0 {
+		conf.HashKey = make([]byte, 32)
+		if _, err := cryptorand.Read(conf.HashKey); err != nil {
+			return nil, err
+		}
+	}
+	l := &queryLog{conf: conf}
+	if conf.Writer != nil {
+		l.encoder = json.NewEncoder(conf.Writer)
+	}
+	if conf.Sink != nil {
+		l.batcher = newQueryLogBatcher(conf.Sink, conf.BatchSize, conf.BatchInterval, logger)
+	}
+	return l, nil
+}
+
+// log records a query and its reply, subject to sampling
+func (l *queryLog) log(q *query, reply *dns.Msg, start time.Time) {
+	if l.conf.SampleRate > 0 && rand.Float64() >= l.conf.SampleRate {
+		return
+	}
+
+	entry := QueryLogEntry{
+		Time:      start.UTC(),
+		Transport: q.transport,
+		Rcode:     dns.RcodeToString[reply.Rcode],
+		Answers:   len(reply.Answer),
+		Duration:  float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if q.client != nil {
+		entry.Client = l.client(q.client)
+	}
+	if q.view != nil && q.view.tenant {
+		entry.Tenant = q.view.name
+	} else if q.view != nil {
+		entry.View = q.view.name
+	}
+	if len(q.msg.Question) > 0 {
+		question := q.msg.Question[0]
+		entry.Name = l.name(question.Name)
+		entry.Type = dns.TypeToString[question.Qtype]
+		entry.Class = dns.ClassToString[question.Qclass]
+	}
+
+	if l.batcher != nil {
+		l.batcher.add(entry)
+	}
+	if l.encoder != nil {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		_ = l.encoder.Encode(entry)
+	}
+}
+
+// close sends the pending entries to the sink
+func (l *queryLog) close() {
+	if l.batcher != nil {
+		l.batcher.close()
+	}
+}
+
+// name redacts a query name according to the config
+func (l *queryLog) name(name string) string {
+	name = strings.ToLower(name)
+	if l.conf.TruncateNames > 0 {
+		labels := dns.SplitDomainName(name)
+		if len(labels) > l.conf.TruncateNames {
+			name = dns.Fqdn(strings.Join(labels[len(labels)-l.conf.TruncateNames:], "."))
+		}
+	}
+	if l.conf.HashNames {
+		mac := hmac.New(sha256.New, l.conf.HashKey)
+		mac.Write([]byte(name))
+		name = hex.EncodeToString(mac.Sum(nil))
+	}
+	return name
+}
+
+// client redacts a client address according to the config
+func (l *queryLog) client(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return addr.String()
+	}
+	if !l.conf.MaskClients {
+		return ip.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
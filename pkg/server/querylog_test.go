@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryLog(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.Example.com.", dns.TypeAAAA)
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, dns.RcodeNameError)
+	q := &query{msg: msg, client: &net.UDPAddr{IP: net.ParseIP("2001:db8:1:2::1"), Port: 5353}, transport: transportDoQ}
+
+	logEntry := func(conf QueryLogConfig) QueryLogEntry {
+		var buf bytes.Buffer
+		conf.Writer = &buf
+		l, err := newQueryLog(conf, logrus.New())
+		assert.Nil(t, err)
+		l.log(q, reply, time.Now())
+		var entry QueryLogEntry
+		assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+		return entry
+	}
+
+	entry := logEntry(QueryLogConfig{})
+	assert.Equal(t, "www.example.com.", entry.Name)
+	assert.Equal(t, "AAAA", entry.Type)
+	assert.Equal(t, "NXDOMAIN", entry.Rcode)
+	assert.Equal(t, "2001:db8:1:2::1", entry.Client)
+
+	entry = logEntry(QueryLogConfig{TruncateNames: 2, MaskClients: true})
+	assert.Equal(t, "example.com.", entry.Name)
+	assert.Equal(t, "2001:db8:1::", entry.Client)
+
+	// Keyed hashes are stable for a key
+	key := []byte("key")
+	a := logEntry(QueryLogConfig{HashNames: true, HashKey: key})
+	b := logEntry(QueryLogConfig{HashNames: true, HashKey: key})
+	assert.Len(t, a.Name, 64)
+	assert.Equal(t, a.Name, b.Name)
+
+	l, err := newQueryLog(QueryLogConfig{}, logrus.New())
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+}
+
+func TestQueryLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newQueryLog(QueryLogConfig{Writer: &buf, SampleRate: 0.1, MaskClients: true}, logrus.New())
+	assert.Nil(t, err)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	q := &query{msg: msg, client: &net.UDPAddr{IP: net.ParseIP("192.0.2.55")}}
+	for i := 0; i < 1000; i++ {
+		l.log(q, msg, time.Now())
+	}
+	lines := bytes.Count(buf.Bytes(), []byte("\n"))
+	assert.Greater(t, lines, 30)
+	assert.Less(t, lines, 200)
+	assert.Contains(t, buf.String(), `"client":"192.0.2.0"`)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// noSizeLimit is the size, in megabytes, of query log files rotated by time
+// only
+const noSizeLimit = 1 << 30
+
+// QueryLogFileConfig configures a query log file and its rotation. Rotated
+// files are renamed with the time of the rotation, e.g.
+// queries-2024-05-01T00-00-00.000.json.
+type QueryLogFileConfig struct {
+	// Path is the file written to
+	Path string
+	// MaxSize rotates the file when it reaches this many megabytes, 0 for
+	// no size limit
+	MaxSize int
+	// RotateEvery rotates the file at this interval, aligned on UTC
+	// boundaries so 24h rotates at midnight UTC, 0 to disable
+	RotateEvery time.Duration
+	// MaxBackups is the number of rotated files kept, all of them when 0
+	MaxBackups int
+	// MaxAge deletes rotated files older than this, rounded up to whole
+	// days, 0 to keep them
+	MaxAge time.Duration
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// QueryLogFile is a query log file rotated by size and time, a Writer for
+// QueryLogConfig
+type QueryLogFile struct {
+	*lumberjack.Logger
+	// written tells whether entries were logged since the last rotation
+	written atomic.Bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewQueryLogFile returns a query log file rotated according to the config.
+// The file is created on the first write.
+func NewQueryLogFile(c QueryLogFileConfig) *QueryLogFile {
+	maxSize := c.MaxSize
+	if maxSize <= 0 {
+		maxSize = noSizeLimit
+	}
+	maxAge := 0
+	if c.MaxAge > 0 {
+		maxAge = int((c.MaxAge + 24*time.Hour - 1) / (24 * time.Hour))
+	}
+	f := &QueryLogFile{
+		Logger: &lumberjack.Logger{
+			Filename:   c.Path,
+			MaxSize:    maxSize,
+			MaxBackups: c.MaxBackups,
+			MaxAge:     maxAge,
+			Compress:   c.Compress,
+		},
+		done: make(chan struct{}),
+	}
+	if c.RotateEvery > 0 {
+		go f.rotateEvery(c.RotateEvery)
+	}
+	return f
+}
+
+// rotateEvery rotates the file at every interval boundary until it is
+// closed
+func (f *QueryLogFile) rotateEvery(interval time.Duration) {
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(interval).Add(interval).Sub(now))
+		select {
+		case <-f.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			// Idle periods don't leave empty files behind
+			if f.written.Swap(false) {
+				_ = f.Rotate()
+			}
+		}
+	}
+}
+
+// Write appends entries to the file
+func (f *QueryLogFile) Write(p []byte) (int, error) {
+	f.written.Store(true)
+	return f.Logger.Write(p)
+}
+
+// Close stops the rotation and closes the file
+func (f *QueryLogFile) Close() error {
+	f.closeOnce.Do(func() { close(f.done) })
+	return f.Logger.Close()
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryLogFileRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "queries.json")
+	f := NewQueryLogFile(QueryLogFileConfig{Path: path, MaxSize: 1, RotateEvery: 200 * time.Millisecond, Compress: true})
+	defer f.Close()
+
+	// Going over the size limit rotates the file
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	for i := 0; i < 1025; i++ {
+		_, err := f.Write(line)
+		assert.Nil(t, err)
+	}
+	// Rotated files are compressed in the background
+	assert.Eventually(t, func() bool {
+		matches, _ := filepath.Glob(filepath.Join(dir, "queries-*.json.gz"))
+		return len(matches) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The file is also rotated at the interval, unless nothing was written
+	assert.Eventually(t, func() bool {
+		matches, _ := filepath.Glob(filepath.Join(dir, "queries-*.json.gz"))
+		return len(matches) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(500 * time.Millisecond)
+	matches, _ := filepath.Glob(filepath.Join(dir, "queries-*.json.gz"))
+	assert.Len(t, matches, 2)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func TestQueryLogFileClose(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "queries.json")
+	f := NewQueryLogFile(QueryLogFileConfig{Path: path, RotateEvery: 100 * time.Millisecond})
+	_, err := f.Write([]byte("{}\n"))
+	assert.Nil(t, err)
+
+	// Closing flushes the file and stops the rotation, closing again is a
+	// no-op
+	assert.Nil(t, f.Close())
+	assert.Nil(t, f.Close())
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "{}\n", string(data))
+	time.Sleep(300 * time.Millisecond)
+	matches, _ := filepath.Glob(filepath.Join(dir, "queries-*.json"))
+	assert.Empty(t, matches)
+}
@@ -0,0 +1,41 @@
+//go:build cgo
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLQueryLogSink(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "queries.db"))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	sink, err := NewSQLQueryLogSink(db, "queries")
+	if !assert.Nil(t, err) {
+		return
+	}
+	// Creating the table again is a no-op
+	_, err = NewSQLQueryLogSink(db, "queries")
+	assert.Nil(t, err)
+
+	var entries []QueryLogEntry
+	for _, name := range []string{"example.com.", "example.net.", "example.com."} {
+		entries = append(entries, QueryLogEntry{Time: time.Now().UTC(), Client: "192.0.2.1", Name: name, Type: "A", Rcode: "NOERROR", Answers: 1, Duration: 1.5})
+	}
+	assert.Nil(t, sink.WriteEntries(context.Background(), entries))
+
+	var name string
+	var count int
+	err = db.QueryRow(`SELECT name, COUNT(*) AS n FROM queries GROUP BY name ORDER BY n DESC LIMIT 1`).Scan(&name, &count)
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com.", name)
+	assert.Equal(t, 2, count)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSink keeps the batches it receives
+type recordingSink struct {
+	lock    sync.Mutex
+	batches [][]QueryLogEntry
+}
+
+func (r *recordingSink) WriteEntries(_ context.Context, entries []QueryLogEntry) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.batches = append(r.batches, entries)
+	return nil
+}
+
+func (r *recordingSink) sizes() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var sizes []int
+	for _, b := range r.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func TestQueryLogBatcher(t *testing.T) {
+	sink := &recordingSink{}
+	b := newQueryLogBatcher(sink, 2, time.Hour, logrus.New())
+	for _, name := range []string{"a.", "b.", "c."} {
+		b.add(QueryLogEntry{Name: name})
+	}
+	// Full batches are sent right away, the rest when closing
+	assert.Eventually(t, func() bool { return len(sink.sizes()) == 1 }, time.Second, 10*time.Millisecond)
+	b.close()
+	assert.Equal(t, []int{2, 1}, sink.sizes())
+
+	// Partial batches are sent every interval
+	sink = &recordingSink{}
+	b = newQueryLogBatcher(sink, 100, 20*time.Millisecond, logrus.New())
+	defer b.close()
+	b.add(QueryLogEntry{Name: "a."})
+	assert.Eventually(t, func() bool { return len(sink.sizes()) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestClickHouseQueryLogSink(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string
+	var rows []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "doqd", user)
+		assert.Equal(t, "secret", password)
+		assert.Equal(t, "dns", r.URL.Query().Get("database"))
+		queries = append(queries, r.URL.Query().Get("query"))
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			row := map[string]interface{}{}
+			assert.Nil(t, json.Unmarshal(scanner.Bytes(), &row))
+			rows = append(rows, row)
+		}
+	}))
+	defer ts.Close()
+
+	_, err := NewClickHouseQueryLogSink(ts.URL, "queries; DROP TABLE x")
+	assert.NotNil(t, err)
+
+	url := strings.Replace(ts.URL, "http://", "http://doqd:secret@", 1) + "/?database=dns"
+	sink, err := NewClickHouseQueryLogSink(url, "queries")
+	if !assert.Nil(t, err) {
+		return
+	}
+	err = sink.WriteEntries(context.Background(), []QueryLogEntry{
+		{Time: time.Now(), Client: "192.0.2.1", Name: "example.com.", Type: "A", Rcode: "NOERROR", Answers: 1},
+		{Time: time.Now(), Client: "192.0.2.2", Name: "example.net.", Type: "AAAA", Rcode: "NXDOMAIN"},
+	})
+	assert.Nil(t, err)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Len(t, queries, 2)
+	assert.True(t, strings.HasPrefix(queries[0], "CREATE TABLE IF NOT EXISTS queries"))
+	assert.Equal(t, "INSERT INTO queries FORMAT JSONEachRow", queries[1])
+	assert.Len(t, rows, 2)
+	assert.Equal(t, "example.net.", rows[1]["name"])
+}
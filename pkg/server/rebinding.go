@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Actions taken on upstream answers resolving to private addresses
+const (
+	// RebindingStrip removes the private address records from the answer
+	RebindingStrip = "strip"
+	// RebindingRefuse answers REFUSED with a "Blocked" Extended DNS Error
+	RebindingRefuse = "refuse"
+)
+
+// RebindingConfig configures DNS rebinding protection, stopping public names
+// from resolving to private, loopback or link-local addresses so web pages
+// cannot use them to reach devices on the client's network
+type RebindingConfig struct {
+	// Action is RebindingStrip or RebindingRefuse, protection is off when
+	// empty
+	Action string
+	// Allowed are the names allowed to resolve to private addresses, e.g.
+	// for split-horizon zones, *.example.com matching the names below
+	// example.com
+	Allowed []string
+}
+
+// rebindingFilter enforces DNS rebinding protection
+type rebindingFilter struct {
+	refuse  bool
+	allowed *domainList
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598)
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// newRebindingFilter returns a rebinding filter, or nil when protection is
+// off
+func newRebindingFilter(c RebindingConfig) (*rebindingFilter, error) {
+	if c.Action == "" {
+		return nil, nil
+	}
+	if c.Action != RebindingStrip && c.Action != RebindingRefuse {
+		return nil, errors.New("rebinding protection: unknown action " + c.Action)
+	}
+	f := &rebindingFilter{refuse: c.Action == RebindingRefuse, allowed: newDomainList()}
+	for _, name := range c.Allowed {
+		if err := f.allowed.add(name); err != nil {
+			return nil, errors.New("rebinding protection: " + err.Error())
+		}
+	}
+	return f, nil
+}
+
+// filter applies the protection to an upstream reply, returning the reply
+// to send
+func (f *rebindingFilter) filter(q *query, reply *dns.Msg, m *metrics) *dns.Msg {
+	if len(q.msg.Question) != 1 || f.allowed.match(strings.ToLower(q.msg.Question[0].Name)) {
+		return reply
+	}
+	answers := reply.Answer[:0:0]
+	for _, rr := range reply.Answer {
+		if !privateRR(rr) {
+			answers = append(answers, rr)
+		}
+	}
+	if len(answers) == len(reply.Answer) {
+		return reply
+	}
+
+	m.rebindingBlocked.Inc()
+	if f.refuse {
+		refused := new(dns.Msg)
+		refused.SetRcode(q.msg, dns.RcodeRefused)
+		refused.RecursionAvailable = true
+		setBlockedEDE(refused, q.msg, "DNS rebinding")
+		return refused
+	}
+	reply.Answer = answers
+	return reply
+}
+
+// privateRR reports whether a record is an address on a private, loopback,
+// link-local or unspecified network
+func privateRR(rr dns.RR) bool {
+	var ip net.IP
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip = rr.A
+	case *dns.AAAA:
+		ip = rr.AAAA
+	default:
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() ||
+		addr.IsUnspecified() || sharedAddressSpace.Contains(addr)
+}
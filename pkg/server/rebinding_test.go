@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// addrUpstream answers A queries with fixed addresses
+type addrUpstream []string
+
+func (u addrUpstream) String() string { return "addrs" }
+
+func (u addrUpstream) Exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	for _, ip := range u {
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+	}
+	return reply, nil
+}
+
+func TestRebindingProtection(t *testing.T) {
+	resolve := func(c RebindingConfig, name string, addrs ...string) *dns.Msg {
+		f, err := newRebindingFilter(c)
+		assert.Nil(t, err)
+		s := &Server{upstream: &monitoredUpstream{Resolver: addrUpstream(addrs)}, logger: logrus.New(), rebinding: f}
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		return s.resolve(&query{msg: msg})
+	}
+	strip := RebindingConfig{Action: RebindingStrip, Allowed: []string{"*.corp.example"}}
+
+	reply := resolve(strip, "evil.example.", "192.0.2.1", "192.168.1.1", "127.0.0.1", "169.254.1.1", "100.64.0.1", "0.0.0.0")
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, "192.0.2.1", reply.Answer[0].(*dns.A).A.String())
+
+	reply = resolve(strip, "intranet.corp.example.", "10.0.0.1")
+	assert.Len(t, reply.Answer, 1)
+
+	refuse := RebindingConfig{Action: RebindingRefuse}
+	assert.Equal(t, dns.RcodeRefused, resolve(refuse, "evil.example.", "10.0.0.1").Rcode)
+	assert.Equal(t, dns.RcodeSuccess, resolve(refuse, "good.example.", "192.0.2.1").Rcode)
+	assert.Len(t, resolve(RebindingConfig{}, "evil.example.", "10.0.0.1").Answer, 1)
+
+	_, err := newRebindingFilter(RebindingConfig{Action: "drop"})
+	assert.NotNil(t, err)
+}
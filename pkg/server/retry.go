@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// newSourceAddressVerifier returns a quic-go VerifySourceAddress callback
+// requiring a Retry round trip from every client when force is set, or from
+// new clients above connPerSecond unvalidated connection attempts per second.
+// It returns nil when address validation is disabled.
+func newSourceAddressVerifier(force bool, connPerSecond int, m *metrics) func(net.Addr) bool {
+	var limiter *rate.Limiter
+	switch {
+	case force:
+	case connPerSecond > 0:
+		limiter = rate.NewLimiter(rate.Limit(connPerSecond), connPerSecond)
+	default:
+		return nil
+	}
+
+	return func(net.Addr) bool {
+		if limiter != nil && limiter.Allow() {
+			return false
+		}
+		m.retries.Inc()
+		return true
+	}
+}
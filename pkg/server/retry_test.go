@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+func TestSourceAddressVerifier(t *testing.T) {
+	assert.Nil(t, newSourceAddressVerifier(false, 0, defaultMetrics()))
+
+	verify := newSourceAddressVerifier(true, 0, defaultMetrics())
+	assert.True(t, verify(nil))
+
+	// Retry only once the burst is used up
+	verify = newSourceAddressVerifier(false, 3, defaultMetrics())
+	for i := 0; i < 3; i++ {
+		assert.False(t, verify(nil))
+	}
+	assert.True(t, verify(nil))
+}
+
+func TestForceRetry(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Cert:       testCertificate(t, "localhost"),
+		Resolver:   &ttlUpstream{ttl: 60},
+		ForceRetry: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = doqServer.Close() })
+	go doqServer.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.NewContext(ctx, client.Config{Server: doqServer.Listener.Addr().String(), TLSSkipVerify: true})
+	require.NoError(t, err)
+	defer c.Close()
+	req := dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := c.SendQueryContext(ctx, req)
+	require.NoError(t, err)
+	assert.Len(t, resp.Answer, 1)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// privateReverseTTL is the TTL of locally answered reverse lookups
+const privateReverseTTL = 300
+
+// privateRanges are the networks whose reverse lookups are answered locally
+// (RFC 6303), so they do not leak to public resolvers
+var privateRanges = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// PrivateReverseConfig configures answering reverse lookups of private
+// addresses locally
+type PrivateReverseConfig struct {
+	// Enabled answers PTR queries for private, loopback and link-local
+	// addresses with the configured names, and with NXDOMAIN otherwise
+	Enabled bool
+	// Names maps IP addresses to their names
+	Names map[string]string
+	// HostsFile adds the names of a hosts file
+	HostsFile string
+}
+
+// privateReverse answers reverse lookups of private addresses
+type privateReverse struct {
+	names map[netip.Addr][]string
+}
+
+// newPrivateReverse loads the reverse names, or returns nil when disabled
+func newPrivateReverse(c PrivateReverseConfig) (*privateReverse, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	p := &privateReverse{names: map[netip.Addr][]string{}}
+	for addr, name := range c.Names {
+		if err := p.add(addr, name); err != nil {
+			return nil, errors.New("private reverse: " + err.Error())
+		}
+	}
+	if c.HostsFile != "" {
+		if err := p.loadHosts(c.HostsFile); err != nil {
+			return nil, errors.New("private reverse: " + err.Error())
+		}
+	}
+	return p, nil
+}
+
+// add names an address
+func (p *privateReverse) add(addr, name string) error {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return err
+	}
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return errors.New("invalid name " + name)
+	}
+	ip = ip.Unmap()
+	p.names[ip] = append(p.names[ip], name)
+	return nil
+}
+
+// loadHosts adds the names of a hosts file
+func (p *privateReverse) loadHosts(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		// Only the canonical name, the first after the address, is used
+		if len(fields) < 2 {
+			return errors.New(path + ": line " + strconv.Itoa(line) + ": missing name")
+		}
+		if err := p.add(fields[0], fields[1]); err != nil {
+			return errors.New(path + ": line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+// answer answers a query for a name in a private reverse zone, or returns
+// nil for other queries
+func (p *privateReverse) answer(msg *dns.Msg) *dns.Msg {
+	if len(msg.Question) != 1 || msg.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := msg.Question[0]
+	prefix, ok := reversePrefix(question.Name)
+	if !ok || !privatePrefix(prefix) {
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(msg)
+	reply.RecursionAvailable = true
+	names, ok := p.names[prefix.Addr()]
+	if !prefix.IsSingleIP() || !ok {
+		reply.Rcode = dns.RcodeNameError
+		return reply
+	}
+	if question.Qtype == dns.TypePTR || question.Qtype == dns.TypeANY {
+		for _, name := range names {
+			reply.Answer = append(reply.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: privateReverseTTL},
+				Ptr: name,
+			})
+		}
+	}
+	return reply
+}
+
+// privatePrefix reports whether a prefix lies within a private range
+func privatePrefix(prefix netip.Prefix) bool {
+	for _, r := range privateRanges {
+		if r.Bits() <= prefix.Bits() && r.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// reversePrefix parses an in-addr.arpa or ip6.arpa name into the prefix it
+// covers, e.g. 168.192.in-addr.arpa. into 192.168.0.0/16
+func reversePrefix(name string) (netip.Prefix, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa."); ok {
+		parts := strings.Split(labels, ".")
+		if len(parts) > 4 {
+			return netip.Prefix{}, false
+		}
+		var b [4]byte
+		for i, part := range parts {
+			n, err := strconv.ParseUint(part, 10, 8)
+			if err != nil {
+				return netip.Prefix{}, false
+			}
+			b[len(parts)-1-i] = byte(n)
+		}
+		return netip.PrefixFrom(netip.AddrFrom4(b), 8*len(parts)), true
+	}
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa."); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) > 32 {
+			return netip.Prefix{}, false
+		}
+		var b [16]byte
+		for i, nibble := range nibbles {
+			n, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return netip.Prefix{}, false
+			}
+			pos := len(nibbles) - 1 - i
+			if pos%2 == 0 {
+				b[pos/2] |= byte(n) << 4
+			} else {
+				b[pos/2] |= byte(n)
+			}
+		}
+		return netip.PrefixFrom(netip.AddrFrom16(b), 4*len(nibbles)), true
+	}
+	return netip.Prefix{}, false
+}
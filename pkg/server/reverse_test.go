@@ -0,0 +1,85 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReversePrefix(t *testing.T) {
+	for name, want := range map[string]string{
+		"1.0.168.192.in-addr.arpa.": "192.168.0.1/32",
+		"168.192.in-addr.arpa.":     "192.168.0.0/16",
+		"10.IN-ADDR.ARPA":           "10.0.0.0/8",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.": "fd00::1/128",
+		"d.f.ip6.arpa.": "fd00::/8",
+	} {
+		prefix, ok := reversePrefix(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, want, prefix.String(), name)
+	}
+	for _, name := range []string{"example.com.", "256.in-addr.arpa.", "1.2.3.4.5.in-addr.arpa.", "ff.ip6.arpa."} {
+		_, ok := reversePrefix(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestPrivateReverse(t *testing.T) {
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	assert.Nil(t, os.WriteFile(hosts, []byte("# lan\n192.168.1.10 nas.lan nas\nfd00::1 router.lan\n"), 0o600))
+	r, err := newPrivateReverse(PrivateReverseConfig{
+		Enabled:   true,
+		Names:     map[string]string{"10.0.0.1": "gateway.lan"},
+		HostsFile: hosts,
+	})
+	assert.Nil(t, err)
+	s := &Server{upstream: &monitoredUpstream{Resolver: addrUpstream{"198.51.100.1"}}, logger: logrus.New(), reverse: r}
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		return s.resolve(&query{msg: msg})
+	}
+
+	reply := resolve("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, "gateway.lan.", reply.Answer[0].(*dns.PTR).Ptr)
+	}
+	reply = resolve("10.1.168.192.in-addr.arpa.", dns.TypePTR)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, "nas.lan.", reply.Answer[0].(*dns.PTR).Ptr)
+	}
+	reply = resolve("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR)
+	if assert.Len(t, reply.Answer, 1) {
+		assert.Equal(t, "router.lan.", reply.Answer[0].(*dns.PTR).Ptr)
+	}
+
+	// Named addresses have no other records
+	reply = resolve("1.0.0.10.in-addr.arpa.", dns.TypeTXT)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+
+	// Unknown private addresses and private zones are not forwarded
+	for _, name := range []string{"2.0.0.10.in-addr.arpa.", "16.172.in-addr.arpa.", "1.0.0.127.in-addr.arpa."} {
+		reply = resolve(name, dns.TypePTR)
+		assert.Equal(t, dns.RcodeNameError, reply.Rcode, name)
+	}
+
+	// Public addresses and zones wider than a private range are forwarded
+	for _, name := range []string{"8.8.8.8.in-addr.arpa.", "172.in-addr.arpa."} {
+		reply = resolve(name, dns.TypePTR)
+		assert.Equal(t, dns.RcodeSuccess, reply.Rcode, name)
+		assert.Len(t, reply.Answer, 1, name)
+	}
+
+	_, err = newPrivateReverse(PrivateReverseConfig{Enabled: true, Names: map[string]string{"nope": "x.lan"}})
+	assert.NotNil(t, err)
+	r, err = newPrivateReverse(PrivateReverseConfig{Names: map[string]string{"10.0.0.1": "x.lan"}})
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rewriteTTL is the TTL of the records synthesized by rewrites
+const rewriteTTL = 60
+
+// rewriter answers names locally with fixed addresses, or with the answer
+// for another name
+type rewriter struct {
+	exact    map[string]*rewriteRule
+	wildcard map[string]*rewriteRule
+}
+
+// rewriteRule is the target of a rewrite, either addresses or a name
+type rewriteRule struct {
+	addrs  []netip.Addr
+	target string
+}
+
+// newRewriter parses rewrite rules mapping a name, or a *. wildcard matching
+// the names below a domain, to comma separated IP addresses or another name.
+// It returns nil when there are no rules.
+func newRewriter(rules map[string]string) (*rewriter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &rewriter{exact: map[string]*rewriteRule{}, wildcard: map[string]*rewriteRule{}}
+	for name, target := range rules {
+		name = strings.ToLower(name)
+		wildcard := strings.HasPrefix(name, "*.")
+		name = dns.Fqdn(strings.TrimPrefix(name, "*."))
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, errors.New("rewrite: invalid name " + name)
+		}
+
+		rule := &rewriteRule{}
+		fields := strings.Split(target, ",")
+		if _, err := netip.ParseAddr(strings.TrimSpace(fields[0])); err != nil && len(fields) == 1 {
+			rule.target = strings.ToLower(dns.Fqdn(strings.TrimSpace(target)))
+			if _, ok := dns.IsDomainName(rule.target); !ok {
+				return nil, errors.New("rewrite " + name + ": invalid target " + target)
+			}
+		} else {
+			for _, field := range fields {
+				addr, err := netip.ParseAddr(strings.TrimSpace(field))
+				if err != nil {
+					return nil, errors.New("rewrite " + name + ": " + err.Error())
+				}
+				rule.addrs = append(rule.addrs, addr.Unmap())
+			}
+		}
+
+		if wildcard {
+			r.wildcard[name] = rule
+		} else {
+			r.exact[name] = rule
+		}
+	}
+	return r, nil
+}
+
+// lookup returns the rule for a lowercased fully qualified name, if any
+func (r *rewriter) lookup(name string) *rewriteRule {
+	if rule, ok := r.exact[name]; ok {
+		return rule
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if rule, ok := r.wildcard[name[off:]]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// rewrite answers a query matching a rewrite rule, or returns nil
+func (s *Server) rewrite(r *rewriter, q *query) *dns.Msg {
+	if len(q.msg.Question) != 1 {
+		return nil
+	}
+	question := q.msg.Question[0]
+	rule := r.lookup(strings.ToLower(question.Name))
+	if rule == nil {
+		return nil
+	}
+
+	if rule.target != "" {
+		// Answer for the target name, behind a CNAME from the queried name
+		msg := q.msg.Copy()
+		msg.Question[0].Name = rule.target
+		target := *q
+		target.msg = msg
+		reply := s.forward(&target)
+		reply.Question = []dns.Question{question}
+		reply.Answer = append([]dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: rewriteTTL},
+			Target: rule.target,
+		}}, reply.Answer...)
+		return reply
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(q.msg)
+	reply.RecursionAvailable = true
+	reply.Answer = addressRRs(question, rule.addrs, rewriteTTL)
+	return reply
+}
+
+// addressRRs returns the records answering an A or AAAA question with
+// addresses, none for other questions
+func addressRRs(question dns.Question, addrs []netip.Addr, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+	hdr := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Ttl: ttl}
+	for _, addr := range addrs {
+		switch {
+		case question.Qtype == dns.TypeA && addr.Is4():
+			hdr.Rrtype = dns.TypeA
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: net.IP(addr.AsSlice())})
+		case question.Qtype == dns.TypeAAAA && addr.Is6():
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: net.IP(addr.AsSlice())})
+		}
+	}
+	return rrs
+}
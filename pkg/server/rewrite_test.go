@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewrite(t *testing.T) {
+	r, err := newRewriter(map[string]string{
+		"router.lan":         "192.168.1.1, fd00::1",
+		"*.internal.example": "10.0.0.1",
+		"search.example":     "safe.search.example",
+	})
+	assert.Nil(t, err)
+	up := &ttlUpstream{ttl: 300}
+	s := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New(), rewriter: r}
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		return s.resolve(&query{msg: msg})
+	}
+
+	reply := resolve("Router.LAN.", dns.TypeA)
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, "Router.LAN.", reply.Answer[0].Header().Name)
+	assert.Equal(t, net.ParseIP("192.168.1.1").To4(), reply.Answer[0].(*dns.A).A)
+	reply = resolve("router.lan.", dns.TypeAAAA)
+	assert.Len(t, reply.Answer, 1)
+	assert.Equal(t, net.ParseIP("fd00::1"), reply.Answer[0].(*dns.AAAA).AAAA)
+	reply = resolve("router.lan.", dns.TypeMX)
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	assert.Empty(t, reply.Answer)
+
+	assert.Len(t, resolve("a.b.internal.example.", dns.TypeA).Answer, 1)
+	assert.Equal(t, int32(0), up.exchanges.Load())
+
+	// Name targets are answered upstream behind a CNAME
+	reply = resolve("search.example.", dns.TypeA)
+	assert.Equal(t, int32(1), up.exchanges.Load())
+	assert.Equal(t, "search.example.", reply.Question[0].Name)
+	assert.Len(t, reply.Answer, 2)
+	assert.Equal(t, "safe.search.example.", reply.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "safe.search.example.", reply.Answer[1].Header().Name)
+
+	for _, rules := range []map[string]string{
+		{"bad..name": "192.0.2.1"},
+		{"example.com": "192.0.2.1,other.example"},
+	} {
+		_, err := newRewriter(rules)
+		assert.NotNil(t, err)
+	}
+}
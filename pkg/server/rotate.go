@@ -0,0 +1,26 @@
+package server
+
+import "github.com/miekg/dns"
+
+// rotateAddresses rotates the order of the A records and of the AAAA records
+// of an answer by n places, so clients of a cached answer do not all pick
+// the same address
+func rotateAddresses(msg *dns.Msg, n uint64) {
+	for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var positions []int
+		var rrs []dns.RR
+		for i, rr := range msg.Answer {
+			if rr.Header().Rrtype == rrtype {
+				positions = append(positions, i)
+				rrs = append(rrs, rr)
+			}
+		}
+		if len(rrs) < 2 {
+			continue
+		}
+		shift := int(n % uint64(len(rrs)))
+		for i, pos := range positions {
+			msg.Answer[pos] = rrs[(i+shift)%len(rrs)]
+		}
+	}
+}
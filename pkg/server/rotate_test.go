@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateAddresses(t *testing.T) {
+	s := &Server{
+		upstream:      &monitoredUpstream{Resolver: addrUpstream{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		logger:        logrus.New(),
+		cache:         NewMemoryCache(10, nil),
+		rotateAnswers: true,
+	}
+	first := func() string {
+		return cacheQuery(s, "example.com.").Answer[0].(*dns.A).A.String()
+	}
+
+	// The upstream answer is left alone, cached ones rotate
+	assert.Equal(t, "192.0.2.1", first())
+	assert.Equal(t, "192.0.2.2", first())
+	assert.Equal(t, "192.0.2.3", first())
+	assert.Equal(t, "192.0.2.1", first())
+
+	msg := new(dns.Msg)
+	msg.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Rrtype: dns.TypeCNAME}},
+		&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: []byte{192, 0, 2, 1}},
+		&dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: []byte{192, 0, 2, 2}},
+	}
+	rotateAddresses(msg, 1)
+	assert.IsType(t, &dns.CNAME{}, msg.Answer[0])
+	assert.Equal(t, "192.0.2.2", msg.Answer[1].(*dns.A).A.String())
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// Response shaping actions
+const (
+	shapeTruncate = "truncate"
+	shapeRefused  = "refused"
+)
+
+// ShapingConfig caps the responses sent over each DoQ connection, protecting
+// the server from clients requesting huge RRsets in tight loops. Responses
+// over a cap are replaced by an empty one, truncated or refused.
+type ShapingConfig struct {
+	// MaxResponseSize is the largest response in bytes, 0 for no limit
+	MaxResponseSize int
+	// BytesPerSecond caps the response bytes per second of a connection,
+	// 0 for no limit
+	BytesPerSecond int
+	// Burst is the number of bytes a connection can receive at once above
+	// BytesPerSecond, the larger of BytesPerSecond and 65535 when zero
+	Burst int
+	// Action is truncate, answering with the TC bit set and no records, or
+	// refused, answering with REFUSED. Truncate is the default.
+	Action string
+}
+
+// shaper caps the responses of DoQ connections
+type shaper struct {
+	conf ShapingConfig
+}
+
+// newShaper validates the shaping config, or returns nil when responses
+// aren't capped
+func newShaper(c ShapingConfig) (*shaper, error) {
+	if c.MaxResponseSize < 0 || c.BytesPerSecond < 0 || c.Burst < 0 {
+		return nil, errors.New("response shaping: limits must not be negative")
+	}
+	switch c.Action {
+	case "":
+		c.Action = shapeTruncate
+	case shapeTruncate, shapeRefused:
+	default:
+		return nil, errors.New("response shaping: unknown action " + c.Action)
+	}
+	if c.MaxResponseSize == 0 && c.BytesPerSecond == 0 {
+		return nil, nil
+	}
+	if c.Burst == 0 {
+		c.Burst = max(c.BytesPerSecond, dns.MaxMsgSize)
+	}
+	return &shaper{conf: c}, nil
+}
+
+// newLimiter returns the byte rate limiter of a connection, nil when the
+// rate isn't capped
+func (s *shaper) newLimiter() *rate.Limiter {
+	if s == nil || s.conf.BytesPerSecond == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(s.conf.BytesPerSecond), s.conf.Burst)
+}
+
+// shape returns the packed reply to send for a query, replaced by an empty
+// one when it is too large or the connection is over its rate. It reports
+// whether the reply was replaced.
+func (s *shaper) shape(q, reply *dns.Msg, packed []byte, limiter *rate.Limiter) ([]byte, bool) {
+	if s == nil {
+		return packed, false
+	}
+	if s.conf.MaxResponseSize == 0 || len(packed) <= s.conf.MaxResponseSize {
+		if limiter == nil || limiter.AllowN(time.Now(), len(packed)) {
+			return packed, false
+		}
+	}
+
+	shaped := emptyReply(q, reply)
+	if s.conf.Action == shapeRefused {
+		shaped.Rcode = dns.RcodeRefused
+	} else {
+		shaped.Truncated = true
+	}
+	b, err := shaped.Pack()
+	if err != nil {
+		return packed, false
+	}
+	return b, true
+}
+
+// emptyReply returns a copy of the reply to q without its records, keeping
+// its ID, rcode and EDNS buffer size
+func emptyReply(q, reply *dns.Msg) *dns.Msg {
+	empty := new(dns.Msg)
+	empty.SetReply(q)
+	empty.Id = reply.Id
+	empty.Rcode = reply.Rcode
+	if opt := reply.IsEdns0(); opt != nil {
+		empty.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return empty
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// largeReply returns a reply to q with n A records
+func largeReply(q *dns.Msg, n int) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(q)
+	for i := 0; i < n; i++ {
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	return reply
+}
+
+func TestNewShaper(t *testing.T) {
+	s, err := newShaper(ShapingConfig{})
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+	assert.Nil(t, s.newLimiter())
+
+	_, err = newShaper(ShapingConfig{MaxResponseSize: 512, Action: "drop"})
+	assert.NotNil(t, err)
+	_, err = newShaper(ShapingConfig{BytesPerSecond: -1})
+	assert.NotNil(t, err)
+
+	s, err = newShaper(ShapingConfig{BytesPerSecond: 1000})
+	assert.Nil(t, err)
+	assert.Equal(t, shapeTruncate, s.conf.Action)
+	assert.Equal(t, dns.MaxMsgSize, s.conf.Burst)
+}
+
+func TestShapeMaxResponseSize(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, true)
+	q.Id = 1234
+
+	for _, action := range []string{shapeTruncate, shapeRefused} {
+		s, err := newShaper(ShapingConfig{MaxResponseSize: 512, Action: action})
+		assert.Nil(t, err)
+
+		small := largeReply(q, 2)
+		packed, _ := small.Pack()
+		out, shaped := s.shape(q, small, packed, s.newLimiter())
+		assert.False(t, shaped)
+		assert.Equal(t, packed, out)
+
+		large := largeReply(q, 100)
+		large.SetEdns0(4096, true)
+		packed, _ = large.Pack()
+		out, shaped = s.shape(q, large, packed, s.newLimiter())
+		assert.True(t, shaped)
+		m := new(dns.Msg)
+		assert.Nil(t, m.Unpack(out))
+		assert.Equal(t, q.Id, m.Id)
+		assert.Equal(t, q.Question, m.Question)
+		assert.Empty(t, m.Answer)
+		assert.NotNil(t, m.IsEdns0())
+		if action == shapeRefused {
+			assert.Equal(t, dns.RcodeRefused, m.Rcode)
+			assert.False(t, m.Truncated)
+		} else {
+			assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+			assert.True(t, m.Truncated)
+		}
+	}
+}
+
+func TestShapeBytesPerSecond(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	reply := largeReply(q, 20)
+	packed, _ := reply.Pack()
+
+	s, err := newShaper(ShapingConfig{BytesPerSecond: 1, Burst: 3 * len(packed)})
+	assert.Nil(t, err)
+	limiter := s.newLimiter()
+	for i := 0; i < 3; i++ {
+		_, shaped := s.shape(q, reply, packed, limiter)
+		assert.False(t, shaped)
+	}
+	_, shaped := s.shape(q, reply, packed, limiter)
+	assert.True(t, shaped)
+
+	// Every connection has its own budget
+	_, shaped = s.shape(q, reply, packed, s.newLimiter())
+	assert.False(t, shaped)
+}
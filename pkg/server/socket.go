@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultSocketBufferSize is the SO_RCVBUF and SO_SNDBUF size requested for
+// the QUIC listener when none is configured
+const defaultSocketBufferSize = 8 << 20
+
+// Address families listeners can be restricted to
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// SocketConfig controls how every listener of the server is bound, for
+// multi-homed hosts
+type SocketConfig struct {
+	// Family restricts listeners to ipv4 or ipv6 addresses, host names
+	// resolving to both are bound to the family's address. Both families are
+	// used when empty.
+	Family string
+	// Interface binds listeners to a network interface, so they only accept
+	// traffic arriving on it. Only supported on Linux.
+	Interface string
+	// V6Only, when set, overrides the IPV6_V6ONLY option of IPv6 listeners:
+	// true only accepts IPv6 traffic on a wildcard address, false IPv4
+	// traffic too. Only supported on Linux.
+	V6Only *bool
+}
+
+// validate checks the socket options
+func (c SocketConfig) validate() error {
+	switch c.Family {
+	case "", FamilyIPv4, FamilyIPv6:
+		return nil
+	default:
+		return errors.New("unknown address family " + c.Family)
+	}
+}
+
+// network returns the network of a listener on tcp or udp, restricted to
+// the address family
+func (c SocketConfig) network(base string) string {
+	switch c.Family {
+	case FamilyIPv4:
+		return base + "4"
+	case FamilyIPv6:
+		return base + "6"
+	default:
+		return base
+	}
+}
+
+// listenConfig applies the socket options before a listener is bound. With
+// reusePort, the address can be shared by several sockets.
+func (c SocketConfig) listenConfig(reusePort bool) *net.ListenConfig {
+	return &net.ListenConfig{Control: func(network, address string, raw syscall.RawConn) error {
+		if reusePort {
+			if err := reusePortControl(network, address, raw); err != nil {
+				return err
+			}
+		}
+		if c.Interface != "" {
+			if err := bindToDeviceControl(raw, c.Interface); err != nil {
+				return err
+			}
+		}
+		if c.V6Only != nil && strings.HasSuffix(network, "6") {
+			if err := v6OnlyControl(raw, *c.V6Only); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
+
+// listen opens a TCP listener with the socket options
+func (c SocketConfig) listen(listenAddr string) (net.Listener, error) {
+	return c.listenConfig(false).Listen(context.Background(), c.network("tcp"), listenAddr)
+}
+
+// listenPacket opens a UDP socket with the socket options
+func (c SocketConfig) listenPacket(listenAddr string, reusePort bool) (net.PacketConn, error) {
+	return c.listenConfig(reusePort).ListenPacket(context.Background(), c.network("udp"), listenAddr)
+}
+
+// listenUDP opens a QUIC listener's UDP socket with the given receive and
+// send buffer sizes, warning when the OS grants less than requested. With
+// reusePort, the address can be shared by several sockets.
+func listenUDP(listenAddr string, socket SocketConfig, bufSize int, reusePort bool, logger *logrus.Logger) (*net.UDPConn, error) {
+	pc, err := socket.listenPacket(listenAddr, reusePort)
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+
+	if err := conn.SetReadBuffer(bufSize); err != nil {
+		logger.Warnf("set UDP receive buffer to %d bytes: %v", bufSize, err)
+	}
+	if err := conn.SetWriteBuffer(bufSize); err != nil {
+		logger.Warnf("set UDP send buffer to %d bytes: %v", bufSize, err)
+	}
+	if read, write, err := socketBufferSizes(conn); err == nil && (read < bufSize || write < bufSize) {
+		logger.Warnf("UDP socket buffers clamped by the OS to %d bytes receive and %d bytes send, requested %d; "+
+			"raise net.core.rmem_max and net.core.wmem_max for better throughput", read, write, bufSize)
+	}
+	return conn, nil
+}
+
+// setOffloadOptions disables UDP segmentation offload (GSO/GRO) and ECN in
+// quic-go, which reads them from the environment when a socket is opened.
+// This applies to every QUIC socket opened afterwards by the process.
+func setOffloadOptions(disableGSO, disableECN bool) {
+	if disableGSO {
+		_ = os.Setenv("QUIC_GO_DISABLE_GSO", "true")
+	}
+	if disableECN {
+		_ = os.Setenv("QUIC_GO_DISABLE_ECN", "true")
+	}
+}
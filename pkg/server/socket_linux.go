@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketBufferSizes returns the effective receive and send buffer sizes of a
+// UDP socket
+func socketBufferSizes(conn *net.UDPConn) (read, write int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		read, serr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		if serr == nil {
+			write, serr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+		}
+	}); err != nil {
+		return 0, 0, err
+	}
+	// Linux reports double the granted size to account for bookkeeping overhead
+	return read / 2, write / 2, serr
+}
+
+// reusePortControl sets SO_REUSEPORT on a socket before it is bound
+func reusePortControl(_, _ string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// bindToDeviceControl binds a socket to a network interface before it is
+// bound to an address
+func bindToDeviceControl(c syscall.RawConn, iface string) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.BindToDevice(int(fd), iface)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return errors.New("bind to interface " + iface + ": " + serr.Error())
+	}
+	return nil
+}
+
+// v6OnlyControl sets IPV6_V6ONLY on an IPv6 socket before it is bound
+func v6OnlyControl(c syscall.RawConn, v6Only bool) error {
+	value := 0
+	if v6Only {
+		value = 1
+	}
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, value)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
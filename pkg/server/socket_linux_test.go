@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+func TestReusePortListeners(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr:         "127.0.0.1:0",
+		Cert:               testCertificate(t, "localhost"),
+		Resolver:           &ttlUpstream{ttl: 60},
+		ReusePortListeners: 4,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = doqServer.Close() })
+	go doqServer.Listen()
+
+	assert.Len(t, doqServer.listeners, 4)
+	addr := doqServer.Listener.Addr().String()
+	for _, l := range doqServer.listeners {
+		assert.Equal(t, addr, l.Addr().String())
+	}
+
+	// Connections from different source ports are spread over the sockets
+	for i := 0; i < 4; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c, err := client.NewContext(ctx, client.Config{Server: addr, TLSSkipVerify: true})
+		require.NoError(t, err)
+		req := dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeA)
+		resp, err := c.SendQueryContext(ctx, req)
+		require.NoError(t, err)
+		assert.Len(t, resp.Answer, 1)
+		_ = c.Close()
+		cancel()
+	}
+}
+
+func TestSocketOptions(t *testing.T) {
+	// The family picks the address of names resolving to both
+	pc, err := SocketConfig{Family: FamilyIPv4}.listenPacket("localhost:0", false)
+	if assert.Nil(t, err) {
+		assert.True(t, pc.LocalAddr().(*net.UDPAddr).IP.To4() != nil)
+		_ = pc.Close()
+	}
+	_, err = SocketConfig{Family: FamilyIPv4}.listen("[::1]:0")
+	assert.NotNil(t, err)
+
+	l, err := SocketConfig{Interface: "lo"}.listen("127.0.0.1:0")
+	if assert.Nil(t, err) {
+		_ = l.Close()
+	}
+	_, err = SocketConfig{Interface: "nonexistent0"}.listen("127.0.0.1:0")
+	assert.NotNil(t, err)
+
+	for _, v6Only := range []bool{true, false} {
+		pc, err := SocketConfig{V6Only: &v6Only}.listenPacket("[::]:0", false)
+		if err != nil {
+			t.Skip("no IPv6 support: ", err)
+		}
+		raw, err := pc.(*net.UDPConn).SyscallConn()
+		assert.Nil(t, err)
+		var value int
+		assert.Nil(t, raw.Control(func(fd uintptr) {
+			value, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_V6ONLY)
+		}))
+		assert.Nil(t, err)
+		assert.Equal(t, v6Only, value == 1)
+		_ = pc.Close()
+	}
+
+	assert.NotNil(t, SocketConfig{Family: "ipx"}.validate())
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// socketBufferSizes is only implemented on Linux
+func socketBufferSizes(*net.UDPConn) (read, write int, err error) {
+	return 0, 0, errors.New("socket buffer sizes: unsupported platform")
+}
+
+// reusePortControl is only implemented on Linux
+func reusePortControl(string, string, syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT: unsupported platform")
+}
+
+// bindToDeviceControl is only implemented on Linux
+func bindToDeviceControl(syscall.RawConn, string) error {
+	return errors.New("bind to interface: unsupported platform")
+}
+
+// v6OnlyControl is only implemented on Linux
+func v6OnlyControl(syscall.RawConn, bool) error {
+	return errors.New("IPV6_V6ONLY: unsupported platform")
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mosajjal/doqd/pkg/upstream"
+)
+
+// Stats is a snapshot of a server's live state
+type Stats struct {
+	// Connections is the number of open QUIC connections, DoQ and DoH3
+	Connections int64 `json:"connections"`
+	// Streams is the number of open DoQ streams
+	Streams int64 `json:"streams"`
+	// QueriesInFlight is the number of queries being answered, on any
+	// front-end
+	QueriesInFlight int64 `json:"queries_in_flight"`
+	// Queries is the number of queries answered since the server started
+	Queries uint64 `json:"queries"`
+	// CacheEntries is the number of cached responses, and CacheHits and
+	// CacheMisses count lookups of cacheable queries
+	CacheEntries int             `json:"cache_entries"`
+	CacheHits    uint64          `json:"cache_hits"`
+	CacheMisses  uint64          `json:"cache_misses"`
+	Upstreams    []UpstreamStats `json:"upstreams"`
+}
+
+// UpstreamStats describes an upstream's state
+type UpstreamStats struct {
+	Address string `json:"address"`
+	// Healthy is false when the last exchange with the upstream failed
+	Healthy   bool    `json:"healthy"`
+	Queries   uint64  `json:"queries"`
+	Errors    uint64  `json:"errors"`
+	LastError string  `json:"last_error,omitempty"`
+	Latency   float64 `json:"avg_latency_ms"`
+	// Capabilities are what the upstream supports, once probed
+	Capabilities *upstream.Capabilities `json:"capabilities,omitempty"`
+}
+
+// Stats returns a snapshot of the server's live state
+func (s *Server) Stats() Stats {
+	stats := Stats{
+		Connections:     s.connections.Load(),
+		Streams:         s.streams.Load(),
+		QueriesInFlight: s.inFlight.Load(),
+		Queries:         s.queries.Load(),
+	}
+	for _, up := range s.upstreams() {
+		stats.Upstreams = append(stats.Upstreams, up.stats())
+	}
+	if s.cache != nil {
+		stats.CacheEntries, _ = s.cache.Len(context.Background())
+		stats.CacheHits = s.cacheHits.Load()
+		stats.CacheMisses = s.cacheMisses.Load()
+	}
+	return stats
+}
+
+// upstreams returns the upstreams of the server, its views and tenants
+func (s *Server) upstreams() []*monitoredUpstream {
+	upstreams := []*monitoredUpstream{s.upstream}
+	for _, v := range append(s.tenants.views(), s.views...) {
+		if v.upstream != s.upstream {
+			upstreams = append(upstreams, v.upstream)
+		}
+	}
+	return upstreams
+}
+
+// probeUpstreams probes what the upstreams able to adapt to it support,
+// then again every interval until the server is closed
+func (s *Server) probeUpstreams(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, up := range s.upstreams() {
+			if p, ok := up.Resolver.(upstream.Prober); ok {
+				c := p.Probe(context.Background())
+				s.logger.Debugf("upstream %s: udp=%t edns=%t udp_size=%d tcp=%t dot=%t case=%t", up, c.UDP, c.EDNS, c.UDPSize, c.TCP, c.DoT, c.Case)
+			}
+		}
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// monitoredUpstream records the outcome of every exchange with an upstream
+type monitoredUpstream struct {
+	upstream.Resolver
+
+	queries atomic.Uint64
+	errors  atomic.Uint64
+	latency atomic.Int64 // total of successful exchanges, in nanoseconds
+
+	lock    sync.Mutex
+	lastErr error
+}
+
+func (m *monitoredUpstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := m.Resolver.Exchange(ctx, msg)
+	if err == nil {
+		// Responses to another question are never returned to the client
+		if err = upstream.CheckResponse(msg, resp); err != nil {
+			resp = nil
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		// Abandoned by the client, the upstream isn't at fault
+		return nil, err
+	}
+	m.queries.Add(1)
+	if err != nil {
+		m.errors.Add(1)
+	} else {
+		m.latency.Add(int64(time.Since(start)))
+	}
+	m.lock.Lock()
+	m.lastErr = err
+	m.lock.Unlock()
+	return resp, err
+}
+
+// String returns the upstream's address, or the type of a custom resolver
+func (m *monitoredUpstream) String() string {
+	if s, ok := m.Resolver.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", m.Resolver)
+}
+
+// stats returns a snapshot of the upstream's state
+func (m *monitoredUpstream) stats() UpstreamStats {
+	m.lock.Lock()
+	lastErr := m.lastErr
+	m.lock.Unlock()
+
+	st := UpstreamStats{
+		Address: m.String(),
+		Healthy: lastErr == nil,
+		Queries: m.queries.Load(),
+		Errors:  m.errors.Load(),
+	}
+	if lastErr != nil {
+		st.LastError = lastErr.Error()
+	}
+	if ok := st.Queries - st.Errors; ok > 0 {
+		st.Latency = float64(time.Duration(m.latency.Load()/int64(ok)).Microseconds()) / 1000
+	}
+	if p, ok := m.Resolver.(upstream.Prober); ok {
+		if caps, ok := p.Capabilities(); ok {
+			st.Capabilities = &caps
+		}
+	}
+	return st
+}
+
+// statsHandler serves the stats of all servers as a JSON array
+func statsHandler(servers []*Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		stats := make([]Stats, 0, len(servers))
+		for _, s := range servers {
+			stats = append(stats, s.Stats())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// downUpstream is a custom resolver failing every exchange
+type downUpstream struct{}
+
+func (downUpstream) Exchange(context.Context, *dns.Msg) (*dns.Msg, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestStats(t *testing.T) {
+	s := &Server{upstream: &monitoredUpstream{Resolver: &slowUpstream{}}}
+	s.connections.Add(2)
+	s.streams.Add(3)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	_, err := s.upstream.exchange(context.Background(), msg)
+	assert.Nil(t, err)
+
+	stats := s.Stats()
+	assert.Equal(t, int64(2), stats.Connections)
+	assert.Equal(t, int64(3), stats.Streams)
+	assert.Equal(t, int64(0), stats.QueriesInFlight)
+	assert.Equal(t, uint64(0), stats.Queries)
+	assert.Len(t, stats.Upstreams, 1)
+	assert.Equal(t, "slow", stats.Upstreams[0].Address)
+	assert.True(t, stats.Upstreams[0].Healthy)
+	assert.Equal(t, uint64(1), stats.Upstreams[0].Queries)
+	assert.GreaterOrEqual(t, stats.Upstreams[0].Latency, float64(100))
+
+	down := &Server{upstream: &monitoredUpstream{Resolver: downUpstream{}}}
+	_, err = down.upstream.exchange(context.Background(), msg)
+	assert.NotNil(t, err)
+	stats = down.Stats()
+	assert.False(t, stats.Upstreams[0].Healthy)
+	assert.Equal(t, "server.downUpstream", stats.Upstreams[0].Address)
+	assert.Equal(t, uint64(1), stats.Upstreams[0].Errors)
+	assert.NotEmpty(t, stats.Upstreams[0].LastError)
+
+	ts := httptest.NewServer(adminMux(AdminConfig{Servers: []*Server{s, down}}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/stats")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var served []Stats
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&served))
+	assert.Len(t, served, 2)
+	assert.Equal(t, int64(2), served[0].Connections)
+}
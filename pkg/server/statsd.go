@@ -0,0 +1,140 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsD packets are flushed when they reach statsdMaxPacket bytes, small
+// enough not to be fragmented on common links, or after statsdFlushInterval
+const (
+	statsdMaxPacket     = 1432
+	statsdFlushInterval = time.Second
+)
+
+// StatsDSink pushes the metrics of servers to a StatsD daemon over UDP, for
+// setups without Prometheus, e.g. with StatsD forwarding to Graphite.
+// Counters are sent as StatsD counters, cache_entries as a gauge and timings
+// in milliseconds. Label values are appended to the metric name, e.g.
+// doqd.tenant_queries.example.
+type StatsDSink struct {
+	prefix string
+	conn   net.Conn
+
+	lock sync.Mutex
+	buf  []byte
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewStatsDSink returns a sink sending metrics to the StatsD daemon at addr,
+// as host:port, named <prefix>.<metric>
+func NewStatsDSink(addr, prefix string) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.New("statsd: " + err.Error())
+	}
+	s := &StatsDSink{prefix: prefix, conn: conn, done: make(chan struct{})}
+	go s.flushLoop()
+	return s, nil
+}
+
+// Add sends a counter increment, or a gauge change for gauges
+func (s *StatsDSink) Add(name string, delta float64, labelValues ...string) {
+	value := strconv.FormatFloat(delta, 'f', -1, 64)
+	if metricKindOf(name) == gaugeMetric {
+		if delta >= 0 {
+			value = "+" + value
+		}
+		s.send(s.name(name, labelValues) + ":" + value + "|g")
+		return
+	}
+	s.send(s.name(name, labelValues) + ":" + value + "|c")
+}
+
+// Timing sends a timing in milliseconds
+func (s *StatsDSink) Timing(name string, d time.Duration) {
+	ms := strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	s.send(s.name(name, nil) + ":" + ms + "|ms")
+}
+
+// Close flushes the buffered metrics and closes the socket
+func (s *StatsDSink) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.flush()
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// name returns the StatsD name of a metric
+func (s *StatsDSink) name(name string, labelValues []string) string {
+	parts := []string{name}
+	if s.prefix != "" {
+		parts = []string{s.prefix, name}
+	}
+	for _, v := range labelValues {
+		parts = append(parts, statsdEscape(v))
+	}
+	return strings.Join(parts, ".")
+}
+
+// statsdEscape replaces the characters of a label value that StatsD and
+// Graphite treat as separators
+func statsdEscape(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ' ', '\t', '\n', '/':
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// send buffers a line, flushing the packet when full
+func (s *StatsDSink) send(line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.buf) > 0 && len(s.buf)+1+len(line) > statsdMaxPacket {
+		s.flush()
+	}
+	if len(s.buf) > 0 {
+		s.buf = append(s.buf, '\n')
+	}
+	s.buf = append(s.buf, line...)
+}
+
+// flush sends the buffered lines. The lock must be held.
+func (s *StatsDSink) flush() {
+	if len(s.buf) == 0 {
+		return
+	}
+	// StatsD is best effort, a daemon that is down loses the metrics
+	_, _ = s.conn.Write(s.buf)
+	s.buf = s.buf[:0]
+}
+
+// flushLoop flushes the buffered lines periodically until the sink is closed
+func (s *StatsDSink) flushLoop() {
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			s.flush()
+			s.lock.Unlock()
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+func TestStatsDSink(t *testing.T) {
+	statsd, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer statsd.Close()
+
+	sink, err := NewStatsDSink(statsd.LocalAddr().String(), "doqd")
+	assert.Nil(t, err)
+	doqServer, err := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Cert:       testCertificate(t, "localhost"),
+		Upstream:   "127.0.0.1:1",
+		Rewrites:   map[string]string{"whoami.test": "192.0.2.1"},
+		Metrics:    sink,
+	})
+	assert.Nil(t, err)
+	defer doqServer.Close()
+	go doqServer.Listen()
+
+	doqClient, err := client.New(client.Config{
+		Server:        doqServer.Listener.Addr().String(),
+		TLSSkipVerify: true,
+	})
+	assert.Nil(t, err)
+	defer doqClient.Close()
+	req := dns.Msg{}
+	req.SetQuestion("whoami.test.", dns.TypeA)
+	req.Id = 0
+	_, err = doqClient.SendQuery(req)
+	assert.Nil(t, err)
+
+	sink.Add("cache_entries", 1)
+	sink.Add("tenant_queries", 1, "example.com")
+	sink.Timing("upstream_latency", 1500*time.Microsecond)
+	assert.Nil(t, sink.Close())
+
+	buf := make([]byte, statsdMaxPacket)
+	_ = statsd.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := statsd.ReadFrom(buf)
+	assert.Nil(t, err)
+	lines := strings.Split(string(buf[:n]), "\n")
+	assert.Contains(t, lines, "doqd.queries:1|c")
+	assert.Contains(t, lines, "doqd.valid_queries:1|c")
+	assert.Contains(t, lines, "doqd.cache_entries:+1|g")
+	assert.Contains(t, lines, "doqd.tenant_queries.example_com:1|c")
+	assert.Contains(t, lines, "doqd.upstream_latency:1.500|ms")
+}
+
+func TestStatsDMemoryCache(t *testing.T) {
+	statsd, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer statsd.Close()
+
+	// A cache shared by servers reports to their sink
+	sink, err := NewStatsDSink(statsd.LocalAddr().String(), "doqd")
+	assert.Nil(t, err)
+	cache := NewMemoryCache(1, sink)
+	for _, name := range []string{"a.example.", "b.example."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		assert.Nil(t, cache.Set(context.Background(), name, msg, time.Minute))
+	}
+	assert.Nil(t, sink.Close())
+
+	buf := make([]byte, statsdMaxPacket)
+	_ = statsd.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := statsd.ReadFrom(buf)
+	assert.Nil(t, err)
+	lines := strings.Split(string(buf[:n]), "\n")
+	assert.Equal(t, []string{
+		"doqd.cache_entries:+1|g",
+		"doqd.cache_entries:-1|g",
+		"doqd.cache_evictions:1|c",
+		"doqd.cache_entries:+1|g",
+	}, lines)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TenantConfig is a resolver hosted on the server's listeners for the TLS
+// server names (SNI) clients connect to, e.g. to serve dns1.example and
+// dns2.example from one process
+type TenantConfig struct {
+	// Name identifies the tenant in logs and metrics, it must be unique
+	Name string
+	// ServerNames are the TLS server names of the tenant. *.example.com
+	// matches the names one label below example.com.
+	ServerNames []string
+	// Cert is presented to the tenant's clients instead of the server's
+	Cert tls.Certificate `json:"-"`
+	// Upstream, when set, replaces the server's upstream
+	Upstream string
+	// Blocking and Rewrites replace the server's for the tenant's clients
+	Blocking BlockingConfig
+	Rewrites map[string]string
+}
+
+// tenant is a view selected by TLS server name, with its own certificate
+type tenant struct {
+	view *view
+	cert *tls.Certificate
+}
+
+// tenants finds the tenant of a TLS server name
+type tenants struct {
+	names map[string]*tenant
+	list  []*tenant
+}
+
+// newTenants creates tenants, using the server's upstream for those without
+// their own, or returns nil without tenants
+func newTenants(configs []TenantConfig, serverUpstream *monitoredUpstream) (*tenants, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	t := &tenants{names: map[string]*tenant{}}
+	seen := map[string]bool{}
+	for _, c := range configs {
+		if c.Name == "" || seen[c.Name] {
+			return nil, errors.New("tenants need a unique name")
+		}
+		seen[c.Name] = true
+		if len(c.ServerNames) == 0 {
+			return nil, errors.New("tenant " + c.Name + ": no server names")
+		}
+
+		v, err := newPolicyView(c.Name, c.Upstream, c.Blocking, c.Rewrites, serverUpstream)
+		if err != nil {
+			return nil, errors.New("tenant " + c.Name + ": " + err.Error())
+		}
+		v.tenant = true
+		tn := &tenant{view: v}
+		if len(c.Cert.Certificate) > 0 {
+			tn.cert = &c.Cert
+		}
+		t.list = append(t.list, tn)
+		for _, name := range c.ServerNames {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if _, ok := t.names[name]; ok {
+				return nil, errors.New("tenant " + c.Name + ": server name " + name + " is already used")
+			}
+			t.names[name] = tn
+		}
+	}
+	return t, nil
+}
+
+// find returns the tenant of a TLS server name, preferring exact names over
+// wildcards, or nil
+func (t *tenants) find(serverName string) *tenant {
+	if t == nil || serverName == "" {
+		return nil
+	}
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if tn, ok := t.names[serverName]; ok {
+		return tn
+	}
+	if next, end := dns.NextLabel(serverName, 0); !end {
+		return t.names["*."+serverName[next:]]
+	}
+	return nil
+}
+
+// lookup returns the view of the tenant of a TLS server name, or nil
+func (t *tenants) lookup(serverName string) *view {
+	if tn := t.find(serverName); tn != nil {
+		return tn.view
+	}
+	return nil
+}
+
+// getCertificate presents the certificate of the tenant a client connects
+// to, falling back to the server's
+func (t *tenants) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if tn := t.find(hello.ServerName); tn != nil && tn.cert != nil {
+		return tn.cert, nil
+	}
+	return nil, nil
+}
+
+// views returns the views of every tenant
+func (t *tenants) views() []*view {
+	if t == nil {
+		return nil
+	}
+	views := make([]*view, 0, len(t.list))
+	for _, tn := range t.list {
+		views = append(views, tn.view)
+	}
+	return views
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+
+	doq "github.com/mosajjal/doqd"
+	"github.com/mosajjal/doqd/pkg/cert"
+)
+
+func testCertificate(t *testing.T, names ...string) tls.Certificate {
+	certPEM, keyPEM, err := cert.Generate(names, 24*time.Hour)
+	assert.Nil(t, err)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+	return pair
+}
+
+func TestTenantLookup(t *testing.T) {
+	tn, err := newTenants([]TenantConfig{
+		{Name: "one", ServerNames: []string{"dns1.example", "*.dns1.example"}},
+		{Name: "two", ServerNames: []string{"DNS2.example."}},
+	}, &monitoredUpstream{Resolver: addrUpstream{}})
+	assert.Nil(t, err)
+
+	for name, want := range map[string]string{
+		"dns1.example":       "one",
+		"eu.dns1.example":    "one",
+		"dns2.example":       "two",
+		"a.eu.dns1.example":  "",
+		"other.example":      "",
+		"":                   "",
+		"dns2.example.":      "two",
+		"sub.dns2.example":   "",
+		"Eu.Dns1.Example":    "one",
+		"dns1.example.extra": "",
+	} {
+		v := tn.lookup(name)
+		if want == "" {
+			assert.Nil(t, v, name)
+		} else if assert.NotNil(t, v, name) {
+			assert.Equal(t, want, v.name, name)
+			assert.True(t, v.tenant)
+		}
+	}
+	assert.Len(t, tn.views(), 2)
+
+	for _, configs := range [][]TenantConfig{
+		{{Name: "one", ServerNames: []string{"a.example"}}, {Name: "one", ServerNames: []string{"b.example"}}},
+		{{Name: "one"}},
+		{{Name: "one", ServerNames: []string{"a.example"}}, {Name: "two", ServerNames: []string{"a.example"}}},
+		{{Name: "one", ServerNames: []string{"a.example"}, Upstream: "nope"}},
+	} {
+		_, err := newTenants(configs, &monitoredUpstream{Resolver: addrUpstream{}})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr: "localhost:8862",
+		Cert:       testCertificate(t, "localhost"),
+		Upstream:   "127.0.0.1:1",
+		Rewrites:   map[string]string{"whoami.test": "192.0.2.100"},
+		Tenants: []TenantConfig{
+			{Name: "one", ServerNames: []string{"dns1.test"}, Cert: testCertificate(t, "dns1.test"), Rewrites: map[string]string{"whoami.test": "192.0.2.1"}},
+			{Name: "two", ServerNames: []string{"dns2.test"}, Cert: testCertificate(t, "dns2.test"), Rewrites: map[string]string{"whoami.test": "192.0.2.2"}},
+		},
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+
+	whoami := func(serverName string) (string, string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := quic.DialAddr(ctx, "localhost:8862", &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			NextProtos:         doq.TlsProtos,
+		}, nil)
+		if !assert.Nil(t, err) {
+			return "", ""
+		}
+		defer conn.CloseWithError(0, "")
+		certName := conn.ConnectionState().TLS.PeerCertificates[0].DNSNames[0]
+
+		stream, err := conn.OpenStreamSync(ctx)
+		assert.Nil(t, err)
+		req := new(dns.Msg)
+		req.SetQuestion("whoami.test.", dns.TypeA)
+		req.Id = 0
+		packed, err := req.Pack()
+		assert.Nil(t, err)
+		_, err = stream.Write(packed)
+		assert.Nil(t, err)
+		_ = stream.Close()
+		packed, err = io.ReadAll(stream)
+		assert.Nil(t, err)
+		var resp dns.Msg
+		assert.Nil(t, resp.Unpack(packed))
+		if !assert.Len(t, resp.Answer, 1) {
+			return certName, ""
+		}
+		return certName, resp.Answer[0].(*dns.A).A.String()
+	}
+
+	certName, addr := whoami("dns1.test")
+	assert.Equal(t, "dns1.test", certName)
+	assert.Equal(t, "192.0.2.1", addr)
+	certName, addr = whoami("dns2.test")
+	assert.Equal(t, "dns2.test", certName)
+	assert.Equal(t, "192.0.2.2", addr)
+	certName, addr = whoami("localhost")
+	assert.Equal(t, "localhost", certName)
+	assert.Equal(t, "192.0.2.100", addr)
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTopWindow is how long top counts are kept when not configured
+const defaultTopWindow = 5 * time.Minute
+
+// topSketchFactor is how many more keys are counted than reported, so the
+// reported ones are counted accurately
+const topSketchFactor = 10
+
+// TopConfig configures the tracking of the most queried names and busiest
+// clients, served at /top
+type TopConfig struct {
+	// Size is the number of names and clients reported. Tracking is disabled
+	// when zero.
+	Size int
+	// Window is how long counts are kept, 5 minutes when zero. Reports cover
+	// the current window and the previous one.
+	Window time.Duration
+}
+
+// TopEntry is a name or client and its approximate query count
+type TopEntry struct {
+	Key     string `json:"key"`
+	Queries uint64 `json:"queries"`
+}
+
+// Top lists the most queried names and busiest clients, most queries first
+type Top struct {
+	Names   []TopEntry `json:"names"`
+	Clients []TopEntry `json:"clients"`
+}
+
+// topTracker counts the queries of the most queried names and busiest
+// clients over two rolling windows
+type topTracker struct {
+	size   int
+	window time.Duration
+
+	lock                   sync.Mutex
+	names, clients         *spaceSaving
+	prevNames, prevClients *spaceSaving
+	started                time.Time
+}
+
+// newTopTracker returns a tracker, or nil when tracking is disabled
+func newTopTracker(c TopConfig) (*topTracker, error) {
+	if c.Size < 0 || c.Window < 0 {
+		return nil, errors.New("top: size and window must not be negative")
+	}
+	if c.Size == 0 {
+		return nil, nil
+	}
+	if c.Window == 0 {
+		c.Window = defaultTopWindow
+	}
+	t := &topTracker{size: c.Size, window: c.Window}
+	t.rotate(time.Now())
+	return t, nil
+}
+
+// rotate starts a new window, keeping the current one as the previous one
+// unless it ended more than a window ago. The lock must be held.
+func (t *topTracker) rotate(now time.Time) {
+	capacity := t.size * topSketchFactor
+	t.prevNames, t.prevClients = newSpaceSaving(capacity), newSpaceSaving(capacity)
+	if t.names != nil && now.Sub(t.started) < 2*t.window {
+		t.prevNames, t.prevClients = t.names, t.clients
+	}
+	t.names, t.clients = newSpaceSaving(capacity), newSpaceSaving(capacity)
+	t.started = now
+}
+
+// record counts a query of a name from a client
+func (t *topTracker) record(name, client string) {
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if now.Sub(t.started) >= t.window {
+		t.rotate(now)
+	}
+	t.names.add(strings.ToLower(name))
+	if client != "" {
+		t.clients.add(client)
+	}
+}
+
+// top returns the counts of the tracked names and clients over both windows
+func (t *topTracker) top() Top {
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if now.Sub(t.started) >= t.window {
+		t.rotate(now)
+	}
+	return Top{
+		Names:   mergeTop(t.names.entries(), t.prevNames.entries()),
+		Clients: mergeTop(t.clients.entries(), t.prevClients.entries()),
+	}
+}
+
+// Top returns the n most queried names and busiest clients, with their
+// approximate query counts over the last one to two windows. It is empty
+// when tracking is disabled.
+func (s *Server) Top(n int) Top {
+	if s.top == nil {
+		return Top{}
+	}
+	top := s.top.top()
+	return Top{Names: truncateTop(top.Names, n), Clients: truncateTop(top.Clients, n)}
+}
+
+// mergeTop sums the counts of lists of entries, most queries first
+func mergeTop(lists ...[]TopEntry) []TopEntry {
+	counts := map[string]uint64{}
+	for _, list := range lists {
+		for _, e := range list {
+			counts[e.Key] += e.Queries
+		}
+	}
+	merged := make([]TopEntry, 0, len(counts))
+	for key, queries := range counts {
+		merged = append(merged, TopEntry{Key: key, Queries: queries})
+	}
+	slices.SortFunc(merged, func(a, b TopEntry) int {
+		if a.Queries != b.Queries {
+			if a.Queries > b.Queries {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return merged
+}
+
+// truncateTop returns the first n entries of a list
+func truncateTop(entries []TopEntry, n int) []TopEntry {
+	return entries[:min(n, len(entries))]
+}
+
+// topHandler serves the most queried names and busiest clients of all
+// servers as JSON, 10 of each or ?n= of them
+func topHandler(servers []*Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := 10
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 1 {
+				http.Error(w, "n must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+		var names, clients [][]TopEntry
+		for _, s := range servers {
+			if s.top == nil {
+				continue
+			}
+			top := s.top.top()
+			names, clients = append(names, top.Names), append(clients, top.Clients)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(Top{
+			Names:   truncateTop(mergeTop(names...), n),
+			Clients: truncateTop(mergeTop(clients...), n),
+		})
+	}
+}
+
+// spaceSaving counts the most frequent keys of a stream in bounded memory
+// with the Space-Saving algorithm: once full, a new key replaces the least
+// counted one and inherits its count, so rare keys are overestimated but
+// frequent ones are never missed
+type spaceSaving struct {
+	capacity int
+	keys     map[string]*topCount
+	counts   topHeap
+}
+
+// topCount is the count of a key, at index i of the heap
+type topCount struct {
+	key   string
+	count uint64
+	i     int
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, keys: map[string]*topCount{}}
+}
+
+// add counts an occurrence of a key
+func (s *spaceSaving) add(key string) {
+	if c, ok := s.keys[key]; ok {
+		c.count++
+		heap.Fix(&s.counts, c.i)
+		return
+	}
+	if len(s.counts) < s.capacity {
+		c := &topCount{key: key, count: 1}
+		s.keys[key] = c
+		heap.Push(&s.counts, c)
+		return
+	}
+	least := s.counts[0]
+	delete(s.keys, least.key)
+	least.key = key
+	least.count++
+	s.keys[key] = least
+	heap.Fix(&s.counts, 0)
+}
+
+// entries returns the counted keys
+func (s *spaceSaving) entries() []TopEntry {
+	entries := make([]TopEntry, 0, len(s.counts))
+	for _, c := range s.counts {
+		entries = append(entries, TopEntry{Key: c.key, Queries: c.count})
+	}
+	return entries
+}
+
+// topHeap is a min-heap of counts
+type topHeap []*topCount
+
+func (h topHeap) Len() int           { return len(h) }
+func (h topHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h topHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].i, h[j].i = i, j
+}
+
+func (h *topHeap) Push(x any) {
+	c := x.(*topCount)
+	c.i = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *topHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
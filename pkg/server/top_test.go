@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	s := newSpaceSaving(20)
+	// Frequent keys stand out among many rare ones
+	for i := 0; i < 1000; i++ {
+		s.add("rare" + strconv.Itoa(i))
+		if i%2 == 0 {
+			s.add("frequent")
+		}
+		if i%5 == 0 {
+			s.add("common")
+		}
+	}
+	top := mergeTop(s.entries())
+	assert.Len(t, top, 20)
+	assert.Equal(t, "frequent", top[0].Key)
+	assert.GreaterOrEqual(t, top[0].Queries, uint64(500))
+	assert.Equal(t, "common", top[1].Key)
+	assert.GreaterOrEqual(t, top[1].Queries, uint64(200))
+}
+
+func TestTopTracker(t *testing.T) {
+	tracker, err := newTopTracker(TopConfig{})
+	assert.Nil(t, err)
+	assert.Nil(t, tracker)
+	_, err = newTopTracker(TopConfig{Size: -1})
+	assert.NotNil(t, err)
+
+	tracker, err = newTopTracker(TopConfig{Size: 2, Window: time.Minute})
+	assert.Nil(t, err)
+	tracker.record("Example.com.", "192.0.2.1")
+	tracker.record("example.com.", "192.0.2.2")
+	tracker.record("example.org.", "192.0.2.1")
+	top := tracker.top()
+	assert.Equal(t, []TopEntry{{"example.com.", 2}, {"example.org.", 1}}, top.Names)
+	assert.Equal(t, []TopEntry{{"192.0.2.1", 2}, {"192.0.2.2", 1}}, top.Clients)
+
+	// Counts of the previous window are kept, older ones dropped
+	tracker.started = tracker.started.Add(-time.Minute)
+	tracker.record("example.net.", "192.0.2.3")
+	assert.Len(t, tracker.top().Names, 3)
+	tracker.started = tracker.started.Add(-2 * time.Minute)
+	assert.Empty(t, tracker.top().Names)
+}
+
+func TestTopEndpoint(t *testing.T) {
+	top, err := newTopTracker(TopConfig{Size: 10})
+	assert.Nil(t, err)
+	s := &Server{upstream: &monitoredUpstream{Resolver: &ttlUpstream{ttl: 60}}, logger: logrus.New(), top: top}
+	for i, name := range []string{"a.example.", "b.example.", "a.example."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		s.resolve(&query{msg: msg, client: &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i%2)), Port: 443}})
+	}
+	assert.Equal(t, []TopEntry{{"a.example.", 2}}, s.Top(1).Names)
+
+	ts := httptest.NewServer(adminMux(AdminConfig{Servers: []*Server{s, {}}}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/top?n=1")
+	if assert.Nil(t, err) {
+		var got Top
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&got))
+		_ = resp.Body.Close()
+		assert.Equal(t, []TopEntry{{"a.example.", 2}}, got.Names)
+		assert.Equal(t, []TopEntry{{"192.0.2.0", 2}}, got.Clients)
+	}
+	resp, err = http.Get(ts.URL + "/top?n=zero")
+	if assert.Nil(t, err) {
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
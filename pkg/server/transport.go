@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// transportSettings are the address validation and handshake limits of the
+// QUIC transports accepting DoQ connections
+type transportSettings struct {
+	tokenKey            *quic.TokenGeneratorKey
+	tokenLifetime       time.Duration
+	verifySourceAddress func(net.Addr) bool
+	connContext         func(context.Context, *quic.ClientInfo) (context.Context, error)
+}
+
+// apply sets the settings a transport doesn't set itself, before its first
+// use
+func (t transportSettings) apply(transport *quic.Transport) {
+	if transport.TokenGeneratorKey == nil {
+		transport.TokenGeneratorKey = t.tokenKey
+	}
+	if transport.MaxTokenAge == 0 {
+		transport.MaxTokenAge = t.tokenLifetime
+	}
+	if transport.VerifySourceAddress == nil {
+		transport.VerifySourceAddress = t.verifySourceAddress
+	}
+	if transport.ConnContext == nil {
+		transport.ConnContext = t.connContext
+	}
+}
+
+// NewWithTransport constructs a Server accepting DoQ connections on a
+// caller's QUIC transport instead of listening on ListenAddr, so the port
+// can be shared with other QUIC protocols. ReusePortListeners and the
+// socket options are ignored, and Retry and handshake limits only apply
+// when the transport doesn't set its own VerifySourceAddress and
+// ConnContext. Close stops accepting connections without closing the
+// transport.
+func NewWithTransport(c Config, transport *quic.Transport) (*Server, error) {
+	if transport == nil {
+		return nil, errors.New("nil QUIC transport")
+	}
+	return newServer(c, transport)
+}
+
+// listen opens a QUIC listener on a socket owned by the server, closed with
+// it
+func (s *Server) listen(conn net.PacketConn) (*quic.Listener, error) {
+	transport := &quic.Transport{Conn: conn}
+	s.transportSettings.apply(transport)
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	select {
+	case <-s.done:
+		return nil, errors.New("server closed")
+	default:
+	}
+	s.transports = append(s.transports, transport)
+	listener, err := transport.Listen(s.tlsConf, s.quicConf)
+	if err != nil {
+		return nil, errors.New("could not start QUIC listener: " + err.Error())
+	}
+	s.listeners = append(s.listeners, listener)
+	return listener, nil
+}
+
+// Serve accepts DoQ connections on a socket created by the caller, e.g.
+// passed by systemd socket activation, in addition to the server's own
+// listeners. It returns once the server is closed, closing the socket.
+func (s *Server) Serve(conn net.PacketConn) error {
+	listener, err := s.listen(conn)
+	if err != nil {
+		return err
+	}
+	s.accept(listener)
+	return nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+// queryWhoami queries whoami.test from a DoQ server
+func queryWhoami(t *testing.T, addr string) {
+	t.Helper()
+	doqClient, err := client.New(client.Config{Server: addr, TLSSkipVerify: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer doqClient.Close()
+	req := dns.Msg{}
+	req.SetQuestion("whoami.test.", dns.TypeA)
+	resp, err := doqClient.SendQuery(req)
+	if assert.Nil(t, err) {
+		assert.Len(t, resp.Answer, 1)
+	}
+}
+
+func TestNewWithTransport(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer conn.Close()
+	transport := &quic.Transport{Conn: conn}
+	defer transport.Close()
+
+	_, err = NewWithTransport(Config{}, nil)
+	assert.NotNil(t, err)
+	doqServer, err := NewWithTransport(Config{
+		Cert:     testCertificate(t, "localhost"),
+		Upstream: "127.0.0.1:1",
+		Rewrites: map[string]string{"whoami.test": "192.0.2.1"},
+	}, transport)
+	assert.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		doqServer.Listen()
+		close(done)
+	}()
+	assert.NotNil(t, transport.TokenGeneratorKey)
+	queryWhoami(t, conn.LocalAddr().String())
+
+	// Closing the server leaves the transport to its owner
+	assert.Nil(t, doqServer.Close())
+	<-done
+	_, err = conn.WriteTo([]byte{0}, conn.LocalAddr())
+	assert.Nil(t, err)
+}
+
+func TestServe(t *testing.T) {
+	doqServer, err := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Cert:       testCertificate(t, "localhost"),
+		Upstream:   "127.0.0.1:1",
+		Rewrites:   map[string]string{"whoami.test": "192.0.2.1"},
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	errs := make(chan error)
+	go func() { errs <- doqServer.Serve(conn) }()
+	queryWhoami(t, conn.LocalAddr().String())
+	queryWhoami(t, doqServer.Listener.Addr().String())
+
+	assert.Nil(t, doqServer.Close())
+	select {
+	case err := <-errs:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve didn't return")
+	}
+	assert.NotNil(t, doqServer.Serve(conn))
+}
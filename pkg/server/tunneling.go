@@ -0,0 +1,254 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// Reasons a query is flagged by tunneling detection, the reason label of
+// the tunneling_queries metric
+const (
+	tunnelingLongLabel = "long_label"
+	tunnelingEntropy   = "entropy"
+	tunnelingTXTRate   = "txt_rate"
+)
+
+// Tunneling detection limits
+const (
+	// tunnelingMinEntropyLength is the length below which names are too
+	// short for their entropy to tell random ones apart
+	tunnelingMinEntropyLength = 16
+	defaultTunnelingLimitFor  = 5 * time.Minute
+	// tunnelingSweepInterval is how often the state of clients back to
+	// normal is forgotten
+	tunnelingSweepInterval = time.Minute
+)
+
+// TunnelingConfig configures the detection of DNS tunneling and names
+// generated by malware (DGA), which smuggle data or look up command servers
+// in query names. Flagged queries are counted in the tunneling_queries
+// metric and by the tunneling alert.
+type TunnelingConfig struct {
+	// MaxLabelLength flags names with a longer label, 0 to disable. Tunnels
+	// fill labels close to their 63 byte limit.
+	MaxLabelLength int
+	// MaxEntropy flags names whose labels but the top-level domain, at least
+	// 16 characters in all, have a higher Shannon entropy in bits per
+	// character, 0 to disable. Encoded data and generated names look
+	// random, e.g. 4 bits.
+	MaxEntropy float64
+	// TXTRate flags the TXT and NULL queries of a client beyond this many
+	// per minute, 0 to disable. Tunnels favor them as they carry the most
+	// data.
+	TXTRate int
+	// Refuse answers flagged queries with REFUSED
+	Refuse bool
+	// LimitRate, when set, limits clients sending a flagged query to this
+	// many queries per second for LimitFor, 5 minutes when zero, refusing
+	// the others
+	LimitRate int
+	LimitFor  time.Duration
+}
+
+// tunnelingDetector flags queries of suspected tunnels and limits the
+// clients sending them
+type tunnelingDetector struct {
+	conf TunnelingConfig
+
+	lock      sync.Mutex
+	txt       map[netip.Addr]*rate.Limiter
+	limited   map[netip.Addr]*tunnelingLimit
+	lastSweep time.Time
+}
+
+// tunnelingLimit is the query rate limit of a flagged client
+type tunnelingLimit struct {
+	limiter *rate.Limiter
+	until   time.Time
+}
+
+// newTunnelingDetector validates the configuration, or returns nil when
+// detection is off
+func newTunnelingDetector(c TunnelingConfig) (*tunnelingDetector, error) {
+	if c.MaxLabelLength < 0 || c.MaxEntropy < 0 || c.TXTRate < 0 || c.LimitRate < 0 || c.LimitFor < 0 {
+		return nil, errors.New("tunneling detection: thresholds must not be negative")
+	}
+	if c.MaxLabelLength == 0 && c.MaxEntropy == 0 && c.TXTRate == 0 {
+		if c.Refuse || c.LimitRate > 0 {
+			return nil, errors.New("tunneling detection: refusing or limiting needs a threshold")
+		}
+		return nil, nil
+	}
+	if c.LimitFor == 0 {
+		c.LimitFor = defaultTunnelingLimitFor
+	}
+	return &tunnelingDetector{
+		conf:      c,
+		txt:       map[netip.Addr]*rate.Limiter{},
+		limited:   map[netip.Addr]*tunnelingLimit{},
+		lastSweep: time.Now(),
+	}, nil
+}
+
+// inspectTunneling flags a query of a suspected tunnel, returning REFUSED
+// when it is refused or its client is over its limit
+func (s *Server) inspectTunneling(q *query) *dns.Msg {
+	t := s.tunneling
+	ip, hasIP := clientAddr(q.client)
+	if hasIP && !t.allow(ip) {
+		return tunnelingRefused(q.msg)
+	}
+	reasons := t.reasons(q.msg, ip, hasIP)
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	name := q.msg.Question[0].Name
+	for _, reason := range reasons {
+		s.metrics().tunnelingQueries.Inc(reason)
+	}
+	s.logger.Debugf("possible DNS tunneling from %s: %s %s", q.client, name, strings.Join(reasons, ","))
+	if hasIP {
+		if s.alerts != nil {
+			s.alerts.observeTunneling(ip)
+		}
+		if t.limit(ip) {
+			s.logger.Warnf("possible DNS tunneling from %s, e.g. %s: limiting it to %d queries per second for %s", ip, name, t.conf.LimitRate, t.conf.LimitFor)
+		}
+	}
+	if t.conf.Refuse {
+		return tunnelingRefused(q.msg)
+	}
+	return nil
+}
+
+// tunnelingRefused returns the REFUSED answer to a query of a suspected
+// tunnel
+func tunnelingRefused(msg *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, dns.RcodeRefused)
+	reply.RecursionAvailable = true
+	setBlockedEDE(reply, msg, "DNS tunneling")
+	return reply
+}
+
+// reasons returns why a query is flagged, none when it looks normal
+func (t *tunnelingDetector) reasons(msg *dns.Msg, ip netip.Addr, hasIP bool) []string {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	question := msg.Question[0]
+	labels := dns.SplitDomainName(question.Name)
+
+	var reasons []string
+	if t.conf.MaxLabelLength > 0 {
+		for _, label := range labels {
+			if len(label) > t.conf.MaxLabelLength {
+				reasons = append(reasons, tunnelingLongLabel)
+				break
+			}
+		}
+	}
+	if t.conf.MaxEntropy > 0 && len(labels) > 1 {
+		if name := strings.ToLower(strings.Join(labels[:len(labels)-1], "")); len(name) >= tunnelingMinEntropyLength && entropy(name) > t.conf.MaxEntropy {
+			reasons = append(reasons, tunnelingEntropy)
+		}
+	}
+	if t.conf.TXTRate > 0 && hasIP && (question.Qtype == dns.TypeTXT || question.Qtype == dns.TypeNULL) && !t.allowTXT(ip) {
+		reasons = append(reasons, tunnelingTXTRate)
+	}
+	return reasons
+}
+
+// entropy returns the Shannon entropy of a string in bits per byte
+func entropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var e float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(s))
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// allowTXT takes a TXT or NULL query from the budget of a client
+func (t *tunnelingDetector) allowTXT(ip netip.Addr) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	t.sweep(now)
+	limiter, ok := t.txt[ip]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(float64(t.conf.TXTRate)/60), t.conf.TXTRate)
+		t.txt[ip] = limiter
+	}
+	return limiter.AllowN(now, 1)
+}
+
+// limit starts limiting a flagged client, reporting whether it wasn't
+// already limited
+func (t *tunnelingDetector) limit(ip netip.Addr) bool {
+	if t.conf.LimitRate == 0 {
+		return false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	if l, ok := t.limited[ip]; ok && now.Before(l.until) {
+		l.until = now.Add(t.conf.LimitFor)
+		return false
+	}
+	t.limited[ip] = &tunnelingLimit{
+		limiter: rate.NewLimiter(rate.Limit(t.conf.LimitRate), t.conf.LimitRate),
+		until:   now.Add(t.conf.LimitFor),
+	}
+	return true
+}
+
+// allow takes a query from the budget of a limited client, always allowing
+// the others
+func (t *tunnelingDetector) allow(ip netip.Addr) bool {
+	if t.conf.LimitRate == 0 {
+		return true
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	t.sweep(now)
+	l, ok := t.limited[ip]
+	if !ok || !now.Before(l.until) {
+		return true
+	}
+	return l.limiter.AllowN(now, 1)
+}
+
+// sweep forgets the clients back to a full TXT budget and those no longer
+// limited. The lock must be held.
+func (t *tunnelingDetector) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < tunnelingSweepInterval {
+		return
+	}
+	for ip, limiter := range t.txt {
+		if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+			delete(t.txt, ip)
+		}
+	}
+	for ip, l := range t.limited {
+		if !now.Before(l.until) {
+			delete(t.limited, ip)
+		}
+	}
+	t.lastSweep = now
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelingDetector(t *testing.T) {
+	d, err := newTunnelingDetector(TunnelingConfig{})
+	assert.Nil(t, err)
+	assert.Nil(t, d)
+	for _, c := range []TunnelingConfig{{MaxLabelLength: -1}, {Refuse: true}, {LimitRate: 10}} {
+		_, err = newTunnelingDetector(c)
+		assert.NotNil(t, err, c)
+	}
+
+	d, err = newTunnelingDetector(TunnelingConfig{MaxLabelLength: 40, MaxEntropy: 4, TXTRate: 2})
+	assert.Nil(t, err)
+	ip := netip.MustParseAddr("192.0.2.1")
+	reasons := func(name string, qtype uint16) []string {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		return d.reasons(msg, ip, true)
+	}
+	for _, name := range []string{"www.example.com.", "mail.subdomain.company.com.", "r3---sn-4g5e6nsz.googlevideo.com.", "com."} {
+		assert.Empty(t, reasons(name, dns.TypeA), name)
+	}
+	assert.Equal(t, []string{tunnelingLongLabel}, reasons("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.example.", dns.TypeA))
+	assert.Equal(t, []string{tunnelingLongLabel, tunnelingEntropy}, reasons("nbswy3dpeb3w64tmmqqhi2ltorxwy5dfonuw45dsorzw633o.t.example.com.", dns.TypeA))
+	assert.Equal(t, []string{tunnelingEntropy}, reasons("k7fq2xw9zp4m1vbr8jdt.example.", dns.TypeA))
+
+	// TXT and NULL queries are flagged beyond their rate
+	assert.Empty(t, reasons("www.example.com.", dns.TypeTXT))
+	assert.Empty(t, reasons("www.example.com.", dns.TypeNULL))
+	assert.Equal(t, []string{tunnelingTXTRate}, reasons("www.example.com.", dns.TypeTXT))
+	assert.Empty(t, reasons("www.example.com.", dns.TypeA))
+}
+
+func TestTunnelingLimit(t *testing.T) {
+	sink := &countingSink{counts: map[string]float64{}}
+	d, err := newTunnelingDetector(TunnelingConfig{MaxLabelLength: 40, LimitRate: 1, LimitFor: time.Hour})
+	assert.Nil(t, err)
+	s := &Server{
+		upstream:  &monitoredUpstream{Resolver: &ttlUpstream{ttl: 60}},
+		logger:    logrus.New(),
+		tunneling: d,
+		metricSet: newMetrics(sink),
+	}
+	resolve := func(name string, client byte) int {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		return s.resolve(&query{msg: msg, client: &net.UDPAddr{IP: net.IPv4(192, 0, 2, client), Port: 443}}).Rcode
+	}
+
+	// A flagged query is answered, then its client is limited
+	long := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.example."
+	assert.Equal(t, dns.RcodeSuccess, resolve(long, 1))
+	assert.Equal(t, 1.0, sink.count("tunneling_queries"))
+	assert.Equal(t, dns.RcodeSuccess, resolve("www.example.com.", 1))
+	assert.Equal(t, dns.RcodeRefused, resolve("www.example.com.", 1))
+	assert.Equal(t, dns.RcodeSuccess, resolve("www.example.com.", 2))
+	assert.Equal(t, dns.RcodeSuccess, resolve("www.example.com.", 2))
+
+	// Flagged queries are refused when configured to
+	d.conf.Refuse = true
+	assert.Equal(t, dns.RcodeRefused, resolve(long, 3))
+	assert.Equal(t, 2.0, sink.count("tunneling_queries"))
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// hllPrecision is the number of hash bits picking a HyperLogLog register,
+// 2^14 registers of a byte estimate counts within about 0.8%
+const hllPrecision = 14
+
+// hyperLogLog estimates the number of distinct values added to it in
+// constant memory
+type hyperLogLog struct {
+	seed      maphash.Seed
+	registers [1 << hllPrecision]uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{seed: maphash.MakeSeed()}
+}
+
+// add records a value
+func (h *hyperLogLog) add(b []byte) {
+	hash := maphash.Bytes(h.seed, b)
+	i := hash >> (64 - hllPrecision)
+	// The rank of the first set bit of the rest, bounded by the sentinel
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// estimate returns the approximate number of distinct values added
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Small counts leave registers empty and are better estimated by
+	// linear counting
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return e
+}
+
+// reset forgets the values added
+func (h *hyperLogLog) reset() {
+	clear(h.registers[:])
+}
+
+// uniqueClients estimates the number of distinct client addresses per
+// window, exported as the unique_clients gauge when a window ends
+type uniqueClients struct {
+	window time.Duration
+	gauge  metric
+
+	lock   sync.Mutex
+	counts *hyperLogLog
+	// reported is the current value of the gauge
+	reported float64
+}
+
+// newUniqueClients returns an estimator, or nil when window is zero
+func newUniqueClients(window time.Duration, gauge metric) (*uniqueClients, error) {
+	if window < 0 {
+		return nil, errors.New("unique clients window must not be negative")
+	}
+	if window == 0 {
+		return nil, nil
+	}
+	return &uniqueClients{window: window, gauge: gauge, counts: newHyperLogLog()}, nil
+}
+
+// record counts a client address
+func (u *uniqueClients) record(addr netip.Addr) {
+	b := addr.As16()
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.counts.add(b[:])
+}
+
+// rotate sets the gauge to the estimate of the window that ended and starts
+// a new one
+func (u *uniqueClients) rotate() {
+	u.lock.Lock()
+	estimate := math.Round(u.counts.estimate())
+	u.counts.reset()
+	u.lock.Unlock()
+	u.set(estimate)
+}
+
+// set changes the gauge, which sinks only add to
+func (u *uniqueClients) set(v float64) {
+	u.gauge.Add(v - u.reported)
+	u.reported = v
+}
+
+// countUniqueClients ends a window of unique clients every window until the
+// server is closed, then takes its count off the gauge
+func (s *Server) countUniqueClients() {
+	ticker := time.NewTicker(s.uniques.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			s.uniques.set(0)
+			return
+		case <-ticker.C:
+			s.uniques.rotate()
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	h := newHyperLogLog()
+	assert.Zero(t, h.estimate())
+	for _, n := range []int{100, 10000, 200000} {
+		h.reset()
+		for i := 0; i < n; i++ {
+			// Each address is added twice
+			b := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}).As16()
+			h.add(b[:])
+			h.add(b[:])
+		}
+		assert.InEpsilon(t, float64(n), h.estimate(), 0.03, n)
+	}
+}
+
+func TestUniqueClients(t *testing.T) {
+	_, err := newUniqueClients(-time.Minute, metric{})
+	assert.NotNil(t, err)
+	u, err := newUniqueClients(0, metric{})
+	assert.Nil(t, err)
+	assert.Nil(t, u)
+
+	sink := &countingSink{counts: map[string]float64{}}
+	u, err = newUniqueClients(time.Hour, metric{sink, "unique_clients"})
+	assert.Nil(t, err)
+	s := &Server{upstream: &monitoredUpstream{Resolver: &ttlUpstream{ttl: 60}}, logger: logrus.New(), uniques: u}
+	for i := 0; i < 30; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		s.resolve(&query{msg: msg, client: &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i%3)), Port: 443}})
+	}
+	// The gauge is set when the window ends
+	assert.Zero(t, sink.count("unique_clients"))
+	u.rotate()
+	assert.Equal(t, 3.0, sink.count("unique_clients"))
+	u.record(netip.MustParseAddr("2001:db8::1"))
+	u.rotate()
+	assert.Equal(t, 1.0, sink.count("unique_clients"))
+	u.rotate()
+	assert.Zero(t, sink.count("unique_clients"))
+}
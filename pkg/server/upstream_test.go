@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mosajjal/doqd/pkg/cert"
+	"github.com/mosajjal/doqd/pkg/client"
+	"github.com/mosajjal/doqd/pkg/upstream"
+)
+
+func TestEncryptedUpstreams(t *testing.T) {
+	certPEM, keyPEM, err := cert.Generate([]string{"dns.test"}, 24*time.Hour)
+	assert.Nil(t, err)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	assert.Nil(t, err)
+	spkiSum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	pin := url.QueryEscape(base64.StdEncoding.EncodeToString(spkiSum[:]))
+	otherSum := sha256.Sum256([]byte("other"))
+	otherPin := url.QueryEscape(base64.StdEncoding.EncodeToString(otherSum[:]))
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, os.WriteFile(caFile, certPEM, 0o600))
+
+	doqServer, err := New(Config{
+		ListenAddr:    "localhost:8866",
+		DoTListenAddr: "localhost:8867",
+		Cert:          pair,
+		Upstream:      "127.0.0.1:1",
+		Rewrites:      map[string]string{"whoami.test": "192.0.2.1"},
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+	time.Sleep(100 * time.Millisecond) // Wait for the DoT server to start
+
+	for params, ok := range map[string]bool{
+		"":                                false,
+		"ca=" + caFile:                    false,
+		"ca=" + caFile + "&name=dns.test": true,
+		"insecure=true":                   true,
+		"insecure=true&pin=" + pin:        true,
+		"insecure=true&pin=" + otherPin:   false,
+		"ca=" + caFile + "&name=dns.test&pin=" + otherPin: false,
+	} {
+		for _, addr := range []string{"tls://localhost:8867", "quic://localhost:8866"} {
+			up, err := upstream.New(addr + "?" + params)
+			if !assert.Nil(t, err) {
+				continue
+			}
+			assert.Equal(t, addr, fmt.Sprint(up))
+
+			req := new(dns.Msg)
+			req.SetQuestion("whoami.test.", dns.TypeA)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			resp, err := up.Exchange(ctx, req)
+			cancel()
+			if ok {
+				if assert.Nil(t, err, addr+"?"+params) && assert.Len(t, resp.Answer, 1) {
+					assert.True(t, strings.HasSuffix(resp.Answer[0].String(), "192.0.2.1"))
+				}
+			} else {
+				assert.NotNil(t, err, addr+"?"+params)
+			}
+		}
+	}
+}
+
+func TestHandlerResolver(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc("example.com.", func(w dns.ResponseWriter, r *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		reply.Answer = append(reply.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{w.RemoteAddr().String()},
+		})
+		_ = w.WriteMsg(reply)
+	})
+
+	doqServer, err := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Cert:       testCertificate(t, "localhost"),
+		Resolver:   upstream.NewHandler(mux),
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+	defer doqServer.Close()
+
+	doqClient, err := client.New(client.Config{Server: doqServer.Listener.Addr().String(), TLSSkipVerify: true})
+	assert.Nil(t, err)
+	defer doqClient.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	resp, err := doqClient.SendQuery(*req)
+	assert.Nil(t, err)
+	if assert.Len(t, resp.Answer, 1) {
+		_, port, _ := net.SplitHostPort(doqClient.Session.LocalAddr().String())
+		assert.Equal(t, []string{"127.0.0.1:" + port}, resp.Answer[0].(*dns.TXT).Txt)
+	}
+
+	req.SetQuestion("example.org.", dns.TypeA)
+	resp, err = doqClient.SendQuery(*req)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+}
+
+func TestMismatchedResponse(t *testing.T) {
+	// The upstream answers another question, or sends back the query
+	mux := dns.NewServeMux()
+	mux.HandleFunc("other.example.", func(w dns.ResponseWriter, r *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetQuestion("bank.example.", dns.TypeA)
+		reply.Id, reply.Response = r.Id, true
+		rr, _ := dns.NewRR("bank.example. 300 IN A 192.0.2.1")
+		reply.Answer = append(reply.Answer, rr)
+		_ = w.WriteMsg(reply)
+	})
+	mux.HandleFunc("echo.example.", func(w dns.ResponseWriter, r *dns.Msg) {
+		_ = w.WriteMsg(r)
+	})
+
+	doqServer, err := New(Config{
+		ListenAddr: "127.0.0.1:0",
+		Cert:       testCertificate(t, "localhost"),
+		Resolver:   upstream.NewHandler(mux),
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+	defer doqServer.Close()
+
+	doqClient, err := client.New(client.Config{Server: doqServer.Listener.Addr().String(), TLSSkipVerify: true})
+	assert.Nil(t, err)
+	defer doqClient.Close()
+
+	for _, name := range []string{"other.example.", "echo.example."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		resp, err := doqClient.SendQuery(*req)
+		if assert.Nil(t, err, name) {
+			assert.Equal(t, dns.RcodeServerFailure, resp.Rcode, name)
+			assert.Empty(t, resp.Answer, name)
+		}
+	}
+	assert.Equal(t, uint64(2), doqServer.Stats().Upstreams[0].Errors)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// Limits of the messages clients send, well above what legitimate queries
+// need
+const (
+	// defaultMaxQuerySize is the largest message in bytes accepted from DoQ
+	// and DoH clients by default, padding included, as large as the EDNS
+	// buffers clients commonly advertise
+	defaultMaxQuerySize = 4096
+	// maxQueryAnswers, maxQueryAuthorities and maxQueryAdditionals are the
+	// records a query may carry in each section, as miekg/dns accepts over
+	// UDP and TCP: an OPT and a TSIG in the additional section
+	maxQueryAnswers     = 1
+	maxQueryAuthorities = 1
+	maxQueryAdditionals = 2
+	// maxNamePointers is the number of compression pointers followed to
+	// read a name
+	maxNamePointers = 8
+	dnsHeaderLen    = 12
+	maxNameLen      = 255
+)
+
+// validateQuery checks that a message is a query doqd can forward, returning
+// the rcode of the error reply otherwise, or RcodeSuccess for valid queries
+func validateQuery(msg *dns.Msg) int {
+	switch {
+	case msg.Response:
+		return dns.RcodeFormatError
+	case msg.Opcode != dns.OpcodeQuery:
+		return dns.RcodeNotImplemented
+	case len(msg.Question) != 1 || !dns.IsFqdn(msg.Question[0].Name):
+		return dns.RcodeFormatError
+	case len(msg.Answer) > maxQueryAnswers || len(msg.Ns) > maxQueryAuthorities || len(msg.Extra) > maxQueryAdditionals:
+		return dns.RcodeFormatError
+	}
+	if _, ok := dns.IsDomainName(msg.Question[0].Name); !ok {
+		return dns.RcodeFormatError
+	}
+	opts := 0
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	if opts > 1 {
+		// RFC 6891 6.1.1
+		return dns.RcodeFormatError
+	}
+	return dns.RcodeSuccess
+}
+
+// checkWire checks the structure of a packed message before it is unpacked
+// or relayed: that its sections hold as many records as its
+// header says and nothing more, and that its names have valid labels and
+// only point back to earlier names, through a bounded number of pointers
+func checkWire(b []byte) error {
+	if len(b) < dnsHeaderLen {
+		return errors.New("message shorter than its header")
+	}
+	off := dnsHeaderLen
+	questions := int(binary.BigEndian.Uint16(b[4:]))
+	records := 0
+	for _, i := range []int{6, 8, 10} {
+		records += int(binary.BigEndian.Uint16(b[i:]))
+	}
+	for i := 0; i < questions+records; i++ {
+		var err error
+		if off, err = checkName(b, off); err != nil {
+			return err
+		}
+		fixed := 4 // Type and class
+		if i >= questions {
+			fixed = 10 // TTL and data length
+		}
+		if off+fixed > len(b) {
+			return errors.New("record truncated")
+		}
+		if i >= questions {
+			off += fixed + int(binary.BigEndian.Uint16(b[off+8:]))
+			if off > len(b) {
+				return errors.New("record data truncated")
+			}
+			continue
+		}
+		off += fixed
+	}
+	if off != len(b) {
+		return errors.New("trailing data after the last record")
+	}
+	return nil
+}
+
+// checkName checks the name at off, returning the offset following it
+func checkName(b []byte, off int) (int, error) {
+	start, next := off, -1
+	length, pointers := 1, 0
+	for {
+		if off >= len(b) {
+			return 0, errors.New("name truncated")
+		}
+		c := int(b[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return next, nil
+			}
+			// Labels longer than 63 bytes would need the reserved types
+			length += c + 1
+			if length > maxNameLen {
+				return 0, errors.New("name longer than 255 bytes")
+			}
+			off += c + 1
+		case 0xC0:
+			if off+1 >= len(b) {
+				return 0, errors.New("compression pointer truncated")
+			}
+			pointers++
+			if pointers > maxNamePointers {
+				return 0, errors.New("too many compression pointers")
+			}
+			target := int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+			if target >= start || target < dnsHeaderLen {
+				return 0, errors.New("compression pointer not to an earlier name")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			start, off = target, target
+		default:
+			return 0, errors.New("invalid label type")
+		}
+	}
+}
+
+// formErrReply returns a FORMERR reply to a packed message failing
+// checkWire, or nil when its header or question can't be read, as DoQ
+// replies must carry a question
+func formErrReply(b []byte) *dns.Msg {
+	if len(b) < dnsHeaderLen || binary.BigEndian.Uint16(b[4:]) == 0 {
+		return nil
+	}
+	off, err := checkName(b, dnsHeaderLen)
+	if err != nil || off+4 > len(b) {
+		return nil
+	}
+	name, _, err := dns.UnpackDomainName(b, dnsHeaderLen)
+	if err != nil {
+		return nil
+	}
+
+	const opcodeShift = 11
+	reply := new(dns.Msg)
+	reply.Id = binary.BigEndian.Uint16(b)
+	reply.Response = true
+	reply.Opcode = int(binary.BigEndian.Uint16(b[2:])>>opcodeShift) & 0xF
+	reply.Rcode = dns.RcodeFormatError
+	reply.Question = []dns.Question{{
+		Name:   name,
+		Qtype:  binary.BigEndian.Uint16(b[off:]),
+		Qclass: binary.BigEndian.Uint16(b[off+2:]),
+	}}
+	return reply
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	doq "github.com/mosajjal/doqd"
+	"github.com/mosajjal/doqd/pkg/cert"
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+func TestValidateQuery(t *testing.T) {
+	s := &Server{upstream: &monitoredUpstream{Resolver: addrUpstream{"198.51.100.1"}}, logger: logrus.New()}
+
+	valid := new(dns.Msg)
+	valid.SetQuestion("example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, validateQuery(valid))
+	assert.Len(t, s.resolve(&query{msg: valid}).Answer, 1)
+
+	noQuestion := new(dns.Msg)
+	answers := valid.Copy()
+	answers.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}}}
+	answers.Answer = append(answers.Answer, answers.Answer[0])
+	twoOPT := valid.Copy()
+	twoOPT.SetEdns0(1232, false)
+	twoOPT.Extra = append(twoOPT.Extra, twoOPT.Extra[0])
+	longLabel := valid.Copy()
+	longLabel.Question[0].Name = strings.Repeat("a", 64) + ".com."
+	twoQuestions := valid.Copy()
+	twoQuestions.Question = append(twoQuestions.Question, dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	response := valid.Copy()
+	response.Response = true
+	notify := valid.Copy()
+	notify.Opcode = dns.OpcodeNotify
+	update := new(dns.Msg)
+	update.SetUpdate("example.com.")
+
+	for msg, rcode := range map[*dns.Msg]int{
+		noQuestion:   dns.RcodeFormatError,
+		twoQuestions: dns.RcodeFormatError,
+		answers:      dns.RcodeFormatError,
+		twoOPT:       dns.RcodeFormatError,
+		longLabel:    dns.RcodeFormatError,
+		response:     dns.RcodeFormatError,
+		notify:       dns.RcodeNotImplemented,
+		update:       dns.RcodeNotImplemented,
+	} {
+		assert.Equal(t, rcode, validateQuery(msg))
+		reply := s.resolve(&query{msg: msg})
+		assert.Equal(t, rcode, reply.Rcode)
+		assert.Empty(t, reply.Answer)
+	}
+}
+
+func TestCheckWire(t *testing.T) {
+	valid := new(dns.Msg)
+	valid.SetQuestion("www.example.com.", dns.TypeA)
+	valid.SetEdns0(1232, true)
+	packed, err := valid.Pack()
+	assert.Nil(t, err)
+	assert.Nil(t, checkWire(packed))
+
+	// A compressed answer pointing back to the question
+	reply := valid.Copy()
+	reply.Compress = true
+	reply.Answer = []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "example.com."}}
+	compressed, err := reply.Pack()
+	assert.Nil(t, err)
+	assert.Nil(t, checkWire(compressed))
+
+	header := packed[:dnsHeaderLen:dnsHeaderLen]
+	question := func(name ...byte) []byte {
+		b := append(append([]byte{}, header...), name...)
+		b[5], b[11] = 1, 0 // One question, no OPT
+		return append(b, 0, 1, 0, 1)
+	}
+	long := []byte{}
+	for i := 0; i < 5; i++ {
+		long = append(long, 63)
+		long = append(long, make([]byte, 63)...)
+	}
+
+	for name, b := range map[string][]byte{
+		"short header":    packed[:5],
+		"trailing data":   append(append([]byte{}, packed...), 0),
+		"truncated":       packed[:len(packed)-3],
+		"long name":       question(append(long, 0)...),
+		"label type":      question(0x40, 0),
+		"self pointer":    question(0xC0, dnsHeaderLen),
+		"forward pointer": question(0xC0, 0xFF),
+		"header pointer":  question(0xC0, 2),
+		"truncated name":  question(3, 'w', 'w'),
+	} {
+		assert.NotNil(t, checkWire(b), name)
+	}
+
+	// Chains of pointers are followed up to a limit
+	chain := func(pointers int) []byte {
+		b := append([]byte{}, header...)
+		b[5], b[7], b[11] = 1, byte(pointers), 0
+		b = append(b, 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+		prev := dnsHeaderLen
+		for i := 0; i < pointers; i++ {
+			cur := len(b)
+			b = append(b, 1, 'a', 0xC0, byte(prev), 0, 1, 0, 1, 0, 0, 0, 0, 0, 0)
+			prev = cur
+		}
+		return b
+	}
+	assert.Nil(t, checkWire(chain(maxNamePointers)))
+	assert.NotNil(t, checkWire(chain(maxNamePointers+1)))
+
+	reply = formErrReply(packed)
+	assert.Equal(t, valid.Id, reply.Id)
+	assert.True(t, reply.Response)
+	assert.Equal(t, dns.RcodeFormatError, reply.Rcode)
+	assert.Equal(t, valid.Question, reply.Question)
+	assert.Nil(t, formErrReply(packed[:5]))
+	assert.Nil(t, formErrReply(question(0xC0, 0xFF)))
+}
+
+func TestDoQProtocolError(t *testing.T) {
+	certPEM, keyPEM, err := cert.Generate([]string{"localhost"}, time.Hour)
+	assert.Nil(t, err)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+
+	doqServer, err := New(Config{
+		ListenAddr: "localhost:8861",
+		Cert:       pair,
+		Upstream:   "127.0.0.1:1",
+	})
+	assert.Nil(t, err)
+	go doqServer.Listen()
+
+	doqClient, err := client.New(client.Config{Server: "localhost:8861", TLSSkipVerify: true})
+	assert.Nil(t, err)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 0
+
+	// Invalid queries are answered
+	update := req.Copy()
+	update.Opcode = dns.OpcodeUpdate
+	resp, err := doqClient.SendQuery(*update)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNotImplemented, resp.Rcode)
+
+	// Pathological messages are answered with FORMERR without unpacking
+	packed, err := req.Pack()
+	assert.Nil(t, err)
+	raw, err := doqClient.ExchangeRaw(context.Background(), append(packed, 0))
+	assert.Nil(t, err)
+	formErr := new(dns.Msg)
+	if assert.Nil(t, formErr.Unpack(raw)) {
+		assert.Equal(t, dns.RcodeFormatError, formErr.Rcode)
+	}
+
+	// Oversized ones reset the stream without being read
+	_, err = doqClient.ExchangeRaw(context.Background(), append(packed, make([]byte, defaultMaxQuerySize)...))
+	assert.NotNil(t, err)
+
+	// Responses abort the connection
+	req.Response = true
+	_, err = doqClient.SendQuery(*req)
+	assert.NotNil(t, err)
+	select {
+	case <-doqClient.Session.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	var appErr *quic.ApplicationError
+	if assert.True(t, errors.As(context.Cause(doqClient.Session.Context()), &appErr)) {
+		assert.Equal(t, quic.ApplicationErrorCode(doq.ProtocolError), appErr.ErrorCode)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/mosajjal/doqd/pkg/upstream"
+)
+
+// ViewConfig is a policy applied to the queries of the clients it matches
+// instead of the server's, e.g. to filter children's devices more strictly
+type ViewConfig struct {
+	// Name identifies the view in logs, it must be unique
+	Name string
+	// Clients are the IP addresses, IP prefixes, and hex SHA-256
+	// fingerprints of client certificates or their public keys the view
+	// applies to
+	Clients []string
+	// Upstream, when set, replaces the server's upstream
+	Upstream string
+	// Blocking and Rewrites replace the server's for the view's clients
+	Blocking BlockingConfig
+	Rewrites map[string]string
+}
+
+// view is a policy for a set of clients, or for the clients of a tenant
+type view struct {
+	name string
+	// tenant is set for the views of tenants, which have no clients
+	tenant   bool
+	clients  *clientMatcher
+	upstream *monitoredUpstream
+	blocker  *blocker
+	rewriter *rewriter
+}
+
+// newViews creates views, using the server's upstream for those without
+// their own
+func newViews(configs []ViewConfig, serverUpstream *monitoredUpstream) ([]*view, error) {
+	var views []*view
+	names := map[string]bool{}
+	for _, c := range configs {
+		if c.Name == "" || names[c.Name] {
+			return nil, errors.New("views need a unique name")
+		}
+		names[c.Name] = true
+
+		v, err := newPolicyView(c.Name, c.Upstream, c.Blocking, c.Rewrites, serverUpstream)
+		if err != nil {
+			return nil, errors.New("view " + c.Name + ": " + err.Error())
+		}
+		if v.clients, err = newClientMatcher(c.Clients); err != nil {
+			return nil, errors.New("view " + c.Name + ": " + err.Error())
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// newPolicyView creates the policy of a view or tenant, using the server's
+// upstream when it has none
+func newPolicyView(name, upstreamAddr string, blocking BlockingConfig, rewrites map[string]string, serverUpstream *monitoredUpstream) (*view, error) {
+	v := &view{name: name, upstream: serverUpstream}
+	if upstreamAddr != "" {
+		up, err := upstream.New(upstreamAddr)
+		if err != nil {
+			return nil, err
+		}
+		v.upstream = &monitoredUpstream{Resolver: up}
+	}
+	var err error
+	if v.blocker, err = newBlocker(blocking); err != nil {
+		return nil, err
+	}
+	if v.rewriter, err = newRewriter(rewrites); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// viewFor returns the tenant of a query, or the first view matching its
+// client, or nil
+func (s *Server) viewFor(q *query) *view {
+	if t := s.tenants.lookup(q.serverName); t != nil {
+		return t
+	}
+	for _, v := range s.views {
+		if v.clients.match(q) {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViews(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "block")
+	assert.Nil(t, os.WriteFile(blocklist, []byte("games.example\n"), 0o600))
+
+	up := &ttlUpstream{ttl: 300}
+	s := &Server{upstream: &monitoredUpstream{Resolver: up}, logger: logrus.New(), cache: NewMemoryCache(10, nil)}
+	var err error
+	s.views, err = newViews([]ViewConfig{
+		{
+			Name:     "kids",
+			Clients:  []string{"192.168.1.128/25"},
+			Blocking: BlockingConfig{Blocklists: []string{blocklist}},
+			Rewrites: map[string]string{"search.example": "192.0.2.1"},
+		},
+		{
+			Name:     "lab",
+			Clients:  []string{"192.168.1.0/24"},
+			Upstream: "192.0.2.53:53",
+		},
+	}, s.upstream)
+	assert.Nil(t, err)
+
+	resolve := func(name, client string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		return s.resolve(&query{msg: msg, client: &net.UDPAddr{IP: net.ParseIP(client)}})
+	}
+
+	// Other clients get the server's policy
+	assert.Equal(t, dns.RcodeSuccess, resolve("games.example.", "198.51.100.1").Rcode)
+	assert.Equal(t, net.IP{192, 0, 2, 1}, resolve("search.example.", "198.51.100.1").Answer[0].(*dns.A).A.To4())
+	assert.Equal(t, int32(2), up.exchanges.Load())
+
+	// The first matching view applies, and does not share cached answers
+	assert.Equal(t, dns.RcodeNameError, resolve("games.example.", "192.168.1.200").Rcode)
+	assert.Equal(t, "192.0.2.1", resolve("search.example.", "192.168.1.200").Answer[0].(*dns.A).A.String())
+	assert.Equal(t, int32(2), up.exchanges.Load())
+	assert.Equal(t, dns.RcodeSuccess, resolve("www.example.", "192.168.1.200").Rcode)
+	assert.Equal(t, int32(3), up.exchanges.Load())
+
+	lab := s.views[1]
+	assert.NotSame(t, s.upstream, lab.upstream)
+	labUpstream := &ttlUpstream{ttl: 300}
+	lab.upstream = &monitoredUpstream{Resolver: labUpstream}
+	assert.Equal(t, dns.RcodeSuccess, resolve("games.example.", "192.168.1.10").Rcode)
+	assert.Equal(t, int32(1), labUpstream.exchanges.Load())
+	assert.Equal(t, int32(3), up.exchanges.Load())
+
+	for _, views := range [][]ViewConfig{
+		{{Clients: []string{"192.0.2.0/24"}}},
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: "a", Clients: []string{"nonsense"}}},
+		{{Name: "a", Upstream: "ftp://example"}},
+	} {
+		_, err := newViews(views, s.upstream)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,89 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// DoH constants (RFC 8484)
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+)
+
+// DoH forwards queries to a DNS over HTTPS resolver
+type DoH struct {
+	url    string
+	client *http.Client
+}
+
+// newDoH parses an https://host/path?options URL. The path defaults to
+// /dns-query, and the options are those of tls:// upstreams.
+func newDoH(u *url.URL) (*DoH, error) {
+	if u.Host == "" {
+		return nil, errors.New("https upstream: missing host")
+	}
+	tlsConf, err := tlsConfig(u)
+	if err != nil {
+		return nil, errors.New("https upstream: " + err.Error())
+	}
+	target := &url.URL{Scheme: "https", Host: u.Host, Path: u.Path}
+	if target.Path == "" {
+		target.Path = dohPath
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConf
+	return &DoH{
+		url:    target.String(),
+		client: &http.Client{Timeout: Timeout, Transport: transport},
+	}, nil
+}
+
+func (d *DoH) String() string {
+	return d.url
+}
+
+// Exchange POSTs a query to the resolver
+func (d *DoH) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// DoH clients use a zero ID to maximize cache friendliness
+	req := msg.Copy()
+	req.Id = 0
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohContentType)
+	httpReq.Header.Set("Accept", dohContentType)
+
+	httpResp, err := d.client.Do(httpReq)
+	if err != nil {
+		return nil, errors.New("upstream https query: " + err.Error())
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, errors.New("upstream https query: status " + strconv.Itoa(httpResp.StatusCode))
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, errors.New("upstream https query read: " + err.Error())
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, errors.New("upstream https answer unpack: " + err.Error())
+	}
+	return resp, nil // nil error
+}
@@ -0,0 +1,55 @@
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoHUpstream(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, dohPath, r.URL.Path)
+		assert.Equal(t, dohContentType, r.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(r.Body)
+		var req dns.Msg
+		assert.Nil(t, req.Unpack(body))
+		assert.Zero(t, req.Id)
+
+		reply := new(dns.Msg)
+		reply.SetReply(&req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+		reply.Answer = append(reply.Answer, rr)
+		packed, _ := reply.Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write(packed)
+	}))
+	defer ts.Close()
+	spkiSum := sha256.Sum256(ts.Certificate().RawSubjectPublicKeyInfo)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for params, ok := range map[string]bool{
+		"":              false,
+		"insecure=true": true,
+		"insecure=true&pin=" + hex.EncodeToString(spkiSum[:]):                true,
+		"insecure=true&pin=" + hex.EncodeToString(make([]byte, sha256.Size)): false,
+	} {
+		up, err := New("https://" + ts.Listener.Addr().String() + "?" + params)
+		if !assert.Nil(t, err) {
+			continue
+		}
+		resp, err := up.Exchange(context.Background(), req)
+		if ok && assert.Nil(t, err, params) {
+			assert.Len(t, resp.Answer, 1)
+		} else if !ok {
+			assert.NotNil(t, err, params)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime/debug"
+
+	"github.com/miekg/dns"
+)
+
+// clientKey is the context key of the client address
+type clientKey struct{}
+
+// WithClient returns a context carrying the address of the client whose
+// query is resolved, for resolvers answering per client
+func WithClient(ctx context.Context, client net.Addr) context.Context {
+	if client == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFromContext returns the client address set by WithClient
+func ClientFromContext(ctx context.Context) (net.Addr, bool) {
+	client, ok := ctx.Value(clientKey{}).(net.Addr)
+	return client, ok
+}
+
+// Handler answers queries with a miekg/dns handler, such as a dns.ServeMux
+// with handlers registered per zone, so existing Go DNS servers can be
+// served over DoQ and doqd's other front-ends
+type Handler struct {
+	handler dns.Handler
+}
+
+// NewHandler returns a resolver answering queries with handler. The handler
+// sees the client address passed by the server through WithClient as a
+// TCP address, so it doesn't truncate answers as it would over UDP: every
+// front-end carries or truncates whole messages itself.
+func NewHandler(handler dns.Handler) *Handler {
+	return &Handler{handler: handler}
+}
+
+func (h *Handler) String() string {
+	return fmt.Sprintf("%T", h.handler)
+}
+
+// Exchange serves a query with the handler and returns the message it
+// writes, or an error when the handler panics before writing one
+func (h *Handler) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	w := &handlerWriter{remote: &net.TCPAddr{}, done: make(chan struct{})}
+	if client, ok := ClientFromContext(ctx); ok {
+		if ap, err := netip.ParseAddrPort(client.String()); err == nil {
+			w.remote = net.TCPAddrFromAddrPort(ap)
+		}
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	go func() {
+		defer w.close()
+		// A panicking handler fails the query rather than the server
+		defer func() {
+			if v := recover(); v != nil && !w.closed {
+				w.err = fmt.Errorf("panic: %v\n%s", v, debug.Stack())
+			}
+		}()
+		h.handler.ServeDNS(w, msg.Copy())
+	}()
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		return nil, errors.New("handler: " + ctx.Err().Error())
+	}
+	if w.err != nil {
+		return nil, errors.New("handler: " + w.err.Error())
+	}
+	if w.reply == nil {
+		return nil, errors.New("handler: no response written")
+	}
+	return w.reply, nil // nil error
+}
+
+// handlerWriter is the dns.ResponseWriter given to a Handler, keeping the
+// first message written
+type handlerWriter struct {
+	remote net.Addr
+	reply  *dns.Msg
+	err    error
+	done   chan struct{}
+	closed bool
+}
+
+func (w *handlerWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (w *handlerWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *handlerWriter) Network() string {
+	return "tcp"
+}
+
+func (w *handlerWriter) WriteMsg(msg *dns.Msg) error {
+	if w.closed || w.reply != nil {
+		return errors.New("response already written")
+	}
+	w.reply = msg
+	w.close()
+	return nil
+}
+
+func (w *handlerWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		w.err = err
+		w.close()
+		return 0, err
+	}
+	if err := w.WriteMsg(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// close signals the response, once
+func (w *handlerWriter) close() {
+	if !w.closed {
+		w.closed = true
+		close(w.done)
+	}
+}
+
+func (w *handlerWriter) Close() error {
+	return nil
+}
+
+func (w *handlerWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *handlerWriter) TsigTimersOnly(bool) {}
+
+func (w *handlerWriter) Hijack() {}
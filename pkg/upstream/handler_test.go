@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc("example.com.", func(w dns.ResponseWriter, r *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		reply.Answer = append(reply.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{w.RemoteAddr().String(), w.Network()},
+		})
+		_ = w.WriteMsg(reply)
+	})
+	mux.HandleFunc("silent.example.", func(dns.ResponseWriter, *dns.Msg) {})
+	mux.HandleFunc("panic.example.", func(dns.ResponseWriter, *dns.Msg) {
+		panic("handler bug")
+	})
+	mux.HandleFunc("slow.example.", func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(time.Second)
+	})
+	h := NewHandler(mux)
+	assert.Equal(t, "*dns.ServeMux", h.String())
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeTXT)
+	ctx := WithClient(context.Background(), &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353})
+	resp, err := h.Exchange(ctx, req)
+	assert.Nil(t, err)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, []string{"192.0.2.1:5353", "tcp"}, resp.Answer[0].(*dns.TXT).Txt)
+	}
+
+	// Zones without a handler are refused by the mux
+	req.SetQuestion("example.org.", dns.TypeA)
+	resp, err = h.Exchange(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+
+	req.SetQuestion("silent.example.", dns.TypeA)
+	_, err = h.Exchange(context.Background(), req)
+	assert.NotNil(t, err)
+
+	req.SetQuestion("panic.example.", dns.TypeA)
+	_, err = h.Exchange(context.Background(), req)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "handler bug")
+	}
+
+	req.SetQuestion("slow.example.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = h.Exchange(ctx, req)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,347 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+)
+
+// Oblivious DoH (RFC 9230) constants
+const (
+	odohVersion        = 0x0001
+	odohMessageQuery   = 0x01
+	odohMessageAnswer  = 0x02
+	odohContentType    = "application/oblivious-dns-message"
+	odohConfigsPath    = "/.well-known/odohconfigs"
+	odohPaddingBlock   = 128
+	odohConfigLifetime = time.Hour
+)
+
+// odohConfig is a target's HPKE public key configuration
+type odohConfig struct {
+	suite     hpke.Suite
+	kdf       hpke.KDF
+	aead      hpke.AEAD
+	publicKey kem.PublicKey
+	keyID     []byte
+}
+
+// ODoH forwards queries to an Oblivious DoH target, optionally through
+// a relay so the target never learns this server's address
+type ODoH struct {
+	target *url.URL
+	relay  *url.URL
+	client *http.Client
+
+	lock      sync.Mutex
+	config    *odohConfig
+	fetchedAt time.Time
+}
+
+// newODoH parses an odoh://target/path?relay=https://relay/path URL.
+// The target path defaults to /dns-query. Without a relay, queries are sent to
+// the target directly, which still hides their content from the target's
+// frontend but not this server's address.
+func newODoH(u *url.URL) (*ODoH, error) {
+	if u.Host == "" {
+		return nil, errors.New("odoh upstream: missing target host")
+	}
+	target := &url.URL{Scheme: "https", Host: u.Host, Path: u.Path}
+	if target.Path == "" {
+		target.Path = dohPath
+	}
+
+	o := &ODoH{
+		target: target,
+		client: &http.Client{Timeout: Timeout},
+	}
+	if relay := u.Query().Get("relay"); relay != "" {
+		r, err := url.Parse(relay)
+		if err != nil {
+			return nil, errors.New("odoh relay: " + err.Error())
+		}
+		if r.Scheme != "https" || r.Host == "" {
+			return nil, errors.New("odoh relay: must be an https URL")
+		}
+		o.relay = r
+	}
+	return o, nil
+}
+
+func (o *ODoH) String() string {
+	if o.relay != nil {
+		return "odoh://" + o.target.Host + o.target.Path + " via " + o.relay.String()
+	}
+	return "odoh://" + o.target.Host + o.target.Path
+}
+
+// Exchange sends an encrypted query to the target
+func (o *ODoH) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	config, err := o.getConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// DoH clients use a zero ID to maximize cache friendliness
+	req := msg.Copy()
+	req.Id = 0
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	query, plaintext, opener, err := config.encryptQuery(packed)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := o.post(ctx, query)
+	if err != nil {
+		// The target may have rotated its key, refetch it on the next query
+		o.lock.Lock()
+		o.config = nil
+		o.lock.Unlock()
+		return nil, err
+	}
+
+	answer, err := opener.decryptAnswer(body, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(answer); err != nil {
+		return nil, errors.New("odoh answer unpack: " + err.Error())
+	}
+	return resp, nil // nil error
+}
+
+// post sends an encrypted query to the relay, or to the target without one
+func (o *ODoH) post(ctx context.Context, query []byte) ([]byte, error) {
+	endpoint := *o.target
+	if o.relay != nil {
+		endpoint = *o.relay
+		params := endpoint.Query()
+		params.Set("targethost", o.target.Host)
+		params.Set("targetpath", o.target.Path)
+		endpoint.RawQuery = params.Encode()
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(query))
+	if err != nil {
+		return nil, errors.New("odoh request: " + err.Error())
+	}
+	httpReq.Header.Set("Content-Type", odohContentType)
+	httpReq.Header.Set("Accept", odohContentType)
+
+	resp, err := o.client.Do(httpReq)
+	if err != nil {
+		return nil, errors.New("odoh request: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("odoh request: unexpected status " + resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize*2))
+}
+
+// getConfig returns the target's public key configuration, fetching it from
+// the well-known path when it is missing or stale
+func (o *ODoH) getConfig(ctx context.Context) (*odohConfig, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.config != nil && time.Since(o.fetchedAt) < odohConfigLifetime {
+		return o.config, nil
+	}
+
+	configURL := url.URL{Scheme: "https", Host: o.target.Host, Path: odohConfigsPath}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, configURL.String(), nil)
+	if err != nil {
+		return nil, errors.New("odoh config fetch: " + err.Error())
+	}
+	resp, err := o.client.Do(httpReq)
+	if err != nil {
+		return nil, errors.New("odoh config fetch: " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("odoh config fetch: unexpected status " + resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, errors.New("odoh config fetch: " + err.Error())
+	}
+
+	config, err := parseODoHConfigs(body)
+	if err != nil {
+		return nil, err
+	}
+	o.config, o.fetchedAt = config, time.Now()
+	return config, nil
+}
+
+// parseODoHConfigs returns the first supported config from a serialized
+// ObliviousDoHConfigs structure
+func parseODoHConfigs(b []byte) (*odohConfig, error) {
+	configs, _, ok := readVector(b)
+	if !ok {
+		return nil, errors.New("odoh configs: malformed")
+	}
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, errors.New("odoh configs: malformed")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		contents, rest, ok := readVector(configs[2:])
+		if !ok {
+			return nil, errors.New("odoh configs: malformed")
+		}
+		configs = rest
+
+		if version != odohVersion {
+			continue
+		}
+		if config, err := parseODoHConfigContents(contents); err == nil {
+			return config, nil
+		}
+	}
+	return nil, errors.New("odoh configs: no supported config")
+}
+
+// parseODoHConfigContents parses a single ObliviousDoHConfigContents
+func parseODoHConfigContents(contents []byte) (*odohConfig, error) {
+	if len(contents) < 6 {
+		return nil, errors.New("odoh config: malformed")
+	}
+	kemID := hpke.KEM(binary.BigEndian.Uint16(contents[0:]))
+	kdfID := hpke.KDF(binary.BigEndian.Uint16(contents[2:]))
+	aeadID := hpke.AEAD(binary.BigEndian.Uint16(contents[4:]))
+	key, _, ok := readVector(contents[6:])
+	if !ok {
+		return nil, errors.New("odoh config: malformed")
+	}
+	if !kemID.IsValid() || !kdfID.IsValid() || !aeadID.IsValid() {
+		return nil, errors.New("odoh config: unsupported HPKE suite")
+	}
+
+	publicKey, err := kemID.Scheme().UnmarshalBinaryPublicKey(key)
+	if err != nil {
+		return nil, errors.New("odoh config: " + err.Error())
+	}
+
+	return &odohConfig{
+		suite:     hpke.NewSuite(kemID, kdfID, aeadID),
+		kdf:       kdfID,
+		aead:      aeadID,
+		publicKey: publicKey,
+		keyID:     kdfID.Expand(kdfID.Extract(contents, nil), []byte("odoh key id"), uint(kdfID.ExtractSize())),
+	}, nil
+}
+
+// odohOpener decrypts the answer to a single query
+type odohOpener struct {
+	config *odohConfig
+	secret []byte
+}
+
+// encryptQuery seals a packed DNS query for the target. It returns the
+// serialized ObliviousDoHMessage, the padded plaintext and the state needed
+// to decrypt the answer.
+func (c *odohConfig) encryptQuery(packed []byte) (query, plaintext []byte, opener *odohOpener, err error) {
+	padding := (odohPaddingBlock - len(packed)%odohPaddingBlock) % odohPaddingBlock
+	plaintext = appendVector(nil, packed)
+	plaintext = appendVector(plaintext, make([]byte, padding))
+
+	sender, err := c.suite.NewSender(c.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, nil, errors.New("odoh encrypt: " + err.Error())
+	}
+	enc, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, errors.New("odoh encrypt: " + err.Error())
+	}
+	ct, err := sealer.Seal(plaintext, odohAAD(odohMessageQuery, c.keyID))
+	if err != nil {
+		return nil, nil, nil, errors.New("odoh encrypt: " + err.Error())
+	}
+
+	query = odohMessage(odohMessageQuery, c.keyID, append(enc, ct...))
+	opener = &odohOpener{config: c, secret: sealer.Export([]byte("odoh response"), c.aead.KeySize())}
+	return query, plaintext, opener, nil
+}
+
+// decryptAnswer opens an ObliviousDoHMessage answer and returns the DNS message
+func (o *odohOpener) decryptAnswer(msg, queryPlaintext []byte) ([]byte, error) {
+	if len(msg) < 1 || msg[0] != odohMessageAnswer {
+		return nil, errors.New("odoh answer: unexpected message type")
+	}
+	nonce, rest, ok := readVector(msg[1:])
+	if !ok {
+		return nil, errors.New("odoh answer: malformed")
+	}
+	ct, _, ok := readVector(rest)
+	if !ok {
+		return nil, errors.New("odoh answer: malformed")
+	}
+
+	kdf, aead := o.config.kdf, o.config.aead
+	salt := appendVector(append([]byte{}, queryPlaintext...), nonce)
+	prk := kdf.Extract(o.secret, salt)
+	cipher, err := aead.New(kdf.Expand(prk, []byte("odoh key"), aead.KeySize()))
+	if err != nil {
+		return nil, errors.New("odoh answer: " + err.Error())
+	}
+	plaintext, err := cipher.Open(nil, kdf.Expand(prk, []byte("odoh nonce"), aead.NonceSize()), ct, odohAAD(odohMessageAnswer, nonce))
+	if err != nil {
+		return nil, errors.New("odoh answer decrypt: " + err.Error())
+	}
+
+	answer, _, ok := readVector(plaintext)
+	if !ok {
+		return nil, errors.New("odoh answer: malformed plaintext")
+	}
+	return answer, nil
+}
+
+// odohMessage serializes an ObliviousDoHMessage
+func odohMessage(messageType byte, keyID, encrypted []byte) []byte {
+	b := []byte{messageType}
+	b = appendVector(b, keyID)
+	return appendVector(b, encrypted)
+}
+
+// odohAAD returns the associated data for a message type and key ID or nonce
+func odohAAD(messageType byte, id []byte) []byte {
+	return appendVector([]byte{messageType}, id)
+}
+
+// appendVector appends a 16 bit length prefixed byte string
+func appendVector(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+// readVector reads a 16 bit length prefixed byte string, returning it and the
+// remaining bytes
+func readVector(b []byte) (v, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
@@ -0,0 +1,99 @@
+package upstream
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// odohTestTarget answers Oblivious DoH queries with a fixed A record, acting
+// as both the relay and the target
+func odohTestTarget(t *testing.T) *httptest.Server {
+	kemID, kdfID, aeadID := hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM
+	publicKey, privateKey, err := kemID.Scheme().GenerateKeyPair()
+	assert.Nil(t, err)
+	keyBytes, err := publicKey.MarshalBinary()
+	assert.Nil(t, err)
+
+	contents := []byte{0, byte(kemID), 0, byte(kdfID), 0, byte(aeadID)}
+	contents = appendVector(contents, keyBytes)
+	configs := appendVector(nil, appendVector([]byte{0, odohVersion}, contents))
+	suite := hpke.NewSuite(kemID, kdfID, aeadID)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(odohConfigsPath, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(configs)
+	})
+	mux.HandleFunc("/proxy", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/dns-query", r.URL.Query().Get("targetpath"))
+		assert.Equal(t, odohContentType, r.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(r.Body)
+
+		// Decrypt the query
+		assert.Equal(t, byte(odohMessageQuery), body[0])
+		keyID, rest, ok := readVector(body[1:])
+		assert.True(t, ok)
+		encrypted, _, ok := readVector(rest)
+		assert.True(t, ok)
+		encSize := kemID.Scheme().CiphertextSize()
+		receiver, err := suite.NewReceiver(privateKey, []byte("odoh query"))
+		assert.Nil(t, err)
+		opener, err := receiver.Setup(encrypted[:encSize])
+		assert.Nil(t, err)
+		plaintext, err := opener.Open(encrypted[encSize:], odohAAD(odohMessageQuery, keyID))
+		if !assert.Nil(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Equal(t, 4, len(plaintext)%odohPaddingBlock) // padded apart from the two length prefixes
+		packed, _, _ := readVector(plaintext)
+
+		var req dns.Msg
+		assert.Nil(t, req.Unpack(packed))
+		reply := new(dns.Msg)
+		reply.SetReply(&req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+		reply.Answer = append(reply.Answer, rr)
+		answer, _ := reply.Pack()
+
+		// Encrypt the answer with keys derived from the query context
+		nonce := make([]byte, aeadID.KeySize())
+		_, _ = rand.Read(nonce)
+		secret := opener.Export([]byte("odoh response"), aeadID.KeySize())
+		prk := kdfID.Extract(secret, appendVector(append([]byte{}, plaintext...), nonce))
+		cipher, _ := aeadID.New(kdfID.Expand(prk, []byte("odoh key"), aeadID.KeySize()))
+		ct := cipher.Seal(nil, kdfID.Expand(prk, []byte("odoh nonce"), aeadID.NonceSize()),
+			appendVector(appendVector(nil, answer), nil), odohAAD(odohMessageAnswer, nonce))
+
+		w.Header().Set("Content-Type", odohContentType)
+		_, _ = w.Write(odohMessage(odohMessageAnswer, nonce, ct))
+	})
+	return httptest.NewTLSServer(mux)
+}
+
+func TestODoHUpstream(t *testing.T) {
+	ts := odohTestTarget(t)
+	defer ts.Close()
+
+	up, err := New("odoh://" + ts.Listener.Addr().String() + "?relay=" + url.QueryEscape(ts.URL+"/proxy"))
+	assert.Nil(t, err)
+	o := up.(*ODoH)
+	o.client = ts.Client()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := o.Exchange(context.Background(), req)
+	assert.Nil(t, err)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, net.ParseIP("192.0.2.1").To4(), resp.Answer[0].(*dns.A).A)
+	}
+}
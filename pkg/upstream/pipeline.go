@@ -0,0 +1,216 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultPoolSize is the number of connections kept open to a tls:// or
+// quic:// upstream
+const defaultPoolSize = 2
+
+// pipelineIdleTimeout closes pooled DoT connections without traffic for this
+// long, and those waiting this long for a response
+const pipelineIdleTimeout = 30 * time.Second
+
+// poolSize returns the number of connections to keep open to a tls:// or
+// quic:// upstream from its conns URL parameter, removing it from the URL
+// so only TLS parameters remain
+func poolSize(u *url.URL) (int, error) {
+	query := u.Query()
+	if !query.Has("conns") {
+		return defaultPoolSize, nil
+	}
+	size, err := strconv.Atoi(query.Get("conns"))
+	if err != nil || size < 1 {
+		return 0, errors.New("conns must be a positive number")
+	}
+	query.Del("conns")
+	u.RawQuery = query.Encode()
+	return size, nil
+}
+
+// pipeline sends queries over a DNS over TLS connection without waiting for
+// the previous responses, matching responses to queries by ID as they
+// arrive in any order (RFC 7766)
+type pipeline struct {
+	conn net.Conn
+	// lastRead is when the last response was read, in Unix nanoseconds
+	lastRead atomic.Int64
+
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	pending   map[uint16]chan *dns.Msg
+	err       error
+	done      chan struct{}
+}
+
+// newPipeline starts reading the responses of a connection
+func newPipeline(conn net.Conn) *pipeline {
+	p := &pipeline{conn: conn, pending: map[uint16]chan *dns.Msg{}, done: make(chan struct{})}
+	p.lastRead.Store(time.Now().UnixNano())
+	_ = conn.SetReadDeadline(time.Now().Add(pipelineIdleTimeout))
+	go p.read()
+	return p
+}
+
+// exchange sends a query with a free ID and waits for its response
+func (p *pipeline) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	req := msg.Copy()
+	resp := make(chan *dns.Msg, 1)
+	if err := p.register(req, resp); err != nil {
+		return nil, err
+	}
+	defer p.unregister(req.Id)
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	sent := time.Now()
+	p.writeLock.Lock()
+	deadline, _ := ctx.Deadline()
+	_ = p.conn.SetWriteDeadline(deadline)
+	_ = p.conn.SetReadDeadline(sent.Add(pipelineIdleTimeout))
+	_, err = (&dns.Conn{Conn: p.conn}).Write(packed)
+	p.writeLock.Unlock()
+	if err != nil {
+		p.close(err)
+		return nil, err
+	}
+
+	select {
+	case r := <-resp:
+		return r, nil // nil error
+	case <-p.done:
+		return nil, p.err
+	case <-ctx.Done():
+		// Nothing read since the query was sent, the connection is likely
+		// dead rather than the upstream slow to answer this query
+		if p.lastRead.Load() < sent.UnixNano() {
+			p.close(errors.New("no response"))
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// register picks a free ID for a query waiting for its response on resp
+func (p *pipeline) register(req *dns.Msg, resp chan *dns.Msg) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	for {
+		req.Id = uint16(rand.N(1 << 16))
+		if _, ok := p.pending[req.Id]; !ok {
+			p.pending[req.Id] = resp
+			return nil
+		}
+	}
+}
+
+// unregister frees the ID of a query
+func (p *pipeline) unregister(id uint16) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.pending, id)
+}
+
+// read hands the responses to their queries until the connection fails or
+// stays idle
+func (p *pipeline) read() {
+	conn := &dns.Conn{Conn: p.conn}
+	for {
+		resp, err := conn.ReadMsg()
+		if err != nil {
+			p.close(err)
+			return
+		}
+		p.lastRead.Store(time.Now().UnixNano())
+		_ = p.conn.SetReadDeadline(time.Now().Add(pipelineIdleTimeout))
+		p.lock.Lock()
+		ch, ok := p.pending[resp.Id]
+		delete(p.pending, resp.Id)
+		p.lock.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// close closes the connection, failing the queries waiting on it
+func (p *pipeline) close(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.err = errors.New("connection closed: " + err.Error())
+	close(p.done)
+	_ = p.conn.Close()
+}
+
+// closed tells whether the connection can no longer carry queries
+func (p *pipeline) closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// pipelinePool spreads queries over a few long-lived DoT connections,
+// redialing them when they close
+type pipelinePool struct {
+	addr    string
+	tlsConf *tls.Config
+	slots   []pipelineSlot
+	next    atomic.Uint32
+}
+
+// pipelineSlot holds one connection of a pool, queries waiting for the same
+// dial when it has none
+type pipelineSlot struct {
+	lock sync.Mutex
+	p    *pipeline
+}
+
+// newPipelinePool returns a pool of size connections, dialed on demand and
+// resuming the TLS sessions of the previous ones
+func newPipelinePool(addr string, tlsConf *tls.Config, size int) *pipelinePool {
+	tlsConf = tlsConf.Clone()
+	if tlsConf.ClientSessionCache == nil {
+		tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(size)
+	}
+	return &pipelinePool{addr: addr, tlsConf: tlsConf, slots: make([]pipelineSlot, size)}
+}
+
+// get returns the next connection of the pool, dialing it when closed, and
+// whether it was already open
+func (pool *pipelinePool) get(ctx context.Context) (*pipeline, bool, error) {
+	slot := &pool.slots[pool.next.Add(1)%uint32(len(pool.slots))]
+	slot.lock.Lock()
+	defer slot.lock.Unlock()
+	if slot.p != nil && !slot.p.closed() {
+		return slot.p, true, nil
+	}
+	d := tls.Dialer{Config: pool.tlsConf}
+	conn, err := d.DialContext(ctx, "tcp", pool.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	slot.p = newPipeline(conn)
+	return slot.p, false, nil
+}
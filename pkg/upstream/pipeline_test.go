@@ -0,0 +1,118 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mosajjal/doqd/pkg/cert"
+)
+
+// reversingUpstream serves DNS over TLS, reading queries in pairs and
+// answering each pair in reverse order, and counts its connections
+func reversingUpstream(t *testing.T) (addr string, conns *atomic.Int32) {
+	certPEM, keyPEM, err := cert.Generate([]string{"dns.test"}, time.Hour)
+	assert.Nil(t, err)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	conns = new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				dnsConn := &dns.Conn{Conn: conn}
+				for {
+					var pair []*dns.Msg
+					for len(pair) < 2 {
+						msg, err := dnsConn.ReadMsg()
+						if err != nil {
+							return
+						}
+						pair = append(pair, msg)
+					}
+					for i := len(pair) - 1; i >= 0; i-- {
+						reply := new(dns.Msg)
+						reply.SetReply(pair[i])
+						rr, _ := dns.NewRR(pair[i].Question[0].Name + " 60 IN TXT answer")
+						reply.Answer = append(reply.Answer, rr)
+						_ = dnsConn.WriteMsg(reply)
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), conns
+}
+
+func TestDoTPipelining(t *testing.T) {
+	addr, conns := reversingUpstream(t)
+	up, err := New("tls://" + addr + "?insecure=true&conns=1")
+	assert.Nil(t, err)
+
+	// Each pair of queries is answered in reverse order
+	exchangePair := func() {
+		var wg sync.WaitGroup
+		for _, name := range []string{"a.example.", "b.example."} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := new(dns.Msg)
+				req.SetQuestion(name, dns.TypeTXT)
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				defer cancel()
+				resp, err := up.Exchange(ctx, req)
+				if assert.Nil(t, err) && assert.Len(t, resp.Answer, 1) {
+					assert.Equal(t, name, resp.Answer[0].Header().Name)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	for i := 0; i < 3; i++ {
+		exchangePair()
+	}
+	assert.Equal(t, int32(1), conns.Load())
+
+	// A closed connection is replaced
+	p, reused, err := up.(*DoT).pool.get(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, reused)
+	p.close(net.ErrClosed)
+	exchangePair()
+	assert.Equal(t, int32(2), conns.Load())
+}
+
+func TestPoolSize(t *testing.T) {
+	u, _ := url.Parse("tls://dns.example?conns=4&insecure=true")
+	size, err := poolSize(u)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, size)
+	assert.Equal(t, "insecure=true", u.RawQuery)
+
+	u, _ = url.Parse("quic://dns.example")
+	size, err = poolSize(u)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultPoolSize, size)
+
+	for _, conns := range []string{"0", "many"} {
+		_, err = poolSize(&url.URL{Scheme: "tls", Host: "dns.example", RawQuery: "conns=" + conns})
+		assert.NotNil(t, err, conns)
+	}
+}
@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// probeUDPSizes are the EDNS buffer sizes probed, largest first, down to
+// the 1232 bytes recommended to avoid fragmentation
+var probeUDPSizes = []int{4096, 1232}
+
+// probeTimeout bounds each probe query
+const probeTimeout = 2 * time.Second
+
+// Capabilities are what a plain DNS resolver supports, as found by Probe
+type Capabilities struct {
+	// UDP tells whether the resolver answers over UDP
+	UDP bool `json:"udp"`
+	// EDNS tells whether it answers EDNS queries over UDP with an OPT record,
+	// rather than dropping them, answering FORMERR or stripping the OPT
+	EDNS bool `json:"edns"`
+	// UDPSize is the largest EDNS buffer size whose large answers arrive
+	// over UDP, 512 when none does
+	UDPSize int `json:"udp_size"`
+	// TCP tells whether it answers over TCP on the same port
+	TCP bool `json:"tcp"`
+	// DoT tells whether it answers DNS over TLS on port 853, whatever its
+	// certificate
+	DoT bool `json:"dot"`
+	// Case tells whether it answers with the query name in the case it was
+	// sent, so names are sent in random case (0x20) over UDP
+	Case bool `json:"case"`
+	// ProbedAt is the time of the probe
+	ProbedAt time.Time `json:"probed_at"`
+}
+
+// Prober is implemented by resolvers adapting how they forward queries to
+// what their upstream supports
+type Prober interface {
+	// Probe finds what the upstream supports and adapts forwarding to it
+	Probe(ctx context.Context) Capabilities
+	// Capabilities returns the result of the last probe, false before the
+	// first one
+	Capabilities() (Capabilities, bool)
+}
+
+// Probe queries the resolver over UDP with and without EDNS, with large
+// buffer sizes and with a mixed case name, over TCP and over DoT. Queries are
+// then sent over TCP when the resolver mishandles EDNS or UDP, and advertise
+// a buffer size no larger than the largest that worked, so larger answers
+// are truncated and retried over TCP instead of being lost to fragmentation.
+// Names are only sent in random case to resolvers preserving it.
+func (u *UDP) Probe(ctx context.Context) Capabilities {
+	caps := Capabilities{UDPSize: dns.MinMsgSize, ProbedAt: time.Now()}
+	host, _, _ := net.SplitHostPort(u.addr)
+
+	plain := probeQuery(dns.TypeSOA, 0)
+	if resp, err := u.probeUDP(ctx, plain); err == nil && resp.Rcode != dns.RcodeFormatError {
+		caps.UDP = true
+	}
+	edns := probeQuery(dns.TypeSOA, dns.DefaultMsgSize)
+	if resp, err := u.probeUDP(ctx, edns); err == nil && resp.IsEdns0() != nil && resp.Rcode != dns.RcodeFormatError {
+		caps.UDP, caps.EDNS = true, true
+	}
+	if caps.EDNS {
+		for _, size := range probeUDPSizes {
+			// The signed root keys answer is about 1 KB, and larger with
+			// more keys during rollovers
+			large := probeQuery(dns.TypeDNSKEY, size)
+			large.IsEdns0().SetDo()
+			if _, err := u.probeUDP(ctx, large); err == nil {
+				caps.UDPSize = size
+				break
+			}
+		}
+	}
+
+	if caps.UDP {
+		mixed := probeQuery(dns.TypeSOA, 0)
+		mixed.Question[0].Name = "cOm."
+		_, err := u.probeUDP(ctx, mixed)
+		caps.Case = err == nil
+	}
+
+	if packed, err := plain.Pack(); err == nil {
+		probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		_, err = exchangeTCP(probeCtx, u.addr, plain.Id, packed)
+		cancel()
+		caps.TCP = err == nil
+	}
+	caps.DoT = probeDoT(ctx, net.JoinHostPort(host, tlsPort), plain)
+
+	u.caps.Store(&caps)
+	return caps
+}
+
+// Capabilities returns the result of the last probe
+func (u *UDP) Capabilities() (Capabilities, bool) {
+	caps := u.caps.Load()
+	if caps == nil {
+		return Capabilities{}, false
+	}
+	return *caps, true
+}
+
+// probeUDP sends a probe query over UDP
+func (u *UDP) probeUDP(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	return u.exchangeUDP(ctx, msg, packed, max(bufferSize(msg), dns.MinMsgSize))
+}
+
+// probeDoT sends a probe query over DNS over TLS
+func probeDoT(ctx context.Context, addr string, msg *dns.Msg) bool {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	d := tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true}}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	dnsConn := &dns.Conn{Conn: conn}
+	if err := dnsConn.WriteMsg(msg); err != nil {
+		return false
+	}
+	resp, err := dnsConn.ReadMsg()
+	return err == nil && resp.Id == msg.Id
+}
+
+// probeQuery returns a probe query for the root, with EDNS when size isn't
+// 0
+func probeQuery(qtype uint16, size int) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", qtype)
+	if size > 0 {
+		msg.SetEdns0(uint16(size), false)
+	}
+	return msg
+}
+
+// adapt applies the probed capabilities to the copy of a query sent
+// upstream, returning whether to send it over TCP
+func (u *UDP) adapt(req *dns.Msg) (tcp bool) {
+	caps := u.caps.Load()
+	if caps == nil {
+		return false
+	}
+	if caps.TCP && (!caps.UDP || (!caps.EDNS && req.IsEdns0() != nil)) {
+		return true
+	}
+	if opt := req.IsEdns0(); opt != nil && caps.EDNS && int(opt.UDPSize()) > caps.UDPSize {
+		opt.SetUDPSize(uint16(caps.UDPSize))
+	}
+	return false
+}
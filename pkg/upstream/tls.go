@@ -0,0 +1,209 @@
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+
+	"github.com/mosajjal/doqd/pkg/client"
+)
+
+// tlsPort is the default port of DoT and DoQ upstreams (RFC 7858,
+// RFC 9250)
+const tlsPort = "853"
+
+// tlsConfig builds the TLS config of a tls://, https:// or quic:// upstream
+// from its URL query parameters:
+//
+//	name      server name to verify and send in SNI, defaults to the host
+//	ca        PEM file of CAs trusted instead of the system roots
+//	pin       SHA-256 of the server's public key, hex or base64, may be repeated
+//	insecure  skip certificate chain verification, pins are still checked
+func tlsConfig(u *url.URL) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: u.Hostname()}
+	pins := map[string]bool{}
+	for key, values := range u.Query() {
+		for _, value := range values {
+			switch key {
+			case "name":
+				conf.ServerName = value
+			case "ca":
+				caPEM, err := os.ReadFile(value)
+				if err != nil {
+					return nil, err
+				}
+				conf.RootCAs = x509.NewCertPool()
+				if !conf.RootCAs.AppendCertsFromPEM(caPEM) {
+					return nil, errors.New("no certificates found in " + value)
+				}
+			case "pin":
+				pin, err := parsePin(value)
+				if err != nil {
+					return nil, err
+				}
+				pins[pin] = true
+			case "insecure":
+				insecure, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, errors.New("insecure: " + err.Error())
+				}
+				conf.InsecureSkipVerify = insecure
+			default:
+				return nil, errors.New("unknown option " + key)
+			}
+		}
+	}
+
+	if len(pins) > 0 {
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[hex.EncodeToString(spkiSum[:])] {
+					return nil
+				}
+			}
+			return errors.New("upstream certificate does not match any pin")
+		}
+	}
+	return conf, nil
+}
+
+// parsePin parses a hex or base64 SHA-256 public key pin into hex
+func parsePin(pin string) (string, error) {
+	if b, err := hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err == nil && len(b) == sha256.Size {
+		return hex.EncodeToString(b), nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(pin); err == nil && len(b) == sha256.Size {
+		return hex.EncodeToString(b), nil
+	}
+	return "", errors.New("pin " + pin + " is not a SHA-256 hash")
+}
+
+// tlsAddr returns the host:port of a tls:// or quic:// upstream URL
+func tlsAddr(u *url.URL) (string, error) {
+	if u.Hostname() == "" {
+		return "", errors.New("missing host")
+	}
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), tlsPort), nil
+	}
+	return u.Host, nil
+}
+
+// DoT forwards queries to a DNS over TLS resolver, pipelining them over a
+// few long-lived connections
+type DoT struct {
+	addr string
+	pool *pipelinePool
+}
+
+// newDoT parses a tls://host:port?options URL
+func newDoT(u *url.URL) (*DoT, error) {
+	addr, err := tlsAddr(u)
+	if err != nil {
+		return nil, errors.New("tls upstream: " + err.Error())
+	}
+	size, err := poolSize(u)
+	if err != nil {
+		return nil, errors.New("tls upstream: " + err.Error())
+	}
+	tlsConf, err := tlsConfig(u)
+	if err != nil {
+		return nil, errors.New("tls upstream: " + err.Error())
+	}
+	return &DoT{addr: addr, pool: newPipelinePool(addr, tlsConf, size)}, nil
+}
+
+func (d *DoT) String() string {
+	return "tls://" + d.addr
+}
+
+// Exchange sends a query over a pooled TLS connection, retrying once over a
+// new connection when the upstream closed an idle one under it. The query is
+// sent with a random ID, the caller restores the client's.
+func (d *DoT) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	for retried := false; ; retried = true {
+		p, reused, err := d.pool.get(ctx)
+		if err != nil {
+			return nil, errors.New("upstream tls connect: " + err.Error())
+		}
+		resp, err := p.exchange(ctx, msg)
+		if err != nil && reused && !retried && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			return nil, errors.New("upstream tls query: " + err.Error())
+		}
+		return resp, nil // nil error
+	}
+}
+
+// DoQ forwards queries to a DNS over QUIC resolver over a few long-lived
+// connections, each carrying concurrent queries on its own streams
+type DoQ struct {
+	addr      string
+	resolvers []*client.Resolver
+	next      atomic.Uint32
+}
+
+// newDoQ parses a quic://host:port?options URL
+func newDoQ(u *url.URL) (*DoQ, error) {
+	addr, err := tlsAddr(u)
+	if err != nil {
+		return nil, errors.New("quic upstream: " + err.Error())
+	}
+	size, err := poolSize(u)
+	if err != nil {
+		return nil, errors.New("quic upstream: " + err.Error())
+	}
+	tlsConf, err := tlsConfig(u)
+	if err != nil {
+		return nil, errors.New("quic upstream: " + err.Error())
+	}
+	d := &DoQ{addr: addr}
+	logger := logrus.New()
+	for i := 0; i < size; i++ {
+		d.resolvers = append(d.resolvers, client.NewResolver(client.ResolverConfig{Config: client.Config{
+			Server:    addr,
+			TLSConfig: tlsConf,
+			Logger:    logger,
+		}}))
+	}
+	return d, nil
+}
+
+func (d *DoQ) String() string {
+	return "quic://" + d.addr
+}
+
+// Exchange sends a query over a pooled QUIC connection, dialing it when
+// closed
+func (d *DoQ) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// DoQ queries carry an ID of 0, the caller restores the client's
+	req := msg.Copy()
+	req.Id = 0
+	r := d.resolvers[d.next.Add(1)%uint32(len(d.resolvers))]
+	resp, err := r.Query(ctx, req)
+	if err != nil {
+		return nil, errors.New("upstream quic query: " + err.Error())
+	}
+	return resp, nil // nil error
+}
@@ -0,0 +1,33 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSConfig(t *testing.T) {
+	for _, params := range []string{
+		"pin=abc",
+		"insecure=maybe",
+		"ca=/nonexistent.pem",
+		"sni=dns.example",
+	} {
+		_, err := tlsConfig(&url.URL{Scheme: "tls", Host: "dns.example", RawQuery: params})
+		assert.NotNil(t, err, params)
+	}
+
+	sum := sha256.Sum256([]byte("key"))
+	conf, err := tlsConfig(&url.URL{Scheme: "tls", Host: "10.0.0.53", RawQuery: "name=dns.example&insecure=1&pin=" + base64.StdEncoding.EncodeToString(sum[:])})
+	assert.Nil(t, err)
+	assert.Equal(t, "dns.example", conf.ServerName)
+	assert.True(t, conf.InsecureSkipVerify)
+	assert.NotNil(t, conf.VerifyConnection)
+
+	addr, err := tlsAddr(&url.URL{Scheme: "quic", Host: "[2001:db8::53]"})
+	assert.Nil(t, err)
+	assert.Equal(t, "[2001:db8::53]:853", addr)
+}
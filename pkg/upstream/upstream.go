@@ -0,0 +1,280 @@
+// Package upstream forwards DNS queries to recursive resolvers over UDP, TCP,
+// DNS over TLS, HTTPS and QUIC, and Oblivious DoH.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Timeout bounds an upstream exchange when the caller sets no deadline
+const Timeout = 5 * time.Second
+
+// Resolver answers DNS queries, such as a recursive resolver. Custom
+// resolvers let doqd front any backend, e.g. a database or service discovery.
+// Exchange must be safe for concurrent use, and the caller restores the
+// query's ID on the response.
+type Resolver interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+// New parses an upstream address. A plain host:port is queried over UDP,
+// tcp://host:port over TCP, tls://host:port over DNS over TLS,
+// https://host/path over DNS over HTTPS, quic://host:port over DNS over QUIC,
+// and odoh://target/path?relay=https://relay/path uses Oblivious DoH.
+func New(addr string) (Resolver, error) {
+	if !strings.Contains(addr, "://") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, errors.New("upstream " + addr + ": " + err.Error())
+		}
+		return &UDP{addr: addr}, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, errors.New("upstream " + addr + ": " + err.Error())
+	}
+	switch u.Scheme {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, errors.New("upstream " + addr + ": " + err.Error())
+		}
+		return &TCP{addr: u.Host}, nil
+	case "tls":
+		return newDoT(u)
+	case "https":
+		return newDoH(u)
+	case "quic":
+		return newDoQ(u)
+	case "odoh":
+		return newODoH(u)
+	default:
+		return nil, errors.New("upstream " + addr + ": unsupported scheme " + u.Scheme)
+	}
+}
+
+// withTimeout applies the default timeout to a context without a deadline
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, Timeout)
+}
+
+// CheckResponse returns an error unless a message is a response to a query:
+// it must have the QR bit set and echo the query's question, the name in
+// any case. Errors may be answered without the question.
+func CheckResponse(query, resp *dns.Msg) error {
+	if !resp.Response {
+		return errors.New("upstream response: QR bit not set")
+	}
+	if len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	if len(resp.Question) != len(query.Question) {
+		return errors.New("upstream response: question mismatch")
+	}
+	for i, q := range query.Question {
+		answered := resp.Question[i]
+		if answered.Qtype != q.Qtype || answered.Qclass != q.Qclass || !strings.EqualFold(answered.Name, q.Name) {
+			return errors.New("upstream response: question mismatch")
+		}
+	}
+	return nil
+}
+
+// UDP forwards queries to a plain DNS resolver over UDP, retrying over TCP
+// when the response is truncated. Once probed, it adapts to what the
+// resolver supports.
+type UDP struct {
+	addr string
+	caps atomic.Pointer[Capabilities]
+}
+
+func (u *UDP) String() string {
+	return u.addr
+}
+
+// Exchange sends a query over UDP, and over TCP when the answer is truncated.
+// The query name is sent in random case (0x20), so spoofed answers must also
+// guess it: answers with the right ID whose name differs only in case are
+// retried over TCP.
+func (u *UDP) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// Use a random ID towards the upstream, the caller restores the client's
+	req := msg.Copy()
+	req.Id = dns.Id()
+	tcp := u.adapt(req)
+	if !tcp && u.preservesCase() {
+		randomizeCase(req)
+	}
+
+	// Pack the DNS message
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	if tcp {
+		return exchangeTCP(ctx, u.addr, req.Id, packed)
+	}
+
+	// An answer that didn't fit the advertised buffer size may be carried
+	// in full over TCP, and TCP answers can't be spoofed off-path
+	resp, err := u.exchangeUDP(ctx, req, packed, bufferSize(req))
+	if errors.Is(err, errCaseMismatch) || (err == nil && resp.Truncated) {
+		resp, err = exchangeTCP(ctx, u.addr, req.Id, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	restoreCase(msg, resp)
+	return resp, nil // nil error
+}
+
+// errCaseMismatch is returned for an answer to a query whose name differs
+// from the query's only in case, spoofed or from a resolver not preserving
+// it
+var errCaseMismatch = errors.New("upstream query read: query name case mismatch")
+
+// exchangeUDP sends a packed query over UDP and reads an answer of up to
+// bufSize bytes
+func (u *UDP) exchangeUDP(ctx context.Context, req *dns.Msg, packed []byte, bufSize int) (*dns.Msg, error) {
+	// Connect to the DNS upstream
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, errors.New("upstream connect: " + err.Error())
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	// Send query to DNS upstream
+	if _, err = conn.Write(packed); err != nil {
+		return nil, errors.New("upstream query write: " + err.Error())
+	}
+
+	// Read the query response from the upstream, skipping stray datagrams
+	// and those not answering the query, possibly spoofed
+	buf := make([]byte, bufSize)
+	for {
+		size, err := conn.Read(buf)
+		if err != nil {
+			return nil, errors.New("upstream query read: " + err.Error())
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:size]); err != nil || resp.Id != req.Id || CheckResponse(req, resp) != nil {
+			continue
+		}
+		if len(resp.Question) == 1 && resp.Question[0].Name != req.Question[0].Name {
+			return nil, errCaseMismatch
+		}
+		return resp, nil // nil error
+	}
+}
+
+// preservesCase tells whether the resolver answers with the query name in
+// the case it was sent, assumed until probed
+func (u *UDP) preservesCase() bool {
+	caps := u.caps.Load()
+	return caps == nil || caps.Case
+}
+
+// randomizeCase randomizes the case of the letters of a query name
+func randomizeCase(msg *dns.Msg) {
+	if len(msg.Question) != 1 {
+		return
+	}
+	name := []byte(msg.Question[0].Name)
+	for i, c := range name {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.N(2) == 0 {
+			name[i] ^= 0x20
+		}
+	}
+	msg.Question[0].Name = string(name)
+}
+
+// restoreCase gives an answer the query name in the case of the original
+// query, in its question and in the records it owns
+func restoreCase(query, resp *dns.Msg) {
+	if len(query.Question) != 1 || len(resp.Question) != 1 {
+		return
+	}
+	sent, name := resp.Question[0].Name, query.Question[0].Name
+	resp.Question[0].Name = name
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Name == sent {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
+
+// TCP forwards queries to a plain DNS resolver over TCP
+type TCP struct {
+	addr string
+}
+
+func (t *TCP) String() string {
+	return "tcp://" + t.addr
+}
+
+// Exchange sends a query over a new TCP connection
+func (t *TCP) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	req := msg.Copy()
+	req.Id = dns.Id()
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	return exchangeTCP(ctx, t.addr, req.Id, packed)
+}
+
+// exchangeTCP sends a packed query over TCP
+func exchangeTCP(ctx context.Context, addr string, id uint16, packed []byte) (*dns.Msg, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.New("upstream tcp connect: " + err.Error())
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	dnsConn := &dns.Conn{Conn: conn}
+	if _, err := dnsConn.Write(packed); err != nil {
+		return nil, errors.New("upstream tcp query write: " + err.Error())
+	}
+	resp, err := dnsConn.ReadMsg()
+	if err != nil {
+		return nil, errors.New("upstream tcp query read: " + err.Error())
+	}
+	if resp.Id != id {
+		return nil, errors.New("upstream tcp query read: ID mismatch")
+	}
+	return resp, nil // nil error
+}
+
+// bufferSize returns the UDP payload size a query advertises through EDNS,
+// or the 512 byte minimum without it
+func bufferSize(msg *dns.Msg) int {
+	if opt := msg.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
@@ -0,0 +1,293 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// largeAnswerUpstream serves 100 A records on UDP and TCP, truncating the UDP
+// answer to the client's buffer size
+func largeAnswerUpstream(t *testing.T) (addr string, shutdown func()) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		for i := 0; i < 100; i++ {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2." + strconv.Itoa(i))
+			reply.Answer = append(reply.Answer, rr)
+		}
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			reply.Truncate(bufferSize(r))
+		}
+		_ = w.WriteMsg(reply)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	assert.Nil(t, err)
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: l, Handler: handler}
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+
+	return pc.LocalAddr().String(), func() {
+		_ = udpServer.Shutdown()
+		_ = tcpServer.Shutdown()
+	}
+}
+
+func TestUDPUpstreamTCPFallback(t *testing.T) {
+	addr, shutdown := largeAnswerUpstream(t)
+	defer shutdown()
+
+	up := &UDP{addr: addr}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+
+	resp, err := up.Exchange(context.Background(), req)
+	assert.Nil(t, err)
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, 100)
+	assert.Greater(t, resp.Len(), 1232)
+}
+
+func TestUDPBufferSize(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	assert.Equal(t, dns.MinMsgSize, bufferSize(msg))
+	msg.SetEdns0(256, false)
+	assert.Equal(t, dns.MinMsgSize, bufferSize(msg))
+	msg.IsEdns0().SetUDPSize(4096)
+	assert.Equal(t, 4096, bufferSize(msg))
+}
+
+func TestTCPUpstream(t *testing.T) {
+	addr, shutdown := largeAnswerUpstream(t)
+	defer shutdown()
+
+	up, err := New("tcp://" + addr)
+	assert.Nil(t, err)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	resp, err := up.Exchange(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Len(t, resp.Answer, 100)
+}
+
+func TestNew(t *testing.T) {
+	for addr, want := range map[string]string{
+		"1.1.1.1:53":                            "1.1.1.1:53",
+		"tcp://1.1.1.1:53":                      "tcp://1.1.1.1:53",
+		"tls://dns.example":                     "tls://dns.example:853",
+		"quic://dns.example:8853":               "quic://dns.example:8853",
+		"https://dns.example":                   "https://dns.example/dns-query",
+		"https://dns.example/custom?insecure=1": "https://dns.example/custom",
+		"odoh://odoh.example":                   "odoh://odoh.example/dns-query",
+	} {
+		up, err := New(addr)
+		if assert.Nil(t, err, addr) {
+			assert.Equal(t, want, fmt.Sprint(up))
+		}
+	}
+
+	for _, addr := range []string{
+		"1.1.1.1",
+		"tcp://1.1.1.1",
+		"ftp://example.com",
+		"quic://dns.example?verify=false",
+		"https://",
+		"odoh://odoh.example?relay=http://relay.example",
+	} {
+		_, err := New(addr)
+		assert.NotNil(t, err, addr)
+	}
+}
+
+func TestUDPProbe(t *testing.T) {
+	addr, shutdown := largeAnswerUpstream(t)
+	defer shutdown()
+
+	up := &UDP{addr: addr}
+	_, ok := up.Capabilities()
+	assert.False(t, ok)
+
+	caps := up.Probe(context.Background())
+	assert.True(t, caps.UDP)
+	assert.False(t, caps.EDNS, "the upstream doesn't echo EDNS")
+	assert.Equal(t, dns.MinMsgSize, caps.UDPSize)
+	assert.True(t, caps.TCP)
+	assert.False(t, caps.DoT)
+	assert.True(t, caps.Case)
+	probed, ok := up.Capabilities()
+	assert.True(t, ok)
+	assert.Equal(t, caps, probed)
+
+	// EDNS queries go over TCP, plain ones over UDP
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	assert.False(t, up.adapt(req))
+	req.SetEdns0(4096, false)
+	assert.True(t, up.adapt(req))
+
+	// Buffer sizes above the largest that worked are lowered
+	up.caps.Store(&Capabilities{UDP: true, EDNS: true, UDPSize: 1232, TCP: true})
+	assert.False(t, up.adapt(req))
+	assert.Equal(t, 1232, bufferSize(req))
+
+	resp, err := up.Exchange(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Len(t, resp.Answer, 100)
+}
+
+func TestUDPCaseRandomization(t *testing.T) {
+	// The upstream answers with the name in lowercase over UDP when lower is
+	// set, recording the names and transports of the queries
+	var lock sync.Mutex
+	var lower bool
+	var received []string
+	queries := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		q := received
+		received = nil
+		return q
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		lock.Lock()
+		defer lock.Unlock()
+		_, udp := w.RemoteAddr().(*net.UDPAddr)
+		received = append(received, fmt.Sprintf("%s/%t", r.Question[0].Name, udp))
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		if lower && udp {
+			reply.Question[0].Name = strings.ToLower(reply.Question[0].Name)
+		}
+		rr, _ := dns.NewRR(reply.Question[0].Name + " 300 IN A 192.0.2.1")
+		reply.Answer = append(reply.Answer, rr)
+		_ = w.WriteMsg(reply)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	assert.Nil(t, err)
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	tcpServer := &dns.Server{Listener: l, Handler: handler}
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	defer func() {
+		_ = udpServer.Shutdown()
+		_ = tcpServer.Shutdown()
+	}()
+
+	up := &UDP{addr: pc.LocalAddr().String()}
+	name := "www.some-long-example-domain.com."
+	exchange := func() {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		resp, err := up.Exchange(context.Background(), req)
+		if assert.Nil(t, err) && assert.Len(t, resp.Answer, 1) {
+			// The original case is restored
+			assert.Equal(t, name, resp.Question[0].Name)
+			assert.Equal(t, name, resp.Answer[0].Header().Name)
+		}
+	}
+
+	exchange()
+	if received := queries(); assert.Len(t, received, 1) {
+		assert.NotEqual(t, name+"/true", received[0], "the name is sent in random case")
+		assert.True(t, strings.EqualFold(name+"/true", received[0]))
+	}
+
+	// Answers with the name in another case are retried over TCP
+	lock.Lock()
+	lower = true
+	lock.Unlock()
+	exchange()
+	if received := queries(); assert.Len(t, received, 2) {
+		assert.True(t, strings.HasSuffix(received[1], "/false"))
+	}
+
+	// Resolvers not preserving the case are sent names as is
+	caps := up.Probe(context.Background())
+	assert.False(t, caps.Case)
+	queries()
+	exchange()
+	assert.Equal(t, []string{name + "/true"}, queries())
+}
+
+func TestCheckResponse(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	reply := func(modify func(*dns.Msg)) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		modify(resp)
+		return resp
+	}
+
+	assert.Nil(t, CheckResponse(query, reply(func(*dns.Msg) {})))
+	assert.Nil(t, CheckResponse(query, reply(func(m *dns.Msg) { m.Question[0].Name = "WWW.example.COM." })))
+	assert.Nil(t, CheckResponse(query, reply(func(m *dns.Msg) { m.Question, m.Rcode = nil, dns.RcodeFormatError })))
+	for name, modify := range map[string]func(*dns.Msg){
+		"query":         func(m *dns.Msg) { m.Response = false },
+		"no question":   func(m *dns.Msg) { m.Question = nil },
+		"other name":    func(m *dns.Msg) { m.Question[0].Name = "www.example.net." },
+		"other type":    func(m *dns.Msg) { m.Question[0].Qtype = dns.TypeAAAA },
+		"other class":   func(m *dns.Msg) { m.Question[0].Qclass = dns.ClassCHAOS },
+		"two questions": func(m *dns.Msg) { m.Question = append(m.Question, m.Question[0]) },
+	} {
+		assert.NotNil(t, CheckResponse(query, reply(modify)), name)
+	}
+}
+
+func TestUDPStrayResponses(t *testing.T) {
+	// The upstream sends datagrams with the query's ID that don't answer
+	// it before the answer
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := new(dns.Msg)
+			if query.Unpack(buf[:n]) != nil {
+				continue
+			}
+			echo := query.Copy()
+			other := new(dns.Msg)
+			other.SetReply(query)
+			other.Question[0].Name = "attacker.example."
+			answer := new(dns.Msg)
+			answer.SetReply(query)
+			rr, _ := dns.NewRR(query.Question[0].Name + " 300 IN A 192.0.2.1")
+			answer.Answer = append(answer.Answer, rr)
+			for _, msg := range []*dns.Msg{echo, other, answer} {
+				packed, _ := msg.Pack()
+				_, _ = pc.WriteTo(packed, addr)
+			}
+		}
+	}()
+
+	up := &UDP{addr: pc.LocalAddr().String()}
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	resp, err := up.Exchange(context.Background(), req)
+	if assert.Nil(t, err) {
+		assert.True(t, resp.Response)
+		assert.Len(t, resp.Answer, 1)
+	}
+}
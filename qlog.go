@@ -0,0 +1,43 @@
+package doq
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/qlog"
+)
+
+// QlogTracer returns a QUIC connection tracer writing a qlog trace for every
+// connection to dir, named <odcid>_<client|server>.sqlog. Connections whose
+// trace file can't be created are not traced.
+func QlogTracer(dir string) func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+	return func(_ context.Context, p logging.Perspective, connID quic.ConnectionID) *logging.ConnectionTracer {
+		label := "server"
+		if p == logging.PerspectiveClient {
+			label = "client"
+		}
+		f, err := os.Create(filepath.Join(dir, connID.String()+"_"+label+".sqlog"))
+		if err != nil {
+			return nil
+		}
+		return qlog.NewConnectionTracer(&bufferedFile{Writer: bufio.NewWriter(f), file: f}, p, connID)
+	}
+}
+
+// bufferedFile flushes its buffer when it is closed
+type bufferedFile struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func (b *bufferedFile) Close() error {
+	if err := b.Flush(); err != nil {
+		_ = b.file.Close()
+		return err
+	}
+	return b.file.Close()
+}
@@ -0,0 +1,54 @@
+package doq
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set by the build process with
+// -ldflags "-X github.com/mosajjal/doqd.version=v1.0.0 -X github.com/mosajjal/doqd.commit=... -X github.com/mosajjal/doqd.date=..."
+var (
+	version string
+	commit  string
+	date    string
+)
+
+// BuildInfo describes the build of the running binary
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	Date      string
+	GoVersion string
+}
+
+// Build returns the build information of the running binary. Values not set
+// at build time are taken from the module and VCS information Go embeds,
+// e.g. with go install, and are empty when unknown.
+func Build() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch {
+		case s.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = s.Value
+		case s.Key == "vcs.time" && info.Date == "":
+			info.Date = s.Value
+		}
+	}
+	return info
+}
+
+// Version returns the version of the running binary, "dev" for builds
+// without one
+func Version() string {
+	if v := Build().Version; v != "" {
+		return v
+	}
+	return "dev"
+}